@@ -0,0 +1,281 @@
+"""Sliding-window abuse detection per API key and client IP, with escalating temporary bans."""
+import json
+import time
+import hashlib
+import logging
+import threading
+from collections import defaultdict, deque
+from typing import Deque, Dict, List, Optional, Tuple
+from fastapi.responses import JSONResponse
+from .config import settings
+from .context import RequestContext
+from .metrics import metrics
+from .token_pool import display_key
+from .oidc import jwt_authenticator
+from .signing import hmac_keys
+
+logger = logging.getLogger(__name__)
+
+metrics.describe("cursor2api_abuse_bans_total", "counter", "Automatic abuse bans, by subject kind and reason")
+
+# Idle subjects and lapsed escalation are swept at most this often
+PRUNE_INTERVAL = 60
+
+# Probes, the dashboard and the admin API never reach Cursor, so bans do not lock operators out of them
+UNGUARDED_PATHS = ("/", "/favicon.ico", "/health", "/readyz", "/metrics", "/status")
+UNGUARDED_PREFIXES = ("/admin", "/static")
+
+
+def _parse_durations(raw: str) -> List[int]:
+    """Parse ABUSE_BAN_DURATIONS into seconds per offence."""
+    try:
+        durations = [int(part) for part in raw.split(",") if part.strip()]
+    except ValueError:
+        durations = []
+    if not durations or min(durations) <= 0:
+        raise ValueError(f"Invalid ABUSE_BAN_DURATIONS: {raw} (use comma-separated positive seconds)")
+    return durations
+
+
+BAN_DURATIONS = _parse_durations(settings.abuse_ban_durations)
+
+
+class AbuseBannedError(Exception):
+    """Raised for a request from a key or IP that is temporarily banned."""
+    
+    def __init__(self, subject: str, reason: str, until: float):
+        self.subject = subject
+        self.reason = reason
+        self.retry_after = max(int(until - time.time()) + 1, 1)
+        super().__init__(f"Temporarily banned for abuse ({reason}); retry in {self.retry_after}s")
+
+
+def subjects_for(api_key: str, client_ip: str) -> List[str]:
+    """The ban subjects a request counts against: its authenticated identity and the connecting IP."""
+    subjects = []
+    if api_key:
+        subjects.append(f"key:{api_key}")
+    if client_ip:
+        subjects.append(f"ip:{client_ip}")
+    return subjects
+
+
+def is_guarded(path: str) -> bool:
+    """Whether bans apply to a path: everything except probes, static files and the admin API."""
+    if path in UNGUARDED_PATHS:
+        return False
+    return not any(path == prefix or path.startswith(prefix + "/") for prefix in UNGUARDED_PREFIXES)
+
+
+async def claimed_subjects(authorization: str, key_id: str, client_ip: str) -> List[str]:
+    """Ban subjects for a request before its handler runs, covering every identity auth may resolve it to."""
+    api_key = authorization[7:] if authorization.startswith("Bearer ") else authorization
+    subjects = subjects_for(api_key, client_ip)
+    # Verifying the signature here would spend its replay nonce, and a claimed key ID only looks a ban up
+    if key_id in hmac_keys:
+        subjects.append(f"key:hmac:{key_id}")
+    identity = await jwt_authenticator.verify(authorization)
+    if identity:
+        subjects.append(f"key:{identity}")
+    return subjects
+
+
+def _display_subject(subject: str) -> str:
+    """Mask the API key of a key subject for admin views."""
+    kind, _, value = subject.partition(":")
+    return f"key:{display_key(value)}" if kind == "key" else subject
+
+
+def is_rejection(upstream_status: Optional[int]) -> bool:
+    """Whether Cursor refused the request itself, rather than the token behind it or nothing at all."""
+    # 401/403/429 are about our token or account; the proxy's own 4xx never reach Cursor
+    return upstream_status is not None and 400 <= upstream_status < 500 and upstream_status not in (401, 403, 429)
+
+
+def prompt_digest(ctx: RequestContext) -> str:
+    """Hash of the last message, which stays the same across repeated spam."""
+    last = ctx.messages[-1] if ctx.messages else None
+    content = getattr(last, "content", last)
+    return hashlib.sha256(json.dumps(content, sort_keys=True, default=str).encode()).hexdigest()[:16]
+
+
+class AbuseMonitor:
+    """Watches error rates, repeated prompts and oversized requests, and bans the offenders."""
+    
+    def __init__(self):
+        # Per subject, events inside ABUSE_WINDOW, oldest first
+        self._responses: Dict[str, Deque[Tuple[float, bool]]] = defaultdict(deque)
+        self._prompts: Dict[str, Deque[Tuple[float, str]]] = defaultdict(deque)
+        self._oversized: Dict[str, Deque[Tuple[float, int]]] = defaultdict(deque)
+        self.bans: Dict[str, dict] = {}
+        # subject -> (offences, time of the last ban), for escalation
+        self._offences: Dict[str, Tuple[int, float]] = {}
+        self._last_prune = 0.0
+        self._lock = threading.Lock()
+    
+    @staticmethod
+    def _trim(events: deque, now: float):
+        """Drop events that have left the window."""
+        cutoff = now - settings.abuse_window
+        while events and events[0][0] < cutoff:
+            events.popleft()
+    
+    def _prune(self, now: float):
+        """Forget subjects with no events left in the window and escalation that has lapsed. Caller holds the lock."""
+        if now - self._last_prune < PRUNE_INTERVAL:
+            return
+        self._last_prune = now
+        for store in (self._responses, self._prompts, self._oversized):
+            for subject in list(store):
+                self._trim(store[subject], now)
+                if not store[subject]:
+                    del store[subject]
+        for subject, ban in list(self.bans.items()):
+            if ban["until"] <= now:
+                del self.bans[subject]
+        for subject, (_, last) in list(self._offences.items()):
+            if now - last > settings.abuse_reset_after and subject not in self.bans:
+                del self._offences[subject]
+    
+    def check(self, subjects: List[str]):
+        """Raise AbuseBannedError if any subject is banned."""
+        if not settings.abuse_detection:
+            return
+        now = time.time()
+        with self._lock:
+            for subject in subjects:
+                ban = self.bans.get(subject)
+                if ban and ban["until"] > now:
+                    raise AbuseBannedError(subject, ban["reason"], ban["until"])
+                if ban:
+                    del self.bans[subject]
+    
+    def _ban(self, subject: str, reason: str, now: float) -> AbuseBannedError:
+        """Ban a subject for the duration its offence count calls for. Caller holds the lock."""
+        offences, last = self._offences.get(subject, (0, 0.0))
+        # A clean stretch resets escalation
+        if now - last > settings.abuse_reset_after:
+            offences = 0
+        duration = BAN_DURATIONS[min(offences, len(BAN_DURATIONS) - 1)]
+        self._offences[subject] = (offences + 1, now)
+        self.bans[subject] = {"reason": reason, "banned_at": now, "until": now + duration, "offence": offences + 1}
+        # Evidence is cleared so the ban does not retrigger the moment it expires
+        for store in (self._responses, self._prompts, self._oversized):
+            store.pop(subject, None)
+        metrics.inc("cursor2api_abuse_bans_total", kind=subject.partition(":")[0], reason=reason)
+        logger.warning("Banned %s for %ds: %s (offence %d)", _display_subject(subject), duration, reason, offences + 1)
+        return AbuseBannedError(subject, reason, now + duration)
+    
+    def record_response(self, subjects: List[str], upstream_status: Optional[int]):
+        """Count a handled request; a spike of requests Cursor rejects bans the caller."""
+        if not settings.abuse_detection:
+            return
+        now = time.time()
+        rejected = is_rejection(upstream_status)
+        with self._lock:
+            self._prune(now)
+            for subject in subjects:
+                events = self._responses[subject]
+                events.append((now, rejected))
+                self._trim(events, now)
+                errors = sum(1 for _, failed in events if failed)
+                if len(events) >= settings.abuse_min_requests and errors / len(events) >= settings.abuse_error_rate:
+                    self._ban(subject, "error_rate", now)
+    
+    def record_size(self, subjects: List[str], size: int):
+        """Count a request body over ABUSE_MAX_REQUEST_BYTES; raise once the limit is reached."""
+        if not settings.abuse_detection or not settings.abuse_max_request_bytes:
+            return
+        if size <= settings.abuse_max_request_bytes:
+            return
+        now = time.time()
+        banned = None
+        with self._lock:
+            self._prune(now)
+            for subject in subjects:
+                events = self._oversized[subject]
+                events.append((now, size))
+                self._trim(events, now)
+                if len(events) >= settings.abuse_oversized_limit:
+                    banned = self._ban(subject, "oversized_requests", now)
+        if banned:
+            raise banned
+    
+    def record_prompt(self, subjects: List[str], digest: str):
+        """Count a prompt; raise once the same one has been sent ABUSE_DUPLICATE_LIMIT times in the window."""
+        if not settings.abuse_detection or not settings.abuse_duplicate_limit:
+            return
+        now = time.time()
+        banned = None
+        with self._lock:
+            self._prune(now)
+            for subject in subjects:
+                events = self._prompts[subject]
+                events.append((now, digest))
+                self._trim(events, now)
+                if sum(1 for _, d in events if d == digest) >= settings.abuse_duplicate_limit:
+                    banned = self._ban(subject, "duplicate_prompts", now)
+        if banned:
+            raise banned
+    
+    def unban(self, subject: str) -> bool:
+        """Lift a ban and forget past offences, returning whether the subject was banned."""
+        with self._lock:
+            self._offences.pop(subject, None)
+            return self.bans.pop(subject, None) is not None
+    
+    def to_dict(self) -> dict:
+        """Serialize active bans, with API keys masked."""
+        now = time.time()
+        with self._lock:
+            bans = {
+                _display_subject(subject): {
+                    **ban,
+                    "remaining": int(ban["until"] - now),
+                }
+                for subject, ban in self.bans.items()
+                if ban["until"] > now
+            }
+        return {"enabled": settings.abuse_detection, "bans": bans}
+
+
+def ban_response(e: AbuseBannedError) -> JSONResponse:
+    """429 for a banned key or IP."""
+    return JSONResponse(
+        status_code=429,
+        content={"error": {"message": str(e), "type": "requests", "param": None, "code": "abuse_banned"}},
+        headers={"Retry-After": str(e.retry_after)},
+    )
+
+
+class AbuseMiddleware:
+    """Turns banned callers away before any work is done and feeds handled requests to the monitor."""
+    
+    def __init__(self, app):
+        self.app = app
+    
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or not settings.abuse_detection or not is_guarded(scope["path"]):
+            await self.app(scope, receive, send)
+            return
+        
+        headers = dict(scope["headers"])
+        # Only looks bans up, so an unverified key is fine here; nothing is counted against it
+        authorization = headers.get(b"authorization", b"").decode("latin-1")
+        key_id = headers.get(b"x-key-id", b"").decode("latin-1")
+        client = scope.get("client")
+        try:
+            abuse_monitor.check(await claimed_subjects(authorization, key_id, client[0] if client else ""))
+        except AbuseBannedError as e:
+            await ban_response(e)(scope, receive, send)
+            return
+        
+        await self.app(scope, receive, send)
+        # Set by the handler once the caller authenticated; the upstream status is final once the body is sent
+        state = scope.get("state", {})
+        if state.get("abuse_subjects"):
+            abuse_monitor.record_response(state["abuse_subjects"], state["upstream"].status)
+
+
+# Global abuse monitor instance
+abuse_monitor = AbuseMonitor()
@@ -0,0 +1,551 @@
+"""Admin API routes."""
+import hmac
+import json
+import time
+import hashlib
+from typing import List, Optional
+from fastapi import APIRouter, Depends, HTTPException, Header, Query
+from pydantic import BaseModel
+from fastapi.responses import PlainTextResponse
+from sse_starlette.sse import EventSourceResponse
+
+from .config import settings
+from .token_pool import token_pool
+from .usage import usage_store
+from .client_stats import client_stats
+from .experiments import experiment_router
+from .rules import rules_engine
+from .registration import registry
+from .model_access import model_access
+from .streams import stream_registry
+from .end_users import end_user_registry, hash_user
+from .log_stream import log_broadcaster
+from .response_cache import response_cache
+from .maintenance import maintenance
+from .notice import notice_board
+from .capacity import capacity_report
+from .response_ids import response_traces
+from .dry_run import dry_run_log
+from .abuse import abuse_monitor, subjects_for
+from .diagnostics import task_dump, thread_dump, gc_stats, heap_top, cpu_profile, PROFILE_SORTS
+
+
+def require_admin_enabled():
+    """Hide the admin API entirely unless ADMIN_KEY is set."""
+    if not settings.get_admin_key():
+        raise HTTPException(status_code=404, detail="Not Found")
+
+
+router = APIRouter(prefix="/admin", dependencies=[Depends(require_admin_enabled)])
+
+# Seconds a log stream token stays valid; enough to open the EventSource right after fetching it
+LOG_STREAM_TOKEN_TTL = 60
+
+
+class ModelBlockRequest(BaseModel):
+    """Block or unblock a model pattern, globally or for one API key."""
+    model: str
+    key: Optional[str] = None
+
+
+class EndUserBlockRequest(BaseModel):
+    """Block or unblock an end user by raw `user` value or by its hash."""
+    user: Optional[str] = None
+    user_hash: Optional[str] = None
+    reason: str = ""
+
+
+class AbuseUnbanRequest(BaseModel):
+    """Lift an automatic abuse ban on an API key or client IP."""
+    key: Optional[str] = None
+    ip: Optional[str] = None
+
+
+class MaintenanceRequest(BaseModel):
+    """Start an ad-hoc maintenance window."""
+    minutes: float
+    reason: str = ""
+
+
+class NoticeRequest(BaseModel):
+    """Set the server notice, optionally for some keys and for a limited time."""
+    text: str
+    keys: List[str] = []
+    ttl: Optional[float] = None
+
+
+class ModelAllowlistRequest(BaseModel):
+    """Replace an allowlist, globally or for one API key."""
+    models: List[str] = []
+    key: Optional[str] = None
+
+
+class InvitationRequest(BaseModel):
+    """Create an invitation code and the quotas of the keys redeemed with it."""
+    max_uses: int = 1
+    ttl: Optional[int] = None
+    models: List[str] = []
+    stream_limit: Optional[int] = None
+    max_requests: Optional[int] = None
+    max_tokens: Optional[int] = None
+    note: str = ""
+
+
+def verify_admin_key(authorization: Optional[str]) -> bool:
+    """Verify admin key from Authorization header."""
+    admin_key = settings.get_admin_key()
+    if not authorization or not admin_key:
+        return False
+    
+    token = authorization
+    if authorization.startswith("Bearer "):
+        token = authorization[7:]
+    
+    return hmac.compare_digest(token.encode(), admin_key.encode())
+
+
+def log_stream_token(expires: int) -> str:
+    """A token for /admin/logs/stream valid until `expires`, signed with the admin key."""
+    # Rotating the admin key revokes every token issued with the old one
+    mac = hmac.new(settings.get_admin_key().encode(), f"logs:{expires}".encode(), hashlib.sha256).hexdigest()
+    return f"{expires}.{mac}"
+
+
+def verify_log_stream_token(token: Optional[str]) -> bool:
+    """Whether a log stream token is unexpired and was signed with the current admin key."""
+    expires, _, _ = (token or "").partition(".")
+    if not settings.get_admin_key() or not expires.isdigit() or int(expires) < time.time():
+        return False
+    return hmac.compare_digest(token.encode(), log_stream_token(int(expires)).encode())
+
+
+@router.get("/tokens")
+async def list_tokens(authorization: Optional[str] = Header(None)):
+    """List Cursor tokens with their fast-request budget usage."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return {
+        "budget_exhausted_action": settings.budget_exhausted_action,
+        "tokens": token_pool.to_list()
+    }
+
+
+@router.get("/usage")
+async def get_usage(authorization: Optional[str] = Header(None)):
+    """Get estimated usage and cost per API key and per Cursor token."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return usage_store.to_dict()
+
+
+@router.get("/experiments")
+async def get_experiments(authorization: Optional[str] = Header(None)):
+    """List A/B experiments with per-variant latency and length stats."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    stats = usage_store.to_dict()["experiments"]
+    return {
+        "experiments": [
+            {**experiment, "stats": stats.get(experiment["id"], {})}
+            for experiment in experiment_router.to_list()
+        ]
+    }
+
+
+@router.get("/rules")
+async def get_rules(authorization: Optional[str] = Header(None)):
+    """List the request rules currently loaded from REQUEST_RULES_FILE."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return {"path": rules_engine.path, "rules": rules_engine.to_list()}
+
+
+@router.get("/registrations")
+async def list_registrations(authorization: Optional[str] = Header(None)):
+    """List invitation codes and the API keys redeemed with them."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return registry.to_dict()
+
+
+@router.post("/invitations")
+async def create_invitation(request: InvitationRequest, authorization: Optional[str] = Header(None)):
+    """Generate an invitation code for /register."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    if request.max_uses < 1:
+        raise HTTPException(status_code=400, detail="max_uses must be at least 1")
+    
+    return registry.create_invitation(
+        request.max_uses, request.ttl, request.models, request.stream_limit,
+        request.max_requests, request.max_tokens, request.note
+    )
+
+
+@router.delete("/invitations/{code}")
+async def revoke_invitation(code: str, authorization: Optional[str] = Header(None)):
+    """Delete an unused or partly used invitation code."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    if not registry.revoke_invitation(code):
+        raise HTTPException(status_code=404, detail="Invitation not found")
+    
+    return {"revoked": code}
+
+
+@router.delete("/registrations/{key_id}")
+async def revoke_registered_key(key_id: str, authorization: Optional[str] = Header(None)):
+    """Disable an API key issued through /register."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    if not registry.revoke_key(key_id):
+        raise HTTPException(status_code=404, detail="Registered key not found")
+    
+    return {"revoked": key_id}
+
+
+@router.get("/streams")
+async def list_streams(authorization: Optional[str] = Header(None)):
+    """List streams currently being sent to clients."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    streams = stream_registry.to_list()
+    return {"count": len(streams), "streams": streams}
+
+
+@router.get("/capacity")
+async def get_capacity(authorization: Optional[str] = Header(None)):
+    """Report load and a recommended replica count for autoscaling."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return capacity_report()
+
+
+@router.get("/responses/{response_id}")
+async def get_response_trace(response_id: str, authorization: Optional[str] = Header(None)):
+    """Look up the upstream conversation and trace behind a response ID."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    entry = response_traces.get(response_id)
+    if entry is None:
+        raise HTTPException(status_code=404, detail=f"No recent response with ID {response_id}")
+    return entry
+
+
+@router.get("/dry-runs")
+async def list_dry_runs(authorization: Optional[str] = Header(None)):
+    """List requests DRY_RUN kept from going upstream, newest first."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return {"dry_run": settings.dry_run, "requests": dry_run_log.to_list()}
+
+
+@router.get("/dry-runs/{request_id}")
+async def get_dry_run(request_id: str, authorization: Optional[str] = Header(None)):
+    """Show one dry-run request with its protobuf and gRPC-Web frame as hex."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    entry = dry_run_log.get(request_id)
+    if entry is None:
+        raise HTTPException(status_code=404, detail=f"No dry-run request with ID {request_id}")
+    return entry
+
+
+@router.post("/logs/token")
+async def create_log_stream_token(authorization: Optional[str] = Header(None)):
+    """Issue a short-lived token for opening the log stream from a browser."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    expires = int(time.time()) + LOG_STREAM_TOKEN_TTL
+    return {"token": log_stream_token(expires), "expires_at": expires}
+
+
+@router.get("/logs/stream")
+async def stream_logs(
+    level: str = "INFO",
+    request_id: Optional[str] = None,
+    token: Optional[str] = Query(None),
+    authorization: Optional[str] = Header(None)
+):
+    """Stream structured log events as SSE, filtered by level and request ID."""
+    # EventSource can't send headers; a short-lived token keeps the admin key out of URLs and access logs
+    if not verify_admin_key(authorization) and not verify_log_stream_token(token):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    async def events():
+        async for event in log_broadcaster.subscribe(level, request_id):
+            yield {"event": "log", "data": json.dumps(event, ensure_ascii=False)}
+    
+    return EventSourceResponse(events())
+
+
+@router.get("/models/access")
+async def get_model_access(authorization: Optional[str] = Header(None)):
+    """Get the global and per-key model block/allow lists."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return model_access.to_dict()
+
+
+@router.post("/models/block")
+async def block_model(request: ModelBlockRequest, authorization: Optional[str] = Header(None)):
+    """Disable a model immediately, for every key or for one key."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    model_access.block(request.model, request.key)
+    return model_access.to_dict()
+
+
+@router.post("/models/unblock")
+async def unblock_model(request: ModelBlockRequest, authorization: Optional[str] = Header(None)):
+    """Re-enable a previously blocked model."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    model_access.unblock(request.model, request.key)
+    return model_access.to_dict()
+
+
+@router.put("/models/allowlist")
+async def set_model_allowlist(request: ModelAllowlistRequest, authorization: Optional[str] = Header(None)):
+    """Replace an allowlist; an empty list allows every model not blocked."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    model_access.set_allowlist(request.models, request.key)
+    return model_access.to_dict()
+
+
+def _user_hash(request: EndUserBlockRequest) -> str:
+    """Get the hash an end user block request refers to."""
+    user_hash = request.user_hash or hash_user(request.user)
+    if not user_hash:
+        raise HTTPException(status_code=400, detail="Either user or user_hash is required")
+    return user_hash
+
+
+@router.get("/clients")
+async def list_clients(authorization: Optional[str] = Header(None)):
+    """Break requests down by client SDK, version, runtime and platform."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return client_stats.to_dict()
+
+
+@router.get("/users")
+async def list_end_users(authorization: Optional[str] = Header(None)):
+    """List end users seen since startup and blocked end users."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return end_user_registry.to_dict()
+
+
+@router.post("/users/block")
+async def block_end_user(request: EndUserBlockRequest, authorization: Optional[str] = Header(None)):
+    """Block an end user behind a shared key."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    user_hash = _user_hash(request)
+    end_user_registry.block(user_hash, request.reason)
+    return {"user_hash": user_hash, "blocked": True}
+
+
+@router.post("/users/unblock")
+async def unblock_end_user(request: EndUserBlockRequest, authorization: Optional[str] = Header(None)):
+    """Unblock an end user."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    user_hash = _user_hash(request)
+    if not end_user_registry.unblock(user_hash):
+        raise HTTPException(status_code=404, detail=f"End user {user_hash} is not blocked")
+    return {"user_hash": user_hash, "blocked": False}
+
+
+@router.get("/abuse")
+async def list_abuse_bans(authorization: Optional[str] = Header(None)):
+    """List active automatic abuse bans."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return abuse_monitor.to_dict()
+
+
+@router.post("/abuse/unban")
+async def unban_abuse(request: AbuseUnbanRequest, authorization: Optional[str] = Header(None)):
+    """Lift an abuse ban early and reset its escalation."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    subjects = subjects_for(request.key or "", request.ip or "")
+    if not subjects:
+        raise HTTPException(status_code=400, detail="Either key or ip is required")
+    found = [abuse_monitor.unban(subject) for subject in subjects]
+    if not any(found):
+        raise HTTPException(status_code=404, detail="No active abuse ban for that key or IP")
+    return {"unbanned": True}
+
+
+@router.get("/cache")
+async def list_cache(authorization: Optional[str] = Header(None)):
+    """List cached responses by key hash."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return {"enabled": response_cache.enabled, "entries": response_cache.to_list()}
+
+
+@router.delete("/cache")
+async def purge_cache(authorization: Optional[str] = Header(None)):
+    """Remove every cached response."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return {"purged": response_cache.purge()}
+
+
+@router.delete("/cache/{key}")
+async def purge_cache_entry(key: str, authorization: Optional[str] = Header(None)):
+    """Remove one cached response by its key hash."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    if not response_cache.purge(key):
+        raise HTTPException(status_code=404, detail=f"No cached response with key {key}")
+    return {"purged": 1}
+
+
+@router.get("/maintenance")
+async def get_maintenance(authorization: Optional[str] = Header(None)):
+    """Show maintenance windows and whether one is active."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return maintenance.to_dict()
+
+
+@router.post("/maintenance")
+async def start_maintenance(body: MaintenanceRequest, authorization: Optional[str] = Header(None)):
+    """Start maintenance now, e.g. while rotating tokens."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    if body.minutes <= 0:
+        raise HTTPException(status_code=400, detail="minutes must be positive")
+    maintenance.start(body.minutes, body.reason)
+    return maintenance.to_dict()
+
+
+@router.delete("/maintenance")
+async def stop_maintenance(authorization: Optional[str] = Header(None)):
+    """End an ad-hoc maintenance window early."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    maintenance.stop()
+    return maintenance.to_dict()
+
+
+@router.get("/notice")
+async def get_notice(authorization: Optional[str] = Header(None)):
+    """Show the server notice and how many end users have been shown it."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return notice_board.to_dict()
+
+
+@router.put("/notice")
+async def set_notice(body: NoticeRequest, authorization: Optional[str] = Header(None)):
+    """Set a notice shown once to each end user at the start of their next reply."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    if not body.text.strip():
+        raise HTTPException(status_code=400, detail="text must not be empty")
+    if body.ttl is not None and body.ttl <= 0:
+        raise HTTPException(status_code=400, detail="ttl must be positive")
+    keys = [k for k in body.keys if k]
+    if not keys:
+        raise HTTPException(status_code=400, detail='keys must list at least one key pattern ("*" for every key)')
+    notice_board.set(body.text.strip(), keys, body.ttl)
+    return notice_board.to_dict()
+
+
+@router.delete("/notice")
+async def clear_notice(authorization: Optional[str] = Header(None)):
+    """Stop showing the server notice."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    notice_board.clear()
+    return notice_board.to_dict()
+
+
+@router.get("/debug/tasks")
+async def debug_tasks(stacks: bool = False, authorization: Optional[str] = Header(None)):
+    """Count asyncio tasks by coroutine, optionally with every task's stack."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return task_dump(stacks)
+
+
+@router.get("/debug/threads")
+async def debug_threads(authorization: Optional[str] = Header(None)):
+    """Dump the stack of every thread."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return {"threads": thread_dump()}
+
+
+@router.get("/debug/gc")
+async def debug_gc(authorization: Optional[str] = Header(None)):
+    """Report garbage collector stats and the most common live object types."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return gc_stats()
+
+
+@router.get("/debug/heap")
+async def debug_heap(limit: int = Query(25, ge=1, le=500), authorization: Optional[str] = Header(None)):
+    """List the allocation sites holding the most memory."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    return heap_top(limit)
+
+
+@router.get("/debug/profile")
+async def debug_profile(
+    seconds: float = Query(10, gt=0),
+    sort: str = "cumulative",
+    limit: int = Query(50, ge=1, le=1000),
+    authorization: Optional[str] = Header(None)
+):
+    """Profile the event loop for a number of seconds and return the report as text."""
+    if not verify_admin_key(authorization):
+        raise HTTPException(status_code=401, detail="Invalid admin key")
+    
+    if sort not in PROFILE_SORTS:
+        raise HTTPException(status_code=400, detail=f"sort must be one of {', '.join(PROFILE_SORTS)}")
+    seconds = min(seconds, settings.diagnostics_max_profile_seconds)
+    return PlainTextResponse(await cpu_profile(seconds, sort, limit))
@@ -0,0 +1,101 @@
+"""Bounded buffer between the upstream reader and the client writer."""
+import asyncio
+import logging
+from collections import deque
+from typing import AsyncGenerator, Optional
+from .config import settings
+from .context import RequestContext
+from .metrics import metrics
+
+logger = logging.getLogger(__name__)
+
+POLICIES = ("block", "coalesce", "cancel")
+
+metrics.describe("cursor2api_stream_buffer_full_total", "counter", "Times a stream buffer was full, by policy")
+metrics.describe("cursor2api_stream_coalesced_chunks_total", "counter", "Upstream chunks merged into a queued chunk")
+metrics.describe("cursor2api_stream_cancelled_total", "counter", "Streams cancelled because the client fell behind")
+
+
+class BackpressureError(Exception):
+    """Raised when the client is too slow and the policy is to cancel upstream."""
+
+
+class StreamBuffer:
+    """Bounded chunk queue applying the configured policy when full."""
+    
+    def __init__(self, size: int, policy: str):
+        self.size = max(size, 1)
+        self.policy = policy
+        self._items: deque = deque()
+        self._closed = False
+        self._error: Optional[BaseException] = None
+        self._changed = asyncio.Event()
+    
+    def _notify(self):
+        self._changed.set()
+        self._changed = asyncio.Event()
+    
+    async def put(self, chunk: str):
+        """Queue a chunk; the policy decides what happens when the buffer is full."""
+        if len(self._items) >= self.size:
+            metrics.inc("cursor2api_stream_buffer_full_total", policy=self.policy)
+            if self.policy == "coalesce":
+                # Nothing is dropped: the chunk is appended to the newest queued one
+                self._items[-1] += chunk
+                metrics.inc("cursor2api_stream_coalesced_chunks_total")
+                return
+            if self.policy == "cancel":
+                metrics.inc("cursor2api_stream_cancelled_total")
+                raise BackpressureError(f"Client fell {self.size} chunks behind the upstream")
+            while len(self._items) >= self.size:
+                await self._changed.wait()
+        self._items.append(chunk)
+        self._notify()
+    
+    def close(self, error: Optional[BaseException] = None):
+        """Mark the end of the stream, optionally with the error that ended it."""
+        self._closed = True
+        self._error = error
+        self._notify()
+    
+    async def get(self) -> Optional[str]:
+        """Get the next chunk, or None once the stream has ended."""
+        while not self._items:
+            if self._closed:
+                if self._error:
+                    raise self._error
+                return None
+            await self._changed.wait()
+        chunk = self._items.popleft()
+        self._notify()
+        return chunk
+
+
+async def buffered_stream(source: AsyncGenerator[str, None], ctx: RequestContext) -> AsyncGenerator[str, None]:
+    """Read the upstream in a separate task so a slow client is handled by policy."""
+    buffer = StreamBuffer(settings.stream_buffer_size, settings.stream_backpressure)
+    
+    async def produce():
+        try:
+            async for chunk in source:
+                await buffer.put(chunk)
+        except BackpressureError as e:
+            logger.warning("[%s] Cancelling upstream: %s", ctx.request_id, e)
+            buffer.close(e)
+        except Exception as e:
+            buffer.close(e)
+        else:
+            buffer.close()
+        finally:
+            await source.aclose()
+    
+    producer = asyncio.create_task(produce())
+    try:
+        while True:
+            chunk = await buffer.get()
+            if chunk is None:
+                return
+            yield chunk
+    finally:
+        # Client went away: stop reading the upstream
+        producer.cancel()
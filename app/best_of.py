@@ -0,0 +1,75 @@
+"""Best-of-N emulation for non-streaming requests."""
+import re
+import asyncio
+import logging
+from typing import List
+from .config import settings
+from .models import Message
+from .cursor_client import cursor_client
+from .context import RequestContext
+
+logger = logging.getLogger(__name__)
+
+REFUSAL_PATTERN = re.compile(r"\b(I can(no|')t|I'm unable to|I am unable to|As an AI)\b", re.IGNORECASE)
+
+JUDGE_INSTRUCTION = (
+    "You are judging candidate answers to the conversation below. "
+    "Reply with only the number of the best candidate."
+)
+
+
+def score_candidate(text: str) -> float:
+    """Score a candidate with a simple heuristic: substance, no refusals, no loops."""
+    if not text.strip():
+        return 0.0
+    lines = [line.strip() for line in text.splitlines() if line.strip()]
+    unique_ratio = len(set(lines)) / len(lines) if lines else 1.0
+    score = min(len(text), 4000) * unique_ratio
+    if REFUSAL_PATTERN.search(text[:300]):
+        score *= 0.2
+    return score
+
+
+async def judge_candidates(ctx: RequestContext, candidates: List[str]) -> int:
+    """Ask the judge model which candidate is best, returning its index."""
+    conversation = "\n".join(f"{m.role}: {m.get_text_content()}" for m in ctx.messages)
+    listing = "\n\n".join(f"### Candidate {i + 1}\n{c}" for i, c in enumerate(candidates))
+    prompt = f"{JUDGE_INSTRUCTION}\n\n## Conversation\n{conversation}\n\n## Candidates\n{listing}"
+    
+    verdict = await cursor_client.chat_completion(ctx.derive(
+        model=settings.best_of_judge_model,
+        messages=[Message(role="user", content=prompt)]
+    ))
+    match = re.search(r"\d+", verdict)
+    if not match or not 1 <= int(match.group()) <= len(candidates):
+        raise ValueError(f"unusable judge verdict: {verdict[:50]!r}")
+    return int(match.group()) - 1
+
+
+async def best_of_completion(ctx: RequestContext, n: int) -> str:
+    """Run n generations in parallel and return the best one."""
+    n = min(n, settings.best_of_max)
+    subs = [ctx.derive() for _ in range(n)]
+    results = await asyncio.gather(
+        *(cursor_client.chat_completion(sub) for sub in subs),
+        return_exceptions=True
+    )
+    
+    candidates = [(r, sub) for r, sub in zip(results, subs) if isinstance(r, str) and r.strip()]
+    if not candidates:
+        errors = [r for r in results if isinstance(r, Exception)]
+        if errors:
+            raise errors[0]
+        return ""
+    
+    texts = [text for text, _ in candidates]
+    best = max(range(len(texts)), key=lambda k: score_candidate(texts[k]))
+    if settings.best_of_judge_model and len(texts) > 1:
+        try:
+            best = await judge_candidates(ctx, texts)
+        except Exception as e:
+            logger.warning("[%s] best_of judge failed, using heuristic choice: %s", ctx.request_id, e)
+    
+    # Report the winning generation's latency and routing outcome
+    ctx.info = candidates[best][1].info
+    return texts[best]
@@ -0,0 +1,204 @@
+"""Async completions delivered to a webhook: accepted with 202, finished in the background, POSTed back signed."""
+import hmac
+import json
+import time
+import fnmatch
+import socket
+import asyncio
+import hashlib
+import logging
+import ipaddress
+from typing import Awaitable, Callable, Optional, Tuple
+from urllib.parse import urlsplit, urlunsplit
+import httpx
+from fastapi.responses import JSONResponse
+from .config import settings
+from .context import RequestContext
+from .metrics import metrics
+
+logger = logging.getLogger(__name__)
+
+SIGNATURE_HEADER = "X-Cursor2API-Signature"
+TIMESTAMP_HEADER = "X-Cursor2API-Timestamp"
+EVENT_HEADER = "X-Cursor2API-Event"
+
+metrics.describe("cursor2api_callbacks_total", "counter", "Webhook callback deliveries, by event and result")
+
+
+class InvalidCallbackError(Exception):
+    """The callback_url cannot be used."""
+
+
+async def resolve_callback_url(url: str) -> Tuple[str, Optional[str]]:
+    """Check a callback_url and return its host and, without CALLBACK_ALLOWED_HOSTS, the public address to use."""
+    if not settings.callback_secret:
+        raise InvalidCallbackError("Webhook callbacks are not enabled on this server")
+    parts = urlsplit(url)
+    if parts.scheme not in ("https", "http") or not parts.hostname:
+        raise InvalidCallbackError("callback_url must be an absolute http(s) URL")
+    if parts.scheme == "http" and not settings.callback_allow_http:
+        raise InvalidCallbackError("callback_url must use https")
+    host = parts.hostname.lower()
+    allowed = [pattern.strip().lower() for pattern in settings.callback_allowed_hosts.split(",") if pattern.strip()]
+    if allowed:
+        # Listed hosts are trusted by the operator, internal ones included
+        if not any(fnmatch.fnmatch(host, pattern) for pattern in allowed):
+            raise InvalidCallbackError(f"callback_url host {host} is not allowed")
+        return host, None
+    # Names like localhost or metadata.google.internal resolve to internal addresses, so every
+    # address the name resolves to must be public
+    try:
+        infos = await asyncio.get_running_loop().getaddrinfo(host, parts.port, type=socket.SOCK_STREAM)
+    except (socket.gaierror, UnicodeError) as e:
+        raise InvalidCallbackError(f"callback_url host {host} cannot be resolved") from e
+    addresses = [ipaddress.ip_address(info[4][0].split("%")[0]) for info in infos]
+    if not addresses or not all(address.is_global for address in addresses):
+        raise InvalidCallbackError(f"callback_url host {host} is not a public address")
+    return host, str(addresses[0])
+
+
+def pin_address(url: str, address: str) -> str:
+    """The URL with its host replaced by a checked address, so a second lookup cannot point it elsewhere."""
+    parts = urlsplit(url)
+    netloc = f"[{address}]" if ":" in address else address
+    if parts.port:
+        netloc = f"{netloc}:{parts.port}"
+    return urlunsplit((parts.scheme, netloc, parts.path, parts.query, ""))
+
+
+def sign(timestamp: str, body: bytes) -> str:
+    """sha256=<hex HMAC> of "<timestamp>\\n" followed by the body, keyed with CALLBACK_SECRET."""
+    digest = hmac.new(settings.callback_secret.encode(), f"{timestamp}\n".encode() + body, hashlib.sha256)
+    return f"sha256={digest.hexdigest()}"
+
+
+class DeltaAccumulator:
+    """Collects streamed deltas so progress events can report the text so far."""
+    
+    def __init__(self):
+        self.text = ""
+        self._sent = 0
+    
+    def feed(self, delta: str):
+        """Append one delta; installed as the request's on_delta hook."""
+        self.text += delta
+    
+    def take(self) -> Optional[dict]:
+        """The progress since the last call, or None if nothing new arrived."""
+        if len(self.text) == self._sent:
+            return None
+        delta, self._sent = self.text[self._sent:], len(self.text)
+        return {"delta": delta, "content": self.text}
+
+
+class CallbackDispatcher:
+    """Runs accepted completions in the background and delivers their results to the webhook."""
+    
+    def __init__(self):
+        self._tasks = set()
+    
+    def submit(
+        self,
+        ctx: RequestContext,
+        response_id: str,
+        url: str,
+        progress: bool,
+        run: Callable[[], Awaitable[JSONResponse]]
+    ) -> JSONResponse:
+        """Start the completion and answer the client with 202 right away."""
+        task = asyncio.get_running_loop().create_task(self._complete(ctx, response_id, url, progress, run))
+        # Keep a reference so the task isn't garbage-collected mid-flight
+        self._tasks.add(task)
+        task.add_done_callback(self._tasks.discard)
+        return JSONResponse(
+            status_code=202,
+            content={
+                "id": response_id,
+                "object": "chat.completion.deferred",
+                "status": "accepted",
+                "callback_url": url,
+            },
+        )
+    
+    async def _complete(self, ctx: RequestContext, response_id: str, url: str, progress: bool, run):
+        """Run the completion, reporting progress meanwhile, then deliver the result."""
+        reporter = None
+        if progress:
+            accumulator = DeltaAccumulator()
+            ctx.overrides["on_delta"] = accumulator.feed
+            reporter = asyncio.create_task(self._report_progress(response_id, url, accumulator))
+        try:
+            response = await run()
+        except Exception as e:
+            logger.exception("[%s] Deferred completion failed", ctx.request_id)
+            response = JSONResponse(status_code=500, content={"error": {"message": str(e), "type": "api_error"}})
+        finally:
+            if reporter:
+                reporter.cancel()
+        
+        payload = json.loads(response.body)
+        event = "completion" if response.status_code == 200 else "error"
+        if event == "error":
+            payload = {"id": response_id, "status": response.status_code, **payload}
+        await self._deliver(url, event, payload, settings.callback_retries)
+    
+    async def _report_progress(self, response_id: str, url: str, accumulator: DeltaAccumulator):
+        """Send the text accumulated so far every CALLBACK_PROGRESS_INTERVAL seconds."""
+        while True:
+            await asyncio.sleep(settings.callback_progress_interval)
+            update = accumulator.take()
+            if update:
+                # Best effort: a missed progress event is superseded by the next one
+                event = {"id": response_id, "object": "chat.completion.progress", **update}
+                await self._deliver(url, "progress", event, 0)
+    
+    async def _deliver(self, url: str, event: str, payload: dict, retries: int) -> bool:
+        """POST one signed event, retrying with backoff on errors and non-2xx answers."""
+        body = json.dumps(payload, ensure_ascii=False).encode()
+        for attempt in range(retries + 1):
+            # Signed per attempt, so a retry is not mistaken for a replay
+            timestamp = str(int(time.time()))
+            headers = {
+                "Content-Type": "application/json",
+                EVENT_HEADER: event,
+                TIMESTAMP_HEADER: timestamp,
+                SIGNATURE_HEADER: sign(timestamp, body),
+            }
+            try:
+                # Resolved again per attempt: the check made when the request arrived may be stale
+                host, address = await resolve_callback_url(url)
+            except InvalidCallbackError as e:
+                error = str(e)
+                break
+            target, extensions = url, {}
+            if address:
+                # Connect to the checked address; Host and TLS still use the name
+                target = pin_address(url, address)
+                headers["Host"] = urlsplit(url).netloc.rsplit("@", 1)[-1]
+                extensions = {"sni_hostname": host}
+            try:
+                async with httpx.AsyncClient(timeout=settings.callback_timeout) as client:
+                    response = await client.post(target, content=body, headers=headers, extensions=extensions)
+                if 200 <= response.status_code < 300:
+                    metrics.inc("cursor2api_callbacks_total", event=event, result="delivered")
+                    return True
+                error = f"HTTP {response.status_code}"
+            except Exception as e:
+                error = str(e) or type(e).__name__
+            if attempt < retries:
+                await asyncio.sleep(2 ** attempt)
+        metrics.inc("cursor2api_callbacks_total", event=event, result="failed")
+        logger.warning("Callback %s to %s failed after %d attempts: %s", event, url, retries + 1, error)
+        return False
+    
+    async def stop(self):
+        """Give in-flight completions a moment to finish and deliver, then cancel them."""
+        if not self._tasks:
+            return
+        _, pending = await asyncio.wait(self._tasks, timeout=settings.callback_shutdown_grace)
+        for task in pending:
+            task.cancel()
+
+
+# Global callback dispatcher instance
+callback_dispatcher = CallbackDispatcher()
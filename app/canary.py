@@ -0,0 +1,73 @@
+"""Background canary that exercises the upstream protocol with a tiny request."""
+import time
+import asyncio
+import logging
+from typing import Optional
+from .config import settings
+from .models import Message
+from .context import RequestContext
+from .metrics import metrics
+from .cursor_client import cursor_client
+from .drift import drift_detector, ProtocolDriftError
+
+logger = logging.getLogger(__name__)
+
+CANARY_PROMPT = "Reply with the single word: pong"
+
+metrics.describe("cursor2api_canary_total", "counter", "Canary requests by result")
+
+
+class Canary:
+    """Periodically sends a minimal chat request and checks the reply parses."""
+    
+    def __init__(self):
+        self.last_run: Optional[float] = None
+        self.last_result: Optional[str] = None
+        self._task: Optional[asyncio.Task] = None
+    
+    async def check(self) -> str:
+        """Send one canary request and return its result."""
+        model = settings.drift_canary_model or settings.get_models()[0]
+        ctx = RequestContext.create(model, [Message(role="user", content=CANARY_PROMPT)], 60)
+        try:
+            text = await cursor_client.chat_completion(ctx)
+            # Parse failures are recorded by the client; an empty reply is the quieter symptom
+            result = "ok" if text.strip() else "empty"
+            if result == "empty":
+                drift_detector.record(False, "canary reply was empty")
+        except ProtocolDriftError:
+            result = "unparseable"
+        except Exception as e:
+            # Network and auth problems say nothing about the protocol
+            result = "error"
+            logger.warning("Canary request failed: %s", e)
+        
+        self.last_run = time.time()
+        self.last_result = result
+        metrics.inc("cursor2api_canary_total", result=result)
+        return result
+    
+    async def _run(self):
+        """Send the canary on an interval."""
+        while True:
+            await asyncio.sleep(max(settings.drift_canary_interval, 60))
+            await self.check()
+    
+    def start(self):
+        """Start the canary if an interval is configured."""
+        if settings.drift_canary_interval > 0 and self._task is None:
+            self._task = asyncio.create_task(self._run())
+    
+    async def stop(self):
+        """Stop the canary."""
+        if self._task:
+            self._task.cancel()
+            self._task = None
+    
+    def to_dict(self) -> dict:
+        """Serialize the last canary outcome for /readyz."""
+        return {"last_run": self.last_run, "last_result": self.last_result}
+
+
+# Global canary instance
+canary = Canary()
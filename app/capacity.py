@@ -0,0 +1,41 @@
+"""Autoscaling hints: stream saturation, queue depth and a recommended replica count."""
+import math
+from .config import settings
+from .limits import stream_limiter
+from .streams import stream_registry
+from .metrics import metrics
+
+if settings.capacity_target_concurrency <= 0:
+    raise ValueError(f"Invalid CAPACITY_TARGET_CONCURRENCY: {settings.capacity_target_concurrency} (must be positive)")
+
+metrics.describe("cursor2api_capacity_load", "gauge", "In-flight plus queued requests on this replica")
+metrics.describe("cursor2api_capacity_saturation", "gauge", "Load as a fraction of CAPACITY_TARGET_CONCURRENCY")
+metrics.describe("cursor2api_capacity_recommended_replicas", "gauge", "Replicas needed for this replica's load")
+
+
+def capacity_report() -> dict:
+    """Measure current load and refresh the capacity gauges."""
+    config = settings.get()
+    in_flight = stream_limiter.in_flight()
+    queued = stream_limiter.queue_depth()
+    # Queued requests are demand the replica could not serve, so they count towards load
+    load = in_flight + queued
+    target = config.capacity_target_concurrency
+    saturation = load / target
+    
+    recommended = max(math.ceil(saturation), config.capacity_min_replicas, 1)
+    if config.capacity_max_replicas > 0:
+        recommended = min(recommended, config.capacity_max_replicas)
+    
+    metrics.set("cursor2api_capacity_load", load)
+    metrics.set("cursor2api_capacity_saturation", round(saturation, 4))
+    metrics.set("cursor2api_capacity_recommended_replicas", recommended)
+    return {
+        "in_flight": in_flight,
+        "active_streams": len(stream_registry.active),
+        "queue_depth": queued,
+        "load": load,
+        "target_concurrency": target,
+        "saturation": round(saturation, 4),
+        "recommended_replicas": recommended,
+    }
@@ -0,0 +1,54 @@
+"""Command-line tools."""
+import sys
+import asyncio
+import difflib
+from .journal import journal
+from .models import ChatCompletionRequest
+from .cursor_client import cursor_client
+from .context import RequestContext
+from .config import settings
+from .token_extract import run_extract
+
+
+async def replay(entry_id: str) -> int:
+    """Re-send a journaled request and diff the new response against the recorded one."""
+    entry = journal.find(entry_id)
+    if entry is None:
+        print(f"Entry {entry_id} not found in {journal.path}", file=sys.stderr)
+        return 1
+    
+    request = ChatCompletionRequest(**entry["request"])
+    print(f"Replaying {entry_id} ({request.model}, {len(request.messages)} messages)...")
+    
+    try:
+        ctx = RequestContext.create(request.model, request.messages, settings.stream_max_duration, request_id=entry_id)
+        response = await cursor_client.chat_completion(ctx)
+    except Exception as e:
+        print(f"Replay failed: {e}", file=sys.stderr)
+        return 1
+    
+    diff = list(difflib.unified_diff(
+        (entry.get("response") or "").splitlines(),
+        response.splitlines(),
+        fromfile="journaled",
+        tofile="replayed",
+        lineterm=""
+    ))
+    if entry.get("error"):
+        print(f"Journaled request had failed: {entry['error']}")
+    if not diff:
+        print("Response identical to journaled response.")
+    else:
+        print("\n".join(diff))
+    return 0
+
+
+def run(argv) -> int:
+    """Dispatch a CLI command."""
+    if len(argv) >= 2 and argv[0] == "replay":
+        return asyncio.run(replay(argv[1]))
+    if len(argv) >= 2 and argv[:2] == ["token", "extract"]:
+        return run_extract(argv[2:])
+    print("Usage: python main.py replay <response-id>", file=sys.stderr)
+    print("       python main.py token extract [--dir PATH]", file=sys.stderr)
+    return 2
@@ -0,0 +1,142 @@
+"""Which client SDKs and versions call the proxy, from User-Agent and x-stainless-* headers."""
+import re
+import time
+import threading
+from collections import Counter
+from typing import Dict, Mapping
+from .config import settings
+from .metrics import metrics
+from .token_pool import display_key
+from .stats_log import stats_log
+
+# Sent by every Stainless-generated SDK (OpenAI, Anthropic and others)
+STAINLESS_HEADERS = {
+    "lang": "x-stainless-lang",
+    "version": "x-stainless-package-version",
+    "runtime": "x-stainless-runtime",
+    "runtime_version": "x-stainless-runtime-version",
+    "os": "x-stainless-os",
+    "arch": "x-stainless-arch",
+}
+
+# The first product token of a User-Agent: "curl/8.4.0", "python-httpx/0.27.0", "LobeChat/1.2"
+PRODUCT_TOKEN = re.compile(r"^\s*([A-Za-z][\w.+-]*)(?:/([\w.+-]+))?")
+
+# Fingerprints beyond CLIENT_STATS_MAX are counted under this name
+OTHER = "other"
+
+# Keys listed per fingerprint, enough to find who runs an old SDK
+MAX_KEYS = 20
+
+# Runtimes and platforms counted per fingerprint; the headers are client-chosen, so the rest go to OTHER
+MAX_BREAKDOWN = 20
+
+metrics.describe("cursor2api_client_requests_total", "counter", "Requests by client SDK")
+
+
+def fingerprint(headers: Mapping[str, str]) -> Dict[str, str]:
+    """Identify the client SDK of a request: Stainless headers first, the User-Agent otherwise."""
+    values = {field: (headers.get(name) or "").strip()[:64] for field, name in STAINLESS_HEADERS.items()}
+    user_agent = (headers.get("user-agent") or "").strip()
+    match = PRODUCT_TOKEN.match(user_agent)
+    product = match.group(1).lower() if match else ""
+    if values["lang"]:
+        # The package name is only in the User-Agent, e.g. "OpenAI/Python 1.30.1" -> openai-python
+        sdk = f"{product or 'stainless'}-{values['lang'].lower()}"
+        version = values["version"]
+    else:
+        sdk = product or "unknown"
+        version = (match.group(2) or "") if match else ""
+    return {
+        "sdk": sdk,
+        "version": version,
+        "runtime": f"{values['runtime']} {values['runtime_version']}".strip(),
+        "os": values["os"],
+        "arch": values["arch"],
+        "user_agent": user_agent[:200],
+    }
+
+
+def _count(counts: Dict[str, int], value: str):
+    """Count a runtime or platform, under OTHER once MAX_BREAKDOWN distinct values are counted."""
+    if value not in counts and len(counts) >= MAX_BREAKDOWN:
+        value = OTHER
+    counts[value] = counts.get(value, 0) + 1
+
+
+class ClientStats:
+    """Request counts per client fingerprint (SDK and version) since startup, or since STATS_DIR began."""
+    
+    def __init__(self):
+        self.entries: Dict[str, dict] = {}
+        self._lock = threading.Lock()
+    
+    def record(self, headers: Mapping[str, str], api_key: str):
+        """Count one request from the client that sent these headers."""
+        event = {**fingerprint(headers), "key": display_key(api_key), "at": int(time.time())}
+        sdk = self._add(event)
+        metrics.inc("cursor2api_client_requests_total", sdk=sdk)
+        stats_log.append("clients", event)
+    
+    def _add(self, event: dict) -> str:
+        """Fold a request into its fingerprint's entry, returning the SDK it was counted under."""
+        name = f"{event['sdk']} {event['version']}".strip()
+        with self._lock:
+            entry = self.entries.get(name)
+            if entry is None:
+                # Unbounded User-Agents must not grow the table, or the metric labels, without limit
+                if len(self.entries) >= settings.client_stats_max:
+                    name, event = OTHER, {**event, "sdk": OTHER, "version": "", "runtime": "", "os": "", "arch": ""}
+                    entry = self.entries.get(name)
+                if entry is None:
+                    entry = self.entries[name] = {
+                        "sdk": event["sdk"], "version": event["version"], "requests": 0,
+                        "first_seen": event["at"], "runtimes": {}, "platforms": {}, "keys": [],
+                    }
+            entry["requests"] += 1
+            entry["last_seen"] = event["at"]
+            entry["user_agent"] = event["user_agent"]
+            if event["runtime"]:
+                _count(entry["runtimes"], event["runtime"])
+            platform = " ".join(filter(None, (event["os"], event["arch"])))
+            if platform:
+                _count(entry["platforms"], platform)
+            if event["key"] not in entry["keys"] and len(entry["keys"]) < MAX_KEYS:
+                entry["keys"].append(event["key"])
+            return entry["sdk"]
+    
+    def apply(self, event: dict):
+        """Replay a request from the stats WAL."""
+        self._add(event)
+    
+    def snapshot(self) -> dict:
+        """Every fingerprint entry, for the stats snapshot."""
+        with self._lock:
+            return {name: {**entry, "runtimes": dict(entry["runtimes"]), "platforms": dict(entry["platforms"]),
+                           "keys": list(entry["keys"])} for name, entry in self.entries.items()}
+    
+    def restore(self, state: dict):
+        """Replace the entries with those of a stats snapshot."""
+        with self._lock:
+            self.entries = dict(state)
+    
+    def to_dict(self) -> dict:
+        """Fingerprints by request count, with totals per SDK, runtime and platform."""
+        with self._lock:
+            entries = sorted(self.entries.values(), key=lambda e: e["requests"], reverse=True)
+            sdks, runtimes, platforms = Counter(), Counter(), Counter()
+            for entry in entries:
+                sdks[entry["sdk"]] += entry["requests"]
+                runtimes.update(entry["runtimes"])
+                platforms.update(entry["platforms"])
+            return {
+                "clients": [{**entry, "keys": list(entry["keys"])} for entry in entries],
+                "sdks": dict(sdks.most_common()),
+                "runtimes": dict(runtimes.most_common()),
+                "platforms": dict(platforms.most_common()),
+            }
+
+
+# Global client stats instance
+client_stats = ClientStats()
+stats_log.register("clients", client_stats.snapshot, client_stats.restore, client_stats.apply)
@@ -0,0 +1,160 @@
+"""Text completion and TGI request shapes, served through the chat completion pipeline."""
+import json
+from typing import AsyncIterator, Optional
+from .config import settings
+from .models import ChatCompletionRequest, CompletionRequest, Message, TGIRequest
+
+# TGI parameter -> chat completion parameter; the rest (top_k, seed, ...) have no Cursor equivalent
+TGI_PARAMETERS = {"max_new_tokens": "max_tokens", "temperature": "temperature", "top_p": "top_p", "stop": "stop"}
+
+# OpenAI finish reason -> TGI finish reason
+TGI_FINISH_REASONS = {"stop": "eos_token", "length": "length", "tool_calls": "eos_token"}
+
+
+def completion_to_chat(request: CompletionRequest) -> ChatCompletionRequest:
+    """Turn a text completion request into a single-turn chat request."""
+    prompt = request.prompt
+    if isinstance(prompt, list):
+        if len(prompt) != 1:
+            raise ValueError("Only a single prompt per request is supported")
+        prompt = prompt[0]
+    
+    # Extra fields such as cursor2api flags carry over unchanged
+    fields = dict(request.model_extra or {})
+    if request.stop is not None:
+        fields["stop"] = request.stop
+    return ChatCompletionRequest(
+        model=request.model,
+        messages=[Message(role="user", content=prompt)],
+        temperature=request.temperature,
+        top_p=request.top_p,
+        n=request.n,
+        stream=request.stream,
+        max_tokens=request.max_tokens,
+        user=request.user,
+        **fields
+    )
+
+
+def tgi_to_chat(request: TGIRequest, stream: bool) -> ChatCompletionRequest:
+    """Turn a TGI generate request into a chat request for TGI_MODEL."""
+    fields = {TGI_PARAMETERS[k]: v for k, v in request.parameters.items() if k in TGI_PARAMETERS and v is not None}
+    return ChatCompletionRequest(
+        model=settings.tgi_model or settings.get_models()[0],
+        messages=[Message(role="user", content=request.inputs)],
+        stream=stream,
+        **fields
+    )
+
+
+def completion_id(chat_id: str) -> str:
+    """Text completion ID for a chat completion ID."""
+    return "cmpl-" + chat_id.removeprefix("chatcmpl-")
+
+
+def completion_response(chat: dict, echo: str = "") -> dict:
+    """Reshape a chat completion into a text completion."""
+    return {
+        "id": completion_id(chat["id"]),
+        "object": "text_completion",
+        "created": chat["created"],
+        "model": chat["model"],
+        "choices": [
+            {
+                "text": echo + ((choice.get("message") or {}).get("content") or ""),
+                "index": choice.get("index", 0),
+                "logprobs": None,
+                "finish_reason": choice.get("finish_reason"),
+            }
+            for choice in chat["choices"]
+        ],
+        "usage": chat.get("usage"),
+        **{field: chat[field] for field in ("metadata", "warnings") if chat.get(field)},
+    }
+
+
+def completion_chunk(chunk: dict, echo: str = "") -> Optional[dict]:
+    """Reshape a chat completion chunk, or None for one with nothing to say (the role delta)."""
+    if "error" in chunk:
+        return chunk
+    choices = [
+        {
+            "text": (choice.get("delta") or {}).get("content") or "",
+            "index": choice.get("index", 0),
+            "logprobs": None,
+            "finish_reason": choice.get("finish_reason"),
+        }
+        for choice in chunk.get("choices", [])
+    ]
+    if echo and choices:
+        choices[0]["text"] = echo + choices[0]["text"]
+    elif choices and not any(c["text"] or c["finish_reason"] for c in choices):
+        return None
+    result = {
+        "id": completion_id(chunk["id"]),
+        "object": "text_completion",
+        "created": chunk["created"],
+        "model": chunk["model"],
+        "choices": choices,
+    }
+    if chunk.get("usage"):
+        result["usage"] = chunk["usage"]
+    return result
+
+
+def tgi_error(error: dict) -> dict:
+    """TGI error body for an OpenAI-style error object."""
+    return {"error": error.get("message", ""), "error_type": error.get("code") or error.get("type") or "generation"}
+
+
+def tgi_response(chat: dict, request: TGIRequest) -> dict:
+    """Reshape a chat completion into a TGI generate response."""
+    choice = chat["choices"][0]
+    text = (choice.get("message") or {}).get("content") or ""
+    if request.parameters.get("return_full_text"):
+        text = request.inputs + text
+    result = {"generated_text": text}
+    if request.parameters.get("details"):
+        result["details"] = {
+            "finish_reason": TGI_FINISH_REASONS.get(choice.get("finish_reason"), "eos_token"),
+            "generated_tokens": (chat.get("usage") or {}).get("completion_tokens", 0),
+            "seed": None,
+        }
+    return result
+
+
+async def tgi_stream(lines: AsyncIterator[str], request: TGIRequest) -> AsyncIterator[dict]:
+    """Turn NDJSON chat completion chunks into TGI generate_stream events."""
+    generated = []
+    index = 0
+    async for line in lines:
+        if not line.strip():
+            continue
+        chunk = json.loads(line)
+        if "error" in chunk:
+            yield {"data": json.dumps(tgi_error(chunk["error"]))}
+            return
+        
+        for choice in chunk.get("choices", []):
+            text = (choice.get("delta") or {}).get("content") or ""
+            finish_reason = choice.get("finish_reason")
+            if not text and not finish_reason:
+                continue
+            index += 1
+            generated.append(text)
+            event = {
+                "index": index,
+                # Cursor does not expose token IDs or logprobs; the final token stands in for EOS
+                "token": {"id": 0, "text": text, "logprob": 0.0, "special": bool(finish_reason) and not text},
+                "generated_text": None,
+                "details": None,
+            }
+            if finish_reason:
+                full = "".join(generated)
+                event["generated_text"] = request.inputs + full if request.parameters.get("return_full_text") else full
+                event["details"] = {
+                    "finish_reason": TGI_FINISH_REASONS.get(finish_reason, "eos_token"),
+                    "generated_tokens": index,
+                    "seed": None,
+                }
+            yield {"data": json.dumps(event)}
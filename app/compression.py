@@ -0,0 +1,150 @@
+"""Heuristic prompt compression for very large prompts (LLMLingua-style pruning)."""
+import re
+import logging
+from typing import List, Optional, Set
+from .config import settings
+from .context import RequestContext
+from .metrics import metrics
+from .pricing import estimate_prompt_tokens
+
+logger = logging.getLogger(__name__)
+
+# PROMPT_COMPRESSION
+# light:      collapse whitespace, drop repeated paragraphs, strip code comments
+# aggressive: also drop stopwords from prose
+
+metrics.describe("cursor2api_prompt_compression_saved_tokens_total", "counter",
+                 "Estimated prompt tokens removed by prompt compression")
+
+FENCE = re.compile(r"^\s*(```|~~~)\s*([\w+#-]*)")
+
+# Languages whose full-line comments start with # or //
+HASH_COMMENT_LANGS = {"python", "py", "sh", "bash", "shell", "zsh", "ruby", "rb", "yaml", "yml", "toml", "perl", "r"}
+SLASH_COMMENT_LANGS = {
+    "js", "javascript", "jsx", "ts", "typescript", "tsx", "java", "c", "cpp", "c++", "cs", "csharp",
+    "go", "rust", "rs", "kotlin", "kt", "swift", "scala", "php", "dart",
+}
+
+# Negations are left out on purpose: dropping "not" flips the meaning
+STOPWORDS = {
+    "a", "an", "the", "of", "to", "in", "on", "at", "by", "for", "with", "about", "as", "into", "from",
+    "is", "are", "was", "were", "be", "been", "being", "am", "it", "its", "this", "that", "these", "those",
+    "and", "or", "so", "very", "just", "also", "then", "there", "here", "which", "who", "whom",
+    "do", "does", "did", "has", "have", "had", "will", "would", "shall", "should", "can", "could", "may",
+    "might", "must", "really", "quite", "some", "such", "own", "same", "too", "than",
+}
+
+# Short paragraphs (headings, "Thanks!") repeat legitimately
+MIN_DUPLICATE_LENGTH = 40
+
+
+def _strip_comments(lines: List[str], lang: str) -> List[str]:
+    """Drop full-line comments from a code block; trailing comments are left alone."""
+    lang = lang.lower()
+    if lang in HASH_COMMENT_LANGS:
+        return [line for line in lines if not line.lstrip().startswith("#") or line.lstrip().startswith("#!")]
+    if lang not in SLASH_COMMENT_LANGS:
+        return lines
+    
+    kept, in_block = [], False
+    for line in lines:
+        stripped = line.strip()
+        if in_block:
+            in_block = "*/" not in stripped
+            continue
+        if stripped.startswith("/*"):
+            in_block = "*/" not in stripped
+            continue
+        if not stripped.startswith("//"):
+            kept.append(line)
+    return kept
+
+
+def _prune_stopwords(line: str) -> str:
+    """Remove stopwords from a prose line, keeping inline code untouched."""
+    parts = re.split(r"(`[^`]*`)", line)
+    for i in range(0, len(parts), 2):
+        words = parts[i].split(" ")
+        # A word carrying sentence punctuation is kept so sentence boundaries survive
+        parts[i] = " ".join(w for w in words if w.lower().strip("\"'()") not in STOPWORDS)
+    return "".join(parts)
+
+
+def compress_text(text: str, level: str, seen: Optional[Set[str]] = None) -> str:
+    """Compress one message; `seen` collects paragraphs across messages to drop repeats."""
+    seen = set() if seen is None else seen
+    out: List[str] = []
+    code: Optional[List[str]] = None
+    lang = ""
+    paragraph: List[str] = []
+    
+    def flush_paragraph():
+        if not paragraph:
+            return
+        block = "\n".join(paragraph)
+        key = " ".join(block.split()).lower()
+        # RAG contexts often contain the same chunk more than once
+        if len(key) >= MIN_DUPLICATE_LENGTH and key in seen:
+            logger.debug("Dropped a repeated %d-char paragraph", len(block))
+        else:
+            seen.add(key)
+            out.extend(paragraph)
+            out.append("")
+        paragraph.clear()
+    
+    for line in text.split("\n"):
+        fence = FENCE.match(line)
+        if code is not None:
+            if fence:
+                out.extend(_strip_comments(code, lang))
+                out.append(line)
+                code = None
+            else:
+                code.append(line)
+            continue
+        if fence:
+            flush_paragraph()
+            out.append(line)
+            code, lang = [], fence.group(2)
+            continue
+        
+        if not line.strip():
+            flush_paragraph()
+            continue
+        line = re.sub(r"[ \t]+", " ", line.strip())
+        if level == "aggressive":
+            line = _prune_stopwords(line)
+        paragraph.append(line)
+    
+    flush_paragraph()
+    if code is not None:
+        # Unclosed fence: keep the code as written
+        out.extend(code)
+    return "\n".join(out).strip("\n")
+
+
+def compress_context(ctx: RequestContext):
+    """Compress ctx.messages in place when the prompt is over PROMPT_COMPRESSION_THRESHOLD."""
+    config = settings.get()
+    if config.prompt_compression == "off":
+        return
+    size = sum(len(m.get_text_content()) for m in ctx.messages)
+    if size < config.prompt_compression_threshold:
+        return
+    
+    roles = {r.strip() for r in config.prompt_compression_roles.split(",") if r.strip()}
+    before = estimate_prompt_tokens(ctx.messages)
+    seen: Set[str] = set()
+    messages = []
+    for msg in ctx.messages:
+        # Multimodal content lists are passed through; only plain text is rewritten
+        if msg.role in roles and isinstance(msg.content, str):
+            msg = msg.model_copy(update={"content": compress_text(msg.content, config.prompt_compression, seen)})
+        messages.append(msg)
+    ctx.messages = messages
+    
+    saved = before - estimate_prompt_tokens(messages)
+    ctx.overrides["compression_saved_tokens"] = saved
+    ctx.warn("prompt_compressed", f"The prompt was compressed ({config.prompt_compression}), saving ~{saved} tokens")
+    metrics.inc("cursor2api_prompt_compression_saved_tokens_total", saved)
+    logger.info("[%s] Prompt compression saved about %d of %d tokens", ctx.request_id, saved, before)
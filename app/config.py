@@ -1,8 +1,74 @@
 """Configuration management for Cursor2API."""
 import os
-from typing import List
-from pydantic_settings import BaseSettings
+import tomllib
+import threading
+from typing import Any, Dict, List, Tuple
+from dotenv import dotenv_values
+from pydantic_settings import BaseSettings, PydanticBaseSettingsSource
 from pydantic import Field
+from .secret_providers import resolve_secrets, read_secret_list
+
+# Allowed values of enumerated settings; kept here so config_check can report them before any module rejects one
+AUTH_MODES = ("api_key", "jwt", "both")
+MAINTENANCE_ACTIONS = ("reject", "defer")
+SYSTEM_ROLE_STRATEGIES = ("assistant", "merge", "field")
+SYSTEM_PROMPT_POSITIONS = ("prepend", "append", "replace", "first", "before_last")
+LENGTH_UNITS = ("bytes", "chars", "tokens")
+COMPRESSION_LEVELS = ("off", "light", "aggressive")
+TTFT_SLO_RETRY_MODES = ("token", "model")
+MESSAGE_UUID_MODES = ("shared", "unique", "session")
+COMPAT_FLAGS = ("role_delta", "stream_usage", "system_fingerprint", "exclude_none")
+LOG_LEVELS = ("DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL")
+
+
+def _bootstrap_value(name: str, default: str = "") -> str:
+    """Read a setting needed before Settings is built (env first, then .env)."""
+    if name in os.environ:
+        return os.environ[name]
+    if os.path.exists(".env"):
+        return dotenv_values(".env").get(name) or default
+    return default
+
+
+def load_profile() -> Dict[str, Any]:
+    """Load the config section selected by PROFILE from CONFIG_FILE."""
+    profile = _bootstrap_value("PROFILE")
+    if not profile:
+        return {}
+    
+    config_file = _bootstrap_value("CONFIG_FILE", "config.toml")
+    if not os.path.exists(config_file):
+        raise ValueError(f"PROFILE={profile} is set but config file {config_file} does not exist")
+    
+    with open(config_file, "rb") as f:
+        profiles = tomllib.load(f).get("profiles", {})
+    if profile not in profiles:
+        available = ", ".join(sorted(profiles)) or "none"
+        raise ValueError(f"Profile '{profile}' not found in {config_file} (available: {available})")
+    
+    values = {}
+    for key, value in profiles[profile].items():
+        # Lists are accepted for comma-separated settings such as cursor_token and models
+        if isinstance(value, list):
+            value = ",".join(str(v) for v in value)
+        values[key.lower()] = value
+    return values
+
+
+class ProfileSettingsSource(PydanticBaseSettingsSource):
+    """Settings source backed by the selected config file profile."""
+    
+    def __init__(self, settings_cls):
+        super().__init__(settings_cls)
+        self.values = load_profile()
+    
+    def get_field_value(self, field, field_name: str) -> Tuple[Any, str, bool]:
+        """Get a single field value from the profile."""
+        return self.values.get(field_name), field_name, False
+    
+    def __call__(self) -> Dict[str, Any]:
+        """Get all known fields defined by the profile."""
+        return {k: v for k, v in self.values.items() if k in self.settings_cls.model_fields}
 
 
 class Settings(BaseSettings):
@@ -10,23 +76,374 @@ class Settings(BaseSettings):
     
     # Server Configuration
     port: int = Field(default=8002, description="Server port")
+    bind_addr: str = Field(
+        default="",
+        description="Listen address, e.g. 127.0.0.1:8002 or [::]:8002 (empty = all IPv4 interfaces on port)"
+    )
+    instance_name: str = Field(
+        default="",
+        description="Deployment label added to metrics, logs, traces and the X-Instance-Name header"
+    )
     debug: bool = Field(default=False, description="Debug mode")
+    log_level: str = Field(default="INFO", description="Logging level")
+    log_stream_backlog: int = Field(
+        default=200,
+        description="Recent log events replayed to new /admin/logs/stream clients"
+    )
+    sentry_dsn: str = Field(default="", description="Sentry DSN for error reporting (requires sentry-sdk)")
+    sentry_environment: str = Field(default="", description="Sentry environment (defaults to the profile)")
+    dry_run: bool = Field(default=False, description="Validate, encode and log requests but never send them upstream")
+    dry_run_response: str = Field(
+        default="This is a dry-run response; the request was not sent upstream.",
+        description="Canned assistant reply returned in dry-run mode"
+    )
+    dry_run_history: int = Field(default=50, description="Encoded dry-run requests kept for /admin/dry-runs")
+    diagnostics_tracemalloc: int = Field(
+        default=0,
+        description="Trace allocations for /admin/debug/heap, keeping this many frames per site (0 = off)"
+    )
+    diagnostics_max_profile_seconds: float = Field(
+        default=60.0,
+        description="Longest CPU profile /admin/debug/profile may take"
+    )
+    
+    # Config Profiles
+    profile: str = Field(default="", description="Named profile to load from config_file")
+    config_file: str = Field(default="config.toml", description="TOML file with [profiles.<name>] sections")
     
     # API Authentication
-    api_key: str = Field(default="sk-cursor2api", description="API key for authentication")
+    api_key: str = Field(default="sk-cursor2api", description="API key(s) for authentication, comma-separated")
+    admin_key: str = Field(default="", description="Admin API key; /admin is disabled while it is empty")
+    hmac_keys: str = Field(
+        default="",
+        description="JSON object of key id -> shared secret for HMAC-signed requests"
+    )
+    hmac_window: int = Field(default=300, description="Seconds a request signature stays valid")
+    
+    # JWT Authentication
+    auth_mode: str = Field(default="api_key", description="Client authentication: api_key, jwt or both")
+    oidc_jwks_url: str = Field(default="", description="JWKS URL of the identity provider")
+    oidc_issuer: str = Field(default="", description="Required iss claim (empty = not checked)")
+    oidc_audience: str = Field(default="", description="Required aud claim; must be set when JWT auth is on")
+    oidc_algorithms: str = Field(default="RS256", description="Comma-separated signing algorithms JWTs may use")
+    oidc_user_claim: str = Field(default="sub", description="Claim identifying the user")
+    oidc_roles_claim: str = Field(default="groups", description="Claim listing the user's roles or groups")
+    oidc_role_policies: str = Field(
+        default="",
+        description="JSON object of {role: {\"models\": [patterns], \"stream_limit\": n}}"
+    )
+    oidc_jwks_cache_ttl: int = Field(default=3600, description="Seconds signing keys are cached")
+    oidc_leeway: int = Field(default=30, description="Allowed clock skew in seconds for exp/nbf")
+    
+    # Per-Key Limits
+    key_stream_limit: int = Field(
+        default=0,
+        description="Maximum concurrent requests per API key (0 = unlimited)"
+    )
+    key_stream_limits: str = Field(
+        default="",
+        description="JSON object of per-key overrides, e.g. {\"sk-agent\": 2}"
+    )
+    key_stream_queue_timeout: float = Field(
+        default=0.0,
+        description="Seconds a request over the limit waits in line for a slot (0 = reject immediately)"
+    )
+    queue_notify_interval: float = Field(
+        default=5.0,
+        description="Seconds between `: queued position=N` SSE comments while a stream waits"
+    )
+    
+    # Abuse Detection
+    abuse_detection: bool = Field(default=False, description="Automatically ban abusive API keys and client IPs")
+    abuse_window: float = Field(default=60.0, description="Sliding window (seconds) abuse signals are counted in")
+    abuse_error_rate: float = Field(
+        default=0.8,
+        description="Share of requests in the window rejected upstream with a 4xx that triggers a ban"
+    )
+    abuse_min_requests: int = Field(default=20, description="Requests in the window before the error rate is judged")
+    abuse_duplicate_limit: int = Field(
+        default=20,
+        description="Identical prompts in the window that trigger a ban (0 = not checked)"
+    )
+    abuse_max_request_bytes: int = Field(
+        default=5_000_000,
+        description="Request bodies larger than this count as oversized (0 = not checked)"
+    )
+    abuse_oversized_limit: int = Field(default=3, description="Oversized requests in the window that trigger a ban")
+    abuse_ban_durations: str = Field(
+        default="300,1800,7200,86400",
+        description="Comma-separated ban lengths in seconds for the 1st, 2nd, ... offence"
+    )
+    abuse_reset_after: float = Field(
+        default=86400.0,
+        description="Seconds without a ban after which escalation starts over"
+    )
+    
+    # Capacity Hints
+    capacity_target_concurrency: int = Field(
+        default=20,
+        description="In-flight requests one replica is sized for; /admin/capacity scales against it"
+    )
+    capacity_min_replicas: int = Field(default=1, description="Lower bound of the recommended replica count")
+    capacity_max_replicas: int = Field(default=0, description="Upper bound of the recommended replica count (0 = none)")
+    
+    # End Users
+    user_hash_salt: str = Field(default="", description="Salt mixed into hashes of the OpenAI user field")
+    user_limit_key: bool = Field(
+        default=False,
+        description="Count concurrent stream limits per key and end user instead of per key"
+    )
+    blocked_users_file: str = Field(
+        default="data/blocked_users.json",
+        description="File where end users blocked via the admin API are saved"
+    )
+    end_user_idle_ttl: int = Field(
+        default=86400,
+        description="Seconds an end user without requests stays listed in /admin/users"
+    )
+    
+    # Maintenance Windows
+    maintenance_windows: str = Field(
+        default="",
+        description="JSON array of {start, end, days?, reason?}; ISO times are one-off, HH:MM times recur"
+    )
+    maintenance_timezone: str = Field(default="UTC", description="Timezone of HH:MM and offset-less windows")
+    maintenance_action: str = Field(default="reject", description="During maintenance: reject or defer")
+    maintenance_defer_max: float = Field(
+        default=30.0,
+        description="Longest remaining window (seconds) a deferred request waits out before it is rejected"
+    )
+    maintenance_priority_keys: str = Field(default="", description="Comma-separated keys exempt from maintenance")
+    
+    # Server Notice
+    notice_text: str = Field(
+        default="",
+        description="Notice prefixed once to each end user's next assistant reply (also settable via /admin/notice)"
+    )
+    notice_keys: str = Field(
+        default="",
+        description="Comma-separated key patterns shown the notice (\"*\" = all, empty = none)"
+    )
+    
+    # Per-Request Flags
+    request_flag_permissions: str = Field(
+        default="",
+        description="JSON object of flags each key may set in extra_body.cursor2api, e.g. {\"sk-dev\": [\"raw\"]}"
+    )
     
     # Supported Models
     models: str = Field(
         default="gpt-4o,claude-3.5-sonnet,claude-3.5-haiku,claude-4-sonnet,gpt-4-turbo,deepseek-r1,gemini-2.5-pro",
         description="Comma-separated list of supported models"
     )
+    model_blocklist: str = Field(default="", description="Comma-separated model patterns disabled for every key")
+    model_allowlist: str = Field(default="", description="Comma-separated model patterns allowed (empty = all)")
+    model_access_file: str = Field(
+        default="data/model_access.json",
+        description="File where block/allow lists changed via the admin API are saved"
+    )
+    
+    # Client Compatibility
+    compat_mode: str = Field(
+        default="",
+        description="Comma-separated compatibility flags: role_delta, stream_usage, system_fingerprint, exclude_none"
+    )
+    strict_params: bool = Field(
+        default=False,
+        description="Reject parameters the backend cannot honor instead of ignoring them"
+    )
+    
+    # Tool Calling
+    tool_emulation: bool = Field(
+        default=False,
+        description="Emulate OpenAI tool calling through a prompted text format"
+    )
+    
+    # Title Generation
+    title_model: str = Field(
+        default="cursor-small",
+        description="Cheap model used for chat title generation (empty = use requested model)"
+    )
+    title_detection: bool = Field(
+        default=False,
+        description="Route chat requests that look like frontend title prompts to title_model"
+    )
+    
+    # Model Fallback
+    model_fallbacks: str = Field(
+        default="",
+        description="Fallback chains, e.g. 'gpt-4o->claude-3.5-sonnet->claude-3.5-haiku;deepseek-r1->gpt-4o'"
+    )
+    
+    # Best-of Emulation
+    best_of_max: int = Field(default=4, description="Maximum parallel generations for best_of")
+    best_of_judge_model: str = Field(
+        default="",
+        description="Model that picks the best candidate (empty = heuristic scoring)"
+    )
+    
+    # Prompt Presets
+    presets_file: str = Field(default="presets.toml", description="TOML file of named prompt presets")
+    
+    # System Role
+    system_role_strategy: str = Field(
+        default="assistant",
+        description="How system messages are sent: assistant (as before), merge (into first user message), field"
+    )
     
     # System Prompt Injection
     system_prompt_inject: str = Field(default="", description="System prompt to inject")
+    system_prompt_position: str = Field(
+        default="append",
+        description="prepend, append or replace the first system message; first or before_last add a new one"
+    )
+    system_prompt_inject_models: str = Field(
+        default="",
+        description="JSON object of per-model prompt variants, keyed by model name or glob"
+    )
+    system_prompt_locked: bool = Field(
+        default=False,
+        description="Drop client system messages so only the injected prompt applies (kiosk mode)"
+    )
+    system_prompt_sanitize: bool = Field(
+        default=False,
+        description="Remove override phrases and escape role tags in client system messages"
+    )
+    system_prompt_override_patterns: str = Field(
+        default="",
+        description="JSON array of regexes removed by SYSTEM_PROMPT_SANITIZE (empty = built-in list)"
+    )
+    
+    # Content Redaction
+    redaction_rules: str = Field(
+        default="",
+        description="JSON array of {pattern, replacement, name} rules applied to outgoing prompts"
+    )
     
     # Request Configuration
-    timeout: int = Field(default=120, description="Request timeout in seconds")
-    max_input_length: int = Field(default=200000, description="Maximum input length")
+    timeout: int = Field(default=120, description="Timeout in seconds for non-streaming upstream calls")
+    connect_timeout: float = Field(default=10, description="Seconds to establish the upstream connection")
+    ttfb_timeout: float = Field(default=60, description="Seconds to wait for the first upstream byte")
+    idle_timeout: float = Field(default=30, description="Seconds allowed between upstream chunks once streaming")
+    stream_max_duration: float = Field(
+        default=600,
+        description="Cap in seconds on a whole request, retries included (0 = unlimited)"
+    )
+    max_input_length: int = Field(default=200000, description="Maximum input length, in length_unit")
+    max_message_length: int = Field(
+        default=0,
+        description="Per-message length limit in length_unit (0 = max_input_length)"
+    )
+    length_unit: str = Field(
+        default="bytes",
+        description="Unit of the input limits: bytes (UTF-8), chars or tokens (estimated, CJK-aware)"
+    )
+    oversize_message_strategy: str = Field(
+        default="truncate",
+        description="Handling of a single message over the limit: truncate, split, summarize, reject"
+    )
+    summarize_model: str = Field(
+        default="",
+        description="Model for summarizing oversized messages (empty = requested model)"
+    )
+    truncation_keep_last: int = Field(
+        default=6,
+        description="Most recent messages always kept when truncating"
+    )
+    truncation_keep_first_user: bool = Field(
+        default=True,
+        description="Keep the first user message (often the task statement) when truncating"
+    )
+    truncation_marker: str = Field(
+        default="…[truncated]…\n",
+        description="Marker prepended to messages whose oldest content was cut"
+    )
+    prompt_compression: str = Field(
+        default="off",
+        description="Prompt compression for large prompts: off, light, aggressive (also drops stopwords)"
+    )
+    prompt_compression_threshold: int = Field(
+        default=50000,
+        description="Prompt size in characters from which compression applies"
+    )
+    prompt_compression_roles: str = Field(default="user,tool", description="Roles whose messages are compressed")
+    output_decode_errors: str = Field(
+        default="replace",
+        description="Invalid UTF-8 in upstream output: replace (U+FFFD), ignore, strict (fail the request)"
+    )
+    response_parser: str = Field(
+        default="v1",
+        description="Response framing parser: v1 (heuristic), v2 (length-prefixed envelope), auto (per frame)"
+    )
+    response_parser_endpoints: str = Field(
+        default="",
+        description='JSON {"AiService method": parser profile} overriding RESPONSE_PARSER per endpoint'
+    )
+    stream_dedup_min_overlap: int = Field(
+        default=0,
+        description="Trim upstream chunks that repeat at least this many trailing chars (0 = off)"
+    )
+    stop_patterns: str = Field(
+        default="",
+        description="JSON array of regexes that end the generation early when matched"
+    )
+    stop_repeat_ngram: int = Field(
+        default=0,
+        description="Word n-gram size for repetition loop detection (0 = off)"
+    )
+    stop_repeat_count: int = Field(
+        default=8,
+        description="Occurrences of the same n-gram that count as a loop"
+    )
+    output_scan: bool = Field(default=False, description="Mask leaked secrets and listed words in output")
+    output_scan_words: str = Field(default="", description="Comma-separated words to mask in output")
+    output_scan_patterns: str = Field(default="", description="JSON array of extra regexes to mask in output")
+    output_scan_entropy: bool = Field(
+        default=True,
+        description="Also mask long high-entropy strings that look like API keys"
+    )
+    output_scan_mask: str = Field(default="[REDACTED]", description="Replacement for masked secrets")
+    ttft_slo: float = Field(default=0, description="Default time-to-first-token SLO in seconds (0 = off)")
+    ttft_slo_models: str = Field(default="", description="JSON object of model pattern -> TTFT SLO seconds")
+    ttft_slo_retry: str = Field(
+        default="token",
+        description="On a missed TTFT SLO: token (retry on another token) or model (next fallback model)"
+    )
+    ttft_slo_retries: int = Field(default=1, description="Token retries after a missed TTFT SLO")
+    stream_buffer_size: int = Field(default=32, description="Chunks buffered between upstream and client")
+    stream_backpressure: str = Field(
+        default="block",
+        description="Policy when the client is slower than upstream: block, coalesce, cancel"
+    )
+    stream_flush_padding: int = Field(
+        default=0,
+        description="Bytes of SSE comment padding sent first to push through buffering proxies"
+    )
+    stream_force_chunked: bool = Field(
+        default=False,
+        description="Always send Transfer-Encoding: chunked on streaming responses"
+    )
+    stream_pacing_cps: float = Field(
+        default=0,
+        description="Typewriter pacing in characters per second (0 = send deltas as they arrive)"
+    )
+    stream_pacing_chunk: int = Field(default=3, description="Characters per paced piece")
+    stream_pacing_max_lag: float = Field(
+        default=2.0,
+        description="Longest a burst may take to drain; larger bursts are sent faster"
+    )
+    stream_markdown_safe: bool = Field(
+        default=False,
+        description="Hold back deltas that would end inside a code fence, emphasis marker or link"
+    )
+    stream_recovery: bool = Field(
+        default=False,
+        description="Retry once with partial output as context on mid-stream failure"
+    )
+    stream_recovery_prompt: str = Field(
+        default="Continue exactly where you left off. Do not repeat anything you already wrote.",
+        description="Instruction sent with the partial output when recovering"
+    )
     
     # Cursor IDE Client Configuration
     cursor_api_url: str = Field(
@@ -35,7 +452,19 @@ class Settings(BaseSettings):
     )
     cursor_token: str = Field(
         default="",
-        description="Cursor session token (WorkosCursorSessionToken)"
+        description="Cursor session token(s) (WorkosCursorSessionToken), comma-separated"
+    )
+    cursor_token_tags: str = Field(
+        default="",
+        description="JSON object of {tag: [token positions]}, 1-based in CURSOR_TOKEN order"
+    )
+    key_token_tags: str = Field(
+        default="",
+        description="JSON object of {api_key: tag} routing each key class to tagged tokens, \"*\" for the rest"
+    )
+    reserved_token_tags: str = Field(
+        default="",
+        description="Comma-separated tags whose tokens only serve requests routed to that tag"
     )
     cursor_checksum: str = Field(
         default="",
@@ -43,25 +472,392 @@ class Settings(BaseSettings):
     )
     cursor_client_key: str = Field(default="", description="Cursor client key")
     cursor_version: str = Field(default="0.48.6", description="Cursor client version")
+    cursor_version_auto: bool = Field(
+        default=False,
+        description="Auto-detect latest Cursor version (overrides cursor_version)"
+    )
+    cursor_version_check_url: str = Field(
+        default="https://www.cursor.com/api/download?platform=linux-x64&releaseTrack=stable",
+        description="Cursor release metadata URL"
+    )
+    cursor_version_check_interval: int = Field(
+        default=21600,
+        description="Version check interval in seconds"
+    )
     cursor_timezone: str = Field(default="Asia/Shanghai", description="Timezone")
     cursor_ghost_mode: bool = Field(default=True, description="Ghost mode enabled")
     cursor_working_dir: str = Field(
         default="/c:/Users/Default",
         description="Working directory path"
     )
+    cursor_extra_headers: str = Field(
+        default="",
+        description="JSON object of extra upstream headers; values may use {placeholders}"
+    )
+    cursor_signing_key: str = Field(default="", description="HMAC key for the {body_hmac} placeholder")
+    shadow_encoder: bool = Field(
+        default=False,
+        description="Also encode each request with generated protobuf and log byte mismatches"
+    )
+    
+    # Warm-up
+    warmup_connections: int = Field(
+        default=2,
+        description="Upstream connections to open at startup (0 = disabled)"
+    )
+    warmup_preflight: bool = Field(
+        default=False,
+        description="Send a tiny authenticated request per token at startup"
+    )
+    warmup_preflight_path: str = Field(
+        default="/auth/full_stripe_profile",
+        description="Upstream path used for pre-flight authentication"
+    )
+    
+    # Protocol Drift Detection
+    drift_window: int = Field(default=20, description="Recent responses considered for drift detection")
+    drift_threshold: float = Field(
+        default=0.5,
+        description="Share of unparseable responses in the window that signals protocol drift"
+    )
+    drift_canary_interval: int = Field(default=0, description="Seconds between canary requests (0 = off)")
+    drift_canary_model: str = Field(default="", description="Model for canary requests (empty = first model)")
+    quarantine_dir: str = Field(
+        default="",
+        description="Directory for scrubbed samples of bytes that failed to encode or parse (empty = metrics only)"
+    )
+    quarantine_sample_bytes: int = Field(default=4096, description="Bytes kept per quarantine sample")
+    quarantine_max_files: int = Field(default=200, description="Samples kept in QUARANTINE_DIR; the oldest are deleted")
+    quarantine_skip_interval: int = Field(
+        default=60,
+        description="Minimum seconds between written samples of parser skips (0 = every skip)"
+    )
+    
+    raw_passthrough: bool = Field(
+        default=False,
+        description="Enable /cursor/raw/{method} protobuf passthrough"
+    )
+    
+    # Response Cache
+    response_cache: bool = Field(default=False, description="Replay responses to identical requests from memory")
+    response_cache_ttl: int = Field(default=3600, description="Seconds a cached response is served (0 = no expiry)")
+    response_cache_size: int = Field(default=1000, description="Maximum cached responses, least recently used dropped")
+    
+    # Request Journal
+    journal_enabled: bool = Field(default=False, description="Journal full request payloads")
+    journal_path: str = Field(default="data/journal.jsonl", description="Request journal file")
+    
+    # Stats Persistence
+    stats_dir: str = Field(
+        default="",
+        description="Directory for the usage counter WAL and snapshots (empty = counters are in memory only)"
+    )
+    stats_flush_interval: float = Field(default=1.0, description="Seconds between WAL flushes")
+    stats_snapshot_interval: int = Field(
+        default=300,
+        description="Seconds between snapshots, which fold the WAL into one file and truncate it"
+    )
+    client_stats_max: int = Field(
+        default=1000,
+        description="Distinct client SDK versions tracked in /admin/clients; further ones count as other"
+    )
+    
+    # Transcripts
+    transcripts: bool = Field(default=False, description="Store transcripts retrievable by response ID")
+    transcript_dir: str = Field(default="data/transcripts", description="Directory for stored transcripts")
+    transcript_retention: int = Field(default=86400, description="Seconds a transcript is kept")
+    
+    # Session History
+    session_history: bool = Field(
+        default=False,
+        description="Keep the message history of X-Session-Id conversations for /v1/sessions/{id}/export"
+    )
+    session_history_dir: str = Field(default="data/sessions", description="Directory for stored session histories")
+    session_history_retention: int = Field(default=604800, description="Seconds an idle session's history is kept")
+    
+    # Self-registration
+    registration: bool = Field(
+        default=False,
+        description="Let users redeem admin-issued invitation codes for API keys at /register"
+    )
+    registration_file: str = Field(
+        default="data/registrations.json",
+        description="File where invitation codes and registered keys are saved"
+    )
+    registration_invite_ttl: int = Field(
+        default=604800,
+        description="Default seconds an invitation code stays valid (0 = never expires)"
+    )
+    
+    # Embeddings
+    embeddings_base_url: str = Field(
+        default="",
+        description="OpenAI-compatible base URL that serves /embeddings (empty = unsupported)"
+    )
+    embeddings_api_key: str = Field(default="", description="API key for the embeddings backend")
+    embeddings_model: str = Field(default="", description="Override the requested embeddings model")
+    
+    # Moderation
+    moderation_rules: str = Field(
+        default="",
+        description="JSON object of {category: [regex, ...]} checked by /v1/moderations"
+    )
+    moderation_base_url: str = Field(
+        default="",
+        description="OpenAI-compatible base URL of an external /moderations classifier, merged with the rules"
+    )
+    moderation_api_key: str = Field(default="", description="API key for the moderation classifier")
+    moderation_model: str = Field(default="", description="Override the requested moderation model")
+    
+    # Context Uploads
+    context_uploads: bool = Field(
+        default=False,
+        description="Accept chunked context uploads at /v1/contexts, referenced by extra_body.context_id"
+    )
+    context_upload_dir: str = Field(default="data/contexts", description="Directory for context uploads")
+    context_upload_max_bytes: int = Field(default=20000000, description="Maximum size of one assembled context")
+    context_upload_ttl: int = Field(default=86400, description="Seconds an upload is kept after it was started")
+    context_upload_max_per_key: int = Field(default=10, description="Unexpired uploads one API key may hold")
+    context_upload_quota_bytes: int = Field(
+        default=100000000,
+        description="Bytes all unexpired uploads of one API key may take up together"
+    )
+    
+    # Idempotency
+    idempotency_ttl: int = Field(
+        default=86400,
+        description="Seconds a non-streaming response is kept for retries with the same Idempotency-Key (0 = off)"
+    )
+    idempotency_max_entries: int = Field(default=10000, description="Stored idempotent responses kept in memory")
+    
+    # Request Rules
+    request_rules_file: str = Field(
+        default="",
+        description="JSON file of per-request rules (match model/key/headers -> rewrite or reject), reloaded on change"
+    )
+    
+    # Experiments
+    experiments: str = Field(
+        default="",
+        description="JSON array of A/B experiments: {id, match, variants: [{id, percent, model, system_prompt, temperature}]}"
+    )
+    
+    # TGI Compatibility
+    tgi_model: str = Field(default="", description="Model served by /generate and /generate_stream (empty = first model)")
+    
+    # Pricing
+    model_pricing: str = Field(
+        default="",
+        description='JSON object of model pattern -> {"input": x, "output": y} price per 1K tokens'
+    )
+    usage_label_keys: str = Field(
+        default="",
+        description="Comma-separated metadata keys aggregated as usage labels (empty = every key)"
+    )
+    usage_max_labels: int = Field(
+        default=1000,
+        description="Distinct usage labels kept; further ones are counted under (other)"
+    )
+    
+    # Webhook Callbacks
+    callback_secret: str = Field(
+        default="",
+        description="HMAC key signing webhook callbacks; callback_url is rejected while empty"
+    )
+    callback_allowed_hosts: str = Field(
+        default="",
+        description="Comma-separated host globs callback_url may point at (empty = any public host)"
+    )
+    callback_allow_http: bool = Field(default=False, description="Accept plain http callback URLs")
+    callback_timeout: float = Field(default=10.0, description="Seconds to wait for the webhook to answer")
+    callback_retries: int = Field(default=3, description="Retries of a failed result delivery, with backoff")
+    callback_progress_interval: float = Field(
+        default=2.0,
+        description="Seconds between progress events when callback_progress is requested"
+    )
+    callback_shutdown_grace: float = Field(
+        default=30.0,
+        description="Seconds deferred completions get to finish on shutdown before they are cancelled"
+    )
+    
+    # Trace Export
+    trace_export: str = Field(
+        default="",
+        description="Trace exporter: empty (disabled), langfuse, otel"
+    )
+    trace_include_content: bool = Field(
+        default=True,
+        description="Include prompts and completions in exported traces"
+    )
+    langfuse_host: str = Field(default="https://cloud.langfuse.com", description="Langfuse host")
+    langfuse_public_key: str = Field(default="", description="Langfuse public key")
+    langfuse_secret_key: str = Field(default="", description="Langfuse secret key")
+    otel_endpoint: str = Field(
+        default="http://localhost:4318/v1/traces",
+        description="OTLP/HTTP traces endpoint"
+    )
+    otel_headers: str = Field(default="", description="JSON object of extra OTLP request headers")
+    otel_service_name: str = Field(default="cursor2api", description="OpenTelemetry service.name")
+    
+    # Fast Request Budget
+    fast_request_budget: int = Field(
+        default=0,
+        description="Monthly fast-request budget per token (0 = unlimited)"
+    )
+    budget_exhausted_action: str = Field(
+        default="rotate",
+        description="Action when a token's budget is exhausted: none, rotate, degrade"
+    )
+    budget_degrade_model: str = Field(
+        default="cursor-small",
+        description="Model used when every token's budget is exhausted (degrade action)"
+    )
+    token_expiry_warn_days: int = Field(
+        default=7,
+        description="Warn this many days before a token's JWT expires"
+    )
+    token_latency_weighting: bool = Field(
+        default=False,
+        description="Pick tokens by TTFB-weighted random choice instead of round-robin"
+    )
+    token_ttfb_alpha: float = Field(default=0.2, description="Smoothing factor of the per-token TTFB average")
+    token_min_weight: float = Field(default=0.1, description="Lowest selection weight of a slow or failing token")
+    token_health_scoring: bool = Field(
+        default=False,
+        description="Weight token selection by a decaying health score of errors, 429s and TTFB"
+    )
+    token_health_half_life: float = Field(
+        default=300.0,
+        description="Seconds after which a token's recorded errors and 429s count half as much (must be positive)"
+    )
+    
+    # Response IDs
+    response_trace_ttl: int = Field(
+        default=86400,
+        description="Seconds a response ID can be looked up in /admin/responses (0 = disabled)"
+    )
+    response_trace_max_entries: int = Field(default=100000, description="Response IDs kept for lookup")
+    
+    # Response Compression
+    response_compression: bool = Field(
+        default=False,
+        description="Compress JSON responses with br or gzip, as negotiated from Accept-Encoding"
+    )
+    response_compression_min_size: int = Field(default=1024, description="Smallest response body compressed, in bytes")
+    response_compression_level: int = Field(default=6, description="Compression level (gzip 1-9, br 0-11)")
+    response_compression_streams: bool = Field(
+        default=False,
+        description="Also compress SSE / NDJSON streams, flushed after every event"
+    )
+    
+    # Session Continuity
+    session_continuity: bool = Field(
+        default=False,
+        description="Keep each conversation on the Cursor token that started it"
+    )
+    session_ttl: int = Field(default=86400, description="Seconds an idle conversation stays pinned")
+    message_uuid_mode: str = Field(
+        default="shared",
+        description="Message UUIDs sent upstream: shared (one per request), unique, session (stable across turns)"
+    )
+    
+    # Secret Providers
+    vault_addr: str = Field(default="", description="Vault address for vault: secrets")
+    vault_token: str = Field(default="", description="Vault token for vault: secrets")
+    vault_namespace: str = Field(default="", description="Vault Enterprise namespace")
+    aws_region: str = Field(default="", description="AWS region for awssm: secrets (empty = SDK default)")
+    cursor_token_file: str = Field(default="", description="File with Cursor token(s), one per line; overrides CURSOR_TOKEN")
+    api_key_file: str = Field(default="", description="File with API key(s), one per line; overrides API_KEY")
+    secret_file_poll_interval: int = Field(default=10, description="Seconds between checks of the secret files for changes (0 = read once)")
     
     class Config:
         env_file = ".env"
         env_file_encoding = "utf-8"
         extra = "ignore"
     
+    @classmethod
+    def settings_customise_sources(
+        cls,
+        settings_cls,
+        init_settings,
+        env_settings,
+        dotenv_settings,
+        file_secret_settings
+    ):
+        """Environment and .env take precedence over the selected profile."""
+        return (
+            init_settings,
+            env_settings,
+            dotenv_settings,
+            ProfileSettingsSource(settings_cls),
+            file_secret_settings,
+        )
+    
+    def get_bind_address(self) -> Tuple[str, int]:
+        """Parse bind_addr into (host, port), falling back to port for a missing port."""
+        addr = self.bind_addr.strip()
+        if not addr:
+            return "0.0.0.0", self.port
+        
+        # Bracketed IPv6: [::]:8002 or [::1]
+        if addr.startswith("["):
+            host, _, rest = addr[1:].partition("]")
+            port = rest.lstrip(":")
+            return host, int(port) if port else self.port
+        
+        # Bare IPv6 without a port: ::, ::1
+        if addr.count(":") > 1:
+            return addr, self.port
+        
+        host, _, port = addr.partition(":")
+        return host or "0.0.0.0", int(port) if port else self.port
+    
     def get_models(self) -> List[str]:
         """Get list of supported models."""
         return [m.strip() for m in self.models.split(",") if m.strip()]
     
+    def get_fallback_chain(self, model: str) -> List[str]:
+        """Get the ordered list of models to try for a request, starting with the model itself."""
+        for chain in self.model_fallbacks.split(";"):
+            models = [m.strip() for m in chain.split("->") if m.strip()]
+            if models and models[0] == model:
+                return models
+        return [model]
+    
+    def has_compat(self, flag: str) -> bool:
+        """Check whether a compatibility flag is enabled."""
+        return flag in [f.strip() for f in self.compat_mode.split(",")]
+    
+    def get_usage_label_keys(self) -> List[str]:
+        """Get the metadata keys aggregated as usage labels; empty means every key."""
+        return [k.strip() for k in self.usage_label_keys.split(",") if k.strip()]
+    
+    def get_oidc_algorithms(self) -> List[str]:
+        """Get the signing algorithms accepted for JWTs."""
+        return [a.strip() for a in self.oidc_algorithms.split(",") if a.strip()]
+    
+    def get_api_keys(self) -> List[str]:
+        """Get list of client API keys."""
+        return [k.strip() for k in self.api_key.split(",") if k.strip()]
+    
+    def get_admin_key(self) -> str:
+        """Get admin API key; empty when the admin API is disabled."""
+        return self.admin_key.strip()
+    
+    def get_clean_tokens(self) -> List[str]:
+        """Get all cleaned Cursor tokens."""
+        tokens = [self._clean_token(t) for t in self.cursor_token.split(",")]
+        return [t for t in tokens if t]
+    
     def get_clean_token(self) -> str:
-        """Get cleaned Cursor token, handling %3A%3A separator."""
-        token = self.cursor_token.strip()
+        """Get the first cleaned Cursor token."""
+        tokens = self.get_clean_tokens()
+        return tokens[0] if tokens else ""
+    
+    @staticmethod
+    def _clean_token(token: str) -> str:
+        """Clean a Cursor token, handling %3A%3A separator."""
+        token = token.strip()
         if not token:
             return ""
         
@@ -78,6 +874,66 @@ class Settings(BaseSettings):
         return token.strip()
 
 
+# A published Settings object is never changed; replace() and update() swap in a new one.
+# Attribute reads go to the latest snapshot, so `from .config import settings` keeps working
+# after a reload. Code reading several related fields takes `settings.get()` once so they all
+# come from the same snapshot.
+class SettingsHolder:
+    """Swappable reference to the current Settings."""
+    
+    def __init__(self, initial: Settings):
+        object.__setattr__(self, "_current", initial)
+        object.__setattr__(self, "_lock", threading.Lock())
+    
+    def get(self) -> Settings:
+        """Get the current snapshot; treat it as read-only."""
+        return self._current
+    
+    def replace(self, new: Settings) -> Settings:
+        """Publish a new snapshot, returning the previous one."""
+        with self._lock:
+            old = self._current
+            # Rebinding a reference is atomic; readers see the old or the new snapshot, never a mix
+            object.__setattr__(self, "_current", new)
+        return old
+    
+    def update(self, **changes) -> Settings:
+        """Publish a validated copy of the current snapshot with some fields changed."""
+        unknown = [name for name in changes if name not in Settings.model_fields]
+        if unknown:
+            raise ValueError(f"Unknown setting: {unknown[0]}")
+        with self._lock:
+            new = Settings.model_validate({**self._current.model_dump(), **changes})
+            object.__setattr__(self, "_current", new)
+        return new
+    
+    def __getattr__(self, name: str):
+        return getattr(self._current, name)
+    
+    def __setattr__(self, name: str, value):
+        raise AttributeError(f"Cannot set settings.{name} in place; use settings.update({name}=...)")
+
+
+# Settings that may be read from a {name}_file, one value per line
+SECRET_FILE_SETTINGS = ("cursor_token", "api_key")
+
+
+def load_settings() -> Settings:
+    """Build Settings from all sources and resolve secret references."""
+    config = Settings()
+    # Values such as CURSOR_TOKEN=vault:secret/data/cursor2api#token are fetched here, before publishing
+    resolve_secrets(config)
+    # Secret files win over the inline values so a mounted secret is never shadowed by a stale env var
+    for name in SECRET_FILE_SETTINGS:
+        path = getattr(config, f"{name}_file")
+        if path:
+            try:
+                setattr(config, name, read_secret_list(path))
+            except OSError as e:
+                raise ValueError(f"Invalid {name.upper()}_FILE: {e}") from e
+    return config
+
+
 # Global settings instance
-settings = Settings()
+settings = SettingsHolder(load_settings())
 
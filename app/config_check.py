@@ -0,0 +1,182 @@
+"""Startup validation of the whole configuration: typos, conflicting options and missing companions."""
+import os
+import sys
+import json
+import difflib
+from typing import Iterable, List, NamedTuple
+from dotenv import dotenv_values
+from .config import (
+    Settings, settings, load_profile, _bootstrap_value,
+    AUTH_MODES, MAINTENANCE_ACTIONS, SYSTEM_ROLE_STRATEGIES, SYSTEM_PROMPT_POSITIONS, LENGTH_UNITS,
+    COMPRESSION_LEVELS, TTFT_SLO_RETRY_MODES, MESSAGE_UUID_MODES, COMPAT_FLAGS, LOG_LEVELS,
+)
+from .backpressure import POLICIES
+from .tracing import EXPORTERS
+from .transport import PARSER_PROFILES, DECODE_ERROR_MODES
+
+OVERSIZE_STRATEGIES = ("truncate", "split", "summarize", "reject")
+BUDGET_ACTIONS = ("none", "rotate", "degrade")
+
+# Read by the launcher or libraries rather than Settings, so never reported as unknown
+EXTERNAL_VARIABLES = {"PROFILE", "CONFIG_FILE"}
+
+
+class ConfigIssue(NamedTuple):
+    """One problem found in the configuration."""
+    level: str  # error or warning
+    setting: str
+    message: str
+    
+    def __str__(self) -> str:
+        return f"{self.level.upper()}: {self.setting}: {self.message}"
+
+
+def _known_names() -> List[str]:
+    """Environment variable names of every setting."""
+    return [name.upper() for name in Settings.model_fields]
+
+
+def unknown_variables(names: Iterable[str], strict: bool) -> List[ConfigIssue]:
+    """Variables that are not settings; with strict=False only those that look like a typo of one."""
+    known = _known_names()
+    known_set = set(known) | EXTERNAL_VARIABLES
+    # The shell environment is shared with everything else, so only names in our namespaces are considered
+    prefixes = {name.split("_")[0] for name in known}
+    issues = []
+    for name in sorted(set(names)):
+        upper = name.upper()
+        if upper in known_set or (not strict and upper.split("_")[0] not in prefixes):
+            continue
+        guess = difflib.get_close_matches(upper, known, n=1, cutoff=0.8)
+        if guess:
+            issues.append(ConfigIssue("warning", name, f"unknown setting, did you mean {guess[0]}?"))
+        elif strict:
+            issues.append(ConfigIssue("warning", name, "unknown setting, ignored"))
+    return issues
+
+
+def _one_of(issues: List[ConfigIssue], setting: str, value: str, allowed: Iterable[str]):
+    """Report a value outside its allowed set."""
+    allowed = tuple(allowed)
+    if value not in allowed:
+        shown = ", ".join(a or "(empty)" for a in allowed)
+        issues.append(ConfigIssue("error", setting.upper(), f"{value!r} is not one of {shown}"))
+
+
+def _json_object(raw: str) -> dict:
+    """A JSON object setting; malformed values are left to the module that parses them."""
+    try:
+        data = json.loads(raw) if raw.strip() else {}
+    except ValueError:
+        return {}
+    return data if isinstance(data, dict) else {}
+
+
+def check_settings(config: Settings) -> List[ConfigIssue]:
+    """Cross-setting checks that no single module can make on its own."""
+    issues: List[ConfigIssue] = []
+    
+    def error(setting: str, message: str):
+        issues.append(ConfigIssue("error", setting, message))
+    
+    def warn(setting: str, message: str):
+        issues.append(ConfigIssue("warning", setting, message))
+    
+    _one_of(issues, "oversize_message_strategy", config.oversize_message_strategy, OVERSIZE_STRATEGIES)
+    _one_of(issues, "budget_exhausted_action", config.budget_exhausted_action, BUDGET_ACTIONS)
+    _one_of(issues, "trace_export", config.trace_export, ("",) + EXPORTERS)
+    _one_of(issues, "stream_backpressure", config.stream_backpressure, POLICIES)
+    _one_of(issues, "response_parser", config.response_parser, PARSER_PROFILES)
+    _one_of(issues, "auth_mode", config.auth_mode, AUTH_MODES)
+    _one_of(issues, "maintenance_action", config.maintenance_action, MAINTENANCE_ACTIONS)
+    _one_of(issues, "system_role_strategy", config.system_role_strategy, SYSTEM_ROLE_STRATEGIES)
+    _one_of(issues, "system_prompt_position", config.system_prompt_position, SYSTEM_PROMPT_POSITIONS)
+    _one_of(issues, "length_unit", config.length_unit, LENGTH_UNITS)
+    _one_of(issues, "prompt_compression", config.prompt_compression, COMPRESSION_LEVELS)
+    _one_of(issues, "ttft_slo_retry", config.ttft_slo_retry, TTFT_SLO_RETRY_MODES)
+    _one_of(issues, "message_uuid_mode", config.message_uuid_mode, MESSAGE_UUID_MODES)
+    _one_of(issues, "output_decode_errors", config.output_decode_errors, DECODE_ERROR_MODES)
+    _one_of(issues, "log_level", config.log_level.upper(), LOG_LEVELS)
+    # List settings: every entry has to be a known value
+    for flag in (f.strip() for f in config.compat_mode.split(",")):
+        if flag:
+            _one_of(issues, "compat_mode", flag, COMPAT_FLAGS)
+    for profile in _json_object(config.response_parser_endpoints).values():
+        _one_of(issues, "response_parser_endpoints", str(profile), PARSER_PROFILES)
+    
+    # Missing companions: the feature is switched on but cannot work
+    if config.auth_mode in ("jwt", "both") and not config.oidc_jwks_url:
+        error("OIDC_JWKS_URL", f"required when AUTH_MODE={config.auth_mode}")
+    if config.auth_mode in ("jwt", "both") and not config.oidc_audience:
+        error("OIDC_AUDIENCE", f"required when AUTH_MODE={config.auth_mode}")
+    if config.auth_mode in ("jwt", "both") and not config.get_oidc_algorithms():
+        error("OIDC_ALGORITHMS", f"required when AUTH_MODE={config.auth_mode}")
+    if config.trace_export == "langfuse" and not (config.langfuse_public_key and config.langfuse_secret_key):
+        error("LANGFUSE_SECRET_KEY", "LANGFUSE_PUBLIC_KEY and LANGFUSE_SECRET_KEY are required for Langfuse export")
+    if config.budget_exhausted_action == "degrade" and not config.budget_degrade_model:
+        error("BUDGET_DEGRADE_MODEL", "required when BUDGET_EXHAUSTED_ACTION=degrade")
+    if config.cursor_checksum and not config.cursor_client_key:
+        warn("CURSOR_CLIENT_KEY", "CURSOR_CHECKSUM is set without a client key; Cursor rejects checksums "
+                                  "that do not belong to the x-client-key sent with them")
+    if not config.get_clean_tokens() and not config.dry_run:
+        warn("CURSOR_TOKEN", "no Cursor token configured; every chat request will fail until one is set")
+    
+    # Tags that no token carries: a routed key class would get 503 on every request
+    token_tags = set(_json_object(config.cursor_token_tags))
+    key_tags = {str(tag) for tag in _json_object(config.key_token_tags).values()}
+    for tag in sorted(key_tags - token_tags):
+        error("KEY_TOKEN_TAGS", f"routes keys to tag {tag}, but no token in CURSOR_TOKEN_TAGS carries it")
+    reserved = {r.strip() for r in config.reserved_token_tags.split(",") if r.strip()}
+    for tag in sorted(reserved - token_tags):
+        warn("RESERVED_TOKEN_TAGS", f"tag {tag} is not used in CURSOR_TOKEN_TAGS")
+    
+    # Conflicting options: one of them is silently ignored
+    if config.auth_mode == "jwt" and config.hmac_keys:
+        warn("HMAC_KEYS", "ignored because AUTH_MODE=jwt only accepts JWTs")
+    if config.cursor_version_auto and _bootstrap_value("CURSOR_VERSION"):
+        warn("CURSOR_VERSION", "ignored because CURSOR_VERSION_AUTO=true detects the version")
+    for name in ("cursor_token", "api_key"):
+        # The loaded value already comes from the file, so look at what was configured
+        if getattr(config, f"{name}_file") and _bootstrap_value(name.upper()):
+            warn(name.upper(), f"overridden by {name.upper()}_FILE")
+    
+    # Settings without effect unless their feature is on
+    if config.response_compression_streams and not config.response_compression:
+        warn("RESPONSE_COMPRESSION_STREAMS", "has no effect without RESPONSE_COMPRESSION=true")
+    if config.callback_allowed_hosts and not config.callback_secret:
+        warn("CALLBACK_ALLOWED_HOSTS", "callbacks stay disabled until CALLBACK_SECRET is set")
+    if config.maintenance_action == "defer" and config.maintenance_defer_max <= 0:
+        warn("MAINTENANCE_DEFER_MAX", "is 0, so MAINTENANCE_ACTION=defer rejects like reject")
+    if config.oversize_message_strategy != "summarize" and config.summarize_model:
+        warn("SUMMARIZE_MODEL", "only used when OVERSIZE_MESSAGE_STRATEGY=summarize")
+    return issues
+
+
+def collect_issues() -> List[ConfigIssue]:
+    """Everything wrong with the current environment, .env file, profile and settings."""
+    issues = unknown_variables(os.environ, strict=False)
+    if os.path.exists(".env"):
+        # .env only holds our settings, so anything unknown in it is worth a warning
+        issues += unknown_variables(dotenv_values(".env"), strict=True)
+    issues += unknown_variables(load_profile(), strict=True)
+    issues += check_settings(settings.get())
+    # A name set in several places is reported once
+    return list(dict.fromkeys(issues))
+
+
+_checked = False
+
+
+def check_config():
+    """Print configuration warnings and exit on errors, once per process."""
+    global _checked
+    if _checked:
+        return
+    _checked = True
+    issues = collect_issues()
+    for issue in issues:
+        print(issue, file=sys.stderr)
+    errors = [issue for issue in issues if issue.level == "error"]
+    if errors:
+        print(f"Configuration has {len(errors)} error(s); see env.sample for valid values", file=sys.stderr)
+        sys.exit(1)
@@ -0,0 +1,113 @@
+"""Per-request context threaded from handlers through the service layer."""
+import time
+import uuid
+import dataclasses
+from dataclasses import dataclass, field
+from typing import Any, Dict, List, Optional
+from .models import Message
+
+
+class UpstreamInfo:
+    """Latency breakdown and routing outcome of a single proxied request."""
+    
+    def __init__(self):
+        self.requested_model: Optional[str] = None
+        self.model: Optional[str] = None
+        self.token: Optional[str] = None
+        self.stop_reason: Optional[str] = None
+        # As actually sent upstream, after request flags and UPSTREAM_EXTRA_HEADERS
+        self.ghost_mode: Optional[bool] = None
+        # IDs of the last upstream attempt, for matching a response to Cursor's side
+        self.trace_id: Optional[str] = None
+        self.conversation_id: Optional[str] = None
+        self.upstream_request_id: Optional[str] = None
+        # HTTP status of the last upstream response, None if nothing was sent
+        self.status: Optional[int] = None
+        self.queue_wait: float = 0.0
+        self.started_at: Optional[float] = None
+        self.first_byte_at: Optional[float] = None
+        self.finished_at: Optional[float] = None
+    
+    def mark_started(self):
+        """Record when the upstream request was sent."""
+        if self.started_at is None:
+            self.started_at = time.monotonic()
+    
+    def mark_first_byte(self):
+        """Record when the first response bytes arrived."""
+        if self.first_byte_at is None:
+            self.first_byte_at = time.monotonic()
+    
+    def mark_finished(self):
+        """Record when the upstream stream completed."""
+        self.finished_at = time.monotonic()
+    
+    @property
+    def ttfb_ms(self) -> Optional[int]:
+        """Time to first upstream byte in milliseconds."""
+        if self.started_at is None or self.first_byte_at is None:
+            return None
+        return int((self.first_byte_at - self.started_at) * 1000)
+    
+    @property
+    def duration_ms(self) -> Optional[int]:
+        """Total upstream duration in milliseconds."""
+        if self.started_at is None or self.finished_at is None:
+            return None
+        return int((self.finished_at - self.started_at) * 1000)
+    
+    def headers(self) -> dict:
+        """Build X-Upstream-* latency headers (milliseconds)."""
+        headers = {"X-Queue-Wait": str(int(self.queue_wait * 1000))}
+        if self.ttfb_ms is not None:
+            headers["X-Upstream-TTFB"] = str(self.ttfb_ms)
+        if self.duration_ms is not None:
+            headers["X-Upstream-Duration"] = str(self.duration_ms)
+        if self.model and self.model != self.requested_model:
+            headers["X-Model-Used"] = self.model
+        if self.ghost_mode is not None:
+            headers["X-Ghost-Mode"] = str(self.ghost_mode).lower()
+        return headers
+
+
+@dataclass
+class RequestContext:
+    """Everything known about a request: caller, target, overrides and deadline."""
+    model: str
+    messages: List[Message]
+    api_key: str = ""
+    request_id: str = field(default_factory=lambda: uuid.uuid4().hex)
+    # Always generated here, unlike request_id which a client may choose and reuse
+    internal_id: str = field(default_factory=lambda: uuid.uuid4().hex)
+    client_ip: str = ""
+    user_agent: str = ""
+    session_key: str = ""
+    # X-Session-Id as sent by the client, empty when the session is derived from the messages
+    session_id: str = ""
+    end_user: str = ""
+    overrides: Dict[str, Any] = field(default_factory=dict)
+    deadline: Optional[float] = None
+    info: UpstreamInfo = field(default_factory=UpstreamInfo)
+    
+    @classmethod
+    def create(cls, model: str, messages: List[Message], timeout: Optional[float] = None, **kwargs) -> "RequestContext":
+        """Create a context whose deadline is `timeout` seconds from now."""
+        deadline = time.monotonic() + timeout if timeout else None
+        return cls(model=model, messages=messages, deadline=deadline, **kwargs)
+    
+    def remaining(self) -> Optional[float]:
+        """Seconds left until the deadline, or None without one."""
+        if self.deadline is None:
+            return None
+        return self.deadline - time.monotonic()
+    
+    def warn(self, code: str, message: str):
+        """Note that the request was not honored verbatim; reported in the response once per code."""
+        warnings = self.overrides.setdefault("warnings", [])
+        if not any(w["code"] == code for w in warnings):
+            warnings.append({"code": code, "message": message})
+    
+    def derive(self, **changes) -> "RequestContext":
+        """Copy the context for a sub-request with its own upstream info."""
+        changes.setdefault("info", UpstreamInfo())
+        return dataclasses.replace(self, **changes)
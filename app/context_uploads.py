@@ -0,0 +1,248 @@
+"""Large prompt contexts uploaded in chunks and referenced from chat requests by context ID."""
+import os
+import re
+import json
+import time
+import uuid
+import shutil
+import hashlib
+import threading
+from typing import AsyncIterator, List, Optional, Tuple
+from .config import settings
+from .models import Message
+from .transcripts import _owner
+
+# IDs are generated by us, but every path segment they reach arrives as user input
+_ID_PATTERN = re.compile(r"^ctx_[0-9a-f]{32}$")
+
+# Chunk indexes are zero-padded in file names so a directory listing sorts in upload order
+MAX_CHUNKS = 100000
+
+# Expired uploads are swept at most this often
+PRUNE_INTERVAL = 60
+
+
+class ContextUploadError(Exception):
+    """Raised for an upload that cannot take a chunk, be completed or be used."""
+    
+    def __init__(self, message: str, status: int = 400, code: str = "invalid_context_upload"):
+        self.status = status
+        self.code = code
+        super().__init__(message)
+
+
+class ContextStore:
+    """One directory per upload: metadata, the chunks while uploading, the assembled text once complete."""
+    
+    def __init__(self, directory: str):
+        self.directory = directory
+        self._last_prune = 0.0
+        self._lock = threading.Lock()
+    
+    def _dir(self, context_id: str) -> str:
+        if not _ID_PATTERN.match(context_id):
+            raise ContextUploadError(f"No context upload with ID {context_id}", 404, "not_found")
+        return os.path.join(self.directory, context_id)
+    
+    def _load(self, context_id: str, api_key: str) -> dict:
+        """Metadata of an upload the caller owns and that has not expired."""
+        path = os.path.join(self._dir(context_id), "meta.json")
+        try:
+            with open(path, encoding="utf-8") as f:
+                meta = json.load(f)
+        except (OSError, ValueError):
+            meta = None
+        # Someone else's upload is reported exactly like a missing one
+        if not meta or meta["owner"] != _owner(api_key) or meta["expires_at"] < time.time():
+            raise ContextUploadError(f"No context upload with ID {context_id}", 404, "not_found")
+        return meta
+    
+    def _save(self, meta: dict):
+        with open(os.path.join(self._dir(meta["id"]), "meta.json"), "w", encoding="utf-8") as f:
+            json.dump(meta, f)
+    
+    @staticmethod
+    def describe(meta: dict) -> dict:
+        """The upload object returned to clients."""
+        return {k: v for k, v in meta.items() if k != "owner"}
+    
+    def _usage(self, owner: str) -> Tuple[int, int]:
+        """Number and total bytes of an owner's unexpired uploads. Caller holds the lock."""
+        count = size = 0
+        now = time.time()
+        if not os.path.isdir(self.directory):
+            return 0, 0
+        for name in os.listdir(self.directory):
+            if not _ID_PATTERN.match(name):
+                continue
+            try:
+                with open(os.path.join(self.directory, name, "meta.json"), encoding="utf-8") as f:
+                    meta = json.load(f)
+            except (OSError, ValueError):
+                continue
+            if meta.get("owner") == owner and meta.get("expires_at", 0) >= now:
+                count += 1
+                size += meta.get("bytes", 0)
+        return count, size
+    
+    def create(self, api_key: str) -> dict:
+        """Start a new upload."""
+        now = time.time()
+        meta = {
+            "id": f"ctx_{uuid.uuid4().hex}",
+            "object": "context",
+            "owner": _owner(api_key),
+            "status": "uploading",
+            "created": int(now),
+            "expires_at": int(now + settings.context_upload_ttl),
+            "bytes": 0,
+            "chunks": 0,
+            "sha256": None,
+        }
+        with self._lock:
+            self._prune()
+            count, _ = self._usage(meta["owner"])
+            if count >= settings.context_upload_max_per_key:
+                raise ContextUploadError(
+                    f"Too many context uploads; delete one or wait for it to expire "
+                    f"(CONTEXT_UPLOAD_MAX_PER_KEY={settings.context_upload_max_per_key})",
+                    429, "too_many_context_uploads",
+                )
+            os.makedirs(self._dir(meta["id"]), exist_ok=True)
+            self._save(meta)
+        return self.describe(meta)
+    
+    def put_chunk(self, context_id: str, api_key: str, index: int, data: bytes) -> dict:
+        """Store one chunk; re-sending an index replaces it, so a failed chunk can simply be retried."""
+        if not 0 <= index < MAX_CHUNKS:
+            raise ContextUploadError(f"Chunk index must be between 0 and {MAX_CHUNKS - 1}")
+        with self._lock:
+            meta = self._load(context_id, api_key)
+            if meta["status"] != "uploading":
+                raise ContextUploadError(f"Context upload {context_id} is already complete", 409, "context_complete")
+            path = os.path.join(self._dir(context_id), f"{index:06d}.part")
+            existed = os.path.exists(path)
+            previous = os.path.getsize(path) if existed else 0
+            total = meta["bytes"] - previous + len(data)
+            if total > settings.context_upload_max_bytes:
+                raise ContextUploadError(
+                    f"Context upload would exceed CONTEXT_UPLOAD_MAX_BYTES ({settings.context_upload_max_bytes})",
+                    413, "context_too_large",
+                )
+            _, used = self._usage(meta["owner"])
+            if used - previous + len(data) > settings.context_upload_quota_bytes:
+                raise ContextUploadError(
+                    f"Context uploads of this key would exceed CONTEXT_UPLOAD_QUOTA_BYTES "
+                    f"({settings.context_upload_quota_bytes})",
+                    413, "context_quota_exceeded",
+                )
+            with open(path, "wb") as f:
+                f.write(data)
+            meta["bytes"] = total
+            meta["chunks"] += 0 if existed else 1
+            self._save(meta)
+        return self.describe(meta)
+    
+    def _chunks(self, context_id: str) -> List[str]:
+        """Chunk files in index order."""
+        return sorted(n for n in os.listdir(self._dir(context_id)) if n.endswith(".part"))
+    
+    def complete(self, context_id: str, api_key: str, sha256: Optional[str] = None) -> dict:
+        """Join the chunks into the context text, checking for gaps, UTF-8 and an optional checksum."""
+        with self._lock:
+            meta = self._load(context_id, api_key)
+            if meta["status"] == "ready":
+                return self.describe(meta)
+            names = self._chunks(context_id)
+            if not names:
+                raise ContextUploadError(f"Context upload {context_id} has no chunks")
+            missing = [i for i, name in enumerate(names) if name != f"{i:06d}.part"]
+            if missing:
+                raise ContextUploadError(f"Context upload {context_id} is missing chunk {missing[0]}")
+            
+            directory = self._dir(context_id)
+            digest = hashlib.sha256()
+            with open(os.path.join(directory, "context.tmp"), "wb") as out:
+                for name in names:
+                    with open(os.path.join(directory, name), "rb") as f:
+                        data = f.read()
+                    digest.update(data)
+                    out.write(data)
+            if sha256 and digest.hexdigest() != sha256.lower():
+                os.remove(os.path.join(directory, "context.tmp"))
+                raise ContextUploadError(f"Checksum mismatch: the chunks hash to {digest.hexdigest()}",
+                                         400, "context_checksum_mismatch")
+            try:
+                with open(os.path.join(directory, "context.tmp"), encoding="utf-8") as f:
+                    f.read()
+            except UnicodeDecodeError as e:
+                os.remove(os.path.join(directory, "context.tmp"))
+                raise ContextUploadError(f"Context is not valid UTF-8 text: {e}")
+            
+            os.replace(os.path.join(directory, "context.tmp"), os.path.join(directory, "context.txt"))
+            for name in names:
+                os.remove(os.path.join(directory, name))
+            meta.update(status="ready", sha256=digest.hexdigest(), chunks=len(names))
+            self._save(meta)
+        return self.describe(meta)
+    
+    def get(self, context_id: str, api_key: str) -> dict:
+        """Describe an upload."""
+        return self.describe(self._load(context_id, api_key))
+    
+    def delete(self, context_id: str, api_key: str):
+        """Remove an upload and everything stored for it."""
+        with self._lock:
+            self._load(context_id, api_key)
+            shutil.rmtree(self._dir(context_id), ignore_errors=True)
+    
+    def text(self, context_id: str, api_key: str) -> str:
+        """The assembled text of a completed upload."""
+        meta = self._load(context_id, api_key)
+        if meta["status"] != "ready":
+            raise ContextUploadError(f"Context upload {context_id} is not complete yet", 409, "context_incomplete")
+        with open(os.path.join(self._dir(context_id), "context.txt"), encoding="utf-8") as f:
+            return f.read()
+    
+    def _prune(self):
+        """Delete uploads past their expiry. Caller holds the lock."""
+        now = time.time()
+        if now - self._last_prune < PRUNE_INTERVAL or not os.path.isdir(self.directory):
+            return
+        self._last_prune = now
+        for name in os.listdir(self.directory):
+            if not _ID_PATTERN.match(name):
+                continue
+            try:
+                with open(os.path.join(self.directory, name, "meta.json"), encoding="utf-8") as f:
+                    expired = json.load(f)["expires_at"] < now
+            except (OSError, ValueError, KeyError):
+                # An upload without readable metadata can never be used
+                expired = True
+            if expired:
+                shutil.rmtree(os.path.join(self.directory, name), ignore_errors=True)
+
+
+async def read_chunk(body: AsyncIterator[bytes], content_length: str) -> bytes:
+    """Read a chunk body, refusing it before buffering more than CONTEXT_UPLOAD_MAX_BYTES."""
+    limit = settings.context_upload_max_bytes
+    error = ContextUploadError(f"Chunk exceeds CONTEXT_UPLOAD_MAX_BYTES ({limit})", 413, "context_too_large")
+    if content_length.isdigit() and int(content_length) > limit:
+        raise error
+    # Content-Length may be missing (chunked transfer) or understated, so the stream is capped as well
+    data = bytearray()
+    async for part in body:
+        data += part
+        if len(data) > limit:
+            raise error
+    return bytes(data)
+
+
+def attach_context(messages: List[Message], text: str) -> List[Message]:
+    """Insert an uploaded context as a user message just before the final user message."""
+    last_user = max((i for i, m in enumerate(messages) if m.role == "user"), default=len(messages))
+    return list(messages[:last_user]) + [Message(role="user", content=text)] + list(messages[last_user:])
+
+
+# Global context store instance
+context_store = ContextStore(settings.context_upload_dir)
@@ -1,12 +1,61 @@
 """Cursor IDE gRPC-Web client implementation."""
-import struct
+import json
+import time
 import uuid
 import hashlib
 import asyncio
-from typing import AsyncGenerator, List, Optional
+import logging
+from contextlib import aclosing
+from typing import AsyncGenerator, Dict, List, Optional
 import httpx
 from .config import settings
 from .models import Message
+from .context import RequestContext
+from .version import version_detector
+from .token_pool import token_pool, TokenState
+from .redaction import redactor
+from .system_prompt import inject_system_prompt
+from .system_role import apply_system_strategy
+from .truncation import truncate_messages
+from .dedup import DeltaDeduplicator
+from .stop_patterns import StopDetector
+from .output_scanner import OutputScanner
+from .extra_headers import render_extra_headers
+from .slo import ttft_slo_for, first_chunk_within, TTFTExceededError
+from .shadow_encoder import shadow_encoder
+from .model_access import model_access, ModelBlockedError
+from .streams import stream_registry
+from .sessions import message_uuids
+from .request_ids import upstream_request_id
+from .errors import upstream_error, grpc_error
+from .dry_run import dry_run_log, DRY_RUN_TOKEN
+from .drift import drift_detector, ProtocolDriftError
+from .quarantine import quarantine
+from .transport import (
+    Transport, Encoder, StreamParser, HttpTransport, GrpcWebEncoder, Utf8Assembler,
+    UpstreamTimeoutError, PARSER_PROFILES, grpc_web_body,
+    grpc_trailer, grpc_header_status
+)
+
+logger = logging.getLogger(__name__)
+
+CHAT_ENDPOINT = "StreamChat"
+
+
+def _parse_parser_endpoints(raw: str) -> Dict[str, str]:
+    """Parse RESPONSE_PARSER_ENDPOINTS: a JSON object of {AiService method: parser profile}."""
+    if not raw.strip():
+        return {}
+    try:
+        data = json.loads(raw)
+        if not isinstance(data, dict):
+            raise ValueError("expected a JSON object")
+    except ValueError as e:
+        raise ValueError(f"Invalid RESPONSE_PARSER_ENDPOINTS: {e}") from e
+    return {str(k): str(v) for k, v in data.items()}
+
+
+parser_endpoints = _parse_parser_endpoints(settings.response_parser_endpoints)
 
 
 class ProtobufEncoder:
@@ -84,6 +133,25 @@ class CursorModel:
         return ProtobufEncoder.encode_string(1, self.model_name)
 
 
+class CursorCurrentFile:
+    """Represents the active file in Cursor format."""
+    
+    def __init__(self, path: str, contents: str = "", line: int = 0):
+        self.path = path
+        self.contents = contents
+        self.line = line
+    
+    def encode(self) -> bytes:
+        """Encode file info to protobuf bytes."""
+        result = b''
+        result += ProtobufEncoder.encode_string(1, self.path)      # relative_workspace_path
+        result += ProtobufEncoder.encode_string(2, self.contents)  # contents
+        if self.line:
+            # cursor_position { line }
+            result += ProtobufEncoder.encode_message(3, ProtobufEncoder.encode_uint64(1, self.line))
+        return result
+
+
 class CursorRequest:
     """Represents a chat request in Cursor format."""
     
@@ -93,23 +161,35 @@ class CursorRequest:
         model: CursorModel,
         paths: str,
         trace_id: str,
-        conversation_id: str
+        conversation_id: str,
+        current_file: Optional[CursorCurrentFile] = None,
+        explicit_context: str = ""
     ):
         self.messages = messages
         self.model = model
         self.paths = paths
         self.trace_id = trace_id
         self.conversation_id = conversation_id
+        self.current_file = current_file
+        self.explicit_context = explicit_context
     
     def encode(self) -> bytes:
         """Encode request to protobuf bytes."""
         result = b''
         
+        # Field 1: current_file
+        if self.current_file:
+            result += ProtobufEncoder.encode_message(1, self.current_file.encode())
+        
         # Field 2: messages (repeated)
         for msg in self.messages:
             msg_bytes = msg.encode()
             result += ProtobufEncoder.encode_message(2, msg_bytes)
         
+        # Field 4: explicit_context { context }
+        if self.explicit_context:
+            result += ProtobufEncoder.encode_message(4, ProtobufEncoder.encode_string(1, self.explicit_context))
+        
         # Field 5: paths
         result += ProtobufEncoder.encode_string(5, self.paths)
         
@@ -132,166 +212,519 @@ class CursorRequest:
 class CursorClient:
     """Async client for Cursor IDE API."""
     
-    def __init__(self):
+    def __init__(
+        self,
+        transport: Optional[Transport] = None,
+        encoder: Optional[Encoder] = None,
+        parser: Optional[StreamParser] = None
+    ):
         self.api_url = settings.cursor_api_url
-        self.token = settings.get_clean_token()
         self.timeout = settings.timeout
+        # Injectable so retries and fallbacks can run against tests.mocks without network access
+        self.transport = transport or HttpTransport(httpx.Timeout(self.timeout, connect=settings.connect_timeout))
+        self.encoder = encoder or GrpcWebEncoder()
+        # An injected parser wins; otherwise each endpoint gets its configured profile
+        self.parser = parser
+    
+    def parser_for(self, endpoint: str) -> StreamParser:
+        """The response parser for an AiService method, per RESPONSE_PARSER and RESPONSE_PARSER_ENDPOINTS."""
+        if self.parser is not None:
+            return self.parser
+        return PARSER_PROFILES[parser_endpoints.get(endpoint, settings.response_parser)]()
+    
+    @property
+    def http(self) -> httpx.AsyncClient:
+        """Shared HTTP client of the default transport, for non-chat upstream calls."""
+        return self.transport.http
     
-    def _build_headers(self, trace_id: str) -> dict:
+    async def close(self):
+        """Close pooled upstream connections."""
+        await self.transport.close()
+    
+    def _build_headers(
+        self,
+        trace_id: str,
+        token: str,
+        body: bytes = b"",
+        ghost_mode: Optional[bool] = None,
+        request_id: Optional[str] = None
+    ) -> dict:
         """Build request headers."""
+        config = settings.get()
+        if ghost_mode is None:
+            ghost_mode = config.cursor_ghost_mode
         headers = {
             "User-Agent": "connect-es/1.6.1",
-            "Authorization": f"Bearer {self.token}",
+            "Authorization": f"Bearer {token}",
             "connect-accept-encoding": "gzip,br",
             "connect-protocol-version": "1",
             "Content-Type": "application/connect+proto",
             "x-amzn-trace-id": f"Root={trace_id}",
-            "x-cursor-client-version": settings.cursor_version,
-            "x-cursor-timezone": settings.cursor_timezone,
-            "x-ghost-mode": str(settings.cursor_ghost_mode).lower(),
-            "x-request-id": trace_id,
+            "x-cursor-client-version": version_detector.current,
+            "x-cursor-timezone": config.cursor_timezone,
+            "x-ghost-mode": str(ghost_mode).lower(),
+            "x-request-id": request_id or trace_id,
         }
         
-        if settings.cursor_client_key:
-            headers["x-client-key"] = settings.cursor_client_key
+        if config.cursor_client_key:
+            headers["x-client-key"] = config.cursor_client_key
         
-        if settings.cursor_checksum:
-            headers["x-cursor-checksum"] = settings.cursor_checksum
+        if config.cursor_checksum:
+            headers["x-cursor-checksum"] = config.cursor_checksum
         else:
             # Generate a default checksum
-            headers["x-cursor-checksum"] = self._generate_checksum()
+            headers["x-cursor-checksum"] = self._generate_checksum(token)
         
+        # Configured headers can add new ones or override the defaults above
+        headers.update(render_extra_headers(trace_id, body))
         return headers
     
-    def _generate_checksum(self) -> str:
+    def _generate_checksum(self, token: str) -> str:
         """Generate x-cursor-checksum header value."""
         # This is a simplified implementation
-        hash1 = hashlib.sha256(self.token.encode()).hexdigest()
-        hash2 = hashlib.sha256(f"{self.token}cursor".encode()).hexdigest()
+        hash1 = hashlib.sha256(token.encode()).hexdigest()
+        hash2 = hashlib.sha256(f"{token}cursor".encode()).hexdigest()
         return f"{hash1[:64]}/{hash2[:64]}"
     
-    def _build_grpc_envelope(self, data: bytes) -> bytes:
-        """Build gRPC-Web envelope with 5-byte length prefix."""
-        # Format: 1-byte compression flag + 4-byte big-endian length + data
-        return struct.pack(">BI", 0, len(data)) + data
-    
-    def _convert_messages(self, messages: List[Message]) -> List[CursorMessage]:
+    def _convert_messages(self, messages: List[Message], session_key: str = "") -> List[CursorMessage]:
         """Convert OpenAI messages to Cursor format."""
         result = []
-        msg_uuid = str(uuid.uuid4())
+        contents = [redactor.redact_prompt(msg.get_text_content(), msg.role) for msg in messages]
+        uuids = message_uuids.assign(session_key, [(msg.role, content) for msg, content in zip(messages, contents)])
         
-        for msg in messages:
+        for msg, content, msg_uuid in zip(messages, contents, uuids):
             role = 1  # user
             if msg.role in ("assistant", "system"):
                 role = 2
             
-            content = msg.get_text_content()
-            
-            # Inject system prompt if configured
-            if msg.role == "system" and settings.system_prompt_inject:
-                content = f"{content}\n{settings.system_prompt_inject}"
-            
             result.append(CursorMessage(content, role, msg_uuid))
         
         return result
     
-    async def chat_completion_stream(
+    @staticmethod
+    def _record_rejection(token_state: TokenState, status: int):
+        """Account an upstream error status to the token the request was sent with."""
+        if status == 401:
+            token_state.mark_dead("upstream returned 401")
+        # Other 4xx answers are about the request, not the account behind the token
+        if status in (403, 429) or status >= 500:
+            token_state.record_outcome(False, rate_limited=status == 429)
+    
+    def _timeout_for(self, ctx: RequestContext) -> httpx.Timeout:
+        """Get the connect and per-read timeouts, bounded by the request deadline."""
+        config = settings.get()
+        connect = config.connect_timeout or None
+        # httpx applies one read timeout to the headers and to every chunk, so it has to allow the longer
+        # of the two phases; the TTFB and idle limits themselves are enforced in _stream_once and _read_chunks
+        read = max(config.ttfb_timeout, config.idle_timeout) if config.ttfb_timeout and config.idle_timeout else None
+        remaining = ctx.remaining()
+        if remaining is not None:
+            if remaining <= 0:
+                raise UpstreamTimeoutError("total", config.stream_max_duration)
+            connect = min(connect or remaining, remaining)
+            read = min(read or remaining, remaining)
+        return httpx.Timeout(read, connect=connect)
+    
+    @staticmethod
+    def _failed_attempt(
+        e: Exception,
+        token_state: TokenState,
+        ctx: RequestContext,
+        timeout: httpx.Timeout,
+        before_first_byte: bool
+    ) -> Optional[UpstreamTimeoutError]:
+        """Account a failed upstream attempt to its token, returning the timeout to raise in its place if any."""
+        if isinstance(e, httpx.ConnectTimeout):
+            token_state.record_outcome(False)
+            return UpstreamTimeoutError("connect", timeout.connect)
+        if isinstance(e, httpx.ReadTimeout):
+            # Only reached when httpx's read timeout beats our own checks, e.g. one cut short by the deadline
+            remaining = ctx.remaining()
+            if remaining is not None and remaining <= 0:
+                return UpstreamTimeoutError("total", settings.stream_max_duration)
+            token_state.record_outcome(False)
+            if before_first_byte:
+                return UpstreamTimeoutError("ttfb", settings.ttfb_timeout)
+            return UpstreamTimeoutError("idle", settings.idle_timeout)
+        if isinstance(e, TimeoutError):
+            token_state.record_outcome(False)
+            return UpstreamTimeoutError("ttfb", settings.ttfb_timeout)
+        # Running out of the request's own duration budget says nothing about the token
+        if not (isinstance(e, UpstreamTimeoutError) and e.phase == "total"):
+            token_state.record_outcome(False)
+        return None
+    
+    async def _read_chunks(self, response, ctx: RequestContext) -> AsyncGenerator[bytes, None]:
+        """Yield response bytes, enforcing the idle and total timeouts."""
+        config = settings.get()
+        chunks = response.aiter_bytes()
+        # The first byte is timed by the caller, from when the request was sent rather than from the headers
+        phase, limit = "ttfb", 0
+        while True:
+            wait = limit or None
+            remaining = ctx.remaining()
+            # The duration cap wins when it is closer than the phase timeout
+            if remaining is not None and (wait is None or remaining < wait):
+                phase, wait, limit = "total", max(remaining, 0), config.stream_max_duration
+            try:
+                chunk = await asyncio.wait_for(chunks.__anext__(), wait)
+            except StopAsyncIteration:
+                return
+            except asyncio.TimeoutError:
+                raise UpstreamTimeoutError(phase, limit) from None
+            yield chunk
+            phase, limit = "idle", config.idle_timeout
+    
+    async def chat_completion_stream(self, ctx: RequestContext) -> AsyncGenerator[str, None]:
+        """Stream chat completion, masking leaked secrets and ending early on stop patterns."""
+        detector = StopDetector()
+        scanner = OutputScanner()
+        async with aclosing(self._stream_with_fallback(ctx)) as upstream:
+            async for chunk in upstream:
+                text, stop = detector.feed(chunk)
+                text = scanner.feed(text)
+                if text:
+                    yield text
+                if stop:
+                    # Leaving the block closes the upstream connection
+                    ctx.info.stop_reason = detector.reason
+                    logger.info("[%s] Stopped generation early: %s", ctx.request_id, detector.reason)
+                    break
+        
+        tail = scanner.flush()
+        if tail:
+            yield tail
+    
+    async def _stream_with_fallback(self, ctx: RequestContext) -> AsyncGenerator[str, None]:
+        """Stream chat completion, falling back along the model's fallback chain."""
+        ctx.info.requested_model = ctx.info.requested_model or ctx.model
+        # Blocked fallbacks are skipped rather than tried
+        chain = model_access.filter(ctx.api_key, settings.get_fallback_chain(ctx.model))
+        if not chain:
+            raise ModelBlockedError(ctx.model)
+        
+        for i, candidate in enumerate(chain):
+            produced = False
+            try:
+                async for chunk in self._stream_with_recovery(ctx, ctx.messages, candidate):
+                    produced = True
+                    yield chunk
+                return
+            except Exception as e:
+                # Output already reached the client, or there is nothing left to try
+                if produced or i == len(chain) - 1:
+                    raise
+                logger.warning("[%s] Model %s failed, falling back to %s: %s",
+                               ctx.request_id, candidate, chain[i + 1], e)
+                ctx.warn("model_fallback", f"{candidate} failed, so the request fell back to {chain[i + 1]}")
+    
+    async def _stream_with_recovery(
         self,
+        ctx: RequestContext,
+        messages: List[Message],
+        model: str
+    ) -> AsyncGenerator[str, None]:
+        """Stream chat completion, recovering once from a mid-stream failure."""
+        partial = ""
+        try:
+            async for chunk in self._stream_with_slo(ctx, messages, model):
+                partial += chunk
+                yield chunk
+            return
+        except Exception as e:
+            # Nothing was sent yet, so there is nothing to stitch onto
+            if not settings.stream_recovery or not partial:
+                raise
+            logger.warning("[%s] Upstream failed after %d chars, recovering: %s",
+                           ctx.request_id, len(partial), e)
+            ctx.warn("stream_recovered", "The upstream failed mid-response; the rest was generated as a continuation")
+        
+        continuation = list(messages) + [
+            Message(role="assistant", content=partial),
+            Message(role="user", content=settings.stream_recovery_prompt),
+        ]
+        async for chunk in self._stream_once(ctx, continuation, model):
+            yield chunk
+    
+    async def _stream_with_slo(
+        self,
+        ctx: RequestContext,
+        messages: List[Message],
+        model: str
+    ) -> AsyncGenerator[str, None]:
+        """Stream chat completion, retrying on another token when the TTFT SLO is missed."""
+        slo = ttft_slo_for(model)
+        if slo is None:
+            async for chunk in self._stream_once(ctx, messages, model):
+                yield chunk
+            return
+        
+        # In "model" mode the error moves the request down the fallback chain instead
+        config = settings.get()
+        attempts = config.ttft_slo_retries + 1 if config.ttft_slo_retry == "token" else 1
+        for attempt in range(attempts):
+            stream = self._stream_once(ctx, messages, model)
+            try:
+                first = await first_chunk_within(stream, model, slo)
+            except TTFTExceededError as e:
+                if attempt == attempts - 1:
+                    raise
+                logger.warning("[%s] %s, retrying on another token", ctx.request_id, e)
+                continue
+            
+            if first is not None:
+                yield first
+            async for chunk in stream:
+                yield chunk
+            return
+    
+    async def _stream_once(
+        self,
+        ctx: RequestContext,
         messages: List[Message],
         model: str
     ) -> AsyncGenerator[str, None]:
         """Stream chat completion from Cursor API."""
-        if not self.token:
-            raise ValueError("CURSOR_TOKEN is not configured")
+        info = ctx.info
+        flags = ctx.overrides.get("flags", {})
+        raw = flags.get("raw", False)
+        requested = model
+        if settings.dry_run:
+            # Not taken from the pool, so budgets and pinning are untouched
+            token_state = TokenState(DRY_RUN_TOKEN)
+        else:
+            # An explicit cursor2api.token_tag wins over the tag of the key's class
+            tag = flags.get("token_tag") or token_pool.tag_for_key(ctx.api_key)
+            token_state, model = token_pool.acquire(model, ctx.session_key, tag)
+        if model != requested:
+            ctx.warn("model_degraded", f"Fast-request budget exhausted; {requested} was answered by {model}")
+        info.model = model
+        info.token = token_state.name
         
         # Build request
         trace_id = str(uuid.uuid4())
         conversation_id = str(uuid.uuid4())
         
-        cursor_messages = self._convert_messages(messages)
+        # Raw passthrough sends the conversation as the client built it, unless the prompt is locked
+        strategy = "assistant" if raw else settings.system_role_strategy
+        if not raw or settings.system_prompt_locked:
+            messages = inject_system_prompt(messages, model, strategy)
+        if flags.get("truncation", True) and not raw:
+            messages, truncated = truncate_messages(messages, settings.max_input_length)
+            if truncated:
+                ctx.warn("messages_truncated",
+                         f"Older messages were cut to fit MAX_INPUT_LENGTH ({settings.max_input_length})")
+        messages, instructions = apply_system_strategy(messages, strategy)
+        cursor_messages = self._convert_messages(messages, ctx.session_key)
         cursor_model = CursorModel(model)
         
+        # Coding assistants can ground the request in their workspace
+        workspace = ctx.overrides.get("workspace")
+        current_file = None
+        if workspace and workspace.active_file:
+            active = workspace.active_file
+            # File contents are prompt text too, so REDACTION_RULES apply to them
+            current_file = CursorCurrentFile(active.path, redactor.redact_prompt(active.content, "active file"),
+                                             active.line)
+        
+        # System instructions (SYSTEM_ROLE_STRATEGY=field) and open files share the explicit context
+        context_parts = [redactor.redact_prompt(instructions, "system")]
+        if workspace:
+            context_parts.append(redactor.redact_prompt(workspace.context_text(), "workspace"))
+        
         request = CursorRequest(
             messages=cursor_messages,
             model=cursor_model,
-            paths=settings.cursor_working_dir,
+            paths=workspace.root if workspace and workspace.root else settings.cursor_working_dir,
             trace_id=trace_id,
-            conversation_id=conversation_id
+            conversation_id=conversation_id,
+            current_file=current_file,
+            explicit_context="\n\n".join(part for part in context_parts if part)
         )
         
         # Encode and wrap in gRPC envelope
-        proto_data = request.encode()
-        envelope = self._build_grpc_envelope(proto_data)
+        try:
+            proto_data = self.encoder.encode(request)
+        except Exception as e:
+            # No bytes exist yet, so the sample is the request the encoder was given
+            dump = json.dumps(request, default=lambda o: getattr(o, "__dict__", str(o)), ensure_ascii=False)
+            quarantine.capture("encode", dump.encode(), f"{type(e).__name__}: {e}", ctx)
+            raise
+        shadow_encoder.compare(request, proto_data)
+        envelope = self.encoder.frame(proto_data)
         
         # Make request
-        url = f"{self.api_url}/aiserver.v1.AiService/StreamChat"
-        headers = self._build_headers(trace_id)
+        endpoint = CHAT_ENDPOINT
+        url = f"{self.api_url}/aiserver.v1.AiService/{endpoint}"
+        # Each attempt (retry, fallback, best_of candidate) gets its own ID derived from the request ID
+        attempt = ctx.overrides["upstream_attempts"] = ctx.overrides.get("upstream_attempts", 0) + 1
+        request_id = upstream_request_id(ctx.request_id, attempt)
+        logger.debug("[%s] Upstream attempt %d sent as x-request-id %s", ctx.request_id, attempt, request_id)
+        headers = self._build_headers(trace_id, token_state.token, envelope, flags.get("ghost_mode"), request_id)
+        info.ghost_mode = headers.get("x-ghost-mode") == "true"
+        info.trace_id, info.conversation_id, info.upstream_request_id = trace_id, conversation_id, request_id
+        
+        if settings.dry_run:
+            dry_run_log.record(ctx, url, headers, proto_data, envelope)
+            ctx.warn("dry_run", "DRY_RUN is enabled; the request was not sent upstream")
+            info.mark_started()
+            info.mark_first_byte()
+            yield settings.dry_run_response
+            info.mark_finished()
+            return
         
-        async with httpx.AsyncClient(timeout=self.timeout) as client:
-            async with client.stream("POST", url, content=envelope, headers=headers) as response:
+        info.mark_started()
+        sent_at = time.monotonic()
+        stream_registry.upstream_opened()
+        try:
+            timeout = self._timeout_for(ctx)
+            # TTFB_TIMEOUT runs from sending the request to the first body byte, including the wait for headers
+            async with (
+                asyncio.timeout(settings.ttfb_timeout or None) as first_byte,
+                self.transport.stream(url, envelope, headers, timeout=timeout) as response,
+            ):
+                info.status = response.status_code
                 if response.status_code != 200:
                     error_body = await response.aread()
-                    raise Exception(f"Cursor API error: {response.status_code} - {error_body.decode()}")
-                
+                    self._record_rejection(token_state, response.status_code)
+                    raise upstream_error(response.status_code, error_body.decode(errors="replace"))
+            
                 buffer = b""
-                async for chunk in response.aiter_bytes():
+                # The start of the raw body, for the drift log line and quarantine samples
+                head = b""
+                frames = 0
+                skipped = b""
+                skips = 0
+                dedup = DeltaDeduplicator(settings.stream_dedup_min_overlap)
+                assembler = Utf8Assembler(settings.output_decode_errors)
+                parser = self.parser_for(endpoint)
+                body = grpc_web_body(response.headers.get("content-type", ""), self._read_chunks(response, ctx))
+                async for chunk in body:
+                    if sent_at is not None:
+                        token_state.record_ttfb((time.monotonic() - sent_at) * 1000)
+                        sent_at = None
+                        first_byte.reschedule(None)
+                    info.mark_first_byte()
                     buffer += chunk
-                    
+                    if len(head) < settings.quarantine_sample_bytes:
+                        head += chunk[:settings.quarantine_sample_bytes - len(head)]
+                
                     # Parse gRPC-Web chunks
                     while True:
-                        text, consumed = self._parse_grpc_chunk(buffer)
+                        payload, consumed = parser.parse(buffer)
                         if consumed == 0:
                             break
-                        
+                    
+                        if payload:
+                            frames += 1
+                        else:
+                            skips += 1
+                            # A skip steps over as little as one byte; the buffer from the first one shows why
+                            skipped = skipped or buffer[:settings.quarantine_sample_bytes]
                         buffer = buffer[consumed:]
                         
+                        text = assembler.feed(payload) if payload else ""
+                        text = dedup.feed(text) if text else text
                         if text:
                             yield text
-    
-    def _parse_grpc_chunk(self, buffer: bytes) -> tuple:
-        """Parse a gRPC-Web chunk and extract text content."""
-        # Look for delimiter pattern: 00 00 00 00
-        delimiter = b'\x00\x00\x00\x00'
-        idx = buffer.find(delimiter)
-        
-        if idx == -1 or len(buffer) < idx + 7:
-            return "", 0
-        
-        # Check bytes after delimiter
-        byte1 = buffer[idx + 4]
-        byte2 = buffer[idx + 5]
-        byte3 = buffer[idx + 6]
-        
-        # Validate: byte2 should be 0x0A
-        if byte2 != 0x0A:
-            return "", idx + 1
-        
-        # Validate: byte1 - 2 should equal byte3
-        if byte1 - 2 != byte3:
-            return "", idx + 1
+                
+                # Bytes of a character the stream never completed
+                text = assembler.flush()
+                text = dedup.feed(text) if text else text
+                if text:
+                    yield text
+                
+                # An error status in place of a response is Cursor refusing the request, not a format change
+                if not frames:
+                    trailer = grpc_trailer(buffer) or grpc_trailer(head) or grpc_header_status(response.headers)
+                    if trailer and trailer[0] != 0:
+                        error = grpc_error(*trailer)
+                        info.status = error.status_code
+                        self._record_rejection(token_state, error.status_code)
+                        raise error
+                # Data arrived but no frame parsed: the format changed rather than the model saying nothing
+                if head and not frames:
+                    drift_detector.record(False, f"no frames in {head[:64].hex()}")
+                    quarantine.capture("unparsed", head, "no parseable frame in the response", ctx)
+                    raise ProtocolDriftError("Upstream response could not be parsed; Cursor may have changed its protocol")
+                if frames:
+                    drift_detector.record(True)
+                    token_state.record_outcome(True)
+                    if skips:
+                        detail = f"parser skipped {skips} time(s) around {frames} frame(s)"
+                        quarantine.capture("skipped", skipped, detail, ctx)
+        except (TimeoutError, UpstreamTimeoutError, httpx.TransportError) as e:
+            timeout_error = self._failed_attempt(e, token_state, ctx, timeout, sent_at is not None)
+            if timeout_error:
+                raise timeout_error from None
+            raise
+        finally:
+            stream_registry.upstream_closed()
         
-        length = byte3
-        chunk_start = idx + 7
-        chunk_end = chunk_start + length
+        info.mark_finished()
+    
+    async def stream_raw(self, method: str, proto_data: bytes, ctx: RequestContext) -> AsyncGenerator[bytes, None]:
+        """Send a pre-built protobuf body to an AiService method and stream the raw response."""
+        info = ctx.info
+        if settings.dry_run:
+            token_state = TokenState(DRY_RUN_TOKEN)
+        else:
+            # Not a chat completion, so the fast-request budget neither filters nor counts it
+            token_state, _ = token_pool.acquire("", tag=token_pool.tag_for_key(ctx.api_key), budgeted=False)
+        info.token = token_state.name
+        trace_id = str(uuid.uuid4())
         
-        if len(buffer) < chunk_end:
-            return "", 0
+        url = f"{self.api_url}/aiserver.v1.AiService/{method}"
+        envelope = self.encoder.frame(proto_data)
+        headers = self._build_headers(trace_id, token_state.token, envelope)
+        info.trace_id = trace_id
+        if settings.dry_run:
+            dry_run_log.record(ctx, url, headers, proto_data, envelope)
+            return
         
+        info.mark_started()
+        sent_at = time.monotonic()
+        stream_registry.upstream_opened()
         try:
-            text = buffer[chunk_start:chunk_end].decode('utf-8')
-            return text, chunk_end
-        except UnicodeDecodeError:
-            return "", chunk_end
+            timeout = self._timeout_for(ctx)
+            async with (
+                asyncio.timeout(settings.ttfb_timeout or None) as first_byte,
+                self.transport.stream(url, envelope, headers, timeout=timeout) as response,
+            ):
+                info.status = response.status_code
+                if response.status_code != 200:
+                    error_body = await response.aread()
+                    self._record_rejection(token_state, response.status_code)
+                    raise upstream_error(response.status_code, error_body.decode(errors="replace"))
+                
+                body = grpc_web_body(response.headers.get("content-type", ""), self._read_chunks(response, ctx))
+                async for chunk in body:
+                    if sent_at is not None:
+                        token_state.record_ttfb((time.monotonic() - sent_at) * 1000)
+                        sent_at = None
+                        first_byte.reschedule(None)
+                    info.mark_first_byte()
+                    yield chunk
+            token_state.record_outcome(True)
+        except (TimeoutError, UpstreamTimeoutError, httpx.TransportError) as e:
+            timeout_error = self._failed_attempt(e, token_state, ctx, timeout, sent_at is not None)
+            if timeout_error:
+                raise timeout_error from None
+            raise
+        finally:
+            stream_registry.upstream_closed()
+        
+        info.mark_finished()
     
-    async def chat_completion(
-        self,
-        messages: List[Message],
-        model: str
-    ) -> str:
+    async def chat_completion(self, ctx: RequestContext) -> str:
         """Get complete chat response from Cursor API."""
         full_response = ""
-        async for chunk in self.chat_completion_stream(messages, model):
+        # Deferred (callback_url) requests report progress from here
+        on_delta = ctx.overrides.get("on_delta")
+        async for chunk in self.chat_completion_stream(ctx):
             full_response += chunk
+            if on_delta:
+                on_delta(chunk)
         return full_response
 
 
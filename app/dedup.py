@@ -0,0 +1,32 @@
+"""Overlap detection for repeated upstream stream chunks."""
+import logging
+
+logger = logging.getLogger(__name__)
+
+# How much already-forwarded text is remembered for overlap checks
+DEDUP_WINDOW = 4096
+
+
+class DeltaDeduplicator:
+    """Trims chunk prefixes that repeat the end of already-forwarded text."""
+    
+    def __init__(self, min_overlap: int):
+        self.min_overlap = min_overlap
+        self.tail = ""
+        self.trimmed_chars = 0
+    
+    def feed(self, chunk: str) -> str:
+        """Return the part of chunk that is new, remembering it for later checks."""
+        if self.min_overlap <= 0:
+            return chunk
+        
+        # Longest overlap first, so a fully re-sent paragraph is dropped whole
+        for size in range(min(len(self.tail), len(chunk)), self.min_overlap - 1, -1):
+            if self.tail.endswith(chunk[:size]):
+                self.trimmed_chars += size
+                logger.debug("Trimmed %d repeated chars from upstream chunk", size)
+                chunk = chunk[size:]
+                break
+        
+        self.tail = (self.tail + chunk)[-DEDUP_WINDOW:]
+        return chunk
@@ -0,0 +1,118 @@
+"""Runtime diagnostics for the admin API: task and thread dumps, GC stats and on-demand profiles."""
+import io
+import gc
+import sys
+import time
+import pstats
+import asyncio
+import cProfile
+import threading
+import traceback
+import tracemalloc
+from collections import Counter
+from typing import List
+from .config import settings
+
+# One profile at a time: cProfile cannot nest, and two would each see the other's overhead
+_profile_lock = asyncio.Lock()
+
+PROFILE_SORTS = ("cumulative", "tottime", "calls")
+
+
+def _task_name(task: asyncio.Task) -> str:
+    """The coroutine a task runs, which groups tasks better than their generated names."""
+    coro = task.get_coro()
+    return getattr(coro, "__qualname__", None) or repr(coro)
+
+
+def task_dump(stacks: bool = False) -> dict:
+    """All asyncio tasks, counted by coroutine, optionally with each task's stack."""
+    tasks = asyncio.all_tasks()
+    dump = {
+        "count": len(tasks),
+        "by_coroutine": dict(Counter(_task_name(task) for task in tasks).most_common()),
+    }
+    if stacks:
+        dump["tasks"] = [
+            {
+                "name": task.get_name(),
+                "coroutine": _task_name(task),
+                "done": task.done(),
+                "stack": _task_stack(task),
+            }
+            for task in tasks
+        ]
+    return dump
+
+
+def _task_stack(task: asyncio.Task) -> List[str]:
+    """A task's suspended stack, innermost frame last."""
+    out = io.StringIO()
+    task.print_stack(file=out)
+    return out.getvalue().splitlines()[1:]
+
+
+def thread_dump() -> List[dict]:
+    """Every thread with its current stack."""
+    frames = sys._current_frames()
+    return [
+        {
+            "name": thread.name,
+            "daemon": thread.daemon,
+            "stack": [line.rstrip() for line in traceback.format_stack(frames[thread.ident])]
+            if thread.ident in frames else [],
+        }
+        for thread in threading.enumerate()
+    ]
+
+
+def gc_stats() -> dict:
+    """Collector counters and the most common live object types."""
+    counts = Counter(type(obj).__name__ for obj in gc.get_objects())
+    return {
+        "enabled": gc.isenabled(),
+        "thresholds": gc.get_threshold(),
+        "counts": gc.get_count(),
+        "generations": gc.get_stats(),
+        "tracked_objects": sum(counts.values()),
+        "top_types": dict(counts.most_common(20)),
+        "tasks": len(asyncio.all_tasks()),
+        "threads": threading.active_count(),
+    }
+
+
+def heap_top(limit: int) -> dict:
+    """Allocation sites holding the most memory, when DIAGNOSTICS_TRACEMALLOC is on."""
+    if not tracemalloc.is_tracing():
+        return {"tracing": False, "sites": []}
+    current, peak = tracemalloc.get_traced_memory()
+    stats = tracemalloc.take_snapshot().statistics("lineno")[:limit]
+    return {
+        "tracing": True,
+        "current_bytes": current,
+        "peak_bytes": peak,
+        "sites": [{"site": str(stat.traceback), "bytes": stat.size, "blocks": stat.count} for stat in stats],
+    }
+
+
+async def cpu_profile(seconds: float, sort: str, limit: int) -> str:
+    """Profile the event loop thread for a while and return the pstats report."""
+    async with _profile_lock:
+        profiler = cProfile.Profile()
+        started = time.monotonic()
+        # Everything the loop runs while this coroutine sleeps lands in the profile
+        profiler.enable()
+        try:
+            await asyncio.sleep(seconds)
+        finally:
+            profiler.disable()
+        out = io.StringIO()
+        out.write(f"CPU profile of the event loop thread over {time.monotonic() - started:.1f}s\n")
+        pstats.Stats(profiler, stream=out).sort_stats(sort).print_stats(limit)
+        return out.getvalue()
+
+
+def start_tracemalloc():
+    """Start allocation tracing if DIAGNOSTICS_TRACEMALLOC is set."""
+    if settings.diagnostics_tracemalloc > 0 and not tracemalloc.is_tracing():
+        tracemalloc.start(settings.diagnostics_tracemalloc)
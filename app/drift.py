@@ -0,0 +1,68 @@
+"""Detection of upstream protocol changes from response parse failures."""
+import time
+import logging
+from collections import deque
+from typing import Optional
+from .config import settings
+from .metrics import metrics
+
+logger = logging.getLogger(__name__)
+
+# Fewer recent responses than this are not enough to call drift
+MIN_SAMPLES = 5
+
+metrics.describe("cursor2api_parse_failures_total", "counter", "Upstream responses whose frames could not be parsed")
+metrics.describe("cursor2api_protocol_drift", "gauge", "1 while parse failures suggest Cursor changed the protocol")
+metrics.set("cursor2api_protocol_drift", 0)
+
+
+class ProtocolDriftError(Exception):
+    """Raised when an upstream response had data but no parseable frames."""
+
+
+class DriftDetector:
+    """Tracks parse outcomes of recent responses and flags a failure spike."""
+    
+    def __init__(self):
+        self.outcomes = deque(maxlen=max(settings.drift_window, MIN_SAMPLES))
+        self.drifted = False
+        self.since: Optional[float] = None
+        self.last_failure: Optional[str] = None
+    
+    def failure_rate(self) -> float:
+        """Share of recent responses that failed to parse."""
+        if not self.outcomes:
+            return 0.0
+        return self.outcomes.count(False) / len(self.outcomes)
+    
+    def record(self, ok: bool, detail: str = ""):
+        """Record whether a response parsed and update the drift state."""
+        self.outcomes.append(ok)
+        if not ok:
+            self.last_failure = detail
+            metrics.inc("cursor2api_parse_failures_total")
+        
+        drifted = len(self.outcomes) >= MIN_SAMPLES and self.failure_rate() >= settings.drift_threshold
+        if drifted and not self.drifted:
+            self.since = time.time()
+            logger.error("Protocol drift suspected: %.0f%% of the last %d responses failed to parse (%s)",
+                         self.failure_rate() * 100, len(self.outcomes), self.last_failure)
+        elif self.drifted and not drifted:
+            self.since = None
+            logger.info("Upstream responses parse again; protocol drift cleared")
+        self.drifted = drifted
+        metrics.set("cursor2api_protocol_drift", 1 if drifted else 0)
+    
+    def to_dict(self) -> dict:
+        """Serialize the drift state for /readyz."""
+        return {
+            "drifted": self.drifted,
+            "since": self.since,
+            "failure_rate": round(self.failure_rate(), 3),
+            "samples": len(self.outcomes),
+            "last_failure": self.last_failure,
+        }
+
+
+# Global drift detector instance
+drift_detector = DriftDetector()
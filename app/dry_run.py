@@ -0,0 +1,60 @@
+"""DRY_RUN: requests are encoded and recorded but never sent upstream."""
+import time
+import logging
+import threading
+from collections import deque
+from typing import Deque, List, Optional
+from .config import settings
+from .context import RequestContext
+from .token_pool import mask_token
+
+logger = logging.getLogger(__name__)
+
+# Stands in for a Cursor token so headers can be built without one configured
+DRY_RUN_TOKEN = "dry-run-placeholder-token"
+
+
+class DryRunLog:
+    """Recent requests that DRY_RUN kept from going upstream, with their encoded bodies."""
+    
+    def __init__(self):
+        self._entries: Deque[dict] = deque(maxlen=max(settings.dry_run_history, 1))
+        self._lock = threading.Lock()
+    
+    def record(self, ctx: Optional[RequestContext], url: str, headers: dict, proto_data: bytes, envelope: bytes):
+        """Keep one encoded request for the debug endpoint."""
+        headers = dict(headers)
+        if "Authorization" in headers:
+            headers["Authorization"] = "Bearer " + mask_token(headers["Authorization"].removeprefix("Bearer "))
+        entry = {
+            "request_id": ctx.request_id if ctx else None,
+            "time": time.time(),
+            "model": ctx.info.model if ctx else None,
+            "url": url,
+            "headers": headers,
+            "protobuf_bytes": len(proto_data),
+            "protobuf_hex": proto_data.hex(),
+            # The gRPC-Web frame as it would go on the wire: flag byte, length, protobuf
+            "envelope_hex": envelope.hex(),
+        }
+        with self._lock:
+            self._entries.append(entry)
+        logger.info("Dry run: %d-byte request for %s not sent", len(proto_data), url)
+    
+    def to_list(self) -> List[dict]:
+        """Recorded requests, newest first, without their bodies."""
+        with self._lock:
+            entries = list(self._entries)
+        return [
+            {k: v for k, v in entry.items() if k not in ("protobuf_hex", "envelope_hex")}
+            for entry in reversed(entries)
+        ]
+    
+    def get(self, request_id: str) -> Optional[dict]:
+        """The newest recorded request with a request ID, including its hex dumps."""
+        with self._lock:
+            return next((e for e in reversed(self._entries) if e["request_id"] == request_id), None)
+
+
+# Global dry run log instance
+dry_run_log = DryRunLog()
@@ -0,0 +1,41 @@
+"""Embeddings forwarding to a secondary OpenAI-compatible backend."""
+from typing import Tuple
+import httpx
+from .config import settings
+
+
+class EmbeddingsUnavailableError(Exception):
+    """Raised when no embeddings backend is configured."""
+
+
+async def forward_embeddings(body: dict) -> Tuple[int, dict]:
+    """Forward an embeddings request, returning the backend's status and JSON body."""
+    config = settings.get()
+    if not config.embeddings_base_url:
+        raise EmbeddingsUnavailableError(
+            "Embeddings are not supported by the Cursor backend; "
+            "configure EMBEDDINGS_BASE_URL to forward them to another provider"
+        )
+    
+    # Clients ask for whatever model they were built with; pin it when configured
+    if config.embeddings_model:
+        body = {**body, "model": config.embeddings_model}
+    
+    headers = {}
+    if config.embeddings_api_key:
+        headers["Authorization"] = f"Bearer {config.embeddings_api_key}"
+    
+    async with httpx.AsyncClient(timeout=config.timeout) as client:
+        response = await client.post(
+            f"{config.embeddings_base_url.rstrip('/')}/embeddings",
+            json=body,
+            headers=headers,
+        )
+    try:
+        return response.status_code, response.json()
+    except ValueError:
+        return 502, {"error": {
+            "message": f"Embeddings backend returned a non-JSON response (HTTP {response.status_code})",
+            "type": "api_error",
+            "code": "embeddings_backend_error",
+        }}
@@ -0,0 +1,116 @@
+"""Attribution and blocking of end users identified by the OpenAI `user` field."""
+import os
+import json
+import time
+import hashlib
+import threading
+from typing import Dict, Optional
+from .config import settings
+from .token_pool import display_key
+
+# Idle end users are swept at most this often
+PRUNE_INTERVAL = 60
+
+
+class EndUserBlockedError(Exception):
+    """Raised when the request's end user has been blocked."""
+    
+    def __init__(self, user_hash: str):
+        self.user_hash = user_hash
+        super().__init__(f"End user {user_hash} is blocked")
+
+
+def hash_user(user: Optional[str]) -> str:
+    """Hash a `user` value for attribution without exposing the raw ID, or "" without one."""
+    if not user:
+        return ""
+    return hashlib.sha256(f"{settings.user_hash_salt}{user}".encode()).hexdigest()[:16]
+
+
+def hide_user(request: dict) -> dict:
+    """A request payload for storage, with the `user` field replaced by its hash."""
+    if not request.get("user"):
+        return request
+    return {**request, "user": hash_user(request["user"])}
+
+
+class EndUserRegistry:
+    """Per-end-user request counts and a blocklist saved to disk."""
+    
+    def __init__(self, path: str):
+        self.path = path
+        self.blocked: Dict[str, dict] = {}
+        self.seen: Dict[str, dict] = {}
+        self._last_prune = 0.0
+        self._lock = threading.Lock()
+        if path and os.path.exists(path):
+            with open(path, encoding="utf-8") as f:
+                self.blocked = json.load(f)
+    
+    def _save(self):
+        """Persist the blocklist."""
+        if not self.path:
+            return
+        os.makedirs(os.path.dirname(self.path) or ".", exist_ok=True)
+        tmp = f"{self.path}.tmp"
+        with open(tmp, "w", encoding="utf-8") as f:
+            json.dump(self.blocked, f, indent=2)
+        os.replace(tmp, self.path)
+    
+    def record(self, user_hash: str, api_key: str):
+        """Count a request from an end user."""
+        if not user_hash:
+            return
+        now = time.time()
+        with self._lock:
+            self._prune(now)
+            entry = self.seen.setdefault(user_hash, {"requests": 0, "first_seen": int(now), "keys": []})
+            entry["requests"] += 1
+            entry["last_seen"] = int(now)
+            # Several shared keys can front the same end user
+            if api_key not in entry["keys"]:
+                entry["keys"].append(api_key)
+    
+    def _prune(self, now: float):
+        """Forget end users idle for END_USER_IDLE_TTL seconds; blocks are kept. Caller holds the lock."""
+        if now - self._last_prune < PRUNE_INTERVAL:
+            return
+        self._last_prune = now
+        cutoff = now - settings.end_user_idle_ttl
+        for user_hash in [h for h, entry in self.seen.items() if entry["last_seen"] < cutoff]:
+            del self.seen[user_hash]
+    
+    def check(self, user_hash: str):
+        """Raise EndUserBlockedError for a blocked end user."""
+        if user_hash and user_hash in self.blocked:
+            raise EndUserBlockedError(user_hash)
+    
+    def block(self, user_hash: str, reason: str = ""):
+        """Block an end user by hash."""
+        with self._lock:
+            self.blocked[user_hash] = {"reason": reason, "blocked_at": int(time.time())}
+            self._save()
+    
+    def unblock(self, user_hash: str) -> bool:
+        """Unblock an end user, returning whether it was blocked."""
+        with self._lock:
+            found = self.blocked.pop(user_hash, None) is not None
+            self._save()
+        return found
+    
+    def to_dict(self) -> dict:
+        """Serialize seen and blocked end users, with API keys masked."""
+        with self._lock:
+            users = {
+                h: {
+                    **entry,
+                    "keys": [display_key(k) for k in entry["keys"]],
+                    "blocked": h in self.blocked,
+                }
+                for h, entry in self.seen.items()
+            }
+            return {"users": users, "blocked": dict(self.blocked)}
+
+
+# Global end user registry instance
+end_user_registry = EndUserRegistry(settings.blocked_users_file)
@@ -0,0 +1,87 @@
+"""Typed upstream errors and the table mapping every proxy error to an HTTP status and OpenAI error."""
+from typing import Dict, NamedTuple, Type
+from .token_pool import BudgetExhaustedError, TokensExpiredError, NoTaggedTokenError
+from .transport import UpstreamTimeoutError, UnexpectedContentTypeError
+from .drift import ProtocolDriftError
+from .slo import TTFTExceededError
+from .backpressure import BackpressureError
+from .model_access import ModelBlockedError
+from .registration import KeyQuotaExceededError
+
+
+class UpstreamError(Exception):
+    """Cursor answered a request with a non-200 status."""
+    
+    def __init__(self, status_code: int, body: str):
+        self.status_code = status_code
+        self.body = body
+        super().__init__(f"Cursor API error: {status_code} - {body}")
+
+
+class UpstreamAuthError(UpstreamError):
+    """Cursor rejected the token (401/403)."""
+
+
+class UpstreamQuotaError(UpstreamError):
+    """Cursor refused the request for rate or usage limits (429)."""
+
+
+def upstream_error(status_code: int, body: str) -> UpstreamError:
+    """The typed error for a non-200 upstream status."""
+    if status_code in (401, 403):
+        return UpstreamAuthError(status_code, body)
+    if status_code == 429:
+        return UpstreamQuotaError(status_code, body)
+    return UpstreamError(status_code, body)
+
+
+# gRPC status codes Cursor reports in a trailer, as the HTTP status an equivalent answer would have had
+GRPC_HTTP_STATUS = {3: 400, 5: 404, 7: 403, 8: 429, 9: 400, 11: 400, 14: 503, 16: 401}
+
+
+def grpc_error(code: int, message: str) -> UpstreamError:
+    """The typed error for a non-OK grpc-status sent in place of a response."""
+    return upstream_error(GRPC_HTTP_STATUS.get(code, 500), f"grpc-status {code}: {message}")
+
+
+class ErrorMapping(NamedTuple):
+    """How an error is reported to the client."""
+    status: int
+    type: str
+    code: str
+
+
+# Looked up along the exception's MRO, so subclasses inherit their parent's mapping
+ERROR_MAPPINGS: Dict[Type[BaseException], ErrorMapping] = {
+    # The token is ours, not the client's: a gateway failure rather than a 401
+    UpstreamAuthError: ErrorMapping(502, "api_error", "upstream_auth_failed"),
+    UpstreamQuotaError: ErrorMapping(429, "insufficient_quota", "upstream_quota_exceeded"),
+    UpstreamError: ErrorMapping(502, "api_error", "cursor_api_error"),
+    UpstreamTimeoutError: ErrorMapping(504, "api_error", "upstream_timeout"),
+    TTFTExceededError: ErrorMapping(504, "api_error", "ttft_slo_exceeded"),
+    ProtocolDriftError: ErrorMapping(502, "api_error", "upstream_parse_error"),
+    UnexpectedContentTypeError: ErrorMapping(502, "api_error", "upstream_content_type"),
+    BackpressureError: ErrorMapping(500, "api_error", "client_too_slow"),
+    BudgetExhaustedError: ErrorMapping(429, "insufficient_quota", "budget_exhausted"),
+    TokensExpiredError: ErrorMapping(503, "service_unavailable", "no_usable_token"),
+    NoTaggedTokenError: ErrorMapping(503, "service_unavailable", "no_tagged_token"),
+    ModelBlockedError: ErrorMapping(403, "invalid_request_error", "model_blocked"),
+    KeyQuotaExceededError: ErrorMapping(429, "insufficient_quota", "key_quota_exceeded"),
+}
+
+# Anything unmapped is an unexpected failure while talking to Cursor
+DEFAULT_MAPPING = ErrorMapping(500, "api_error", "cursor_api_error")
+
+
+def classify(error: BaseException) -> ErrorMapping:
+    """Map an exception to its HTTP status and OpenAI error type and code."""
+    for cls in type(error).__mro__:
+        if cls in ERROR_MAPPINGS:
+            return ERROR_MAPPINGS[cls]
+    return DEFAULT_MAPPING
+
+
+def error_payload(error: BaseException) -> dict:
+    """OpenAI-style error object for an exception, as sent in a stream."""
+    mapping = classify(error)
+    return {"error": {"message": str(error), "type": mapping.type, "code": mapping.code}}
@@ -0,0 +1,140 @@
+"""Request-level A/B experiments on model, system prompt and temperature."""
+import json
+import hashlib
+from fnmatch import fnmatchcase
+from typing import Dict, List, Optional, Tuple
+from .config import settings
+from .models import ChatCompletionRequest, Message
+from .context import RequestContext
+
+
+class Variant:
+    """One arm of an experiment; unset fields leave the request as the client sent it."""
+    
+    def __init__(
+        self,
+        variant_id: str,
+        percent: float,
+        model: Optional[str] = None,
+        system_prompt: Optional[str] = None,
+        temperature: Optional[float] = None
+    ):
+        self.id = variant_id
+        self.percent = percent
+        self.model = model
+        self.system_prompt = system_prompt
+        self.temperature = temperature
+    
+    def apply(self, request: ChatCompletionRequest):
+        """Rewrite the request for this variant."""
+        if self.model:
+            request.model = self.model
+        if self.temperature is not None:
+            request.temperature = self.temperature
+        if self.system_prompt:
+            request.messages = [Message(role="system", content=self.system_prompt)] + list(request.messages)
+    
+    def to_dict(self) -> dict:
+        return {
+            "id": self.id,
+            "percent": self.percent,
+            "model": self.model,
+            "system_prompt": self.system_prompt,
+            "temperature": self.temperature,
+        }
+
+
+class Experiment:
+    """Variants splitting the traffic of the models matching a pattern."""
+    
+    def __init__(self, experiment_id: str, match: str, variants: List[Variant]):
+        self.id = experiment_id
+        self.match = match
+        self.variants = variants
+        total = sum(v.percent for v in variants)
+        if total > 100:
+            raise ValueError(f"experiment {experiment_id} assigns {total:g}% of traffic")
+        if len({v.id for v in variants}) != len(variants):
+            raise ValueError(f"experiment {experiment_id} has duplicate variant IDs")
+    
+    def pick(self, bucket: float) -> Optional[Variant]:
+        """The variant owning a 0-100 bucket; traffic past the last variant is left alone."""
+        upper = 0.0
+        for variant in self.variants:
+            upper += variant.percent
+            if bucket < upper:
+                return variant
+        return None
+
+
+def _parse_experiments(raw: str) -> List[Experiment]:
+    """Parse EXPERIMENTS, a JSON array of {id, match?, variants: [{id, percent, ...}]}."""
+    if not raw.strip():
+        return []
+    try:
+        experiments = [
+            Experiment(
+                str(e["id"]),
+                str(e.get("match", "*")),
+                [
+                    Variant(
+                        str(v["id"]),
+                        float(v["percent"]),
+                        v.get("model"),
+                        v.get("system_prompt"),
+                        float(v["temperature"]) if v.get("temperature") is not None else None,
+                    )
+                    for v in e["variants"]
+                ],
+            )
+            for e in json.loads(raw)
+        ]
+    except (ValueError, TypeError, KeyError, AttributeError) as e:
+        raise ValueError(f"Invalid EXPERIMENTS: {e}") from e
+    if len({e.id for e in experiments}) != len(experiments):
+        raise ValueError("Invalid EXPERIMENTS: duplicate experiment IDs")
+    return experiments
+
+
+class ExperimentRouter:
+    """Assigns requests to experiment variants."""
+    
+    def __init__(self):
+        self.experiments = _parse_experiments(settings.experiments)
+    
+    @staticmethod
+    def _bucket(experiment_id: str, session_key: str) -> float:
+        """Stable 0-100 bucket, so every turn of a conversation sees the same variant."""
+        digest = hashlib.sha256(f"{experiment_id}\0{session_key}".encode()).digest()
+        return int.from_bytes(digest[:8], "big") / 2 ** 64 * 100
+    
+    def assign(self, session_key: str, request: ChatCompletionRequest) -> Optional[Tuple[str, str]]:
+        """Apply the first matching experiment's variant, returning (experiment ID, variant ID)."""
+        for experiment in self.experiments:
+            if not fnmatchcase(request.model, experiment.match):
+                continue
+            variant = experiment.pick(self._bucket(experiment.id, session_key))
+            if variant is None:
+                return None
+            variant.apply(request)
+            return experiment.id, variant.id
+        return None
+    
+    @staticmethod
+    def fields(ctx: RequestContext) -> Dict[str, dict]:
+        """The `experiment` extension field for a response, if the request was assigned a variant."""
+        assigned = ctx.overrides.get("experiment")
+        if not assigned:
+            return {}
+        return {"experiment": {"id": assigned[0], "variant": assigned[1]}}
+    
+    def to_list(self) -> List[dict]:
+        """Describe configured experiments for the admin API."""
+        return [
+            {"id": e.id, "match": e.match, "variants": [v.to_dict() for v in e.variants]}
+            for e in self.experiments
+        ]
+
+
+# Global experiment router instance
+experiment_router = ExperimentRouter()
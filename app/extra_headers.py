@@ -0,0 +1,54 @@
+"""Configurable extra upstream headers with per-request templates."""
+import re
+import hmac
+import json
+import time
+import uuid
+import hashlib
+from typing import Callable, Dict
+from .config import settings
+from .version import version_detector
+
+PLACEHOLDER = re.compile(r"\{(\w+)\}")
+
+# Placeholder -> value, given the trace ID and the request body
+TEMPLATES: Dict[str, Callable[[str, bytes], str]] = {
+    "uuid": lambda trace_id, body: str(uuid.uuid4()),
+    "trace_id": lambda trace_id, body: trace_id,
+    "timestamp": lambda trace_id, body: str(int(time.time())),
+    "timestamp_ms": lambda trace_id, body: str(int(time.time() * 1000)),
+    "client_version": lambda trace_id, body: version_detector.current,
+    "body_sha256": lambda trace_id, body: hashlib.sha256(body).hexdigest(),
+    "body_hmac": lambda trace_id, body: hmac.new(
+        settings.cursor_signing_key.encode(), body, hashlib.sha256
+    ).hexdigest(),
+}
+
+
+def _parse_extra_headers(raw: str) -> Dict[str, str]:
+    """Parse extra headers from a JSON object, rejecting unknown placeholders."""
+    if not raw.strip():
+        return {}
+    try:
+        headers = json.loads(raw)
+    except ValueError as e:
+        raise ValueError(f"Invalid CURSOR_EXTRA_HEADERS: {e}") from e
+    if not isinstance(headers, dict):
+        raise ValueError("Invalid CURSOR_EXTRA_HEADERS: expected a JSON object")
+    
+    for name, value in headers.items():
+        for placeholder in PLACEHOLDER.findall(str(value)):
+            if placeholder not in TEMPLATES:
+                raise ValueError(f"Invalid CURSOR_EXTRA_HEADERS: unknown placeholder {{{placeholder}}} in {name}")
+    return {str(k): str(v) for k, v in headers.items()}
+
+
+extra_headers = _parse_extra_headers(settings.cursor_extra_headers)
+
+
+def render_extra_headers(trace_id: str, body: bytes = b"") -> Dict[str, str]:
+    """Render the configured extra headers for one upstream request."""
+    return {
+        name: PLACEHOLDER.sub(lambda m: TEMPLATES[m.group(1)](trace_id, body), value)
+        for name, value in extra_headers.items()
+    }
@@ -0,0 +1,125 @@
+"""gzip / br compression of proxy responses, negotiated from Accept-Encoding."""
+import zlib
+from typing import Callable, Dict, Optional
+from starlette.datastructures import MutableHeaders
+from .config import settings
+
+try:
+    import brotli
+except ImportError:
+    brotli = None
+
+# Streams are compressed per event only when RESPONSE_COMPRESSION_STREAMS is on
+STREAM_TYPES = ("text/event-stream", "application/x-ndjson")
+COMPRESSIBLE_TYPES = ("application/json", "text/") + STREAM_TYPES
+
+
+class GzipEncoder:
+    """gzip with a sync flush per chunk, so a compressed stream never holds an event back."""
+    
+    def __init__(self, level: int):
+        self._z = zlib.compressobj(min(max(level, 1), 9), zlib.DEFLATED, 31)
+    
+    def encode(self, data: bytes, final: bool) -> bytes:
+        return self._z.compress(data) + self._z.flush(zlib.Z_FINISH if final else zlib.Z_SYNC_FLUSH)
+
+
+class BrotliEncoder:
+    """Brotli, flushed after every chunk like GzipEncoder."""
+    
+    def __init__(self, level: int):
+        self._c = brotli.Compressor(quality=min(max(level, 0), 11))
+    
+    def encode(self, data: bytes, final: bool) -> bytes:
+        out = self._c.process(data)
+        return out + (self._c.finish() if final else self._c.flush())
+
+
+# Preference order when the client accepts several
+ENCODERS: Dict[str, Callable[[int], object]] = {"gzip": GzipEncoder}
+if brotli is not None:
+    ENCODERS = {"br": BrotliEncoder, **ENCODERS}
+
+
+def negotiate(accept_encoding: str) -> Optional[str]:
+    """Pick the preferred encoding the client accepts, honoring q=0."""
+    accepted = {}
+    for part in accept_encoding.split(","):
+        name, _, params = part.strip().partition(";")
+        q = 1.0
+        if params.strip().startswith("q="):
+            try:
+                q = float(params.strip()[2:])
+            except ValueError:
+                q = 0.0
+        accepted[name.strip().lower()] = q
+    for name in ENCODERS:
+        if accepted.get(name, accepted.get("*", 0.0)) > 0:
+            return name
+    return None
+
+
+class CompressionMiddleware:
+    """Compresses JSON and text responses, and optionally SSE / NDJSON streams per event."""
+    
+    def __init__(self, app):
+        self.app = app
+    
+    async def __call__(self, scope, receive, send):
+        config = settings.get()
+        if scope["type"] != "http" or not config.response_compression:
+            await self.app(scope, receive, send)
+            return
+        encoding = negotiate(dict(scope["headers"]).get(b"accept-encoding", b"").decode("latin-1"))
+        if encoding is None:
+            await self.app(scope, receive, send)
+            return
+        
+        start = None
+        encoder = None
+        passthrough = False
+        
+        async def send_compressed(message):
+            nonlocal start, encoder, passthrough
+            if message["type"] == "http.response.start":
+                # Held back until the first body message shows whether this is a stream
+                start = message
+                return
+            if message["type"] != "http.response.body" or passthrough:
+                await send(message)
+                return
+            
+            body = message.get("body", b"")
+            more = message.get("more_body", False)
+            if encoder is None:
+                headers = MutableHeaders(scope=start)
+                content_type = headers.get("content-type", "")
+                streaming = content_type.startswith(STREAM_TYPES)
+                eligible = (
+                    "content-encoding" not in headers
+                    and content_type.startswith(COMPRESSIBLE_TYPES)
+                    and (config.response_compression_streams if streaming else not more)
+                    and (streaming or len(body) >= config.response_compression_min_size)
+                )
+                if not eligible:
+                    passthrough = True
+                    await send(start)
+                    await send(message)
+                    return
+                
+                encoder = ENCODERS[encoding](config.response_compression_level)
+                headers["Content-Encoding"] = encoding
+                headers.append("Vary", "Accept-Encoding")
+                if streaming:
+                    del headers["Content-Length"]
+                else:
+                    body = encoder.encode(body, True)
+                    headers["Content-Length"] = str(len(body))
+                    await send(start)
+                    await send({"type": "http.response.body", "body": body})
+                    return
+                await send(start)
+            
+            await send({"type": "http.response.body", "body": encoder.encode(body, not more), "more_body": more})
+        
+        await self.app(scope, receive, send_compressed)
@@ -0,0 +1,134 @@
+"""Idempotency-Key support: a retried non-streaming request gets the stored response instead of a new generation."""
+import json
+import time
+import asyncio
+import hashlib
+import threading
+from collections import OrderedDict
+from typing import Awaitable, Callable, Optional
+from fastapi.responses import Response
+from .config import settings
+from .metrics import metrics
+
+# Same limit as Stripe and the IETF draft, so keys generated for other APIs fit
+MAX_KEY_LENGTH = 255
+
+REPLAYED_HEADER = "Idempotent-Replayed"
+
+metrics.describe("cursor2api_idempotency_total", "counter", "Requests with an Idempotency-Key, by result")
+
+
+class IdempotencyKeyError(Exception):
+    """Raised for a malformed key, or a key reused with a different request body."""
+    
+    def __init__(self, message: str, code: str):
+        self.code = code
+        super().__init__(message)
+
+
+def fingerprint(body: dict) -> str:
+    """Hash of the request body, to catch a key reused for a different request."""
+    return hashlib.sha256(json.dumps(body, sort_keys=True, ensure_ascii=False, default=str).encode()).hexdigest()
+
+
+class IdempotencyEntry:
+    """A request seen under one key, in flight until `done` resolves."""
+    
+    def __init__(self, request_hash: str):
+        self.request_hash = request_hash
+        self.created = time.time()
+        self.done = asyncio.get_running_loop().create_future()
+        self.status_code = 0
+        self.body = b""
+        self.media_type: Optional[str] = None
+        self.headers: dict = {}
+    
+    def expired(self) -> bool:
+        return time.time() - self.created > settings.idempotency_ttl
+    
+    def replay(self) -> Response:
+        """The stored response, marked as a replay."""
+        headers = {**self.headers, REPLAYED_HEADER: "true"}
+        return Response(content=self.body, status_code=self.status_code, headers=headers, media_type=self.media_type)
+
+
+class IdempotencyStore:
+    """Completed responses per caller and key, kept for IDEMPOTENCY_TTL."""
+    
+    def __init__(self):
+        self._entries: "OrderedDict[str, IdempotencyEntry]" = OrderedDict()
+        self._lock = threading.Lock()
+    
+    @property
+    def enabled(self) -> bool:
+        return settings.idempotency_ttl > 0
+    
+    @staticmethod
+    def _scoped(api_key: str, key: str) -> str:
+        # Scoped per caller so one tenant's key never returns another's response
+        return hashlib.sha256(f"{api_key}\0{key}".encode()).hexdigest()
+    
+    def _prune(self):
+        """Drop expired entries and the oldest beyond IDEMPOTENCY_MAX_ENTRIES. Caller holds the lock."""
+        while self._entries:
+            oldest = next(iter(self._entries.values()))
+            if not oldest.expired() and len(self._entries) <= settings.idempotency_max_entries:
+                break
+            self._entries.popitem(last=False)
+    
+    async def run(
+        self,
+        api_key: str,
+        key: str,
+        body: dict,
+        handler: Callable[[], Awaitable[Response]]
+    ) -> Response:
+        """Run the handler once per key, replaying its response for retries."""
+        if not key or len(key) > MAX_KEY_LENGTH:
+            raise IdempotencyKeyError(
+                f"Idempotency-Key must be 1 to {MAX_KEY_LENGTH} characters", "invalid_idempotency_key"
+            )
+        scoped = self._scoped(api_key, key)
+        request_hash = fingerprint(body)
+        
+        while True:
+            with self._lock:
+                self._prune()
+                entry = self._entries.get(scoped)
+                if entry is None:
+                    entry = self._entries[scoped] = IdempotencyEntry(request_hash)
+                    break
+            if entry.request_hash != request_hash:
+                metrics.inc("cursor2api_idempotency_total", result="conflict")
+                raise IdempotencyKeyError(
+                    "This Idempotency-Key was already used with a different request body", "idempotency_key_reused"
+                )
+            if entry.done.done() and entry.status_code:
+                metrics.inc("cursor2api_idempotency_total", result="replayed")
+                return entry.replay()
+            # The first attempt is still generating: wait for it rather than start a duplicate
+            metrics.inc("cursor2api_idempotency_total", result="waited")
+            await asyncio.shield(entry.done)
+        
+        stored = False
+        try:
+            response = await handler()
+            # Only answers worth repeating are kept; after an error a retry runs again
+            if response.status_code in (200, 202) and hasattr(response, "body"):
+                entry.status_code = response.status_code
+                entry.body = response.body
+                entry.media_type = response.media_type
+                entry.headers = {k: v for k, v in response.headers.items() if k.lower().startswith("x-")}
+                stored = True
+            metrics.inc("cursor2api_idempotency_total", result="stored" if stored else "not_stored")
+            return response
+        finally:
+            if not stored:
+                with self._lock:
+                    if self._entries.get(scoped) is entry:
+                        del self._entries[scoped]
+            entry.done.set_result(None)
+
+
+# Global idempotency store instance
+idempotency_store = IdempotencyStore()
@@ -0,0 +1,60 @@
+"""Persistent request journal for debugging protocol regressions."""
+import os
+import json
+import time
+import threading
+from typing import Optional
+from .config import settings
+from .end_users import hide_user
+
+
+class Journal:
+    """Append-only JSONL journal of full request payloads and responses."""
+    
+    def __init__(self, path: str):
+        self.path = path
+        self._lock = threading.Lock()
+    
+    def record(
+        self,
+        entry_id: str,
+        request: dict,
+        response: str,
+        model: str,
+        error: Optional[str] = None,
+        end_user: str = ""
+    ):
+        """Append a request/response pair to the journal."""
+        if not settings.journal_enabled:
+            return
+        entry = {
+            "id": entry_id,
+            "timestamp": int(time.time()),
+            "model": model,
+            "request": hide_user(request),
+            "response": response,
+            "error": error,
+            "end_user": end_user or None,
+        }
+        with self._lock:
+            os.makedirs(os.path.dirname(self.path) or ".", exist_ok=True)
+            with open(self.path, "a", encoding="utf-8") as f:
+                f.write(json.dumps(entry, ensure_ascii=False) + "\n")
+    
+    def find(self, entry_id: str) -> Optional[dict]:
+        """Find a journaled entry by ID (the response ID); the latest entry wins."""
+        if not os.path.exists(self.path):
+            return None
+        found = None
+        with open(self.path, encoding="utf-8") as f:
+            for line in f:
+                if not line.strip():
+                    continue
+                entry = json.loads(line)
+                if entry.get("id") == entry_id:
+                    found = entry
+        return found
+
+
+# Global journal instance
+journal = Journal(settings.journal_path)
@@ -0,0 +1,185 @@
+"""Per-API-key concurrent stream limits."""
+import json
+import math
+import time
+import asyncio
+import threading
+from collections import deque
+from typing import AsyncGenerator, Deque, Dict
+from .config import settings
+from .metrics import metrics
+from .oidc import jwt_authenticator
+from .registration import registry
+
+# Assumed stream duration before any stream of a key has finished
+DEFAULT_HOLD_SECONDS = 10.0
+# Smoothing factor of the per-key stream duration average
+HOLD_ALPHA = 0.2
+
+metrics.describe("cursor2api_queued_requests", "gauge", "Requests waiting for a per-key concurrency slot")
+metrics.set("cursor2api_queued_requests", 0)
+
+
+class StreamLimitExceeded(Exception):
+    """Raised when an API key already has its maximum number of streams open."""
+    
+    def __init__(self, current: int, limit: int, retry_after: int = 1):
+        self.current = current
+        self.limit = limit
+        self.retry_after = retry_after
+        super().__init__(
+            f"Too many concurrent requests for this API key: {current} active, limit is {limit}. "
+            "Wait for a running request to finish before starting another."
+        )
+
+
+def _parse_key_limits(raw: str) -> Dict[str, int]:
+    """Parse per-key overrides from a JSON object of {api_key: limit}."""
+    if not raw.strip():
+        return {}
+    try:
+        return {str(k): int(v) for k, v in json.loads(raw).items()}
+    except (ValueError, TypeError, AttributeError) as e:
+        raise ValueError(f"Invalid KEY_STREAM_LIMITS: {e}") from e
+
+
+class StreamLimiter:
+    """Counts in-flight upstream streams per API key."""
+    
+    def __init__(self):
+        self.active: Dict[str, int] = {}
+        self.key_limits = _parse_key_limits(settings.key_stream_limits)
+        self._lock = threading.Lock()
+        # Slot key -> requests queued for it, first in line first
+        self._waiters: Dict[str, Deque[asyncio.Event]] = {}
+        # Slot key -> start times of its active streams, and their average duration
+        self._started: Dict[str, Deque[float]] = {}
+        self._hold: Dict[str, float] = {}
+    
+    def limit_for(self, api_key: str) -> int:
+        """Get the concurrent stream limit for a key (0 = unlimited)."""
+        role_limit = jwt_authenticator.stream_limit(api_key)
+        if role_limit is not None:
+            return role_limit
+        invited_limit = registry.stream_limit(api_key)
+        if invited_limit is not None:
+            return invited_limit
+        return self.key_limits.get(api_key, settings.key_stream_limit)
+    
+    @staticmethod
+    def slot_key(api_key: str, end_user: str = "") -> str:
+        """Key slots are counted under; per end user when USER_LIMIT_KEY is on."""
+        if settings.user_limit_key and end_user:
+            return f"{api_key}|{end_user}"
+        return api_key
+    
+    def estimate_wait(self, slot: str, position: int, limit: int) -> int:
+        """Estimate seconds until the request at `position` in a slot's queue gets a slot."""
+        hold = self._hold.get(slot, DEFAULT_HOLD_SECONDS)
+        started = self._started.get(slot)
+        # The oldest active stream frees the first slot, then each batch of `limit` takes a full hold
+        first = max(hold - (time.time() - started[0]), 0) if started else 0
+        return max(math.ceil(first + hold * ((position - 1) // max(limit, 1))), 1)
+    
+    def _exceeded(self, slot: str, limit: int) -> StreamLimitExceeded:
+        """Build the rejection for a request that would be next after the current queue."""
+        position = len(self._waiters.get(slot, ())) + 1
+        return StreamLimitExceeded(self.active.get(slot, 0), limit, self.estimate_wait(slot, position, limit))
+    
+    def _take(self, slot: str):
+        """Count a newly started stream."""
+        self.active[slot] = self.active.get(slot, 0) + 1
+        self._started.setdefault(slot, deque()).append(time.time())
+    
+    def acquire(self, api_key: str, end_user: str = ""):
+        """Reserve a stream slot for a key or raise StreamLimitExceeded."""
+        slot = self.slot_key(api_key, end_user)
+        with self._lock:
+            current = self.active.get(slot, 0)
+            limit = self.limit_for(api_key)
+            # Queued requests are served first
+            if limit > 0 and (current >= limit or self._waiters.get(slot)):
+                raise self._exceeded(slot, limit)
+            self._take(slot)
+    
+    async def wait(self, api_key: str, end_user: str = "", timeout: float = 0) -> AsyncGenerator[int, None]:
+        """Queue for a slot, yielding the queue position now and every QUEUE_NOTIFY_INTERVAL seconds."""
+        slot = self.slot_key(api_key, end_user)
+        event = asyncio.Event()
+        with self._lock:
+            limit = self.limit_for(api_key)
+            if limit <= 0 or (self.active.get(slot, 0) < limit and not self._waiters.get(slot)):
+                self._take(slot)
+                return
+            waiters = self._waiters.setdefault(slot, deque())
+            waiters.append(event)
+        metrics.inc("cursor2api_queued_requests")
+        
+        deadline = time.monotonic() + timeout
+        interval = max(settings.queue_notify_interval, 0.1)
+        acquired = False
+        try:
+            while not event.is_set():
+                remaining = deadline - time.monotonic()
+                if remaining <= 0:
+                    with self._lock:
+                        if not event.is_set():
+                            raise self._exceeded(slot, limit)
+                    break
+                yield waiters.index(event) + 1
+                try:
+                    await asyncio.wait_for(event.wait(), min(interval, remaining))
+                except asyncio.TimeoutError:
+                    pass
+            acquired = True
+        finally:
+            metrics.inc("cursor2api_queued_requests", -1)
+            with self._lock:
+                handed_over = event.is_set()
+                if not handed_over:
+                    waiters.remove(event)
+                    if not waiters:
+                        self._waiters.pop(slot, None)
+            # The client went away after release() had already handed it the slot
+            if handed_over and not acquired:
+                self.release(api_key, end_user)
+    
+    def in_flight(self) -> int:
+        """Count requests holding a slot, across all keys."""
+        with self._lock:
+            return sum(self.active.values())
+    
+    def queue_depth(self) -> int:
+        """Count requests waiting for a slot, across all keys."""
+        with self._lock:
+            return sum(len(waiters) for waiters in self._waiters.values())
+    
+    def release(self, api_key: str, end_user: str = ""):
+        """Free a stream slot for a key, handing it to the first queued request if any."""
+        slot = self.slot_key(api_key, end_user)
+        with self._lock:
+            started = self._started.get(slot)
+            if started:
+                # Releases are matched to the oldest start; close enough for a wait estimate
+                held = time.time() - started.popleft()
+                previous = self._hold.get(slot)
+                self._hold[slot] = held if previous is None else HOLD_ALPHA * held + (1 - HOLD_ALPHA) * previous
+                if not started:
+                    self._started.pop(slot, None)
+            
+            current = self.active.get(slot, 0) - 1
+            if current > 0:
+                self.active[slot] = current
+            else:
+                self.active.pop(slot, None)
+            
+            waiters = self._waiters.get(slot)
+            if waiters:
+                waiters.popleft().set()
+                if not waiters:
+                    self._waiters.pop(slot, None)
+                self._take(slot)
+
+
+# Global stream limiter instance
+stream_limiter = StreamLimiter()
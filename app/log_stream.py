@@ -0,0 +1,96 @@
+"""Live log streaming for /admin/logs/stream."""
+import asyncio
+import logging
+import threading
+from collections import deque
+from contextvars import ContextVar
+from typing import AsyncGenerator, List, Optional, Tuple
+from .config import settings
+
+# Set per request so log lines can be filtered by request ID without changing every call site
+current_request_id: ContextVar[str] = ContextVar("current_request_id", default="")
+
+# Events buffered per subscriber before new ones are dropped for a slow reader
+SUBSCRIBER_QUEUE_SIZE = 1000
+
+
+class LogBroadcaster(logging.Handler):
+    """Logging handler that keeps recent events and fans them out to subscribers."""
+    
+    def __init__(self, backlog: int):
+        super().__init__()
+        self.recent = deque(maxlen=max(backlog, 0))
+        self._subscribers: List[Tuple[asyncio.Queue, asyncio.AbstractEventLoop]] = []
+        self._sub_lock = threading.Lock()
+    
+    def emit(self, record: logging.LogRecord):
+        """Turn a log record into an event and hand it to every subscriber."""
+        try:
+            event = {
+                "time": round(record.created, 3),
+                "level": record.levelname,
+                "logger": record.name,
+                "message": record.getMessage(),
+                "request_id": getattr(record, "request_id", None) or current_request_id.get() or None,
+            }
+            if settings.instance_name:
+                event["instance"] = settings.instance_name
+            if record.exc_info:
+                event["exception"] = logging.Formatter().formatException(record.exc_info)
+        except Exception:
+            self.handleError(record)
+            return
+        
+        self.recent.append(event)
+        with self._sub_lock:
+            subscribers = list(self._subscribers)
+        for queue, loop in subscribers:
+            # Records can come from any thread; queues belong to the event loop
+            loop.call_soon_threadsafe(self._offer, queue, event)
+    
+    @staticmethod
+    def _offer(queue: asyncio.Queue, event: dict):
+        """Queue an event, dropping it if the subscriber is too far behind."""
+        if not queue.full():
+            queue.put_nowait(event)
+    
+    async def subscribe(
+        self,
+        level: str = "INFO",
+        request_id: Optional[str] = None
+    ) -> AsyncGenerator[dict, None]:
+        """Yield buffered and then live events at or above a level, optionally for one request."""
+        threshold = logging.getLevelName(level.upper())
+        if not isinstance(threshold, int):
+            threshold = logging.INFO
+        
+        def wanted(event: dict) -> bool:
+            if logging.getLevelName(event["level"]) < threshold:
+                return False
+            return not request_id or event["request_id"] == request_id
+        
+        queue: asyncio.Queue = asyncio.Queue(maxsize=SUBSCRIBER_QUEUE_SIZE)
+        entry = (queue, asyncio.get_running_loop())
+        with self._sub_lock:
+            self._subscribers.append(entry)
+        try:
+            for event in list(self.recent):
+                if wanted(event):
+                    yield event
+            while True:
+                event = await queue.get()
+                if wanted(event):
+                    yield event
+        finally:
+            with self._sub_lock:
+                self._subscribers.remove(entry)
+    
+    def install(self):
+        """Attach to the root logger."""
+        root = logging.getLogger()
+        if self not in root.handlers:
+            root.addHandler(self)
+
+
+# Global log broadcaster instance
+log_broadcaster = LogBroadcaster(settings.log_stream_backlog)
@@ -0,0 +1,153 @@
+"""Scheduled and ad-hoc maintenance windows."""
+import json
+import time
+import asyncio
+import logging
+from datetime import datetime, timedelta, timezone
+from typing import List, Optional
+from zoneinfo import ZoneInfo
+from .config import settings
+
+logger = logging.getLogger(__name__)
+
+DAYS = ("mon", "tue", "wed", "thu", "fri", "sat", "sun")
+
+
+class MaintenanceError(Exception):
+    """Raised for a request that arrives during a maintenance window."""
+    
+    def __init__(self, window: "Window", ends_at: float):
+        self.window = window
+        self.ends_at = ends_at
+        self.retry_after = max(int(ends_at - time.time()) + 1, 1)
+        until = datetime.fromtimestamp(ends_at, timezone.utc).isoformat().replace("+00:00", "Z")
+        reason = f": {window.reason}" if window.reason else ""
+        super().__init__(f"The service is in a maintenance window until {until}{reason}")
+
+
+class Window:
+    """A one-off window (ISO start/end) or a daily/weekly one (HH:MM start/end, optional days)."""
+    
+    def __init__(self, start: str, end: str, days: Optional[List[str]] = None, reason: str = ""):
+        self.start = start
+        self.end = end
+        self.days = [d.lower()[:3] for d in days] if days else None
+        self.reason = reason
+        self.recurring = len(start) <= 5
+        if self.days and any(d not in DAYS for d in self.days):
+            raise ValueError(f"days must be among {', '.join(DAYS)}")
+        if self.recurring:
+            self._start_time = datetime.strptime(start, "%H:%M").time()
+            self._end_time = datetime.strptime(end, "%H:%M").time()
+        else:
+            self._start_at = self._parse_instant(start)
+            self._end_at = self._parse_instant(end)
+    
+    @staticmethod
+    def _parse_instant(value: str) -> float:
+        """Parse an ISO 8601 time; without an offset it is taken in MAINTENANCE_TIMEZONE."""
+        moment = datetime.fromisoformat(value.replace("Z", "+00:00"))
+        if moment.tzinfo is None:
+            moment = moment.replace(tzinfo=ZoneInfo(settings.maintenance_timezone))
+        return moment.timestamp()
+    
+    def active_until(self, now: float) -> Optional[float]:
+        """When the window ends if it is active at `now`, else None."""
+        if not self.recurring:
+            return self._end_at if self._start_at <= now < self._end_at else None
+        
+        local = datetime.fromtimestamp(now, ZoneInfo(settings.maintenance_timezone))
+        # A window crossing midnight (22:00-02:00) may have started the day before
+        for offset in (0, -1):
+            day = local.date() + timedelta(days=offset)
+            if self.days and DAYS[day.weekday()] not in self.days:
+                continue
+            start = datetime.combine(day, self._start_time, local.tzinfo)
+            end = datetime.combine(day, self._end_time, local.tzinfo)
+            if end <= start:
+                end += timedelta(days=1)
+            if start <= local < end:
+                return end.timestamp()
+        return None
+    
+    def to_dict(self) -> dict:
+        """Serialize for the admin API."""
+        return {"start": self.start, "end": self.end, "days": self.days, "reason": self.reason}
+
+
+def _parse_windows(raw: str) -> List[Window]:
+    """Parse MAINTENANCE_WINDOWS, a JSON array of {start, end, days?, reason?}."""
+    if not raw.strip():
+        return []
+    try:
+        return [
+            Window(str(w["start"]), str(w["end"]), w.get("days"), str(w.get("reason", "")))
+            for w in json.loads(raw)
+        ]
+    except (ValueError, TypeError, KeyError, AttributeError) as e:
+        raise ValueError(f"Invalid MAINTENANCE_WINDOWS: {e}") from e
+
+
+class MaintenanceSchedule:
+    """Decides whether a request may go upstream right now."""
+    
+    def __init__(self):
+        self.windows = _parse_windows(settings.maintenance_windows)
+        self.priority_keys = {k.strip() for k in settings.maintenance_priority_keys.split(",") if k.strip()}
+        # Started from the admin API, e.g. while rotating tokens
+        self.adhoc: Optional[Window] = None
+    
+    def current(self, now: Optional[float] = None) -> Optional[tuple]:
+        """The active window and when it ends, or None."""
+        now = time.time() if now is None else now
+        for window in ([self.adhoc] if self.adhoc else []) + self.windows:
+            ends_at = window.active_until(now)
+            if ends_at is not None:
+                return window, ends_at
+        return None
+    
+    def start(self, minutes: float, reason: str = "") -> Window:
+        """Start an ad-hoc window lasting `minutes`."""
+        now = datetime.now(timezone.utc)
+        self.adhoc = Window(now.isoformat(), (now + timedelta(minutes=minutes)).isoformat(), reason=reason)
+        logger.warning("Maintenance started for %.0f minutes%s", minutes, f": {reason}" if reason else "")
+        return self.adhoc
+    
+    def stop(self):
+        """End the ad-hoc window early."""
+        if self.adhoc:
+            logger.warning("Maintenance ended")
+        self.adhoc = None
+    
+    async def admit(self, api_key: str):
+        """Let a request through, wait out a short window, or raise MaintenanceError."""
+        if api_key in self.priority_keys:
+            return
+        active = self.current()
+        if active is None:
+            return
+        window, ends_at = active
+        wait = ends_at - time.time()
+        if settings.maintenance_action == "defer" and wait <= settings.maintenance_defer_max:
+            await asyncio.sleep(max(wait, 0))
+            # Another window may follow directly
+            active = self.current()
+            if active is None:
+                return
+            window, ends_at = active
+        raise MaintenanceError(window, ends_at)
+    
+    def to_dict(self) -> dict:
+        """Schedule and current state for the admin API."""
+        active = self.current()
+        return {
+            "active": active is not None,
+            "current": {**active[0].to_dict(), "ends_in": round(active[1] - time.time())} if active else None,
+            "adhoc": self.adhoc.to_dict() if self.adhoc else None,
+            "windows": [w.to_dict() for w in self.windows],
+            "action": settings.maintenance_action,
+        }
+
+
+# Global maintenance schedule instance
+maintenance = MaintenanceSchedule()
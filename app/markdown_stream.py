@@ -0,0 +1,98 @@
+"""Markdown-safe re-chunking of streamed output for strict incremental renderers."""
+import re
+from typing import AsyncGenerator
+from .config import settings
+
+# A construct still open after this many characters is emitted rather than held back
+MAX_HOLD = 256
+
+# Characters that may be the start of a longer marker: ``` fences, ** bold, ~~ strikethrough
+MARKER_CHARS = "`*_~"
+
+# An unfinished link or image at the end of the text: "[text", "[text]" or "[text](url"
+PARTIAL_LINK = re.compile(r"!?\[[^\]\n]*(?:\](?:\([^)\n]*)?)?$")
+
+FENCES = ("```", "~~~")
+
+
+def _is_fence_prefix(line: str) -> bool:
+    """Whether an unterminated line is, or could still become, a code fence line."""
+    stripped = line.lstrip(" ")
+    if stripped.startswith(FENCES):
+        return True
+    # "`" or "``" at the start of a line may be the first half of a fence
+    return bool(stripped) and len(stripped) < 3 and all(c == stripped[0] for c in stripped) and stripped[0] in "`~"
+
+
+class MarkdownHolder:
+    """Holds back the tail of the stream while it could be half of a markdown construct."""
+    
+    def __init__(self):
+        self._pending = ""
+        # The emitted part of the line being written, to recognise fence lines when they end
+        self._line = ""
+        self._in_code = False
+        # Decided once per stream so held-back text is never skipped by a mid-stream reload
+        self.enabled = settings.stream_markdown_safe
+    
+    def _code_after(self, text: str) -> bool:
+        """Whether the stream is inside a fenced code block after the complete lines of text."""
+        in_code = self._in_code
+        for line in (self._line + text).split("\n")[:-1]:
+            if line.lstrip(" ").startswith(FENCES):
+                in_code = not in_code
+        return in_code
+    
+    def _hold_from(self, text: str) -> int:
+        """Index in text where the held-back tail starts (len(text) when nothing is held)."""
+        line_start = text.rfind("\n") + 1
+        line = text[line_start:]
+        # Fence lines go out whole, so the info string never arrives as "```py" then "thon"
+        if _is_fence_prefix((self._line if line_start == 0 else "") + line):
+            return line_start
+        cut = len(text)
+        while cut > line_start and text[cut - 1] in MARKER_CHARS:
+            cut -= 1
+        # Brackets inside code are array indexes, not links
+        if not self._code_after(text):
+            match = PARTIAL_LINK.search(text, line_start)
+            if match:
+                cut = min(cut, match.start())
+        return cut
+    
+    def _emit(self, text: str) -> str:
+        """Track fence state across the text being released."""
+        self._in_code = self._code_after(text)
+        self._line = (self._line + text).rsplit("\n", 1)[-1]
+        return text
+    
+    def feed(self, chunk: str) -> str:
+        """Consume a chunk and return the text that can be emitted without splitting a construct."""
+        if not self.enabled:
+            return chunk
+        self._pending += chunk
+        cut = self._hold_from(self._pending)
+        if len(self._pending) - cut > MAX_HOLD:
+            cut = len(self._pending)
+        ready, self._pending = self._pending[:cut], self._pending[cut:]
+        return self._emit(ready)
+    
+    def flush(self) -> str:
+        """Emit whatever is still held back once the stream has ended."""
+        text, self._pending = self._pending, ""
+        return self._emit(text)
+
+
+async def markdown_safe_stream(source: AsyncGenerator[str, None]) -> AsyncGenerator[str, None]:
+    """Re-chunk deltas so none ends halfway through a code fence, emphasis marker or link."""
+    holder = MarkdownHolder()
+    try:
+        async for chunk in source:
+            text = holder.feed(chunk)
+            if text:
+                yield text
+        tail = holder.flush()
+        if tail:
+            yield tail
+    finally:
+        await source.aclose()
@@ -0,0 +1,57 @@
+"""In-process metrics with Prometheus text exposition."""
+import threading
+from typing import Dict, Tuple
+from .config import settings
+
+Labels = Tuple[Tuple[str, str], ...]
+
+
+class Metrics:
+    """Registry of counters and gauges keyed by name and labels."""
+    
+    def __init__(self):
+        self._help: Dict[str, Tuple[str, str]] = {}
+        self._values: Dict[str, Dict[Labels, float]] = {}
+        self._lock = threading.Lock()
+    
+    def describe(self, name: str, kind: str, help_text: str):
+        """Register a metric's type (counter or gauge) and help text."""
+        self._help[name] = (kind, help_text)
+        self._values.setdefault(name, {})
+    
+    def inc(self, name: str, value: float = 1, **labels: str):
+        """Increment a counter or gauge."""
+        key = tuple(sorted(labels.items()))
+        with self._lock:
+            series = self._values.setdefault(name, {})
+            series[key] = series.get(key, 0) + value
+    
+    def set(self, name: str, value: float, **labels: str):
+        """Set a gauge."""
+        key = tuple(sorted(labels.items()))
+        with self._lock:
+            self._values.setdefault(name, {})[key] = value
+    
+    def get(self, name: str, **labels: str) -> float:
+        """Read the current value of a series."""
+        return self._values.get(name, {}).get(tuple(sorted(labels.items())), 0)
+    
+    def render(self) -> str:
+        """Render all metrics in the Prometheus text format."""
+        lines = []
+        # Added at render time, so INSTANCE_NAME applies to every series without touching call sites
+        instance = (("instance_name", settings.instance_name),) if settings.instance_name else ()
+        with self._lock:
+            for name, series in sorted(self._values.items()):
+                kind, help_text = self._help.get(name, ("untyped", ""))
+                lines.append(f"# HELP {name} {help_text}")
+                lines.append(f"# TYPE {name} {kind}")
+                for labels, value in series.items():
+                    labels = instance + labels
+                    label_str = ",".join(f'{k}="{v}"' for k, v in labels)
+                    lines.append(f"{name}{{{label_str}}} {value:g}" if label_str else f"{name} {value:g}")
+        return "\n".join(lines) + "\n"
+
+
+# Global metrics instance
+metrics = Metrics()
@@ -0,0 +1,146 @@
+"""Runtime-manageable model blocklists and allowlists, globally and per API key."""
+import os
+import json
+import threading
+from fnmatch import fnmatch
+from typing import Dict, Iterable, List, Optional, Set
+from .config import settings
+from .token_pool import display_key
+from .oidc import jwt_authenticator
+from .registration import registry
+
+
+class ModelBlockedError(Exception):
+    """Raised when a model is blocked for the caller."""
+    
+    def __init__(self, model: str):
+        self.model = model
+        super().__init__(f"The model `{model}` is currently disabled")
+
+
+def _split(raw: str) -> Set[str]:
+    """Parse a comma-separated list of model patterns."""
+    return {m.strip() for m in raw.split(",") if m.strip()}
+
+
+def _matches(model: str, patterns: Iterable[str]) -> bool:
+    """Whether a model matches any exact name or glob pattern."""
+    return any(model == p or fnmatch(model, p) for p in patterns)
+
+
+class ModelRules:
+    """A blocklist and an optional allowlist of model patterns."""
+    
+    def __init__(self, blocked: Optional[Iterable[str]] = None, allowed: Optional[Iterable[str]] = None):
+        self.blocked: Set[str] = set(blocked or ())
+        # Empty allowlist = every model not blocked
+        self.allowed: Set[str] = set(allowed or ())
+    
+    def permits(self, model: str) -> bool:
+        """Whether these rules let a model through."""
+        if _matches(model, self.blocked):
+            return False
+        return not self.allowed or _matches(model, self.allowed)
+    
+    def is_empty(self) -> bool:
+        """Whether these rules restrict nothing."""
+        return not self.blocked and not self.allowed
+    
+    def to_dict(self) -> dict:
+        """Serialize the rules as sorted lists."""
+        return {"blocklist": sorted(self.blocked), "allowlist": sorted(self.allowed)}
+
+
+class ModelAccess:
+    """Global and per-key model rules, changeable at runtime and saved to disk."""
+    
+    def __init__(self, path: str):
+        self.path = path
+        self.global_rules = ModelRules(_split(settings.model_blocklist), _split(settings.model_allowlist))
+        self.key_rules: Dict[str, ModelRules] = {}
+        self._lock = threading.Lock()
+        self._load()
+    
+    def _load(self):
+        """Restore rules changed through the admin API, overriding the env defaults."""
+        if not self.path or not os.path.exists(self.path):
+            return
+        with open(self.path, encoding="utf-8") as f:
+            data = json.load(f)
+        if "global" in data:
+            self.global_rules = ModelRules(data["global"].get("blocklist"), data["global"].get("allowlist"))
+        for key, rules in (data.get("keys") or {}).items():
+            self.key_rules[key] = ModelRules(rules.get("blocklist"), rules.get("allowlist"))
+    
+    def _save(self):
+        """Persist the current rules so they survive a restart."""
+        if not self.path:
+            return
+        data = {
+            "global": self.global_rules.to_dict(),
+            "keys": {key: rules.to_dict() for key, rules in self.key_rules.items()},
+        }
+        os.makedirs(os.path.dirname(self.path) or ".", exist_ok=True)
+        tmp = f"{self.path}.tmp"
+        with open(tmp, "w", encoding="utf-8") as f:
+            json.dump(data, f, indent=2)
+        os.replace(tmp, self.path)
+    
+    def _rules(self, api_key: Optional[str]) -> ModelRules:
+        """Get the rules for a scope, creating per-key rules on first use."""
+        if not api_key:
+            return self.global_rules
+        return self.key_rules.setdefault(api_key, ModelRules())
+    
+    def is_allowed(self, api_key: Optional[str], model: str) -> bool:
+        """Whether a key may use a model under both global and per-key rules."""
+        if not self.global_rules.permits(model) or not jwt_authenticator.allows_model(api_key, model):
+            return False
+        if not registry.allows_model(api_key, model):
+            return False
+        rules = self.key_rules.get(api_key) if api_key else None
+        return rules is None or rules.permits(model)
+    
+    def check(self, api_key: Optional[str], model: str):
+        """Raise ModelBlockedError if a key may not use a model."""
+        if not self.is_allowed(api_key, model):
+            raise ModelBlockedError(model)
+    
+    def filter(self, api_key: Optional[str], models: Iterable[str]) -> List[str]:
+        """Keep only the models a key may use."""
+        return [m for m in models if self.is_allowed(api_key, m)]
+    
+    def block(self, model: str, api_key: Optional[str] = None):
+        """Block a model pattern globally or for one key."""
+        with self._lock:
+            self._rules(api_key).blocked.add(model)
+            self._save()
+    
+    def unblock(self, model: str, api_key: Optional[str] = None):
+        """Remove a model pattern from the global or per-key blocklist."""
+        with self._lock:
+            rules = self._rules(api_key)
+            rules.blocked.discard(model)
+            if api_key and rules.is_empty():
+                del self.key_rules[api_key]
+            self._save()
+    
+    def set_allowlist(self, models: List[str], api_key: Optional[str] = None):
+        """Replace the global or per-key allowlist (empty = allow everything not blocked)."""
+        with self._lock:
+            rules = self._rules(api_key)
+            rules.allowed = {m for m in models if m}
+            if api_key and rules.is_empty():
+                del self.key_rules[api_key]
+            self._save()
+    
+    def to_dict(self) -> dict:
+        """Current rules, with API keys masked."""
+        return {
+            "global": self.global_rules.to_dict(),
+            "keys": {display_key(key): rules.to_dict() for key, rules in self.key_rules.items()},
+        }
+
+
+# Global model access instance
+model_access = ModelAccess(settings.model_access_file)
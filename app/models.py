@@ -1,6 +1,6 @@
 """Data models for OpenAI-compatible API."""
 from typing import List, Optional, Union, Dict, Any
-from pydantic import BaseModel, Field
+from pydantic import BaseModel, ConfigDict, Field
 import time
 import uuid
 
@@ -8,8 +8,10 @@ import uuid
 class Message(BaseModel):
     """Chat message."""
     role: str
-    content: Union[str, List[Dict[str, Any]]]
+    content: Optional[Union[str, List[Dict[str, Any]]]] = None
     name: Optional[str] = None
+    tool_calls: Optional[List[Dict[str, Any]]] = None
+    tool_call_id: Optional[str] = None
     
     def get_text_content(self) -> str:
         """Extract text content from message."""
@@ -26,6 +28,9 @@ class Message(BaseModel):
 
 class ChatCompletionRequest(BaseModel):
     """OpenAI chat completion request."""
+    # Unknown parameters are kept so strict mode can report them
+    model_config = ConfigDict(extra="allow")
+    
     model: str
     messages: List[Message]
     temperature: Optional[float] = 0.7
@@ -36,13 +41,65 @@ class ChatCompletionRequest(BaseModel):
     presence_penalty: Optional[float] = 0
     frequency_penalty: Optional[float] = 0
     user: Optional[str] = None
+    stream_options: Optional[Dict[str, Any]] = None
+    best_of: Optional[int] = None
+    tools: Optional[List[Dict[str, Any]]] = None
+    tool_choice: Optional[Union[str, Dict[str, Any]]] = None
+    workspace: Optional[Dict[str, Any]] = None
+    metadata: Optional[Dict[str, str]] = None
+    # Deferred mode: answered with 202, the result is POSTed here when done
+    callback_url: Optional[str] = None
+    callback_progress: Optional[bool] = False
+
+
+class CompletionRequest(BaseModel):
+    """OpenAI legacy text completion request."""
+    model_config = ConfigDict(extra="allow")
+    
+    model: str
+    prompt: Union[str, List[str]]
+    temperature: Optional[float] = 0.7
+    top_p: Optional[float] = 1.0
+    n: Optional[int] = 1
+    stream: Optional[bool] = False
+    max_tokens: Optional[int] = None
+    stop: Optional[Union[str, List[str]]] = None
+    echo: Optional[bool] = False
+    user: Optional[str] = None
+
+
+class TGIRequest(BaseModel):
+    """Hugging Face Text Generation Inference request."""
+    model_config = ConfigDict(extra="allow")
+    
+    inputs: str
+    parameters: Dict[str, Any] = Field(default_factory=dict)
+    stream: Optional[bool] = False
+
+
+class TitleRequest(BaseModel):
+    """Chat title generation request."""
+    messages: List[Message]
+    model: Optional[str] = None
+
+
+class TitleResponse(BaseModel):
+    """Chat title generation response."""
+    title: str
+    model: str
+
+
+class RegisterRequest(BaseModel):
+    """Redeem an invitation code for an API key."""
+    invitation_code: str
+    name: str = ""
 
 
 class Choice(BaseModel):
     """Chat completion choice."""
     index: int = 0
     message: Optional[Message] = None
-    delta: Optional[Dict[str, str]] = None
+    delta: Optional[Dict[str, Any]] = None
     finish_reason: Optional[str] = None
 
 
@@ -61,6 +118,7 @@ class ChatCompletionResponse(BaseModel):
     model: str
     choices: List[Choice]
     usage: Optional[Usage] = None
+    system_fingerprint: Optional[str] = None
 
 
 class ChatCompletionStreamResponse(BaseModel):
@@ -70,6 +128,8 @@ class ChatCompletionStreamResponse(BaseModel):
     created: int
     model: str
     choices: List[Choice]
+    usage: Optional[Usage] = None
+    system_fingerprint: Optional[str] = None
 
 
 class ModelInfo(BaseModel):
@@ -78,6 +138,7 @@ class ModelInfo(BaseModel):
     object: str = "model"
     created: int = 1700000000
     owned_by: str = "cursor"
+    pricing: Optional[Dict[str, float]] = None
 
 
 class ModelListResponse(BaseModel):
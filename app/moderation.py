@@ -0,0 +1,125 @@
+"""OpenAI-compatible moderation from local regex rules, optionally merged with an external classifier."""
+import re
+import json
+import uuid
+from typing import Any, Dict, List
+import httpx
+from .config import settings
+
+# The categories of the OpenAI moderation schema, all reported in every result
+CATEGORIES = (
+    "harassment",
+    "harassment/threatening",
+    "hate",
+    "hate/threatening",
+    "illicit",
+    "illicit/violent",
+    "self-harm",
+    "self-harm/intent",
+    "self-harm/instructions",
+    "sexual",
+    "sexual/minors",
+    "violence",
+    "violence/graphic",
+)
+
+LOCAL_MODEL = "cursor2api-rules"
+
+
+class ModerationInputError(ValueError):
+    """Raised for an input the moderation schema does not accept."""
+
+
+def _parse_rules(raw: str) -> Dict[str, List[re.Pattern]]:
+    """Parse {category: [regex, ...]}; patterns match case-insensitively."""
+    if not raw.strip():
+        return {}
+    try:
+        rules = {
+            str(category): [re.compile(p, re.IGNORECASE) for p in patterns]
+            for category, patterns in json.loads(raw).items()
+        }
+    except (ValueError, TypeError, AttributeError, re.error) as e:
+        raise ValueError(f"Invalid MODERATION_RULES: {e}") from e
+    unknown = [c for c in rules if c not in CATEGORIES]
+    if unknown:
+        raise ValueError(f"Invalid MODERATION_RULES: unknown category {unknown[0]}")
+    return rules
+
+
+rules = _parse_rules(settings.moderation_rules)
+
+
+def input_texts(value: Any) -> List[str]:
+    """The texts to classify: a string, an array of strings, or an array of multimodal text parts."""
+    if isinstance(value, str):
+        return [value]
+    if isinstance(value, list) and value:
+        texts = []
+        for item in value:
+            if isinstance(item, str):
+                texts.append(item)
+            elif isinstance(item, dict) and item.get("type") == "text" and isinstance(item.get("text"), str):
+                texts.append(item["text"])
+            elif isinstance(item, dict) and item.get("type") == "image_url":
+                # Images cannot be judged by text rules; they count as one unflagged input
+                texts.append("")
+            else:
+                raise ModerationInputError("input items must be strings or text/image_url parts")
+        return texts
+    raise ModerationInputError("input must be a string or a non-empty array")
+
+
+def classify_local(text: str) -> dict:
+    """One result from MODERATION_RULES: a category is flagged with score 1 when any of its patterns matches."""
+    categories = {c: any(p.search(text) for p in rules.get(c, ())) for c in CATEGORIES}
+    return {
+        "flagged": any(categories.values()),
+        "categories": categories,
+        "category_scores": {c: 1.0 if hit else 0.0 for c, hit in categories.items()},
+    }
+
+
+def merge_results(local: dict, remote: dict) -> dict:
+    """Combine a local and a classifier result: a category is flagged by either, scored by the higher."""
+    remote_categories = remote.get("categories") or {}
+    remote_scores = remote.get("category_scores") or {}
+    categories = {c: local["categories"][c] or bool(remote_categories.get(c)) for c in CATEGORIES}
+    scores = {c: max(local["category_scores"][c], float(remote_scores.get(c) or 0.0)) for c in CATEGORIES}
+    return {
+        "flagged": any(categories.values()) or bool(remote.get("flagged")),
+        "categories": categories,
+        "category_scores": scores,
+    }
+
+
+async def _classify_remote(body: dict) -> List[dict]:
+    """Results from the external classifier at MODERATION_BASE_URL."""
+    config = settings.get()
+    headers = {}
+    if config.moderation_api_key:
+        headers["Authorization"] = f"Bearer {config.moderation_api_key}"
+    if config.moderation_model:
+        body = {**body, "model": config.moderation_model}
+    async with httpx.AsyncClient(timeout=config.timeout) as client:
+        response = await client.post(
+            f"{config.moderation_base_url.rstrip('/')}/moderations",
+            json=body,
+            headers=headers,
+        )
+    response.raise_for_status()
+    return response.json()["results"]
+
+
+async def moderate(body: dict) -> dict:
+    """Classify a /v1/moderations request, raising ModerationInputError for bad input."""
+    texts = input_texts(body.get("input"))
+    results = [classify_local(text) for text in texts]
+    model = LOCAL_MODEL
+    if settings.moderation_base_url:
+        remote = await _classify_remote(body)
+        if len(remote) != len(results):
+            raise ValueError(f"classifier returned {len(remote)} results for {len(results)} inputs")
+        results = [merge_results(local, other) for local, other in zip(results, remote)]
+        model = settings.moderation_model or body.get("model") or LOCAL_MODEL
+    return {"id": f"modr-{uuid.uuid4().hex}", "model": model, "results": results}
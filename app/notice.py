@@ -0,0 +1,106 @@
+"""A one-time server notice shown to end users at the start of their next assistant reply."""
+import time
+import uuid
+import logging
+import threading
+from fnmatch import fnmatchcase
+from typing import Dict, List, Optional
+from .config import settings
+from .context import RequestContext
+from .token_pool import display_key
+
+logger = logging.getLogger(__name__)
+
+# Audiences remembered per notice; beyond this the earliest half is forgotten and may see it again
+MAX_AUDIENCES = 100000
+
+
+def _split(raw: str) -> List[str]:
+    """Parse a comma-separated list of key patterns."""
+    return [k.strip() for k in raw.split(",") if k.strip()]
+
+
+class Notice:
+    """The notice text, the keys it is shown to and when it stops being shown."""
+    
+    def __init__(self, text: str, keys: Optional[List[str]] = None, expires_at: Optional[float] = None):
+        self.id = uuid.uuid4().hex[:8]
+        self.text = text
+        # Key patterns; keys are opted in explicitly ("*" for all), so empty reaches no one
+        self.keys = keys or []
+        self.expires_at = expires_at
+        self.created = time.time()
+    
+    def applies_to(self, api_key: str) -> bool:
+        """Whether the notice is live and targets a key."""
+        if self.expires_at is not None and time.time() >= self.expires_at:
+            return False
+        return any(fnmatchcase(api_key, pattern) for pattern in self.keys)
+    
+    def to_dict(self) -> dict:
+        """Serialize for the admin API, with API keys masked."""
+        return {
+            "id": self.id,
+            "text": self.text,
+            "keys": [display_key(k) for k in self.keys],
+            "created": int(self.created),
+            "expires_at": int(self.expires_at) if self.expires_at is not None else None,
+        }
+
+
+class NoticeBoard:
+    """Holds the current notice and who has already seen it."""
+    
+    def __init__(self):
+        self.notice: Optional[Notice] = None
+        if settings.notice_text:
+            self.notice = Notice(settings.notice_text, _split(settings.notice_keys))
+            if not self.notice.keys:
+                logger.warning("NOTICE_TEXT is set but NOTICE_KEYS is empty, so no key will be shown the notice")
+        # Insertion-ordered, so trimming drops the audiences that saw it longest ago
+        self._seen: Dict[str, None] = {}
+        self._lock = threading.Lock()
+    
+    def set(self, text: str, keys: Optional[List[str]] = None, ttl: Optional[float] = None) -> Notice:
+        """Replace the notice; everyone sees the new one once, including those who saw the old one."""
+        expires_at = time.time() + ttl if ttl else None
+        with self._lock:
+            self.notice = Notice(text, keys, expires_at)
+            self._seen = {}
+        logger.info("Server notice set%s: %s", f" for {len(keys)} key pattern(s)" if keys else "", text)
+        return self.notice
+    
+    def clear(self):
+        """Stop showing the notice."""
+        with self._lock:
+            self.notice = None
+            self._seen = {}
+    
+    def take(self, ctx: RequestContext) -> str:
+        """The prefix for this reply: the notice the first time its audience gets a reply, else ""."""
+        notice = self.notice
+        # The handler marks the requests whose reply a person reads as plain chat text
+        if notice is None or not ctx.overrides.get("notice") or not notice.applies_to(ctx.api_key):
+            return ""
+        # A shared key serves many people, so each end user of it sees the notice once
+        audience = f"{ctx.api_key}|{ctx.end_user}"
+        with self._lock:
+            if notice is not self.notice or audience in self._seen:
+                return ""
+            if len(self._seen) >= MAX_AUDIENCES:
+                self._seen = dict.fromkeys(list(self._seen)[MAX_AUDIENCES // 2:])
+            self._seen[audience] = None
+        # A blank line keeps the notice its own paragraph in Markdown chat UIs
+        return f"{notice.text}\n\n"
+    
+    def to_dict(self) -> dict:
+        """The current notice and how many audiences have seen it."""
+        with self._lock:
+            return {
+                "notice": self.notice.to_dict() if self.notice else None,
+                "delivered": len(self._seen),
+            }
+
+
+# Global notice board instance
+notice_board = NoticeBoard()
@@ -0,0 +1,176 @@
+"""JWT bearer authentication against an OIDC provider's JWKS."""
+import json
+import time
+import logging
+import threading
+from collections import OrderedDict
+from fnmatch import fnmatchcase
+from typing import Dict, List, Optional
+import httpx
+from .config import settings
+
+logger = logging.getLogger(__name__)
+
+# Minimum seconds between JWKS refetches triggered by an unknown key ID
+JWKS_REFRESH_MIN_INTERVAL = 30
+
+# Callers whose role policy is remembered; the least recently seen are forgotten first
+MAX_IDENTITIES = 10000
+
+
+class RolePolicy:
+    """Models and concurrency granted to holders of a role claim."""
+    
+    def __init__(self, models: Optional[List[str]] = None, stream_limit: Optional[int] = None):
+        self.models = models
+        self.stream_limit = stream_limit
+
+
+def _parse_policies(raw: str) -> Dict[str, RolePolicy]:
+    """Parse {role: {"models": [patterns], "stream_limit": n}}."""
+    if not raw.strip():
+        return {}
+    try:
+        policies = {}
+        for role, policy in json.loads(raw).items():
+            models = policy.get("models")
+            limit = policy.get("stream_limit")
+            policies[str(role)] = RolePolicy(
+                [str(m) for m in models] if models is not None else None,
+                int(limit) if limit is not None else None,
+            )
+        return policies
+    except (ValueError, TypeError, AttributeError) as e:
+        raise ValueError(f"Invalid OIDC_ROLE_POLICIES: {e}") from e
+
+
+class JWTAuthenticator:
+    """Verifies bearer JWTs and remembers the policy their claims map to."""
+    
+    def __init__(self):
+        self.policies = _parse_policies(settings.oidc_role_policies)
+        self._keys: Dict[str, dict] = {}
+        self._fetched_at = 0.0
+        # Caller identity -> policy from its latest token, least recently seen first
+        self._identities: "OrderedDict[str, RolePolicy]" = OrderedDict()
+        self._lock = threading.Lock()
+        self.check_config()
+    
+    @property
+    def enabled(self) -> bool:
+        return settings.auth_mode != "api_key"
+    
+    def check_config(self):
+        """Fail at startup when JWT auth is on but cannot work."""
+        if not self.enabled:
+            return
+        if not settings.oidc_jwks_url:
+            raise ValueError(f"AUTH_MODE={settings.auth_mode} needs OIDC_JWKS_URL")
+        # Without it, tokens the provider issued to any of its other clients would be accepted
+        if not settings.oidc_audience:
+            raise ValueError(f"AUTH_MODE={settings.auth_mode} needs OIDC_AUDIENCE")
+        if not settings.get_oidc_algorithms():
+            raise ValueError(f"AUTH_MODE={settings.auth_mode} needs OIDC_ALGORITHMS")
+        try:
+            import jwt  # noqa: F401
+        except ImportError:
+            raise ValueError('JWT authentication needs PyJWT (pip install "pyjwt[crypto]")') from None
+    
+    async def _fetch_keys(self):
+        """Download the provider's signing keys."""
+        async with httpx.AsyncClient(timeout=10) as client:
+            response = await client.get(settings.oidc_jwks_url)
+            response.raise_for_status()
+        self._keys = {k.get("kid", ""): k for k in response.json().get("keys", [])}
+        self._fetched_at = time.time()
+    
+    async def _signing_key(self, kid: str) -> Optional[dict]:
+        """Find a JWK by key ID, refetching when it is unknown or the cache is stale."""
+        age = time.time() - self._fetched_at
+        if age > settings.oidc_jwks_cache_ttl or (kid not in self._keys and age > JWKS_REFRESH_MIN_INTERVAL):
+            try:
+                await self._fetch_keys()
+            except Exception as e:
+                # Keep serving with the cached keys; the provider may be briefly down
+                logger.warning("Failed to fetch JWKS from %s: %s", settings.oidc_jwks_url, e)
+        return self._keys.get(kid)
+    
+    def _policy_for(self, claims: dict) -> RolePolicy:
+        """Merge the policies of every role in the token: union of models, highest limit."""
+        roles = claims.get(settings.oidc_roles_claim) or []
+        if isinstance(roles, str):
+            roles = roles.split()
+        matched = [self.policies[r] for r in roles if r in self.policies]
+        if not matched:
+            return RolePolicy()
+        
+        models: Optional[List[str]] = []
+        for policy in matched:
+            # A role without a model list grants every model
+            if policy.models is None:
+                models = None
+                break
+            models.extend(policy.models)
+        limits = [p.stream_limit for p in matched if p.stream_limit is not None]
+        return RolePolicy(models, max(limits) if limits else None)
+    
+    async def verify(self, authorization: Optional[str]) -> Optional[str]:
+        """Verify a bearer JWT, returning the caller identity (jwt:<user claim>)."""
+        if not self.enabled or not authorization or not authorization.startswith("Bearer "):
+            return None
+        token = authorization[7:]
+        if token.count(".") != 2:
+            return None
+        
+        import jwt
+        try:
+            header = jwt.get_unverified_header(token)
+            jwk = await self._signing_key(header.get("kid", ""))
+            if jwk is None:
+                return None
+            # Only configured algorithms, never whatever the token header claims
+            algorithms = settings.get_oidc_algorithms()
+            if jwk.get("alg") and jwk["alg"] not in algorithms:
+                return None
+            key = jwt.PyJWK(jwk)
+            claims = jwt.decode(
+                token,
+                key.key,
+                algorithms=algorithms,
+                audience=settings.oidc_audience,
+                issuer=settings.oidc_issuer or None,
+                leeway=settings.oidc_leeway,
+            )
+        except jwt.PyJWTError as e:
+            logger.debug("Rejected JWT: %s", e)
+            return None
+        
+        subject = claims.get(settings.oidc_user_claim)
+        if not subject:
+            return None
+        identity = f"jwt:{subject}"
+        with self._lock:
+            self._identities[identity] = self._policy_for(claims)
+            self._identities.move_to_end(identity)
+            while len(self._identities) > MAX_IDENTITIES:
+                self._identities.popitem(last=False)
+        return identity
+    
+    def allows_model(self, identity: Optional[str], model: str) -> bool:
+        """Whether the identity's role policy permits a model; non-JWT callers always pass."""
+        policy = self._identities.get(identity) if identity else None
+        if policy is None:
+            # A JWT caller whose policy was forgotten has to present its token again
+            return not (identity or "").startswith("jwt:")
+        if policy.models is None:
+            return True
+        return any(fnmatchcase(model, pattern) for pattern in policy.models)
+    
+    def stream_limit(self, identity: str) -> Optional[int]:
+        """Concurrent stream limit from the identity's roles, or None to use the key limits."""
+        policy = self._identities.get(identity)
+        return policy.stream_limit if policy else None
+
+
+# Global JWT authenticator instance
+jwt_authenticator = JWTAuthenticator()
@@ -0,0 +1,102 @@
+"""OpenAPI spec customization: auth, extension headers and error formats."""
+from fastapi import FastAPI
+from fastapi.openapi.utils import get_openapi
+from .models import ErrorResponse
+
+# Extension headers returned by proxied completion endpoints
+LATENCY_HEADERS = {
+    "X-Upstream-TTFB": "Upstream time to first byte in milliseconds",
+    "X-Upstream-Duration": "Total upstream duration in milliseconds (non-streaming only)",
+    "X-Queue-Wait": "Time spent queued in the proxy in milliseconds",
+    "X-Model-Used": "Model that actually served the request, when it differs from the requested model",
+    "X-Cache": "HIT or MISS when the response cache is enabled",
+    "X-Ghost-Mode": "Whether the request was sent upstream in ghost (privacy) mode",
+}
+
+COMPLETION_PATHS = ("/v1/chat/completions", "/v1/chat/title", "/v1/completions", "/generate", "/generate_stream")
+
+PUBLIC_PATHS = ("/", "/favicon.ico", "/health", "/readyz", "/metrics", "/status", "/register")
+
+
+def _error_responses() -> dict:
+    """Common error responses shared by authenticated endpoints."""
+    detail = {"$ref": "#/components/schemas/HTTPErrorDetail"}
+    openai_error = {"$ref": "#/components/schemas/ErrorResponse"}
+    return {
+        "401": {"description": "Invalid API key", "content": {"application/json": {"schema": detail}}},
+        "429": {
+            "description": "Rate limit or budget exceeded",
+            "content": {"application/json": {"schema": {"oneOf": [openai_error, detail]}}},
+        },
+        "500": {"description": "Upstream or proxy error", "content": {"application/json": {"schema": detail}}},
+    }
+
+
+def build_openapi(app: FastAPI) -> dict:
+    """Generate the OpenAPI schema, caching it on the app."""
+    if app.openapi_schema:
+        return app.openapi_schema
+    
+    schema = get_openapi(
+        title=app.title,
+        version=app.version,
+        description=app.description,
+        routes=app.routes,
+    )
+    components = schema.setdefault("components", {})
+    schemas = components.setdefault("schemas", {})
+    schemas["ErrorResponse"] = ErrorResponse.model_json_schema(ref_template="#/components/schemas/{model}")
+    schemas.update(schemas["ErrorResponse"].pop("$defs", {}))
+    schemas["HTTPErrorDetail"] = {
+        "type": "object",
+        "properties": {"detail": {"type": "string"}},
+        "required": ["detail"],
+    }
+    components.setdefault("securitySchemes", {})["BearerAuth"] = {
+        "type": "http",
+        "scheme": "bearer",
+        "description": "API_KEY for /v1 endpoints, ADMIN_KEY for /admin endpoints",
+    }
+    components["securitySchemes"]["HmacSignature"] = {
+        "type": "apiKey",
+        "in": "header",
+        "name": "X-Signature",
+        "description": (
+            "Alternative to API_KEY: hex HMAC-SHA256 of \"<X-Timestamp>\\n<METHOD>\\n<path>\\n\" + body "
+            "with the secret of X-Key-Id (see HMAC_KEYS)"
+        ),
+    }
+    
+    for path, operations in schema.get("paths", {}).items():
+        if path in PUBLIC_PATHS:
+            continue
+        for operation in operations.values():
+            operation["security"] = [{"BearerAuth": []}]
+            if not path.startswith("/admin"):
+                operation["security"].append({"HmacSignature": []})
+            responses = operation.setdefault("responses", {})
+            for status, response in _error_responses().items():
+                responses.setdefault(status, response)
+            
+            if path in COMPLETION_PATHS:
+                ok = responses.setdefault("200", {"description": "Successful Response"})
+                ok["headers"] = {
+                    name: {"description": description, "schema": {"type": "string"}}
+                    for name, description in LATENCY_HEADERS.items()
+                }
+                if path == "/v1/chat/completions":
+                    ok.setdefault("content", {})
+                    ok["content"]["text/event-stream"] = {
+                        "schema": {"type": "string", "description": "SSE chunks when stream=true"}
+                    }
+                    ok["content"]["application/x-ndjson"] = {
+                        "schema": {"type": "string", "description": "NDJSON chunks when Accept: application/x-ndjson"}
+                    }
+                elif path in ("/v1/completions", "/generate_stream"):
+                    ok.setdefault("content", {})
+                    ok["content"]["text/event-stream"] = {
+                        "schema": {"type": "string", "description": "SSE events when streaming"}
+                    }
+    
+    app.openapi_schema = schema
+    return schema
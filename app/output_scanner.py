@@ -0,0 +1,125 @@
+"""Masking of leaked secrets and listed words in model output."""
+import re
+import json
+import math
+from collections import Counter
+from typing import List, Tuple
+from .config import settings
+from .metrics import metrics
+
+# Well-known credential formats
+SECRET_PATTERNS = [
+    re.compile(r"\bsk-(?:ant-|proj-)?[A-Za-z0-9_-]{20,}"),
+    re.compile(r"\bAKIA[0-9A-Z]{16}\b"),
+    re.compile(r"\bgh[pousr]_[A-Za-z0-9]{36,}\b"),
+    re.compile(r"\bAIza[0-9A-Za-z_-]{35}\b"),
+    re.compile(r"\bxox[abposr]-[A-Za-z0-9-]{10,}"),
+    re.compile(r"\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}"),
+    re.compile(r"-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(?:-----END [A-Z ]*PRIVATE KEY-----|$)"),
+]
+
+# Candidates for the entropy heuristic: long runs of key-like characters
+ENTROPY_CANDIDATE = re.compile(r"[A-Za-z0-9+/_=-]{32,}")
+ENTROPY_THRESHOLD = 4.0
+
+# A partial token longer than this is emitted rather than held back
+MAX_HOLD = 256
+
+metrics.describe("cursor2api_output_redactions_total", "counter", "Spans masked in model output by the output scanner")
+
+
+def _parse_patterns(raw: str) -> List[re.Pattern]:
+    """Parse extra patterns from a JSON array of regexes."""
+    if not raw.strip():
+        return []
+    try:
+        return [re.compile(p) for p in json.loads(raw)]
+    except (ValueError, TypeError, re.error) as e:
+        raise ValueError(f"Invalid OUTPUT_SCAN_PATTERNS: {e}") from e
+
+
+def _word_pattern(raw: str):
+    """Build a whole-word, case-insensitive pattern from a comma-separated word list."""
+    words = [w.strip() for w in raw.split(",") if w.strip()]
+    if not words:
+        return None
+    return re.compile(r"\b(?:" + "|".join(re.escape(w) for w in words) + r")\b", re.IGNORECASE)
+
+
+extra_patterns = _parse_patterns(settings.output_scan_patterns)
+word_pattern = _word_pattern(settings.output_scan_words)
+
+
+def shannon_entropy(text: str) -> float:
+    """Bits of entropy per character."""
+    counts = Counter(text)
+    return -sum(n / len(text) * math.log2(n / len(text)) for n in counts.values())
+
+
+def _looks_random(candidate: str) -> bool:
+    """Heuristic for API-key-like strings: mixed letters and digits with high entropy."""
+    return (
+        any(c.isdigit() for c in candidate)
+        and any(c.isalpha() for c in candidate)
+        and shannon_entropy(candidate) >= ENTROPY_THRESHOLD
+    )
+
+
+def scan(text: str) -> Tuple[str, int]:
+    """Mask matches in text, returning the result and the number of masked spans."""
+    mask = settings.output_scan_mask
+    total = 0
+    for kind, patterns in (("secret", SECRET_PATTERNS), ("custom", extra_patterns)):
+        for pattern in patterns:
+            text, count = pattern.subn(mask, text)
+            if count:
+                metrics.inc("cursor2api_output_redactions_total", count, kind=kind)
+                total += count
+    if word_pattern:
+        text, count = word_pattern.subn(lambda m: "*" * len(m.group(0)), text)
+        if count:
+            metrics.inc("cursor2api_output_redactions_total", count, kind="word")
+            total += count
+    if settings.output_scan_entropy:
+        hits = []
+        
+        def mask_random(match: re.Match) -> str:
+            if not _looks_random(match.group(0)):
+                return match.group(0)
+            hits.append(match)
+            return mask
+        
+        text = ENTROPY_CANDIDATE.sub(mask_random, text)
+        if hits:
+            metrics.inc("cursor2api_output_redactions_total", len(hits), kind="entropy")
+            total += len(hits)
+    return text, total
+
+
+class OutputScanner:
+    """Scans streamed deltas, holding back a partial token until it is complete."""
+    
+    def __init__(self):
+        self._pending = ""
+        # Decided once per stream so held-back text is never skipped by a mid-stream reload
+        self.enabled = settings.output_scan
+    
+    def feed(self, chunk: str) -> str:
+        """Consume a chunk and return the masked text that is safe to emit."""
+        if not self.enabled:
+            return chunk
+        self._pending += chunk
+        
+        # A secret can straddle chunks, so keep everything after the last whitespace
+        cut = max(self._pending.rfind(" "), self._pending.rfind("\n"), self._pending.rfind("\t"))
+        if cut == -1 and len(self._pending) <= MAX_HOLD:
+            return ""
+        if len(self._pending) - cut - 1 > MAX_HOLD:
+            cut = len(self._pending) - 1
+        ready, self._pending = self._pending[:cut + 1], self._pending[cut + 1:]
+        return scan(ready)[0]
+    
+    def flush(self) -> str:
+        """Emit whatever is still held back once the stream has ended."""
+        text, self._pending = self._pending, ""
+        return scan(text)[0] if text else ""
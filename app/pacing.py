@@ -0,0 +1,30 @@
+"""Typewriter pacing of streamed output."""
+import asyncio
+from typing import AsyncGenerator, List, Tuple
+from .config import settings
+
+
+def plan_pieces(chunk: str, cps: float, piece_chars: int, max_lag: float) -> Tuple[List[str], float]:
+    """Split a chunk into small pieces and pick the delay after each one."""
+    size = max(piece_chars, 1)
+    pieces = [chunk[i:i + size] for i in range(0, len(chunk), size)]
+    duration = len(chunk) / cps
+    # A large burst is sped up so it never trails the upstream by more than max_lag
+    if max_lag > 0:
+        duration = min(duration, max_lag)
+    return pieces, duration / max(len(pieces), 1)
+
+
+async def paced_stream(source: AsyncGenerator[str, None]) -> AsyncGenerator[str, None]:
+    """Re-chunk upstream deltas into small pieces sent at STREAM_PACING_CPS characters per second."""
+    config = settings.get()
+    try:
+        async for chunk in source:
+            pieces, delay = plan_pieces(
+                chunk, config.stream_pacing_cps, config.stream_pacing_chunk, config.stream_pacing_max_lag
+            )
+            for piece in pieces:
+                yield piece
+                await asyncio.sleep(delay)
+    finally:
+        await source.aclose()
@@ -0,0 +1,92 @@
+"""Named prompt presets referenced as `preset:<name>` models."""
+import os
+import tomllib
+import logging
+import threading
+from typing import Any, Dict, List, Optional
+from .config import settings
+from .models import ChatCompletionRequest, Message
+
+logger = logging.getLogger(__name__)
+
+PRESET_PREFIX = "preset:"
+
+# Request parameters a preset may set
+PRESET_PARAMETERS = ("temperature", "top_p", "max_tokens", "presence_penalty", "frequency_penalty")
+
+
+class PresetNotFoundError(Exception):
+    """Raised when a request references an unknown preset."""
+
+
+class PresetStore:
+    """Loads presets from PRESETS_FILE, reloading when the file changes."""
+    
+    def __init__(self, path: str):
+        self.path = path
+        self._presets: Dict[str, Dict[str, Any]] = {}
+        self._mtime: Optional[float] = None
+        self._lock = threading.Lock()
+    
+    def _load(self):
+        """Reload the presets file if it was modified."""
+        try:
+            mtime = os.path.getmtime(self.path)
+        except OSError:
+            self._presets, self._mtime = {}, None
+            return
+        if mtime == self._mtime:
+            return
+        
+        with self._lock:
+            with open(self.path, "rb") as f:
+                presets = tomllib.load(f).get("presets", {})
+            for name, preset in presets.items():
+                if not preset.get("model"):
+                    raise ValueError(f"Preset '{name}' in {self.path} has no model")
+            self._presets, self._mtime = presets, mtime
+            logger.info("Loaded %d prompt presets from %s", len(presets), self.path)
+    
+    def get(self, name: str) -> Dict[str, Any]:
+        """Get a preset by name."""
+        self._load()
+        if name not in self._presets:
+            raise PresetNotFoundError(f"Preset '{name}' does not exist")
+        return self._presets[name]
+    
+    def to_list(self) -> List[dict]:
+        """Serialize presets for /v1/presets."""
+        self._load()
+        return [
+            {
+                "id": f"{PRESET_PREFIX}{name}",
+                "description": preset.get("description", ""),
+                "model": preset["model"],
+                "parameters": {k: preset[k] for k in PRESET_PARAMETERS if k in preset},
+                "turns": len(preset.get("messages", [])),
+            }
+            for name, preset in sorted(self._presets.items())
+        ]
+    
+    def expand(self, request: ChatCompletionRequest):
+        """Expand a `preset:<name>` model into its model, prompt turns and parameters."""
+        if not request.model.startswith(PRESET_PREFIX):
+            return
+        preset = self.get(request.model[len(PRESET_PREFIX):])
+        
+        prefix = []
+        if preset.get("system_prompt"):
+            prefix.append(Message(role="system", content=preset["system_prompt"]))
+        prefix.extend(Message(**m) for m in preset.get("messages", []))
+        
+        request.model = preset["model"]
+        request.messages = prefix + list(request.messages)
+        
+        # Parameters the client set explicitly win over the preset
+        for key in PRESET_PARAMETERS:
+            if key in preset and key not in request.model_fields_set:
+                setattr(request, key, preset[key])
+
+
+# Global preset store instance
+preset_store = PresetStore(settings.presets_file)
@@ -0,0 +1,60 @@
+"""Token estimation and configurable per-model pricing."""
+import re
+import json
+from fnmatch import fnmatch
+from typing import Dict, List, Optional
+from .config import settings
+from .models import Message
+
+
+def _parse_pricing(raw: str) -> Dict[str, Dict[str, float]]:
+    """Parse pricing from a JSON object of {model pattern: {input, output}} per 1K tokens."""
+    if not raw.strip():
+        return {}
+    try:
+        table = json.loads(raw)
+        return {
+            str(pattern): {"input": float(p.get("input", 0)), "output": float(p.get("output", 0))}
+            for pattern, p in table.items()
+        }
+    except (ValueError, TypeError, AttributeError) as e:
+        raise ValueError(f"Invalid MODEL_PRICING: {e}") from e
+
+
+model_pricing = _parse_pricing(settings.model_pricing)
+
+
+# Hangul, CJK ideographs, kana, CJK punctuation and fullwidth forms: roughly one token per character
+CJK_PATTERN = re.compile(
+    "[\u1100-\u11ff\u2e80-\u9fff\ua960-\ua97f\uac00-\ud7ff\uf900-\ufaff\ufe30-\ufe4f\uff00-\uffef"
+    "\U00020000-\U0002fa1f]"
+)
+
+
+def estimate_tokens(text: str) -> int:
+    """Roughly estimate the token count of a text: one per CJK character, about 4 characters per token otherwise."""
+    cjk = len(CJK_PATTERN.findall(text))
+    return cjk + (len(text) - cjk + 3) // 4
+
+
+def estimate_prompt_tokens(messages: List[Message]) -> int:
+    """Estimate the token count of a prompt."""
+    return sum(estimate_tokens(msg.get_text_content()) for msg in messages)
+
+
+def get_pricing(model: str) -> Optional[Dict[str, float]]:
+    """Get the price per 1K tokens for a model, or None when not configured."""
+    if model in model_pricing:
+        return model_pricing[model]
+    for pattern, price in model_pricing.items():
+        if fnmatch(model, pattern):
+            return price
+    return None
+
+
+def estimate_cost(model: str, prompt_tokens: int, completion_tokens: int) -> Optional[float]:
+    """Estimate the cost of a request in the pricing table's currency."""
+    price = get_pricing(model)
+    if price is None:
+        return None
+    return (prompt_tokens * price["input"] + completion_tokens * price["output"]) / 1000
@@ -0,0 +1,113 @@
+"""Bounded, secret-scrubbed samples of bytes the protobuf encoder or stream parser choked on."""
+import os
+import json
+import time
+import uuid
+import hashlib
+import logging
+import threading
+from collections import OrderedDict
+from typing import Dict, Optional
+from .config import settings
+from .context import RequestContext
+from .metrics import metrics
+from .output_scanner import SECRET_PATTERNS
+from .registration import KEY_PATTERN
+
+logger = logging.getLogger(__name__)
+
+# encode:   the request could not be encoded
+# skipped:  the parser stepped over bytes that were not a text frame
+# unparsed: a response had data but not a single parseable frame
+FAILURE_KINDS = ("encode", "skipped", "unparsed")
+
+metrics.describe("cursor2api_protocol_failures_total", "counter", "Protobuf encode and stream parse failures, by kind")
+metrics.describe("cursor2api_quarantine_samples_total", "counter", "Failure samples written to QUARANTINE_DIR")
+
+
+def scrub(data: bytes) -> bytes:
+    """Mask configured secrets and well-known credential formats, keeping every offset in place."""
+    # latin-1 maps bytes to characters one to one, so masks never shift the bytes around them
+    text = data.decode("latin-1")
+    config = settings.get()
+    secrets = config.get_clean_tokens() + config.get_api_keys() + [config.admin_key, config.cursor_client_key]
+    for secret in filter(None, secrets):
+        text = text.replace(secret, "*" * len(secret))
+    # Registered keys are only stored hashed, so they are found by their format
+    for pattern in [KEY_PATTERN, *SECRET_PATTERNS]:
+        text = pattern.sub(lambda m: "*" * len(m.group(0)), text)
+    return text.encode("latin-1")
+
+
+class Quarantine:
+    """Counts protocol failures and keeps the newest QUARANTINE_MAX_FILES samples on disk."""
+    
+    def __init__(self):
+        self._lock = threading.Lock()
+        # Digests of the samples written, newest last, so a repeat is not written again
+        self._digests: "OrderedDict[str, None]" = OrderedDict()
+        # Kind -> when its last sample was written
+        self._written: Dict[str, float] = {}
+    
+    def _should_write(self, kind: str, digest: str, now: float) -> bool:
+        """Whether a sample is new and, for parser skips, due. Caller holds the lock."""
+        if digest in self._digests:
+            return False
+        interval = settings.quarantine_skip_interval if kind == "skipped" else 0
+        return interval <= 0 or now - self._written.get(kind, 0) >= interval
+    
+    def capture(self, kind: str, data: bytes, detail: str = "", ctx: Optional[RequestContext] = None):
+        """Record one failure and, with QUARANTINE_DIR set, write a sample of the offending bytes."""
+        metrics.inc("cursor2api_protocol_failures_total", kind=kind)
+        directory = settings.quarantine_dir
+        if not directory:
+            return
+        sample = scrub(data[:settings.quarantine_sample_bytes])
+        now = time.time()
+        digest = hashlib.sha256(kind.encode() + sample).hexdigest()
+        with self._lock:
+            if not self._should_write(kind, digest, now):
+                return
+            self._written[kind] = now
+            self._digests[digest] = None
+            while len(self._digests) > max(settings.quarantine_max_files, 1):
+                self._digests.popitem(last=False)
+        entry = {
+            "kind": kind,
+            "detail": detail,
+            "request_id": ctx.request_id if ctx else None,
+            "model": (ctx.info.model or ctx.model) if ctx else None,
+            "captured_at": now,
+            "bytes": len(data),
+            "sample_bytes": len(sample),
+            "sample_hex": sample.hex(),
+        }
+        # Millisecond timestamps first, so names sort in capture order for trimming
+        stamp = f"{time.strftime('%Y%m%d-%H%M%S', time.localtime(now))}.{int(now * 1000) % 1000:03d}"
+        name = f"{stamp}-{kind}-{uuid.uuid4().hex[:8]}.json"
+        try:
+            with self._lock:
+                os.makedirs(directory, exist_ok=True)
+                with open(os.path.join(directory, name), "w", encoding="utf-8") as f:
+                    json.dump(entry, f, indent=2)
+                self._trim(directory)
+        except OSError as e:
+            # Losing a sample must never fail the request it came from
+            logger.warning("Could not write quarantine sample: %s", e)
+            return
+        metrics.inc("cursor2api_quarantine_samples_total", kind=kind)
+        logger.warning("Quarantined %s sample (%d bytes): %s", kind, len(data), os.path.join(directory, name))
+    
+    @staticmethod
+    def _trim(directory: str):
+        """Delete the oldest samples beyond QUARANTINE_MAX_FILES. Caller holds the lock."""
+        names = sorted(n for n in os.listdir(directory) if n.endswith(".json"))
+        for name in names[:max(len(names) - settings.quarantine_max_files, 0)]:
+            try:
+                os.remove(os.path.join(directory, name))
+            except OSError:
+                pass
+
+
+# Global quarantine instance
+quarantine = Quarantine()
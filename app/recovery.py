@@ -0,0 +1,62 @@
+"""Recovery from unhandled exceptions, with optional Sentry reporting."""
+import uuid
+import logging
+from fastapi import Request
+from fastapi.responses import JSONResponse
+from .config import settings
+
+logger = logging.getLogger(__name__)
+
+_sentry = None
+
+
+def init_sentry():
+    """Initialize Sentry when SENTRY_DSN is configured."""
+    global _sentry
+    if not settings.sentry_dsn:
+        return
+    try:
+        import sentry_sdk
+    except ImportError:
+        logger.warning("SENTRY_DSN is set but sentry-sdk is not installed (pip install sentry-sdk)")
+        return
+    sentry_sdk.init(dsn=settings.sentry_dsn, environment=settings.sentry_environment or settings.profile or None)
+    _sentry = sentry_sdk
+
+
+def request_id_of(request: Request) -> str:
+    """Get the request ID assigned by the handler, or a new one."""
+    return getattr(request.state, "request_id", None) or uuid.uuid4().hex
+
+
+def report_exception(exc: BaseException, request_id: str, where: str):
+    """Log an unexpected exception with its stack trace and send it to Sentry."""
+    logger.error("[%s] Unhandled error in %s: %s", request_id, where, exc, exc_info=exc)
+    if _sentry:
+        with _sentry.push_scope() as scope:
+            scope.set_tag("request_id", request_id)
+            scope.set_tag("where", where)
+            _sentry.capture_exception(exc)
+
+
+def error_body(message: str, request_id: str) -> dict:
+    """Build an OpenAI-style internal error body."""
+    return {
+        "error": {
+            "message": f"{message} (request ID: {request_id})",
+            "type": "api_error",
+            "param": None,
+            "code": "internal_error",
+        }
+    }
+
+
+async def unhandled_exception_handler(request: Request, exc: Exception) -> JSONResponse:
+    """Convert an exception that escaped a handler into a 500 OpenAI error."""
+    request_id = request_id_of(request)
+    report_exception(exc, request_id, f"{request.method} {request.url.path}")
+    return JSONResponse(
+        status_code=500,
+        content=error_body("Internal server error", request_id),
+        headers={"X-Request-ID": request_id},
+    )
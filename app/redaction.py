@@ -0,0 +1,64 @@
+"""Regex-based redaction of outgoing prompt content."""
+import re
+import json
+import logging
+from typing import Dict, List, Tuple
+from .config import settings
+
+logger = logging.getLogger(__name__)
+
+
+class RedactionRule:
+    """A single regex -> replacement rule."""
+    
+    def __init__(self, pattern: str, replacement: str = "[REDACTED]", name: str = ""):
+        self.pattern = re.compile(pattern)
+        self.replacement = replacement
+        self.name = name or pattern
+
+
+class Redactor:
+    """Applies configured redaction rules to prompt text."""
+    
+    def __init__(self, rules_json: str):
+        self.rules = self._parse_rules(rules_json)
+    
+    @staticmethod
+    def _parse_rules(rules_json: str) -> List[RedactionRule]:
+        """Parse rules from a JSON array of {pattern, replacement, name} objects."""
+        if not rules_json.strip():
+            return []
+        
+        # Fail loudly: silently skipping redaction would violate the data-handling policy
+        try:
+            items = json.loads(rules_json)
+            return [
+                RedactionRule(item["pattern"], item.get("replacement", "[REDACTED]"), item.get("name", ""))
+                for item in items
+            ]
+        except (ValueError, KeyError, TypeError, re.error) as e:
+            raise ValueError(f"Invalid REDACTION_RULES: {e}") from e
+    
+    def redact(self, text: str) -> Tuple[str, Dict[str, int]]:
+        """Redact text, returning the result and match counts per rule."""
+        hits = {}
+        for rule in self.rules:
+            text, count = rule.pattern.subn(rule.replacement, text)
+            if count:
+                hits[rule.name] = hits.get(rule.name, 0) + count
+        return text, hits
+    
+    def redact_prompt(self, text: str, role: str) -> str:
+        """Redact a prompt message and write an audit note when rules fired."""
+        if not self.rules or not text:
+            return text
+        text, hits = self.redact(text)
+        if hits:
+            # Audit note records which rules fired, never the matched content
+            logger.warning("Redaction applied to %s message: %s", role,
+                           ", ".join(f"{name} x{count}" for name, count in hits.items()))
+        return text
+
+
+# Global redactor instance
+redactor = Redactor(settings.redaction_rules)
@@ -0,0 +1,244 @@
+"""Self-service API keys: admins issue invitation codes, users redeem them at /register."""
+import os
+import re
+import json
+import time
+import hashlib
+import secrets
+import threading
+from fnmatch import fnmatch
+from typing import Dict, List, Optional
+from .config import settings
+from .token_pool import display_key
+from .metrics import metrics
+
+# Registered keys are told apart from configured ones at a glance
+KEY_PREFIX = "sk-c2a-"
+INVITE_PREFIX = "inv-"
+# Only hashes are stored, so this is how logs and samples recognize a registered key
+KEY_PATTERN = re.compile(re.escape(KEY_PREFIX) + r"[A-Za-z0-9_-]{32}")
+# Usage counters are written at most this often; a clean shutdown writes the rest
+SAVE_INTERVAL = 10
+
+metrics.describe("cursor2api_registrations_total", "counter", "Invitation code redemptions, by result")
+
+
+class RegistrationError(Exception):
+    """Raised for an invitation code that cannot be redeemed."""
+    
+    def __init__(self, message: str = "Invalid or expired invitation code", status: int = 403,
+                 code: str = "invalid_invitation"):
+        self.status = status
+        self.code = code
+        super().__init__(message)
+
+
+class KeyQuotaExceededError(Exception):
+    """Raised when a registered key has used up the requests or tokens of its invitation."""
+    
+    def __init__(self, limit: str, used: int, quota: int):
+        self.limit = limit
+        super().__init__(f"This API key has used {used} of its {quota} {limit}; ask for a new invitation code")
+
+
+def hash_key(key: str) -> str:
+    """The form a registered key is stored and looked up in."""
+    return hashlib.sha256(key.encode()).hexdigest()
+
+
+class Registry:
+    """Invitation codes and the keys redeemed with them, saved to REGISTRATION_FILE."""
+    
+    def __init__(self, path: str):
+        self.path = path
+        self.invitations: Dict[str, dict] = {}
+        # SHA-256 of each issued key -> its entry; the key itself is only shown once, at redemption
+        self.keys: Dict[str, dict] = {}
+        self._lock = threading.Lock()
+        self._dirty = False
+        self._last_save = 0.0
+        self._load()
+    
+    def _load(self):
+        """Restore invitations and issued keys, hashing any saved before keys were stored hashed."""
+        if not self.path or not os.path.exists(self.path):
+            return
+        with open(self.path, encoding="utf-8") as f:
+            data = json.load(f)
+        self.invitations = data.get("invitations") or {}
+        migrated = False
+        for key, entry in (data.get("keys") or {}).items():
+            if key.startswith(KEY_PREFIX):
+                key, entry, migrated = hash_key(key), {"key": display_key(key), **entry}, True
+            self.keys[key] = entry
+        if migrated:
+            with self._lock:
+                self._save()
+    
+    def _save(self):
+        """Persist invitations and keys so they survive a restart. Caller holds the lock."""
+        self._dirty = False
+        self._last_save = time.monotonic()
+        if not self.path:
+            return
+        os.makedirs(os.path.dirname(self.path) or ".", exist_ok=True)
+        tmp = f"{self.path}.tmp"
+        with open(tmp, "w", encoding="utf-8") as f:
+            json.dump({"invitations": self.invitations, "keys": self.keys}, f, indent=2)
+        os.replace(tmp, self.path)
+    
+    def flush(self):
+        """Write usage counted since the last save."""
+        with self._lock:
+            if self._dirty:
+                self._save()
+    
+    def _entry(self, key: str) -> Optional[dict]:
+        """The entry of a registered key that is still valid."""
+        if not settings.registration or not key.startswith(KEY_PREFIX):
+            return None
+        return self.keys.get(hash_key(key))
+    
+    def is_key(self, key: str) -> bool:
+        """Whether a key was issued through registration and not revoked."""
+        return self._entry(key) is not None
+    
+    def stream_limit(self, key: str) -> Optional[int]:
+        """The concurrent stream limit of a registered key's invitation, None for other keys."""
+        entry = self._entry(key)
+        return entry.get("stream_limit") if entry else None
+    
+    def allows_model(self, key: Optional[str], model: str) -> bool:
+        """Whether a registered key's invitation lets it use a model; other keys are not restricted here."""
+        entry = self._entry(key) if key else None
+        patterns = entry.get("models") if entry else None
+        return not patterns or any(model == p or fnmatch(model, p) for p in patterns)
+    
+    def check_quota(self, key: str):
+        """Raise KeyQuotaExceededError if a registered key has no requests or tokens left."""
+        entry = self._entry(key)
+        if not entry:
+            return
+        for limit in ("requests", "tokens"):
+            quota, used = entry.get(f"max_{limit}"), entry.get(limit, 0)
+            if quota and used >= quota:
+                raise KeyQuotaExceededError(limit, used, quota)
+    
+    def record_usage(self, key: str, tokens: int):
+        """Count a finished request and its estimated tokens against a registered key's quota."""
+        if not key.startswith(KEY_PREFIX):
+            return
+        with self._lock:
+            entry = self.keys.get(hash_key(key))
+            if entry is None:
+                return
+            entry["requests"] = entry.get("requests", 0) + 1
+            entry["tokens"] = entry.get("tokens", 0) + tokens
+            self._dirty = True
+            if time.monotonic() - self._last_save >= SAVE_INTERVAL:
+                self._save()
+    
+    def create_invitation(
+        self,
+        max_uses: int = 1,
+        ttl: Optional[int] = None,
+        models: Optional[List[str]] = None,
+        stream_limit: Optional[int] = None,
+        max_requests: Optional[int] = None,
+        max_tokens: Optional[int] = None,
+        note: str = ""
+    ) -> dict:
+        """Generate an invitation code carrying the quotas of the keys it will issue."""
+        if max_uses < 1:
+            raise ValueError("max_uses must be at least 1")
+        ttl = settings.registration_invite_ttl if ttl is None else ttl
+        now = time.time()
+        code = f"{INVITE_PREFIX}{secrets.token_urlsafe(16)}"
+        invitation = {
+            "created": int(now),
+            # 0 = the code never expires
+            "expires_at": int(now + ttl) if ttl > 0 else 0,
+            "max_uses": max_uses,
+            "uses": 0,
+            "models": [m for m in models or [] if m],
+            "stream_limit": stream_limit,
+            # None = unlimited
+            "max_requests": max_requests,
+            "max_tokens": max_tokens,
+            "note": note,
+        }
+        with self._lock:
+            self.invitations[code] = invitation
+            self._save()
+        return {"code": code, **invitation}
+    
+    def revoke_invitation(self, code: str) -> bool:
+        """Delete an invitation; keys already redeemed with it keep working."""
+        with self._lock:
+            if self.invitations.pop(code, None) is None:
+                return False
+            self._save()
+        return True
+    
+    def redeem(self, code: str, name: str = "") -> dict:
+        """Issue a new API key for a valid invitation code."""
+        with self._lock:
+            invitation = self.invitations.get(code)
+            expired = invitation and invitation["expires_at"] and invitation["expires_at"] < time.time()
+            # Unknown, expired and used-up codes get the same answer, so codes cannot be probed
+            if not invitation or expired or invitation["uses"] >= invitation["max_uses"]:
+                metrics.inc("cursor2api_registrations_total", result="rejected")
+                raise RegistrationError()
+            key = f"{KEY_PREFIX}{secrets.token_urlsafe(24)}"
+            entry = {
+                # Only the masked key is kept, so revocation goes by this ID
+                "id": f"key_{secrets.token_hex(6)}",
+                "key": display_key(key),
+                "name": name,
+                "invitation": code,
+                "note": invitation["note"],
+                "created": int(time.time()),
+                "models": invitation["models"],
+                "stream_limit": invitation["stream_limit"],
+                "max_requests": invitation.get("max_requests"),
+                "max_tokens": invitation.get("max_tokens"),
+                "requests": 0,
+                "tokens": 0,
+            }
+            invitation["uses"] += 1
+            self.keys[hash_key(key)] = entry
+            self._save()
+        metrics.inc("cursor2api_registrations_total", result="issued")
+        hidden = ("key", "invitation", "note", "requests", "tokens")
+        return {"api_key": key, **{k: v for k, v in entry.items() if k not in hidden}}
+    
+    def revoke_key(self, key_id: str) -> bool:
+        """Disable a registered key, given by its ID or the key itself."""
+        hashed = hash_key(key_id) if key_id.startswith(KEY_PREFIX) else ""
+        with self._lock:
+            digest = next((h for h, entry in self.keys.items() if h == hashed or entry.get("id") == key_id), None)
+            if digest is None:
+                return False
+            del self.keys[digest]
+            self._save()
+        return True
+    
+    def to_dict(self) -> dict:
+        """Invitations and issued keys for the admin API, with keys masked."""
+        now = time.time()
+        return {
+            "enabled": settings.registration,
+            "invitations": [
+                {
+                    "code": code,
+                    **invitation,
+                    "expired": bool(invitation["expires_at"] and invitation["expires_at"] < now),
+                }
+                for code, invitation in self.invitations.items()
+            ],
+            "keys": list(self.keys.values()),
+        }
+
+
+# Global registry instance
+registry = Registry(settings.registration_file)
@@ -0,0 +1,80 @@
+"""Per-request toggles sent as `extra_body.cursor2api`."""
+import json
+from typing import Any, Dict, List
+from .config import settings
+
+# Flag name -> expected type
+FLAGS = {
+    "truncation": bool,   # false: send the conversation without MAX_INPUT_LENGTH truncation
+    "ghost_mode": bool,   # override CURSOR_GHOST_MODE for this request
+    "token_tag": str,     # only use pool tokens carrying this tag
+    "raw": bool,          # skip system prompt injection, truncation and the system role strategy
+}
+
+
+class RequestFlagError(ValueError):
+    """Raised for a malformed cursor2api object."""
+    
+    def __init__(self, message: str, param: str = "cursor2api"):
+        self.param = param
+        super().__init__(message)
+
+
+class FlagNotPermittedError(Exception):
+    """Raised when the API key may not use a flag."""
+    
+    def __init__(self, flag: str):
+        self.param = f"cursor2api.{flag}"
+        super().__init__(f"This API key is not permitted to set cursor2api.{flag}")
+
+
+def _parse_permissions(raw: str) -> Dict[str, List[str]]:
+    """Parse a JSON object of {api_key: [flag, ...]}, where "*" as a key or flag means any."""
+    if not raw.strip():
+        return {}
+    try:
+        data = json.loads(raw)
+        permissions = {str(k): [str(f) for f in v] for k, v in data.items()}
+    except (ValueError, TypeError, AttributeError) as e:
+        raise ValueError(f"Invalid REQUEST_FLAG_PERMISSIONS: {e}") from e
+    for flags in permissions.values():
+        unknown = [f for f in flags if f != "*" and f not in FLAGS]
+        if unknown:
+            raise ValueError(f"Invalid REQUEST_FLAG_PERMISSIONS: unknown flag {unknown[0]}")
+    return permissions
+
+
+class RequestFlags:
+    """Validates cursor2api objects against what each API key may toggle."""
+    
+    def __init__(self):
+        self.permissions = _parse_permissions(settings.request_flag_permissions)
+    
+    def allowed(self, api_key: str) -> List[str]:
+        """Flags a key may set; keys without an entry fall back to "*"."""
+        flags = self.permissions.get(api_key, self.permissions.get("*", []))
+        return list(FLAGS) if "*" in flags else flags
+    
+    def parse(self, api_key: str, data: Any) -> Dict[str, Any]:
+        """Validate a cursor2api object, raising RequestFlagError or FlagNotPermittedError."""
+        if not isinstance(data, dict):
+            raise RequestFlagError("cursor2api must be an object")
+        
+        allowed = self.allowed(api_key)
+        flags = {}
+        for name, value in data.items():
+            expected = FLAGS.get(name)
+            if expected is None:
+                raise RequestFlagError(f"Unknown cursor2api flag: {name}", f"cursor2api.{name}")
+            if not isinstance(value, expected):
+                raise RequestFlagError(
+                    f"cursor2api.{name} must be a {expected.__name__}", f"cursor2api.{name}"
+                )
+            if name not in allowed:
+                raise FlagNotPermittedError(name)
+            flags[name] = value
+        return flags
+
+
+# Global request flags instance
+request_flags = RequestFlags()
@@ -0,0 +1,73 @@
+"""Request IDs: accepted or generated per call, echoed back, logged and derived for upstream."""
+import re
+import uuid
+import logging
+from starlette.datastructures import MutableHeaders
+from .config import settings
+from .log_stream import current_request_id
+
+REQUEST_ID_HEADER = "X-Request-ID"
+INSTANCE_HEADER = "X-Instance-Name"
+
+# Client IDs end up in logs and upstream headers, so anything unusual is replaced
+REQUEST_ID_PATTERN = re.compile(r"[A-Za-z0-9._:-]{1,128}")
+
+# INSTANCE_NAME goes into headers and log lines, so it is held to the same character set
+if settings.instance_name and not REQUEST_ID_PATTERN.fullmatch(settings.instance_name):
+    raise ValueError(f"Invalid INSTANCE_NAME: {settings.instance_name} (use 1-128 letters, digits or ._:-)")
+
+# Namespace for the upstream IDs derived from a request ID
+UPSTREAM_NAMESPACE = uuid.UUID("5b0c6f3e-9c1d-4d8a-8f43-2a7e1c9b6d10")
+
+
+def accept_request_id(value: str) -> str:
+    """Use the client's request ID when it is well-formed, otherwise generate one."""
+    if value and REQUEST_ID_PATTERN.fullmatch(value):
+        return value
+    return uuid.uuid4().hex
+
+
+def upstream_request_id(request_id: str, attempt: int) -> str:
+    """The x-request-id sent upstream: a UUID derived from the request ID and attempt number."""
+    # Stable, so an upstream ID found in Cursor's errors maps back to our request ID
+    return str(uuid.uuid5(UPSTREAM_NAMESPACE, f"{request_id}/{attempt}"))
+
+
+class RequestIdMiddleware:
+    """Assigns every HTTP call a request ID and returns it in X-Request-ID, with X-Instance-Name."""
+    
+    def __init__(self, app):
+        self.app = app
+    
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+        
+        incoming = dict(scope["headers"]).get(REQUEST_ID_HEADER.lower().encode(), b"").decode("latin-1")
+        request_id = accept_request_id(incoming.strip())
+        # request.state reads from the scope, so handlers and the exception handler see the same ID
+        scope.setdefault("state", {})["request_id"] = request_id
+        token = current_request_id.set(request_id)
+        
+        async def send_with_id(message):
+            if message["type"] == "http.response.start":
+                headers = MutableHeaders(scope=message)
+                headers[REQUEST_ID_HEADER] = request_id
+                if settings.instance_name:
+                    headers[INSTANCE_HEADER] = settings.instance_name
+            await send(message)
+        
+        try:
+            await self.app(scope, receive, send_with_id)
+        finally:
+            current_request_id.reset(token)
+
+
+class RequestIdFormatter(logging.Formatter):
+    """Log formatter that adds the current request ID, or "-" outside a request, and INSTANCE_NAME."""
+    
+    def format(self, record: logging.LogRecord) -> str:
+        record.request_id_label = getattr(record, "request_id", None) or current_request_id.get() or "-"
+        record.instance_label = f"{settings.instance_name} " if settings.instance_name else ""
+        return super().format(record)
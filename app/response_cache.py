@@ -0,0 +1,123 @@
+"""In-memory cache of completed responses for repeated identical requests."""
+import json
+import time
+import hashlib
+import threading
+from collections import OrderedDict
+from typing import Dict, List, Optional
+from .config import settings
+from .context import RequestContext
+from .metrics import metrics
+
+metrics.describe("cursor2api_response_cache_total", "counter", "Response cache lookups by result (hit, miss, bypass)")
+
+# Parameters that change how a response is delivered, not what it says
+DELIVERY_FIELDS = {"stream", "stream_options", "user", "metadata"}
+
+
+class CacheEntry:
+    """A cached completion text."""
+    
+    def __init__(self, text: str, model: str):
+        self.text = text
+        self.model = model
+        self.created = time.time()
+        self.hits = 0
+    
+    def expired(self) -> bool:
+        """Check whether the entry is past RESPONSE_CACHE_TTL."""
+        return settings.response_cache_ttl > 0 and time.time() - self.created > settings.response_cache_ttl
+
+
+class ResponseCache:
+    """LRU of completion texts keyed by a hash of the caller and request."""
+    
+    def __init__(self):
+        self._entries: "OrderedDict[str, CacheEntry]" = OrderedDict()
+        self._lock = threading.Lock()
+    
+    @property
+    def enabled(self) -> bool:
+        return settings.response_cache
+    
+    @staticmethod
+    def key_for(api_key: str, request) -> str:
+        """Hash the caller and every request field that affects the output."""
+        body = request.model_dump(exclude=DELIVERY_FIELDS)
+        # Scoped per key so one tenant never sees another's cached answer
+        raw = json.dumps({"key": api_key, "request": body}, sort_keys=True, ensure_ascii=False, default=str)
+        return hashlib.sha256(raw.encode()).hexdigest()
+    
+    def lookup(self, ctx: RequestContext, request, cache_control: str = "") -> Optional[str]:
+        """Return the cached text for a request, remembering on ctx whether to store the result."""
+        if not self.enabled:
+            return None
+        directives = {d.strip().lower() for d in cache_control.split(",")}
+        key = self.key_for(ctx.api_key, request)
+        if "no-store" not in directives:
+            ctx.overrides["cache_key"] = key
+        
+        # no-cache asks for a fresh answer, which then replaces the cached one
+        if "no-cache" in directives or "no-store" in directives:
+            metrics.inc("cursor2api_response_cache_total", result="bypass")
+            ctx.overrides["cache"] = "MISS"
+            return None
+        
+        with self._lock:
+            entry = self._entries.get(key)
+            if entry and entry.expired():
+                del self._entries[key]
+                entry = None
+            if entry:
+                self._entries.move_to_end(key)
+                entry.hits += 1
+        
+        result = "hit" if entry else "miss"
+        metrics.inc("cursor2api_response_cache_total", result=result)
+        ctx.overrides["cache"] = result.upper()
+        return entry.text if entry else None
+    
+    def store(self, ctx: RequestContext, text: str):
+        """Cache a completed response if lookup() allowed it."""
+        key = ctx.overrides.get("cache_key")
+        if not key or ctx.overrides.get("cache") == "HIT":
+            return
+        with self._lock:
+            self._entries[key] = CacheEntry(text, ctx.info.model or ctx.model)
+            self._entries.move_to_end(key)
+            while len(self._entries) > max(settings.response_cache_size, 1):
+                self._entries.popitem(last=False)
+    
+    @staticmethod
+    def headers(ctx: RequestContext) -> Dict[str, str]:
+        """X-Cache header for a request that went through the cache."""
+        status = ctx.overrides.get("cache")
+        return {"X-Cache": status} if status else {}
+    
+    def purge(self, key: Optional[str] = None) -> int:
+        """Remove one entry by key hash, or everything; returns how many were removed."""
+        with self._lock:
+            if key is None:
+                count = len(self._entries)
+                self._entries.clear()
+                return count
+            return 1 if self._entries.pop(key, None) else 0
+    
+    def to_list(self) -> List[dict]:
+        """Describe cached entries for the admin API, most recently used last."""
+        now = time.time()
+        with self._lock:
+            return [
+                {
+                    "key": key,
+                    "model": entry.model,
+                    "chars": len(entry.text),
+                    "age": round(now - entry.created),
+                    "hits": entry.hits,
+                }
+                for key, entry in self._entries.items()
+            ]
+
+
+# Global response cache instance
+response_cache = ResponseCache()
@@ -0,0 +1,83 @@
+"""Response IDs grouped by conversation, and a short-lived response -> upstream trace lookup."""
+import time
+import hashlib
+import threading
+from collections import OrderedDict
+from typing import Dict, Optional
+from .config import settings
+from .context import RequestContext
+from .token_pool import display_key
+
+
+def response_id_for(ctx: RequestContext) -> str:
+    """chatcmpl- ID whose prefix is shared by the conversation's responses and whose rest is unique."""
+    # The client picks X-Request-ID and may reuse it, so the unique part comes from the server-side ID
+    conversation = hashlib.sha256(ctx.session_key.encode()).hexdigest()
+    digest = hashlib.sha256(f"{ctx.session_key}\0{ctx.request_id}\0{ctx.internal_id}".encode()).hexdigest()
+    return f"chatcmpl-{conversation[:8]}{digest[:21]}"
+
+
+class ResponseTraces:
+    """Remembers which upstream conversation and trace produced each response ID."""
+    
+    def __init__(self):
+        self._entries: "OrderedDict[str, dict]" = OrderedDict()
+        self._lock = threading.Lock()
+    
+    @staticmethod
+    def fields(ctx: RequestContext) -> Dict[str, dict]:
+        """The `upstream` extension field, once a request has been sent upstream."""
+        info = ctx.info
+        if not info.trace_id:
+            return {}
+        return {
+            "upstream": {
+                "conversation_id": info.conversation_id,
+                "trace_id": info.trace_id,
+                "request_id": info.upstream_request_id,
+            }
+        }
+    
+    def record(self, response_id: str, ctx: RequestContext, error: Optional[str] = None):
+        """Remember the upstream IDs behind a finished response."""
+        config = settings.get()
+        if config.response_trace_ttl <= 0:
+            return
+        info = ctx.info
+        entry = {
+            "response_id": response_id,
+            "request_id": ctx.request_id,
+            "key": display_key(ctx.api_key),
+            "model": info.model or ctx.model,
+            "token": info.token,
+            # None for cached responses, which never reached Cursor
+            "upstream_conversation_id": info.conversation_id,
+            "upstream_trace_id": info.trace_id,
+            "upstream_request_id": info.upstream_request_id,
+            "attempts": ctx.overrides.get("upstream_attempts", 0),
+            "error": error,
+            "recorded_at": time.time(),
+        }
+        with self._lock:
+            self._entries[response_id] = entry
+            self._entries.move_to_end(response_id)
+            self._expire(config)
+    
+    def _expire(self, config):
+        """Drop entries past RESPONSE_TRACE_TTL or over RESPONSE_TRACE_MAX_ENTRIES, oldest first."""
+        cutoff = time.time() - config.response_trace_ttl
+        while self._entries:
+            oldest = next(iter(self._entries.values()))
+            if oldest["recorded_at"] >= cutoff and len(self._entries) <= config.response_trace_max_entries:
+                break
+            self._entries.popitem(last=False)
+    
+    def get(self, response_id: str) -> Optional[dict]:
+        """Look up a response ID, as reported by a user."""
+        with self._lock:
+            self._expire(settings.get())
+            return self._entries.get(response_id)
+
+
+# Global response trace instance
+response_traces = ResponseTraces()
@@ -1,10 +1,14 @@
 """API routes for OpenAI-compatible endpoints."""
+import re
 import time
-import uuid
 import json
-from typing import Optional
+import base64
+import binascii
+from contextlib import aclosing
+from typing import AsyncGenerator, Optional
 from fastapi import APIRouter, HTTPException, Header, Request
-from fastapi.responses import StreamingResponse, JSONResponse
+from fastapi.responses import StreamingResponse, JSONResponse, PlainTextResponse
+from starlette.background import BackgroundTask
 from sse_starlette.sse import EventSourceResponse
 
 from .config import settings
@@ -19,33 +23,209 @@ from .models import (
     Usage,
     ErrorResponse,
     ErrorDetail,
+    TitleRequest,
+    TitleResponse,
+    CompletionRequest,
+    TGIRequest,
+    RegisterRequest,
 )
 from .cursor_client import cursor_client
+from .context import RequestContext
+from .sessions import conversation_key
+from .token_pool import BudgetExhaustedError, TokensExpiredError, NoTaggedTokenError
+from .request_flags import request_flags, RequestFlagError, FlagNotPermittedError
+from .version import version_detector
+from .warmup import warmup
+from .drift import drift_detector
+from .transport import Utf8Assembler
+from .canary import canary
+from .metrics import metrics
+from .token_pool import token_pool
+from .titles import is_title_request, build_title_messages, clean_title
+from .best_of import best_of_completion
+from .journal import journal
+from .tracing import tracer
+from .usage import usage_store
+from .transcripts import transcript_store
+from .session_history import session_history, EXPORT_FORMATS
+from .context_uploads import context_store, attach_context, read_chunk, ContextUploadError
+from .response_cache import response_cache
+from .idempotency import idempotency_store, IdempotencyKeyError
+from .maintenance import maintenance, MaintenanceError
+from .streams import stream_registry
+from .end_users import end_user_registry, hash_user, EndUserBlockedError
+from .abuse import abuse_monitor, subjects_for, prompt_digest, ban_response, AbuseBannedError
+from .callbacks import callback_dispatcher, resolve_callback_url, InvalidCallbackError
+from .log_stream import current_request_id
+from .pricing import get_pricing, estimate_tokens, estimate_prompt_tokens
+from .limits import stream_limiter, StreamLimitExceeded
+from .capacity import capacity_report
+from .response_ids import response_id_for, response_traces
+from .errors import classify, error_payload
+from .splitting import handle_oversized_messages, OversizedMessageError
+from .compression import compress_context
+from .validation import (
+    validate_strict, validate_metadata, ignored_parameters, dropped_content_types,
+    UnsupportedParameterError, InvalidMetadataError
+)
+from .model_access import model_access, ModelBlockedError
+from .moderation import moderate, ModerationInputError
+from .registration import registry, RegistrationError, KeyQuotaExceededError
+from .client_stats import client_stats
+from .notice import notice_board
+from .embeddings import forward_embeddings, EmbeddingsUnavailableError
+from .completions import (
+    completion_to_chat, tgi_to_chat, completion_response, completion_chunk, tgi_response, tgi_stream, tgi_error
+)
+from .presets import preset_store, PresetNotFoundError
+from .experiments import experiment_router
+from .rules import rules_engine, RuleRejectedError
+from .backpressure import buffered_stream
+from .pacing import paced_stream
+from .markdown_stream import markdown_safe_stream
+from .recovery import report_exception, request_id_of
+from .workspace import Workspace
+from .signing import signature_verifier
+from .oidc import jwt_authenticator
+from .tools import tools_enabled, prepare_tool_messages, parse_tool_calls, ToolCallParser
 
 router = APIRouter()
 
+# Reported as system_fingerprint when the compat flag is enabled
+SYSTEM_FINGERPRINT = "fp_cursor2api"
+
+
+def dump_response(response) -> dict:
+    """Serialize a response model, applying compatibility flags."""
+    return response.model_dump(mode="json", exclude_none=settings.has_compat("exclude_none"))
+
+
+def extension_fields(ctx: RequestContext, final: bool = False) -> dict:
+    """Non-OpenAI response fields: the experiment variant, plus upstream IDs, metadata and warnings at the end."""
+    fields = experiment_router.fields(ctx)
+    if final:
+        # Upstream IDs are only known once the request has gone out
+        fields.update(response_traces.fields(ctx))
+        if ctx.overrides.get("metadata"):
+            fields["metadata"] = ctx.overrides["metadata"]
+        if ctx.overrides.get("warnings"):
+            fields["warnings"] = ctx.overrides["warnings"]
+    return fields
+
+
+def estimated_usage(ctx: RequestContext, completion: str) -> Usage:
+    """Estimated token counts for a response, the same ones recorded in /admin/usage."""
+    prompt_tokens = estimate_prompt_tokens(ctx.messages)
+    completion_tokens = estimate_tokens(completion)
+    return Usage(
+        prompt_tokens=prompt_tokens,
+        completion_tokens=completion_tokens,
+        total_tokens=prompt_tokens + completion_tokens
+    )
 
-def verify_api_key(authorization: Optional[str]) -> bool:
-    """Verify API key from Authorization header."""
+
+def verify_api_key(authorization: Optional[str]) -> Optional[str]:
+    """Verify API key from Authorization header, returning the matched key."""
     if not authorization:
-        return False
+        return None
     
     # Handle both "Bearer xxx" and "xxx" formats
     token = authorization
     if authorization.startswith("Bearer "):
         token = authorization[7:]
     
-    return token == settings.api_key
+    return token if token in settings.get_api_keys() or registry.is_key(token) else None
+
+
+async def authenticate(http_request: Request, authorization: Optional[str]) -> Optional[str]:
+    """Authenticate a bearer API key, HMAC-signed request or JWT, returning the caller identity."""
+    if settings.auth_mode != "jwt":
+        identity = verify_api_key(authorization) or await signature_verifier.verify(http_request)
+        if identity:
+            return identity
+    return await jwt_authenticator.verify(authorization)
+
+
+def build_context(
+    http_request: Request,
+    api_key: str,
+    model: str,
+    messages,
+    user: Optional[str] = None
+) -> RequestContext:
+    """Build the per-request context from an incoming HTTP request."""
+    ctx = RequestContext.create(
+        model,
+        messages,
+        settings.stream_max_duration,
+        api_key=api_key,
+        client_ip=http_request.client.host if http_request.client else "",
+        user_agent=http_request.headers.get("user-agent", ""),
+        session_key=conversation_key(api_key, messages, http_request.headers.get("x-session-id")),
+        session_id=http_request.headers.get("x-session-id", ""),
+        end_user=hash_user(user),
+        # Assigned by RequestIdMiddleware, from the client's X-Request-ID when it sent one
+        request_id=request_id_of(http_request),
+    )
+    # Lets the exception handler and log stream report the same ID
+    http_request.state.request_id = ctx.request_id
+    # Abuse detection counts against the authenticated caller, never a key that merely appeared in a header
+    http_request.state.abuse_subjects = subjects_for(api_key, ctx.client_ip)
+    http_request.state.upstream = ctx.info
+    current_request_id.set(ctx.request_id)
+    client_stats.record(http_request.headers, api_key)
+    return ctx
+
+
+def stream_headers() -> dict:
+    """Headers that stop reverse proxies from buffering a stream."""
+    # no-transform keeps proxies and CDNs from compressing, and therefore buffering, the body
+    headers = {
+        "Cache-Control": "no-cache, no-transform",
+        "X-Accel-Buffering": "no",
+        "Connection": "keep-alive",
+    }
+    if settings.stream_force_chunked:
+        headers["Transfer-Encoding"] = "chunked"
+    return headers
+
+
+def error_response(
+    status_code: int,
+    message: str,
+    error_type: str,
+    code: str,
+    headers: Optional[dict] = None,
+    param: Optional[str] = None
+):
+    """Build an OpenAI-style error response."""
+    error = ErrorResponse(error=ErrorDetail(message=message, type=error_type, param=param, code=code))
+    return JSONResponse(status_code=status_code, content=error.model_dump(), headers=headers)
+
+
+def exception_response(e: Exception):
+    """Error response for an exception, with the status and code from the error table."""
+    mapping = classify(e)
+    return error_response(mapping.status, str(e), mapping.type, mapping.code)
+
+
+def maintenance_response(e: MaintenanceError):
+    """503 for a request refused during a maintenance window."""
+    return error_response(
+        503, str(e), "service_unavailable", "maintenance",
+        headers={"Retry-After": str(e.retry_after)}
+    )
 
 
 @router.get("/v1/models")
-async def list_models(authorization: Optional[str] = Header(None)):
+async def list_models(http_request: Request, authorization: Optional[str] = Header(None)):
     """List available models."""
-    if not verify_api_key(authorization):
+    api_key = await authenticate(http_request, authorization)
+    if not api_key:
         raise HTTPException(status_code=401, detail="Invalid API key")
     
     models = []
-    for model_id in settings.get_models():
+    for model_id in model_access.filter(api_key, settings.get_models()):
         # Determine provider
         owned_by = "cursor"
         if "claude" in model_id.lower():
@@ -61,126 +241,954 @@ async def list_models(authorization: Optional[str] = Header(None)):
         elif "kimi" in model_id.lower():
             owned_by = "moonshot"
         
-        models.append(ModelInfo(id=model_id, owned_by=owned_by))
+        models.append(ModelInfo(id=model_id, owned_by=owned_by, pricing=get_pricing(model_id)))
     
     return ModelListResponse(data=models)
 
 
+@router.get("/v1/presets")
+async def list_presets(http_request: Request, authorization: Optional[str] = Header(None)):
+    """List prompt presets usable as `preset:<name>` models."""
+    if not await authenticate(http_request, authorization):
+        raise HTTPException(status_code=401, detail="Invalid API key")
+    
+    return {"object": "list", "data": preset_store.to_list()}
+
+
 @router.post("/v1/chat/completions")
 async def chat_completions(
     request: ChatCompletionRequest,
-    authorization: Optional[str] = Header(None)
+    http_request: Request,
+    authorization: Optional[str] = Header(None),
+    accept: Optional[str] = Header(None)
 ):
     """Create chat completion."""
-    if not verify_api_key(authorization):
+    api_key = await authenticate(http_request, authorization)
+    if not api_key:
         raise HTTPException(status_code=401, detail="Invalid API key")
     
+    # A stream cannot be replayed once part of it was delivered, so only whole responses are idempotent
+    idempotency_key = http_request.headers.get("idempotency-key")
+    if idempotency_key is not None and not request.stream and idempotency_store.enabled:
+        async def handler():
+            return await process_chat_completion(request, http_request, api_key, accept)
+        try:
+            return await idempotency_store.run(api_key, idempotency_key, request.model_dump(), handler)
+        except IdempotencyKeyError as e:
+            status = 422 if e.code == "idempotency_key_reused" else 400
+            return error_response(status, str(e), "invalid_request_error", e.code, param="Idempotency-Key")
+    return await process_chat_completion(request, http_request, api_key, accept)
+
+
+async def process_chat_completion(
+    request: ChatCompletionRequest,
+    http_request: Request,
+    api_key: str,
+    accept: Optional[str]
+):
+    """Run an authenticated chat completion request."""
     # Check if Cursor token is configured
-    if not settings.get_clean_token():
+    if not settings.get_clean_token() and not settings.dry_run:
         raise HTTPException(
             status_code=500,
             detail="CURSOR_TOKEN is not configured. Please set it in .env file."
         )
     
-    response_id = f"chatcmpl-{uuid.uuid4().hex[:29]}"
+    try:
+        await maintenance.admit(api_key)
+    except MaintenanceError as e:
+        return maintenance_response(e)
+    
+    try:
+        registry.check_quota(api_key)
+    except KeyQuotaExceededError as e:
+        return exception_response(e)
+    
+    try:
+        preset_store.expand(request)
+    except PresetNotFoundError as e:
+        return error_response(404, str(e), "invalid_request_error", "model_not_found", param="model")
+    # Policy sees the preset's model
+    try:
+        rules_engine.evaluate(request, api_key, http_request.headers)
+    except RuleRejectedError as e:
+        return error_response(e.status, str(e), "invalid_request_error", "rejected_by_rule")
+    
+    # Frontends call this constantly; send it to the cheap model
+    config = settings.get()
+    if config.title_detection and config.title_model and is_title_request(request.messages):
+        request.model = config.title_model
+    
+    # Assigned per conversation, before the access check so a variant's model is checked too
+    session_id = http_request.headers.get("x-session-id")
+    experiment = experiment_router.assign(conversation_key(api_key, request.messages, session_id), request)
+    
+    try:
+        model_access.check(api_key, request.model)
+    except ModelBlockedError as e:
+        return error_response(403, str(e), "invalid_request_error", "model_blocked", param="model")
+    
+    if settings.strict_params:
+        try:
+            validate_strict(request)
+        except UnsupportedParameterError as e:
+            return error_response(400, str(e), "invalid_request_error", "unsupported_parameter", param=e.param)
+    
+    if request.metadata:
+        try:
+            validate_metadata(request.metadata)
+        except InvalidMetadataError as e:
+            return error_response(400, str(e), "invalid_request_error", "invalid_metadata", param=e.param)
+    
+    if request.best_of and request.best_of > 1 and request.stream:
+        raise HTTPException(
+            status_code=400,
+            detail="best_of is only supported for non-streaming requests"
+        )
+    
+    if request.callback_url:
+        if request.stream:
+            return error_response(400, "callback_url cannot be combined with stream", "invalid_request_error",
+                                  "invalid_callback_url", param="callback_url")
+        try:
+            await resolve_callback_url(request.callback_url)
+        except InvalidCallbackError as e:
+            return error_response(400, str(e), "invalid_request_error", "invalid_callback_url", param="callback_url")
+    
+    # Uploaded in chunks beforehand, so the prompt does not have to fit in one request body
+    extra = request.model_extra or {}
+    context_id = extra.get("context_id") or (extra.get("extra_body") or {}).get("context_id")
+    if context_id and not settings.context_uploads:
+        return error_response(400, "Context uploads are disabled", "invalid_request_error", "invalid_context_upload",
+                              param="context_id")
+    if context_id:
+        try:
+            request.messages = attach_context(request.messages, context_store.text(str(context_id), api_key))
+        except ContextUploadError as e:
+            return error_response(e.status, str(e), "invalid_request_error", e.code, param="context_id")
+    
+    messages = request.messages
+    if tools_enabled(request.tools, request.tool_choice):
+        messages = prepare_tool_messages(messages, request.tools, request.tool_choice)
+    
+    ctx = build_context(http_request, api_key, request.model, messages, request.user)
+    # Completions and TGI come through run_as_chat, and structured output is parsed, so neither gets the notice
+    ctx.overrides["notice"] = (
+        http_request.url.path == "/v1/chat/completions" and not (request.model_extra or {}).get("response_format")
+    )
+    if experiment:
+        ctx.overrides["experiment"] = experiment
+    # Labels for billing: stored with usage and echoed back on the response
+    if request.metadata:
+        ctx.overrides["metadata"] = request.metadata
+    # Outside strict mode these are dropped quietly; warnings tell the client
+    ignored = [] if config.strict_params else ignored_parameters(request)
+    if ignored:
+        ctx.warn("parameters_ignored", f"Not supported by this backend and ignored: {', '.join(ignored)}")
+    dropped = dropped_content_types(request)
+    if dropped:
+        ctx.warn("content_dropped", f"Only text is sent upstream; dropped {', '.join(dropped)} content parts")
+    try:
+        end_user_registry.check(ctx.end_user)
+    except EndUserBlockedError as e:
+        return error_response(403, str(e), "invalid_request_error", "user_blocked", param="user")
+    end_user_registry.record(ctx.end_user, api_key)
+    try:
+        length = http_request.headers.get("content-length", "")
+        if length.isdigit():
+            abuse_monitor.record_size(http_request.state.abuse_subjects, int(length))
+        abuse_monitor.record_prompt(http_request.state.abuse_subjects, prompt_digest(ctx))
+    except AbuseBannedError as e:
+        return ban_response(e)
+    
+    # Sent via extra_body, which OpenAI SDKs merge into the top-level body
+    extra_body = (request.model_extra or {}).get("extra_body") or {}
+    workspace = request.workspace or (extra_body.get("workspace") if isinstance(extra_body, dict) else None)
+    if workspace:
+        try:
+            ctx.overrides["workspace"] = Workspace.parse(workspace)
+        except ValueError as e:
+            return error_response(400, f"Invalid workspace: {e}", "invalid_request_error",
+                                  "invalid_workspace", param="workspace")
+    
+    # Per-request toggles for advanced clients, limited by REQUEST_FLAG_PERMISSIONS
+    raw_flags = (request.model_extra or {}).get("cursor2api")
+    if raw_flags is None and isinstance(extra_body, dict):
+        raw_flags = extra_body.get("cursor2api")
+    # X-Ghost-Mode is the same override as cursor2api.ghost_mode, for clients that cannot change the body
+    ghost_header = http_request.headers.get("x-ghost-mode")
+    if ghost_header is not None:
+        ghost_header = ghost_header.strip().lower()
+        if ghost_header not in ("true", "false"):
+            return error_response(400, "X-Ghost-Mode must be true or false", "invalid_request_error",
+                                  "invalid_request_flag", param="X-Ghost-Mode")
+        if raw_flags is None or isinstance(raw_flags, dict):
+            raw_flags = {**(raw_flags or {}), "ghost_mode": ghost_header == "true"}
+    if raw_flags is not None:
+        try:
+            flags = request_flags.parse(api_key, raw_flags)
+        except RequestFlagError as e:
+            return error_response(400, str(e), "invalid_request_error", "invalid_request_flag", param=e.param)
+        except FlagNotPermittedError as e:
+            return error_response(403, str(e), "invalid_request_error", "flag_not_permitted", param=e.param)
+        tag = flags.get("token_tag")
+        if tag and not token_pool.has_tag(tag):
+            return error_response(400, f"No Cursor token is tagged {tag}", "invalid_request_error",
+                                  "invalid_request_flag", param="cursor2api.token_tag")
+        ctx.overrides["flags"] = flags
+    
+    # Raw passthrough sends the conversation exactly as the client built it
+    if not ctx.overrides.get("flags", {}).get("raw"):
+        compress_context(ctx)
+    
+    try:
+        await handle_oversized_messages(ctx)
+    except OversizedMessageError as e:
+        return error_response(400, str(e), "invalid_request_error", "context_length_exceeded")
+    except StreamLimitExceeded as e:
+        return stream_limit_response(e)
+    except Exception as e:
+        raise HTTPException(status_code=502, detail=f"Failed to summarize oversized message: {e}")
+    
+    # A hit is replayed instead of sent upstream, but still counts against the key's limits
+    cached = response_cache.lookup(ctx, request, http_request.headers.get("cache-control", ""))
+    if cached is not None:
+        ctx.overrides["cached_response"] = cached
+    
+    queued = False
+    try:
+        stream_limiter.acquire(api_key, ctx.end_user)
+    except StreamLimitExceeded as e:
+        if settings.key_stream_queue_timeout <= 0:
+            return stream_limit_response(e)
+        queued = True
+    
+    response_id = response_id_for(ctx)
     created = int(time.time())
     
+    if request.callback_url:
+        async def deferred():
+            if queued:
+                try:
+                    async for _ in wait_for_slot(ctx):
+                        pass
+                except StreamLimitExceeded as e:
+                    return stream_limit_response(e)
+            try:
+                return await non_stream_chat_completion(request, ctx, response_id, created)
+            finally:
+                stream_limiter.release(api_key, ctx.end_user)
+        
+        # best_of candidates would interleave in one progress stream
+        progress = bool(request.callback_progress) and not (request.best_of and request.best_of > 1)
+        return callback_dispatcher.submit(ctx, response_id, request.callback_url, progress, deferred)
+    
     if request.stream:
-        return await stream_chat_completion(request, response_id, created)
-    else:
-        return await non_stream_chat_completion(request, response_id, created)
+        if queued:
+            return await queued_stream_chat_completion(request, ctx, response_id, created, accept)
+        # The slot is released when the stream generator finishes
+        return await stream_chat_completion(request, ctx, response_id, created, accept)
+    if queued:
+        try:
+            async for _ in wait_for_slot(ctx):
+                pass
+        except StreamLimitExceeded as e:
+            return stream_limit_response(e)
+    try:
+        return await non_stream_chat_completion(request, ctx, response_id, created)
+    finally:
+        stream_limiter.release(api_key, ctx.end_user)
+
+
+async def replay(text: str) -> AsyncGenerator[str, None]:
+    """Stream a cached response as a single delta."""
+    yield text
+
+
+def stream_limit_response(e: StreamLimitExceeded):
+    """429 for a key at its concurrent stream limit, with an estimate of when to retry."""
+    return error_response(
+        429, str(e), "requests", "rate_limit_exceeded",
+        headers={
+            "Retry-After": str(e.retry_after),
+            "X-RateLimit-Limit-Streams": str(e.limit),
+            "X-RateLimit-Current-Streams": str(e.current),
+        }
+    )
+
+
+async def wait_for_slot(ctx: RequestContext) -> AsyncGenerator[int, None]:
+    """Wait in the key's queue for a stream slot, yielding the queue position as it changes."""
+    started = time.monotonic()
+    try:
+        async with aclosing(stream_limiter.wait(ctx.api_key, ctx.end_user,
+                                                settings.key_stream_queue_timeout)) as waiting:
+            async for position in waiting:
+                yield position
+    finally:
+        ctx.info.queue_wait = time.monotonic() - started
+
+
+async def queued_stream_chat_completion(
+    request: ChatCompletionRequest,
+    ctx: RequestContext,
+    response_id: str,
+    created: int,
+    accept: Optional[str] = None
+):
+    """Handle a streaming request that has to wait for a slot first."""
+    # NDJSON has no comment lines, so those clients wait silently for the response
+    if accept and "application/x-ndjson" in accept:
+        try:
+            async for _ in wait_for_slot(ctx):
+                pass
+        except StreamLimitExceeded as e:
+            return stream_limit_response(e)
+        return await stream_chat_completion(request, ctx, response_id, created, accept)
+    
+    async def generate_sse():
+        # Headers go out right away; comments show the client it is queued rather than hung
+        try:
+            async with aclosing(wait_for_slot(ctx)) as waiting:
+                async for position in waiting:
+                    yield {"comment": f"queued position={position}"}
+        except StreamLimitExceeded as e:
+            yield {"data": json.dumps({"error": {
+                "message": str(e),
+                "type": "requests",
+                "code": "rate_limit_exceeded",
+                "retry_after": e.retry_after,
+            }})}
+            return
+        
+        response = await stream_chat_completion(request, ctx, response_id, created, accept)
+        try:
+            async with aclosing(response.body_iterator) as events:
+                async for event in events:
+                    yield event
+        finally:
+            # The inner response's background task never runs here
+            release_stream(ctx)
+    
+    return EventSourceResponse(generate_sse(), headers=stream_headers())
+
+
+def release_stream(ctx: RequestContext):
+    """Free a stream's key slot and registry entry; safe to call from every path that may end it."""
+    if ctx.overrides.pop("stream_open", False):
+        stream_limiter.release(ctx.api_key, ctx.end_user)
+        stream_registry.close(ctx)
 
 
 async def stream_chat_completion(
     request: ChatCompletionRequest,
+    ctx: RequestContext,
     response_id: str,
-    created: int
+    created: int,
+    accept: Optional[str] = None
 ):
     """Handle streaming chat completion."""
+    # One snapshot for the whole stream, so a reload mid-response cannot change its framing
+    config = settings.get()
+    fingerprint = SYSTEM_FINGERPRINT if config.has_compat("system_fingerprint") else None
+    include_usage = config.has_compat("stream_usage") or bool(
+        request.stream_options and request.stream_options.get("include_usage")
+    )
+    
+    def make_chunk(delta: dict, finish_reason: Optional[str] = None) -> str:
+        response = ChatCompletionStreamResponse(
+            id=response_id,
+            created=created,
+            model=info.model or request.model,
+            choices=[
+                Choice(
+                    index=0,
+                    delta=delta,
+                    finish_reason=finish_reason
+                )
+            ],
+            system_fingerprint=fingerprint
+        )
+        # With include_usage the usage chunk comes last and carries the metadata instead
+        final = finish_reason is not None and not include_usage
+        return json.dumps({**dump_response(response), **extension_fields(ctx, final)})
+    
+    info = ctx.info
+    # Registered before the first chunk so streams stuck waiting on upstream show up too
+    active = stream_registry.open(ctx)
+    ctx.overrides["stream_open"] = True
+    cached = ctx.overrides.get("cached_response")
+    source = replay(cached) if cached is not None else cursor_client.chat_completion_stream(ctx)
+    upstream = buffered_stream(source, ctx)
+    if config.stream_pacing_cps > 0:
+        upstream = paced_stream(upstream)
+    # After pacing, which would otherwise cut the held-back constructs apart again
+    if config.stream_markdown_safe:
+        upstream = markdown_safe_stream(upstream)
+    tool_parser = ToolCallParser() if tools_enabled(request.tools, request.tool_choice) else None
+    
+    def make_deltas(chunk: str) -> list:
+        # Tool calls stream as argument fragments, like OpenAI
+        if tool_parser:
+            return tool_parser.feed(chunk)
+        return [{"content": chunk}]
+    
+    # Wait for the first chunk so X-Upstream-TTFB can go out with the response headers
+    first_chunk, first_error = None, None
+    try:
+        first_chunk = await upstream.__anext__()
+    except StopAsyncIteration:
+        pass
+    except Exception as e:
+        first_error = e
+    except BaseException:
+        # The client left while upstream was still silent; generate() will never run to free the slot
+        release_stream(ctx)
+        raise
     
     async def generate():
+        """Yield serialized JSON chunks, independent of the wire framing."""
+        collected = []
         try:
-            async for chunk in cursor_client.chat_completion_stream(
-                request.messages,
-                request.model
-            ):
+            if first_error:
+                raise first_error
+            
+            # OpenAI announces the role in the first delta; some SDKs require it
+            if config.has_compat("role_delta"):
+                yield make_chunk({"role": "assistant", "content": ""})
+            
+            # Not part of the generation, so kept out of `collected` and everything recorded from it
+            notice = notice_board.take(ctx) if not tool_parser else ""
+            if notice:
+                yield make_chunk({"content": notice})
+            
+            if first_chunk:
+                collected.append(first_chunk)
+                for delta in make_deltas(first_chunk):
+                    yield make_chunk(delta)
+            
+            async for chunk in upstream:
                 if chunk:
-                    response = ChatCompletionStreamResponse(
-                        id=response_id,
-                        created=created,
-                        model=request.model,
-                        choices=[
-                            Choice(
-                                index=0,
-                                delta={"content": chunk},
-                                finish_reason=None
-                            )
-                        ]
-                    )
-                    yield {"data": response.model_dump_json()}
+                    collected.append(chunk)
+                    for delta in make_deltas(chunk):
+                        yield make_chunk(delta)
+            
+            finish_reason = "stop"
+            if tool_parser:
+                for delta in tool_parser.flush():
+                    yield make_chunk(delta)
+                if tool_parser.calls:
+                    finish_reason = "tool_calls"
             
             # Send final chunk with finish_reason
-            final_response = ChatCompletionStreamResponse(
-                id=response_id,
-                created=created,
-                model=request.model,
-                choices=[
-                    Choice(
-                        index=0,
-                        delta={},
-                        finish_reason="stop"
-                    )
-                ]
-            )
-            yield {"data": final_response.model_dump_json()}
-            yield {"data": "[DONE]"}
+            yield make_chunk({}, finish_reason)
             
+            # Usage arrives in a trailing chunk with empty choices, as in OpenAI
+            if include_usage:
+                usage_response = ChatCompletionStreamResponse(
+                    id=response_id,
+                    created=created,
+                    model=info.model or request.model,
+                    choices=[],
+                    usage=estimated_usage(ctx, "".join(collected)),
+                    system_fingerprint=fingerprint
+                )
+                yield json.dumps({**dump_response(usage_response), **extension_fields(ctx, final=True)})
+            
+            journal.record(
+                response_id, request.model_dump(), "".join(collected), info.model or request.model,
+                end_user=ctx.end_user
+            )
+            tracer.export(ctx, response_id, "".join(collected))
+            response_traces.record(response_id, ctx)
+            usage_store.record(ctx, "".join(collected))
+            response_cache.store(ctx, "".join(collected))
+            transcript_store.record(ctx, response_id, created, request.model_dump(), "".join(collected), finish_reason)
+            session_history.record(ctx, request.model_dump()["messages"], "".join(collected))
+        
         except Exception as e:
-            error_data = {
-                "error": {
-                    "message": str(e),
-                    "type": "api_error",
-                    "code": "cursor_api_error"
-                }
-            }
-            yield {"data": json.dumps(error_data)}
-            yield {"data": "[DONE]"}
+            # Headers are already sent, so the error goes out as a stream event
+            report_exception(e, ctx.request_id, "chat completion stream")
+            journal.record(
+                response_id, request.model_dump(), "".join(collected), request.model, str(e),
+                end_user=ctx.end_user
+            )
+            tracer.export(ctx, response_id, "".join(collected), str(e))
+            response_traces.record(response_id, ctx, str(e))
+            usage_store.record(ctx, "".join(collected))
+            transcript_store.record(ctx, response_id, created, request.model_dump(), "".join(collected), error=str(e))
+            yield json.dumps(error_payload(e))
+        finally:
+            release_stream(ctx)
+    
+    # X-Upstream-Duration is unknown while streaming, so only TTFB and queue wait are sent
+    headers = {**info.headers(), **response_cache.headers(ctx), **stream_headers()}
+    
+    # NDJSON: one JSON object per line, no [DONE] sentinel
+    if accept and "application/x-ndjson" in accept:
+        async def generate_ndjson():
+            async for data in generate():
+                active.sent(data + "\n")
+                yield data + "\n"
+        
+        return StreamingResponse(
+            generate_ndjson(),
+            media_type="application/x-ndjson",
+            headers=headers,
+            # Runs even when the client disconnects before the body is iterated, and generate() never starts
+            background=BackgroundTask(release_stream, ctx)
+        )
     
-    return EventSourceResponse(generate())
+    async def generate_sse():
+        # Some proxies hold the first few KB regardless of headers; a comment pushes past that
+        if config.stream_flush_padding > 0:
+            yield {"comment": " " * config.stream_flush_padding}
+        # Known once the first chunk has arrived; later ones only make the final chunk's `warnings`
+        for warning in ctx.overrides.get("warnings", []):
+            yield {"comment": f"warning {warning['code']}: {warning['message']}"}
+        async for data in generate():
+            active.sent(data)
+            yield {"data": data}
+        yield {"data": "[DONE]"}
+    
+    return EventSourceResponse(generate_sse(), headers=headers, background=BackgroundTask(release_stream, ctx))
 
 
 async def non_stream_chat_completion(
     request: ChatCompletionRequest,
+    ctx: RequestContext,
     response_id: str,
     created: int
 ):
     """Handle non-streaming chat completion."""
     try:
-        full_response = await cursor_client.chat_completion(
-            request.messages,
-            request.model
-        )
+        cached = ctx.overrides.get("cached_response")
+        if cached is not None:
+            full_response = cached
+        elif request.best_of and request.best_of > 1:
+            full_response = await best_of_completion(ctx, request.best_of)
+        else:
+            full_response = await cursor_client.chat_completion(ctx)
         
-        return ChatCompletionResponse(
+        # best_of swaps in the winning generation's info
+        info = ctx.info
+        
+        message = Message(role="assistant", content=full_response)
+        finish_reason = "stop"
+        if tools_enabled(request.tools, request.tool_choice):
+            content, calls = parse_tool_calls(full_response)
+            if calls:
+                message = Message(role="assistant", content=content, tool_calls=calls)
+                finish_reason = "tool_calls"
+        else:
+            # Only in the response; the cache, usage and transcripts keep the generation itself
+            message.content = notice_board.take(ctx) + full_response
+        
+        response = ChatCompletionResponse(
             id=response_id,
             created=created,
-            model=request.model,
+            model=info.model or request.model,
             choices=[
                 Choice(
                     index=0,
-                    message=Message(role="assistant", content=full_response),
-                    finish_reason="stop"
+                    message=message,
+                    finish_reason=finish_reason
                 )
             ],
-            usage=Usage(
-                prompt_tokens=0,
-                completion_tokens=0,
-                total_tokens=0
-            )
+            usage=estimated_usage(ctx, full_response),
+            system_fingerprint=SYSTEM_FINGERPRINT if settings.has_compat("system_fingerprint") else None
+        )
+        journal.record(
+            response_id, request.model_dump(), full_response, info.model or request.model,
+            end_user=ctx.end_user
         )
+        tracer.export(ctx, response_id, full_response)
+        response_traces.record(response_id, ctx)
+        usage_store.record(ctx, full_response)
+        response_cache.store(ctx, full_response)
+        transcript_store.record(ctx, response_id, created, request.model_dump(), full_response, finish_reason)
+        session_history.record(ctx, request.model_dump()["messages"], full_response)
+        headers = {**info.headers(), **response_cache.headers(ctx)}
+        content = {**dump_response(response), **extension_fields(ctx, final=True)}
+        return JSONResponse(content=content, headers=headers)
+    
+    except (BudgetExhaustedError, TokensExpiredError, NoTaggedTokenError) as e:
+        # Refused before anything was sent upstream
+        journal.record(response_id, request.model_dump(), "", request.model, str(e), end_user=ctx.end_user)
+        return exception_response(e)
+    except Exception as e:
+        report_exception(e, ctx.request_id, "chat completion")
+        journal.record(response_id, request.model_dump(), "", request.model, str(e), end_user=ctx.end_user)
+        tracer.export(ctx, response_id, "", str(e))
+        response_traces.record(response_id, ctx, str(e))
+        transcript_store.record(ctx, response_id, created, request.model_dump(), "", error=str(e))
+        return exception_response(e)
+
+
+@router.get("/v1/chat/completions/{response_id}")
+async def get_chat_completion(
+    response_id: str,
+    http_request: Request,
+    authorization: Optional[str] = Header(None)
+):
+    """Retrieve a stored transcript by response ID."""
+    api_key = await authenticate(http_request, authorization)
+    if not api_key:
+        raise HTTPException(status_code=401, detail="Invalid API key")
+    
+    if not settings.transcripts:
+        return error_response(404, "Transcript storage is disabled", "invalid_request_error", "not_found")
+    
+    transcript = transcript_store.get(response_id, api_key)
+    if transcript is None:
+        return error_response(404, f"No stored completion with ID {response_id}", "invalid_request_error", "not_found")
+    return transcript
+
+
+@router.get("/v1/sessions/{session_id}/export")
+async def export_session(
+    session_id: str,
+    http_request: Request,
+    format: str = "openai",
+    authorization: Optional[str] = Header(None)
+):
+    """Export the message history of an X-Session-Id conversation."""
+    api_key = await authenticate(http_request, authorization)
+    if not api_key:
+        raise HTTPException(status_code=401, detail="Invalid API key")
+    
+    if not settings.session_history:
+        return error_response(404, "Session history is disabled", "invalid_request_error", "not_found")
+    if format not in EXPORT_FORMATS:
+        return error_response(400, f"format must be one of {', '.join(EXPORT_FORMATS)}", "invalid_request_error",
+                              "invalid_format", param="format")
+    
+    entry = session_history.get(session_id, api_key)
+    if entry is None:
+        return error_response(404, f"No stored session with ID {session_id}", "invalid_request_error", "not_found")
+    exported = session_history.export(entry, format)
+    if format == "markdown":
+        return PlainTextResponse(exported, media_type="text/markdown; charset=utf-8")
+    return exported
+
+
+async def context_call(http_request: Request, authorization: Optional[str], action):
+    """Authenticate and run a context upload operation, mapping its errors to responses."""
+    api_key = await authenticate(http_request, authorization)
+    if not api_key:
+        raise HTTPException(status_code=401, detail="Invalid API key")
+    if not settings.context_uploads:
+        return error_response(404, "Context uploads are disabled", "invalid_request_error", "not_found")
+    try:
+        return await action(api_key)
+    except ContextUploadError as e:
+        return error_response(e.status, str(e), "invalid_request_error", e.code)
+
+
+@router.post("/v1/contexts")
+async def create_context(http_request: Request, authorization: Optional[str] = Header(None)):
+    """Start a chunked upload of a large prompt context."""
+    async def action(api_key):
+        return context_store.create(api_key)
+    return await context_call(http_request, authorization, action)
+
+
+@router.put("/v1/contexts/{context_id}/chunks/{index}")
+async def upload_context_chunk(
+    context_id: str,
+    index: int,
+    http_request: Request,
+    authorization: Optional[str] = Header(None)
+):
+    """Store one chunk of a context upload; the raw request body is the chunk."""
+    async def action(api_key):
+        data = await read_chunk(http_request.stream(), http_request.headers.get("content-length", ""))
+        return context_store.put_chunk(context_id, api_key, index, data)
+    return await context_call(http_request, authorization, action)
+
+
+@router.post("/v1/contexts/{context_id}/complete")
+async def complete_context(context_id: str, http_request: Request, authorization: Optional[str] = Header(None)):
+    """Assemble the uploaded chunks, optionally verifying {"sha256": "..."} from the body."""
+    async def action(api_key):
+        body = await http_request.body()
+        try:
+            sha256 = json.loads(body).get("sha256") if body.strip() else None
+        except (ValueError, AttributeError):
+            return error_response(400, "Request body must be a JSON object", "invalid_request_error", "invalid_json")
+        return context_store.complete(context_id, api_key, sha256)
+    return await context_call(http_request, authorization, action)
+
+
+@router.get("/v1/contexts/{context_id}")
+async def get_context(context_id: str, http_request: Request, authorization: Optional[str] = Header(None)):
+    """Describe a context upload."""
+    async def action(api_key):
+        return context_store.get(context_id, api_key)
+    return await context_call(http_request, authorization, action)
+
+
+@router.delete("/v1/contexts/{context_id}")
+async def delete_context(context_id: str, http_request: Request, authorization: Optional[str] = Header(None)):
+    """Delete a context upload."""
+    async def action(api_key):
+        context_store.delete(context_id, api_key)
+        return {"id": context_id, "object": "context", "deleted": True}
+    return await context_call(http_request, authorization, action)
+
+
+@router.post("/v1/embeddings")
+async def embeddings(http_request: Request, authorization: Optional[str] = Header(None)):
+    """Create embeddings through the configured secondary backend."""
+    if not await authenticate(http_request, authorization):
+        raise HTTPException(status_code=401, detail="Invalid API key")
+    
+    try:
+        body = await http_request.json()
+    except ValueError:
+        return error_response(400, "Request body must be JSON", "invalid_request_error", "invalid_json")
+    
+    try:
+        status_code, content = await forward_embeddings(body)
+    except EmbeddingsUnavailableError as e:
+        return error_response(501, str(e), "invalid_request_error", "unsupported_endpoint")
+    except Exception as e:
+        return error_response(502, f"Embeddings backend error: {e}", "api_error", "embeddings_backend_error")
+    return JSONResponse(status_code=status_code, content=content)
+
+
+@router.post("/v1/moderations")
+async def moderations(http_request: Request, authorization: Optional[str] = Header(None)):
+    """Classify input against MODERATION_RULES and, when configured, an external classifier."""
+    if not await authenticate(http_request, authorization):
+        raise HTTPException(status_code=401, detail="Invalid API key")
+    
+    try:
+        body = await http_request.json()
+    except ValueError:
+        return error_response(400, "Request body must be JSON", "invalid_request_error", "invalid_json")
+    if not isinstance(body, dict):
+        return error_response(400, "Request body must be a JSON object", "invalid_request_error", "invalid_json")
     
+    try:
+        return await moderate(body)
+    except ModerationInputError as e:
+        return error_response(400, str(e), "invalid_request_error", "invalid_input", param="input")
     except Exception as e:
-        raise HTTPException(status_code=500, detail=str(e))
+        return error_response(502, f"Moderation backend error: {e}", "api_error", "moderation_backend_error")
+
+
+@router.post("/register")
+async def register(request: RegisterRequest):
+    """Redeem an invitation code for a new API key; no API key is needed to call this."""
+    if not settings.registration:
+        raise HTTPException(status_code=404, detail="Registration is disabled")
+    try:
+        return registry.redeem(request.invitation_code.strip(), request.name.strip())
+    except RegistrationError as e:
+        return error_response(e.status, str(e), "invalid_request_error", e.code, param="invitation_code")
+
+
+async def run_as_chat(
+    chat_request: ChatCompletionRequest,
+    http_request: Request,
+    authorization: Optional[str]
+):
+    """Run a translated request through the chat completion pipeline; streams come back as NDJSON."""
+    return await chat_completions(chat_request, http_request, authorization, accept="application/x-ndjson")
+
+
+def passthrough_headers(response) -> dict:
+    """Extension headers (X-Upstream-TTFB, X-Cache, ...) to carry over to the reshaped response."""
+    return {k: v for k, v in response.headers.items() if k.lower().startswith("x-")}
+
+
+@router.post("/v1/completions")
+async def completions(
+    request: CompletionRequest,
+    http_request: Request,
+    authorization: Optional[str] = Header(None)
+):
+    """Create a text completion (legacy OpenAI / vLLM format)."""
+    try:
+        chat_request = completion_to_chat(request)
+    except ValueError as e:
+        return error_response(400, str(e), "invalid_request_error", "invalid_prompt", param="prompt")
+    echo = chat_request.messages[0].get_text_content() if request.echo else ""
+    
+    response = await run_as_chat(chat_request, http_request, authorization)
+    if response.status_code != 200:
+        return response
+    
+    if not isinstance(response, StreamingResponse):
+        content = completion_response(json.loads(response.body), echo)
+        return JSONResponse(content=content, headers=passthrough_headers(response))
+    
+    async def generate_sse():
+        first = True
+        async with aclosing(response.body_iterator) as lines:
+            async for line in lines:
+                if not line.strip():
+                    continue
+                chunk = completion_chunk(json.loads(line), echo if first else "")
+                if chunk is not None:
+                    first = False
+                    yield {"data": json.dumps(chunk)}
+        yield {"data": "[DONE]"}
+    
+    return EventSourceResponse(generate_sse(), headers={**passthrough_headers(response), **stream_headers()})
+
+
+@router.post("/generate")
+async def tgi_generate(
+    request: TGIRequest,
+    http_request: Request,
+    authorization: Optional[str] = Header(None)
+):
+    """Generate text (Hugging Face TGI format)."""
+    if request.stream:
+        return await tgi_generate_stream(request, http_request, authorization)
+    
+    response = await run_as_chat(tgi_to_chat(request, False), http_request, authorization)
+    body = json.loads(response.body)
+    if response.status_code != 200:
+        return JSONResponse(status_code=response.status_code, content=tgi_error(body.get("error", {})),
+                            headers=passthrough_headers(response))
+    return JSONResponse(content=tgi_response(body, request), headers=passthrough_headers(response))
+
+
+@router.post("/generate_stream")
+async def tgi_generate_stream(
+    request: TGIRequest,
+    http_request: Request,
+    authorization: Optional[str] = Header(None)
+):
+    """Stream generated tokens (Hugging Face TGI format)."""
+    response = await run_as_chat(tgi_to_chat(request, True), http_request, authorization)
+    if not isinstance(response, StreamingResponse):
+        body = json.loads(response.body)
+        return JSONResponse(status_code=response.status_code, content=tgi_error(body.get("error", {})),
+                            headers=passthrough_headers(response))
+    
+    async def generate_sse():
+        async with aclosing(response.body_iterator) as lines:
+            async for event in tgi_stream(lines, request):
+                yield event
+    
+    return EventSourceResponse(generate_sse(), headers={**passthrough_headers(response), **stream_headers()})
+
+
+@router.post("/v1/chat/title")
+async def chat_title(
+    request: TitleRequest,
+    http_request: Request,
+    authorization: Optional[str] = Header(None)
+):
+    """Generate a short title for a conversation."""
+    model = settings.title_model or request.model or settings.get_models()[0]
+    chat_request = ChatCompletionRequest(model=model, messages=build_title_messages(request.messages), stream=False)
+    
+    # Same admission, quotas and accounting as any other generation
+    response = await run_as_chat(chat_request, http_request, authorization)
+    if response.status_code != 200:
+        return response
+    
+    body = json.loads(response.body)
+    text = body["choices"][0]["message"].get("content") or ""
+    title = TitleResponse(title=clean_title(text), model=body.get("model") or model)
+    return JSONResponse(content=title.model_dump(), headers=passthrough_headers(response))
+
+
+@router.post("/cursor/raw/{method}")
+async def cursor_raw(
+    method: str,
+    http_request: Request,
+    format: str = "raw",
+    authorization: Optional[str] = Header(None)
+):
+    """Forward a pre-built protobuf body to Cursor, adding only auth headers and framing."""
+    api_key = await authenticate(http_request, authorization)
+    if not api_key:
+        raise HTTPException(status_code=401, detail="Invalid API key")
+    if not settings.raw_passthrough:
+        raise HTTPException(status_code=404, detail="Raw passthrough is disabled")
+    # Opaque bodies cannot be checked against a registered key's models or metered against its quota
+    if registry.is_key(api_key):
+        return error_response(403, "Raw passthrough is not available to registered keys", "invalid_request_error",
+                              "raw_passthrough_forbidden")
+    try:
+        await maintenance.admit(api_key)
+    except MaintenanceError as e:
+        return maintenance_response(e)
+    if not re.fullmatch(r"[A-Za-z]+", method):
+        raise HTTPException(status_code=400, detail="Invalid method name")
+    
+    # Binary bodies are sent as-is; anything else is treated as base64
+    body = await http_request.body()
+    content_type = http_request.headers.get("content-type", "")
+    if "octet-stream" not in content_type and "proto" not in content_type:
+        try:
+            body = base64.b64decode(body.strip(), validate=True)
+        except binascii.Error:
+            raise HTTPException(status_code=400, detail="Body is neither binary protobuf nor valid base64")
+    
+    try:
+        stream_limiter.acquire(api_key)
+    except StreamLimitExceeded as e:
+        return stream_limit_response(e)
+    released = False
+    
+    def release():
+        nonlocal released
+        if not released:
+            released = True
+            stream_limiter.release(api_key)
+    
+    ctx = build_context(http_request, api_key, "", [])
+    upstream = cursor_client.stream_raw(method, body, ctx)
+    try:
+        first_chunk = await upstream.__anext__()
+    except StopAsyncIteration:
+        first_chunk = b""
+    except Exception as e:
+        release()
+        return exception_response(e)
+    except BaseException:
+        release()
+        raise
+    
+    async def generate_raw():
+        try:
+            yield first_chunk
+            async for chunk in upstream:
+                yield chunk
+        finally:
+            release()
+    
+    if format == "text":
+        # Decode text frames with the parser configured for the method
+        async def generate_text():
+            buffer = b""
+            assembler = Utf8Assembler(settings.output_decode_errors)
+            parser = cursor_client.parser_for(method)
+            async for chunk in generate_raw():
+                buffer += chunk
+                while True:
+                    payload, consumed = parser.parse(buffer)
+                    if consumed == 0:
+                        break
+                    buffer = buffer[consumed:]
+                    text = assembler.feed(payload)
+                    if text:
+                        yield text
+            tail = assembler.flush()
+            if tail:
+                yield tail
+        
+        return StreamingResponse(generate_text(), media_type="text/plain; charset=utf-8",
+                                 background=BackgroundTask(release))
+    
+    return StreamingResponse(generate_raw(), media_type="application/connect+proto", background=BackgroundTask(release))
 
 
 @router.get("/health")
@@ -193,14 +1201,43 @@ async def health_check():
     }
 
 
+@router.get("/readyz")
+async def readyz():
+    """Readiness probe: warm-up finished, at least one usable token and no protocol drift."""
+    usable = sum(1 for t in token_pool.tokens if t.is_usable())
+    ready = warmup.done and usable > 0 and not drift_detector.drifted
+    return JSONResponse(
+        status_code=200 if ready else 503,
+        content={
+            "ready": ready,
+            "usable_tokens": usable,
+            "warmup": warmup.to_dict(),
+            "protocol": {**drift_detector.to_dict(), "canary": canary.to_dict()},
+        }
+    )
+
+
+@router.get("/metrics")
+async def get_metrics():
+    """Expose metrics in the Prometheus text format."""
+    # Capacity gauges are derived on demand, so each scrape sees current values
+    capacity_report()
+    return PlainTextResponse(metrics.render(), media_type="text/plain; version=0.0.4")
+
+
 @router.get("/status")
 async def status():
     """Get service status."""
+    config = settings.get()
     return {
         "status": "running",
-        "models_count": len(settings.get_models()),
-        "cursor_token_set": bool(settings.get_clean_token()),
-        "cursor_api_url": settings.cursor_api_url,
-        "cursor_version": settings.cursor_version
+        "profile": config.profile or "default",
+        "models_count": len(config.get_models()),
+        "cursor_token_set": bool(config.get_clean_token()),
+        "cursor_tokens_count": len(config.get_clean_tokens()),
+        "dry_run": config.dry_run,
+        "cursor_api_url": config.cursor_api_url,
+        "cursor_version": version_detector.current,
+        "cursor_version_auto": config.cursor_version_auto
     }
 
@@ -0,0 +1,176 @@
+"""Declarative per-request rules from REQUEST_RULES_FILE: match on model, key or header, then rewrite or reject."""
+import os
+import json
+import logging
+import threading
+from fnmatch import fnmatchcase
+from typing import Any, Dict, List, Mapping, Optional
+from .config import settings
+from .models import ChatCompletionRequest, Message
+from .token_pool import display_key
+
+logger = logging.getLogger(__name__)
+
+# Request fields a rule may set; anything else would bypass validation or the proxy's own plumbing
+SETTABLE_PARAMS = {"temperature", "top_p", "max_tokens", "presence_penalty", "frequency_penalty", "user"}
+
+
+class RuleRejectedError(Exception):
+    """Raised when a matching rule rejects the request."""
+    
+    def __init__(self, rule: str, message: str, status: int):
+        self.rule = rule
+        self.status = status
+        super().__init__(message)
+
+
+def _patterns(value: Any) -> List[str]:
+    """A glob or a list of globs."""
+    return [str(v) for v in value] if isinstance(value, list) else [str(value)]
+
+
+class Rule:
+    """Match conditions (all must hold) and the actions taken when they do."""
+    
+    def __init__(self, data: dict, index: int):
+        self.name = str(data.get("name") or f"rule-{index + 1}")
+        match = data.get("match") or {}
+        unknown = set(match) - {"model", "key", "headers"}
+        if unknown:
+            raise ValueError(f"rule {self.name}: unknown match field {sorted(unknown)[0]}")
+        self.models = _patterns(match["model"]) if "model" in match else []
+        self.keys = _patterns(match["key"]) if "key" in match else []
+        # Header names are matched case-insensitively, values as globs
+        self.headers = {str(k).lower(): _patterns(v) for k, v in (match.get("headers") or {}).items()}
+        
+        actions = data.get("actions") or {}
+        unknown = set(actions) - {"model", "system", "params", "reject"}
+        if unknown:
+            raise ValueError(f"rule {self.name}: unknown action {sorted(unknown)[0]}")
+        self.model: Optional[str] = actions.get("model")
+        self.system: Optional[str] = actions.get("system")
+        self.params: Dict[str, Any] = dict(actions.get("params") or {})
+        bad = set(self.params) - SETTABLE_PARAMS
+        if bad:
+            raise ValueError(f"rule {self.name}: params cannot set {sorted(bad)[0]}")
+        reject = actions.get("reject")
+        if isinstance(reject, str):
+            reject = {"message": reject}
+        if reject is not None and not 400 <= int(reject.get("status", 403)) <= 499:
+            raise ValueError(f"rule {self.name}: reject status must be a 4xx code")
+        self.reject: Optional[dict] = reject
+        # Later rules still run after this one unless it says stop
+        self.stop = bool(data.get("stop", False))
+    
+    def matches(self, model: str, api_key: str, headers: Mapping[str, str]) -> bool:
+        """Whether every condition of the rule holds."""
+        if self.models and not any(fnmatchcase(model, p) for p in self.models):
+            return False
+        if self.keys and not any(fnmatchcase(api_key, p) for p in self.keys):
+            return False
+        for name, patterns in self.headers.items():
+            value = headers.get(name)
+            if value is None or not any(fnmatchcase(value, p) for p in patterns):
+                return False
+        return True
+    
+    def apply(self, request: ChatCompletionRequest):
+        """Rewrite the request, or raise RuleRejectedError."""
+        if self.reject is not None:
+            raise RuleRejectedError(
+                self.name,
+                str(self.reject.get("message") or "Request rejected by policy"),
+                int(self.reject.get("status", 403)),
+            )
+        if self.model:
+            request.model = self.model
+        for name, value in self.params.items():
+            setattr(request, name, value)
+        if self.system:
+            request.messages = [Message(role="system", content=self.system)] + list(request.messages)
+    
+    def to_dict(self) -> dict:
+        return {
+            "name": self.name,
+            "match": {"model": self.models, "key": [display_key(k) for k in self.keys], "headers": self.headers},
+            "actions": {"model": self.model, "system": self.system, "params": self.params, "reject": self.reject},
+            "stop": self.stop,
+        }
+
+
+def load_rules(path: str) -> List[Rule]:
+    """Parse a rules file: a JSON array of {name, match, actions, stop}."""
+    try:
+        with open(os.path.expanduser(path), encoding="utf-8") as f:
+            data = json.load(f)
+        if not isinstance(data, list):
+            raise ValueError("expected a JSON array of rules")
+        rules = [Rule(item, i) for i, item in enumerate(data)]
+    except (OSError, ValueError, TypeError, KeyError, AttributeError) as e:
+        raise ValueError(f"Invalid REQUEST_RULES_FILE: {e}") from e
+    if len({rule.name for rule in rules}) != len(rules):
+        raise ValueError("Invalid REQUEST_RULES_FILE: duplicate rule names")
+    return rules
+
+
+class RulesEngine:
+    """Evaluates the rules file per request, reloading it when it changes on disk."""
+    
+    def __init__(self, path: str):
+        self.path = path
+        self.rules: List[Rule] = []
+        self._mtime = 0.0
+        self._lock = threading.Lock()
+        if path:
+            # A broken file at startup is a configuration error, not something to serve without
+            self._mtime = self._stat()
+            self.rules = load_rules(path)
+    
+    def _stat(self) -> float:
+        """Modification time of the rules file, or 0 when it is missing."""
+        try:
+            return os.path.getmtime(os.path.expanduser(self.path))
+        except OSError:
+            return 0.0
+    
+    def _refresh(self):
+        """Reload the file if it changed; a broken edit keeps the previous rules."""
+        mtime = self._stat()
+        if mtime == self._mtime:
+            return
+        with self._lock:
+            if mtime == self._mtime:
+                return
+            self._mtime = mtime
+            try:
+                self.rules = load_rules(self.path)
+            except ValueError as e:
+                logger.warning("%s; keeping the previous %d rule(s)", e, len(self.rules))
+                return
+        logger.info("Reloaded %d request rule(s) from %s", len(self.rules), self.path)
+    
+    def evaluate(self, request: ChatCompletionRequest, api_key: str, headers: Mapping[str, str]) -> List[str]:
+        """Apply every matching rule in order, returning the names of those applied."""
+        if not self.path:
+            return []
+        self._refresh()
+        applied = []
+        for rule in self.rules:
+            # Each rule sees the model as rewritten by the rules before it
+            if not rule.matches(request.model, api_key, headers):
+                continue
+            rule.apply(request)
+            applied.append(rule.name)
+            if rule.stop:
+                break
+        if applied:
+            logger.debug("Request rules applied: %s", ", ".join(applied))
+        return applied
+    
+    def to_list(self) -> List[dict]:
+        """Describe the loaded rules for the admin API, without API keys."""
+        return [rule.to_dict() for rule in self.rules]
+
+
+# Global rules engine instance
+rules_engine = RulesEngine(settings.request_rules_file)
@@ -0,0 +1,86 @@
+"""Watch CURSOR_TOKEN_FILE and API_KEY_FILE and publish their contents when they change."""
+import os
+import asyncio
+import logging
+from typing import Dict, Optional
+from .config import settings, SECRET_FILE_SETTINGS
+from .secret_providers import read_secret_list
+from .token_pool import token_pool
+
+logger = logging.getLogger(__name__)
+
+
+class SecretFileWatcher:
+    """Re-reads secret files (Docker / Kubernetes secret mounts) when they are modified."""
+    
+    def __init__(self):
+        self._mtimes: Dict[str, float] = {}
+        self._task: Optional[asyncio.Task] = None
+        for name in SECRET_FILE_SETTINGS:
+            path = getattr(settings, f"{name}_file")
+            if path:
+                self._mtimes[name] = self._mtime(path)
+    
+    @staticmethod
+    def _mtime(path: str) -> float:
+        """Modification time of a file, or 0 when it is missing."""
+        try:
+            # stat follows symlinks, so Kubernetes' ..data swap shows up as a new mtime
+            return os.path.getmtime(os.path.expanduser(path))
+        except OSError:
+            return 0.0
+    
+    def check(self):
+        """Reload every secret file whose modification time changed."""
+        config = settings.get()
+        for name in SECRET_FILE_SETTINGS:
+            path = getattr(config, f"{name}_file")
+            if not path:
+                continue
+            mtime = self._mtime(path)
+            if mtime == self._mtimes.get(name):
+                continue
+            self._mtimes[name] = mtime
+            try:
+                value = read_secret_list(path)
+            except OSError as e:
+                # A secret mount is briefly missing during updates; keep serving with the old values
+                logger.warning("Could not read %s_FILE, keeping the current values: %s", name.upper(), e)
+                continue
+            if not value:
+                logger.warning("%s_FILE is empty, keeping the current values", name.upper())
+                continue
+            if value == getattr(config, name):
+                continue
+            
+            try:
+                if name == "cursor_token":
+                    # Validates tags against the new count before anything is published
+                    tokens = [config._clean_token(t) for t in value.split(",")]
+                    token_pool.reload([t for t in tokens if t])
+                settings.update(**{name: value})
+            except ValueError as e:
+                logger.warning("Ignoring the new %s_FILE: %s", name.upper(), e)
+                continue
+            logger.info("Reloaded %s from %s", name.upper(), path)
+    
+    async def _run(self):
+        """Check the secret files on an interval."""
+        while True:
+            await asyncio.sleep(settings.secret_file_poll_interval)
+            self.check()
+    
+    def start(self):
+        """Start watching if a secret file and a poll interval are configured."""
+        if self._mtimes and settings.secret_file_poll_interval > 0 and self._task is None:
+            self._task = asyncio.create_task(self._run())
+    
+    async def stop(self):
+        """Stop watching."""
+        if self._task:
+            self._task.cancel()
+            self._task = None
+
+
+# Global secret file watcher instance
+secret_file_watcher = SecretFileWatcher()
@@ -0,0 +1,103 @@
+"""Resolve config values that reference external secret stores."""
+import os
+import json
+import logging
+from typing import Callable, Dict, Optional, Tuple
+import httpx
+
+logger = logging.getLogger(__name__)
+
+
+def _split_ref(ref: str) -> Tuple[str, Optional[str]]:
+    """Split `<location>#<key>` into its location and optional key."""
+    location, _, key = ref.partition("#")
+    return location, key or None
+
+
+def _pick(value, key: Optional[str], ref: str) -> str:
+    """Select a key from a structured secret, or use a plain string as is."""
+    if key is None:
+        if isinstance(value, str):
+            return value
+        raise ValueError(f"secret {ref} holds several values; select one with #<key>")
+    if isinstance(value, str):
+        try:
+            value = json.loads(value)
+        except ValueError:
+            raise ValueError(f"secret {ref} is not JSON, so #{key} cannot be selected") from None
+    if not isinstance(value, dict) or key not in value:
+        raise ValueError(f"key {key} not found in secret {ref}")
+    return str(value[key])
+
+
+def resolve_file(ref: str, config) -> str:
+    """Read a secret from a local file, e.g. file:/run/secrets/cursor_token."""
+    with open(os.path.expanduser(ref), encoding="utf-8") as f:
+        return f.read().strip()
+
+
+def read_secret_list(path: str) -> str:
+    """Read a list of secrets, one per line or comma-separated, skipping blanks and # comments."""
+    with open(os.path.expanduser(path), encoding="utf-8") as f:
+        lines = [line.strip() for line in f]
+    values = [v.strip() for line in lines if line and not line.startswith("#") for v in line.split(",")]
+    # Settings hold lists comma-separated, as CURSOR_TOKEN does
+    return ",".join(v for v in values if v)
+
+
+def resolve_vault(ref: str, config) -> str:
+    """Read a secret from Vault KV v1 or v2, e.g. vault:secret/data/cursor2api#cursor_token."""
+    if not config.vault_addr or not config.vault_token:
+        raise ValueError("VAULT_ADDR and VAULT_TOKEN are required for vault: secrets")
+    path, key = _split_ref(ref)
+    headers = {"X-Vault-Token": config.vault_token}
+    if config.vault_namespace:
+        headers["X-Vault-Namespace"] = config.vault_namespace
+    response = httpx.get(f"{config.vault_addr.rstrip('/')}/v1/{path.lstrip('/')}", headers=headers, timeout=10)
+    response.raise_for_status()
+    data = response.json().get("data") or {}
+    # KV v2 nests the secret under data.data
+    if isinstance(data.get("data"), dict) and "metadata" in data:
+        data = data["data"]
+    return _pick(data, key, ref)
+
+
+def resolve_awssm(ref: str, config) -> str:
+    """Read a secret from AWS Secrets Manager, e.g. awssm:prod/cursor2api#cursor_token."""
+    # Credentials come from the usual AWS chain: env, shared config, instance role
+    try:
+        import boto3
+    except ImportError:
+        raise ValueError("awssm: secrets need boto3 (pip install boto3)") from None
+    secret_id, key = _split_ref(ref)
+    client = boto3.client("secretsmanager", region_name=config.aws_region or None)
+    secret = client.get_secret_value(SecretId=secret_id)["SecretString"]
+    return _pick(secret, key, ref)
+
+
+PROVIDERS: Dict[str, Callable[[str, object], str]] = {
+    "file:": resolve_file,
+    "vault:": resolve_vault,
+    "awssm:": resolve_awssm,
+}
+
+# Provider settings are resolved first, so VAULT_TOKEN itself may be a file: secret
+PROVIDER_SETTINGS = ("vault_addr", "vault_token", "vault_namespace", "aws_region")
+
+
+def resolve_secrets(config):
+    """Replace every string setting that starts with a provider prefix by the secret it points to."""
+    names = sorted(type(config).model_fields, key=lambda n: n not in PROVIDER_SETTINGS)
+    for name in names:
+        value = getattr(config, name)
+        if not isinstance(value, str):
+            continue
+        prefix = next((p for p in PROVIDERS if value.startswith(p)), None)
+        if prefix is None:
+            continue
+        ref = value[len(prefix):]
+        try:
+            setattr(config, name, PROVIDERS[prefix](ref, config))
+        except Exception as e:
+            raise ValueError(f"Invalid secret for {name.upper()} ({prefix}{ref}): {e}") from e
+        logger.info("Resolved %s from %s", name.upper(), prefix.rstrip(":"))
@@ -0,0 +1,129 @@
+"""Message history of X-Session-Id conversations, exportable as OpenAI messages or Markdown."""
+import os
+import json
+import time
+import threading
+from typing import Any, List, Optional
+from .config import settings
+from .context import RequestContext
+from .sessions import conversation_key
+from .transcripts import _owner
+
+EXPORT_FORMATS = ("openai", "markdown")
+
+# Expired sessions are swept at most this often
+PRUNE_INTERVAL = 60
+
+
+def _text(content: Any) -> str:
+    """Readable text of a message's content, with non-text parts shown as placeholders."""
+    if content is None:
+        return ""
+    if isinstance(content, str):
+        return content
+    parts = []
+    for part in content:
+        if isinstance(part, dict) and part.get("type") == "text":
+            parts.append(part.get("text", ""))
+        elif isinstance(part, dict):
+            parts.append(f"[{part.get('type', 'attachment')}]")
+        else:
+            parts.append(str(part))
+    return "\n".join(parts)
+
+
+def to_markdown(entry: dict) -> str:
+    """Render a session as a Markdown document, one section per message."""
+    lines = [f"# Session {entry['session_id']}", ""]
+    lines.append(f"- Model: {entry['model']}")
+    lines.append(f"- Updated: {time.strftime('%Y-%m-%d %H:%M:%S', time.localtime(entry['updated']))}")
+    lines.append("")
+    for message in entry["messages"]:
+        name = f" ({message['name']})" if message.get("name") else ""
+        lines.append(f"## {message['role'].capitalize()}{name}")
+        lines.append("")
+        lines.append(_text(message.get("content")))
+        for call in message.get("tool_calls") or []:
+            function = call.get("function", {})
+            lines.append("")
+            lines.append(f"Tool call `{function.get('name')}`: `{function.get('arguments')}`")
+        lines.append("")
+    return "\n".join(lines)
+
+
+class SessionHistory:
+    """One JSON file per session, rewritten with the whole conversation after every turn."""
+    
+    def __init__(self, directory: str):
+        self.directory = directory
+        self._last_prune = 0.0
+        self._lock = threading.Lock()
+    
+    def _path(self, session_key: str) -> str:
+        """File for a session key, which is always a hex digest."""
+        return os.path.join(self.directory, f"{session_key}.json")
+    
+    def record(self, ctx: RequestContext, messages: List[dict], response: str):
+        """Save the messages a turn was sent with plus the reply, replacing the previous turn's history."""
+        if not settings.session_history or not ctx.session_id:
+            return
+        # Clients resend the whole conversation each turn, so the latest request is the full history
+        history = [{k: v for k, v in m.items() if v is not None} for m in messages]
+        history.append({"role": "assistant", "content": response})
+        entry = {
+            "session_id": ctx.session_id,
+            "owner": _owner(ctx.api_key),
+            "model": ctx.info.model or ctx.model,
+            "updated": time.time(),
+            "messages": history,
+        }
+        with self._lock:
+            os.makedirs(self.directory, exist_ok=True)
+            with open(self._path(ctx.session_key), "w", encoding="utf-8") as f:
+                json.dump(entry, f, ensure_ascii=False)
+            self._prune()
+    
+    def _prune(self):
+        """Delete sessions idle for longer than the retention window."""
+        now = time.time()
+        if now - self._last_prune < PRUNE_INTERVAL:
+            return
+        self._last_prune = now
+        cutoff = now - settings.session_history_retention
+        for name in os.listdir(self.directory):
+            path = os.path.join(self.directory, name)
+            try:
+                if name.endswith(".json") and os.path.getmtime(path) < cutoff:
+                    os.remove(path)
+            except OSError:
+                pass
+    
+    def get(self, session_id: str, api_key: str) -> Optional[dict]:
+        """Load a session by the X-Session-Id it was sent with, if the caller owns it."""
+        # Keyed the same way as token pinning, so the ID alone cannot reach another key's session
+        path = self._path(conversation_key(api_key, [], session_id))
+        if not os.path.exists(path):
+            return None
+        if time.time() - os.path.getmtime(path) > settings.session_history_retention:
+            return None
+        with open(path, encoding="utf-8") as f:
+            entry = json.load(f)
+        if entry.get("owner") != _owner(api_key):
+            return None
+        return entry
+    
+    def export(self, entry: dict, export_format: str):
+        """A stored session as an OpenAI messages object or Markdown text."""
+        if export_format == "markdown":
+            return to_markdown(entry)
+        return {
+            "object": "session.export",
+            "id": entry["session_id"],
+            "model": entry["model"],
+            "updated": int(entry["updated"]),
+            "messages": entry["messages"],
+        }
+
+
+# Global session history instance
+session_history = SessionHistory(settings.session_history_dir)
@@ -0,0 +1,65 @@
+"""Conversation identity for session continuity."""
+import time
+import uuid
+import hashlib
+import threading
+from typing import Dict, List, Optional, Tuple
+from .config import settings
+from .models import Message
+
+# MESSAGE_UUID_MODE
+# shared:  one UUID for every message of a request, as before
+# unique:  a fresh UUID per message on every request
+# session: a message keeps its UUID on later turns of the same conversation, as in the IDE
+
+
+def conversation_key(api_key: str, messages: List[Message], session_id: Optional[str] = None) -> str:
+    """Derive a key that stays the same across a conversation's turns."""
+    # The opening user message is unchanged as turns are appended
+    if session_id:
+        source = f"{api_key}\0id\0{session_id}"
+    else:
+        first_user = next((m.get_text_content() for m in messages if m.role == "user"), "")
+        source = f"{api_key}\0msg\0{first_user}"
+    return hashlib.sha256(source.encode("utf-8")).hexdigest()[:32]
+
+
+class MessageUUIDs:
+    """Assigns the UUIDs sent with each upstream message."""
+    
+    def __init__(self):
+        # Session key -> (message fingerprint -> UUID, last used)
+        self._sessions: Dict[str, Tuple[Dict[str, str], float]] = {}
+        self._lock = threading.Lock()
+    
+    @staticmethod
+    def _fingerprints(messages: List[Tuple[str, str]]) -> List[str]:
+        """Identify messages by role and content, numbering repeats so each stays distinct."""
+        seen: Dict[str, int] = {}
+        result = []
+        for role, content in messages:
+            digest = hashlib.sha256(f"{role}\0{content}".encode("utf-8")).hexdigest()[:32]
+            seen[digest] = seen.get(digest, 0) + 1
+            result.append(f"{digest}:{seen[digest]}")
+        return result
+    
+    def assign(self, session_key: str, messages: List[Tuple[str, str]]) -> List[str]:
+        """Return a UUID for each (role, content) pair per MESSAGE_UUID_MODE."""
+        config = settings.get()
+        if config.message_uuid_mode == "shared":
+            return [str(uuid.uuid4())] * len(messages)
+        if config.message_uuid_mode == "unique" or not session_key:
+            return [str(uuid.uuid4()) for _ in messages]
+        
+        # Keyed by content rather than position, so truncating old turns does not renumber the rest
+        now = time.time()
+        with self._lock:
+            self._sessions = {k: v for k, v in self._sessions.items() if now - v[1] < config.session_ttl}
+            known = self._sessions.get(session_key, ({}, now))[0]
+            uuids = [known.setdefault(fp, str(uuid.uuid4())) for fp in self._fingerprints(messages)]
+            self._sessions[session_key] = (known, now)
+        return uuids
+
+
+# Global message UUID instance
+message_uuids = MessageUUIDs()
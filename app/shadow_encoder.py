@@ -0,0 +1,83 @@
+"""Shadow validation of the manual protobuf encoder against generated code."""
+import logging
+from typing import Optional
+from .config import settings
+from .metrics import metrics
+
+logger = logging.getLogger(__name__)
+
+metrics.describe("cursor2api_shadow_encoder_total", "counter", "Requests encoded by both protobuf encoders, by result")
+
+
+def _load_generated():
+    """Import the protoc-generated module, or None when it has not been built."""
+    try:
+        from . import aiserver_pb2
+        return aiserver_pb2
+    except ImportError as e:
+        logger.warning("SHADOW_ENCODER is on but generated protobuf is unavailable (%s); "
+                       "run: protoc -I proto --python_out=app proto/aiserver.proto", e)
+        return None
+
+
+class ShadowEncoder:
+    """Re-encodes requests with the generated encoder and reports byte mismatches."""
+    
+    def __init__(self):
+        self._pb2 = _load_generated() if settings.shadow_encoder else None
+    
+    @property
+    def enabled(self) -> bool:
+        """Whether requests are being shadow-encoded."""
+        return self._pb2 is not None
+    
+    def encode(self, request) -> bytes:
+        """Encode a CursorRequest with the generated StreamChatRequest message."""
+        pb2 = self._pb2
+        msg = pb2.StreamChatRequest()
+        # Only set what the manual encoder would emit, so proto3 presence matches
+        if request.current_file:
+            f = request.current_file
+            msg.current_file.relative_workspace_path = f.path
+            msg.current_file.contents = f.contents
+            if f.line:
+                msg.current_file.cursor_position.line = f.line
+        for m in request.messages:
+            msg.conversation.add(text=m.content, type=m.role, bubble_id=m.uuid)
+        if request.explicit_context:
+            msg.explicit_context.context = request.explicit_context
+        msg.workspace_root_path = request.paths
+        msg.model_details.model_name = request.model.model_name
+        msg.request_id = request.trace_id
+        msg.conversation_id = request.conversation_id
+        msg.unknown16 = 1
+        return msg.SerializeToString()
+    
+    def compare(self, request, manual: bytes) -> Optional[bool]:
+        """Compare manual bytes with the generated encoding; None if not checked."""
+        if not self.enabled:
+            return None
+        try:
+            generated = self.encode(request)
+        except Exception as e:
+            metrics.inc("cursor2api_shadow_encoder_total", result="error")
+            logger.warning("Shadow encoder failed for trace %s: %s", request.trace_id, e)
+            return None
+        if generated == manual:
+            metrics.inc("cursor2api_shadow_encoder_total", result="match")
+            return True
+        offset = next(
+            (i for i, (a, b) in enumerate(zip(manual, generated)) if a != b),
+            min(len(manual), len(generated))
+        )
+        metrics.inc("cursor2api_shadow_encoder_total", result="mismatch")
+        logger.warning(
+            f"Protobuf encoder mismatch for trace {request.trace_id}: "
+            f"manual={len(manual)}B generated={len(generated)}B first diff at byte {offset} "
+            f"(manual {manual[offset:offset + 16].hex()} vs generated {generated[offset:offset + 16].hex()})"
+        )
+        return False
+
+
+# Global shadow encoder instance
+shadow_encoder = ShadowEncoder()
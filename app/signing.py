@@ -0,0 +1,77 @@
+"""HMAC request signatures for machine-to-machine callers."""
+import hmac
+import json
+import time
+import hashlib
+import threading
+from typing import Dict, Optional
+from fastapi import Request
+from .config import settings
+
+
+def _parse_keys(raw: str) -> Dict[str, str]:
+    """Parse signing keys from a JSON object of {key id: shared secret}."""
+    if not raw.strip():
+        return {}
+    try:
+        keys = json.loads(raw)
+    except ValueError as e:
+        raise ValueError(f"Invalid HMAC_KEYS: {e}") from e
+    if not isinstance(keys, dict):
+        raise ValueError("Invalid HMAC_KEYS: expected a JSON object")
+    return {str(k): str(v) for k, v in keys.items()}
+
+
+hmac_keys = _parse_keys(settings.hmac_keys)
+
+
+def signing_payload(timestamp: str, method: str, path: str, body: bytes) -> bytes:
+    """Build the bytes a caller signs: timestamp, method and path on lines, then the body."""
+    return f"{timestamp}\n{method.upper()}\n{path}\n".encode() + body
+
+
+class SignatureVerifier:
+    """Validates X-Signature headers and rejects replays inside the time window."""
+    
+    def __init__(self):
+        # Signature -> timestamp, kept for one window
+        self._seen: Dict[str, int] = {}
+        self._lock = threading.Lock()
+    
+    def _is_replay(self, signature: str, timestamp: int) -> bool:
+        """Record a signature, returning True if it was already used."""
+        cutoff = int(time.time()) - settings.hmac_window
+        with self._lock:
+            self._seen = {s: ts for s, ts in self._seen.items() if ts >= cutoff}
+            if signature in self._seen:
+                return True
+            self._seen[signature] = timestamp
+            return False
+    
+    async def verify(self, request: Request) -> Optional[str]:
+        """Verify a signed request, returning the caller identity (hmac:<key id>)."""
+        key_id = request.headers.get("x-key-id")
+        timestamp = request.headers.get("x-timestamp", "")
+        signature = request.headers.get("x-signature", "")
+        if not key_id or key_id not in hmac_keys or not timestamp.isdigit() or not signature:
+            return None
+        
+        # Stale or future timestamps fall outside the replay window
+        if abs(time.time() - int(timestamp)) > settings.hmac_window:
+            return None
+        
+        body = await request.body()
+        expected = hmac.new(
+            hmac_keys[key_id].encode(),
+            signing_payload(timestamp, request.method, request.url.path, body),
+            hashlib.sha256
+        ).hexdigest()
+        if not hmac.compare_digest(expected, signature.lower()):
+            return None
+        if self._is_replay(signature.lower(), int(timestamp)):
+            return None
+        return f"hmac:{key_id}"
+
+
+# Global signature verifier instance
+signature_verifier = SignatureVerifier()
@@ -0,0 +1,47 @@
+"""Per-model time-to-first-token SLOs."""
+import json
+import asyncio
+from fnmatch import fnmatch
+from typing import AsyncGenerator, Dict, Optional
+from .config import settings
+from .metrics import metrics
+
+metrics.describe("cursor2api_ttft_slo_exceeded_total", "counter", "Upstream attempts cancelled for missing the TTFT SLO")
+
+
+class TTFTExceededError(Exception):
+    """Raised when the upstream produced nothing within the TTFT SLO."""
+
+
+def _parse_slos(raw: str) -> Dict[str, float]:
+    """Parse per-model SLOs from a JSON object of {model pattern: seconds}."""
+    if not raw.strip():
+        return {}
+    try:
+        return {str(k): float(v) for k, v in json.loads(raw).items()}
+    except (ValueError, TypeError, AttributeError) as e:
+        raise ValueError(f"Invalid TTFT_SLO_MODELS: {e}") from e
+
+
+model_slos = _parse_slos(settings.ttft_slo_models)
+
+
+def ttft_slo_for(model: str) -> Optional[float]:
+    """Get the TTFT SLO in seconds for a model, or None when not enforced."""
+    if model in model_slos:
+        slo = model_slos[model]
+    else:
+        slo = next((v for pattern, v in model_slos.items() if fnmatch(model, pattern)), settings.ttft_slo)
+    return slo if slo > 0 else None
+
+
+async def first_chunk_within(stream: AsyncGenerator[str, None], model: str, timeout: float) -> Optional[str]:
+    """Wait for the first chunk, cancelling the upstream if the SLO is missed."""
+    try:
+        return await asyncio.wait_for(stream.__anext__(), timeout)
+    except StopAsyncIteration:
+        return None
+    except asyncio.TimeoutError:
+        await stream.aclose()
+        metrics.inc("cursor2api_ttft_slo_exceeded_total", model=model)
+        raise TTFTExceededError(f"No output from {model} within the {timeout:g}s TTFT SLO")
@@ -0,0 +1,122 @@
+"""Handling of single messages that exceed the per-message input limit."""
+import logging
+from contextlib import aclosing
+from typing import List
+from .config import settings
+from .models import Message
+from .context import RequestContext
+from .limits import stream_limiter
+from .truncation import measure, take_head
+from .cursor_client import cursor_client
+
+logger = logging.getLogger(__name__)
+
+SUMMARIZE_INSTRUCTION = (
+    "Below is part {part} of {total} of a long message. Summarize it densely, "
+    "preserving every fact, name, number, identifier and code snippet that may be "
+    "needed to answer questions about it. Reply with the summary only."
+)
+
+
+class OversizedMessageError(Exception):
+    """Raised when a message exceeds the limit and the strategy is reject."""
+
+
+def message_limit() -> int:
+    """Get the per-message length limit in LENGTH_UNIT."""
+    config = settings.get()
+    return config.max_message_length or config.max_input_length
+
+
+def split_text(text: str, limit: int) -> List[str]:
+    """Split text into parts of at most `limit` in LENGTH_UNIT, preferring line boundaries."""
+    parts, current = [], ""
+    for line in text.splitlines(keepends=True):
+        # A single over-long line is hard-split; a limit below one character still advances by one
+        while measure(line) > limit:
+            head = take_head(line, limit) or line[0]
+            if current:
+                parts.append(current)
+                current = ""
+            parts.append(head)
+            line = line[len(head):]
+        if measure(current) + measure(line) > limit:
+            parts.append(current)
+            current = ""
+        current += line
+    if current:
+        parts.append(current)
+    return parts
+
+
+def _split_message(msg: Message, limit: int) -> List[Message]:
+    """Turn an oversized message into sequential part messages."""
+    # Leave room for the part header
+    parts = split_text(msg.get_text_content(), max(limit - 64, 1))
+    total = len(parts)
+    return [
+        Message(role=msg.role, content=f"[Part {i + 1}/{total}]\n{part}", name=msg.name)
+        for i, part in enumerate(parts)
+    ]
+
+
+async def _acquire_slot(ctx: RequestContext):
+    """Take one of the key's stream slots, queueing for it when KEY_STREAM_QUEUE_TIMEOUT is set."""
+    timeout = settings.key_stream_queue_timeout
+    if timeout <= 0:
+        stream_limiter.acquire(ctx.api_key, ctx.end_user)
+        return
+    async with aclosing(stream_limiter.wait(ctx.api_key, ctx.end_user, timeout)) as waiting:
+        async for _ in waiting:
+            pass
+
+
+async def _summarize_message(ctx: RequestContext, msg: Message, limit: int) -> Message:
+    """Map-reduce an oversized message into a summary of its parts."""
+    parts = split_text(msg.get_text_content(), limit)
+    total = len(parts)
+    # The parts go upstream one at a time under a single slot of the caller's key
+    await _acquire_slot(ctx)
+    summaries = []
+    try:
+        for i, part in enumerate(parts):
+            summaries.append(await cursor_client.chat_completion(ctx.derive(
+                model=settings.summarize_model or ctx.model,
+                messages=[Message(
+                    role="user",
+                    content=f"{SUMMARIZE_INSTRUCTION.format(part=i + 1, total=total)}\n\n{part}"
+                )]
+            )))
+    finally:
+        stream_limiter.release(ctx.api_key, ctx.end_user)
+    content = f"[Summary of an oversized message in {total} parts]\n\n" + "\n\n".join(summaries)
+    return Message(role=msg.role, content=content, name=msg.name)
+
+
+async def handle_oversized_messages(ctx: RequestContext):
+    """Apply the configured strategy to messages that alone exceed the limit."""
+    strategy = settings.oversize_message_strategy
+    limit = message_limit()
+    unit = settings.length_unit
+    if strategy == "truncate" or limit <= 0:
+        return
+    
+    result = []
+    for msg in ctx.messages:
+        size = measure(msg.get_text_content())
+        if size <= limit:
+            result.append(msg)
+            continue
+        
+        logger.info("[%s] %s message is %d %s (limit %d), applying %s",
+                    ctx.request_id, msg.role, size, unit, limit, strategy)
+        if strategy == "reject":
+            raise OversizedMessageError(
+                f"A {msg.role} message is {size} {unit}, which exceeds the per-message limit of {limit} {unit}"
+            )
+        if strategy == "summarize":
+            result.append(await _summarize_message(ctx, msg, limit))
+            ctx.warn("message_summarized", f"A {msg.role} message over {limit} {unit} was replaced by a summary")
+        else:
+            result.extend(_split_message(msg, limit))
+    ctx.messages = result
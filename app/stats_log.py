@@ -0,0 +1,191 @@
+"""Crash-safe usage and quota counters: a buffered write-ahead log folded into periodic snapshots."""
+import os
+import json
+import time
+import asyncio
+import logging
+import threading
+from typing import Any, Callable, Dict, List, NamedTuple, Optional
+from .config import settings
+from .metrics import metrics
+
+logger = logging.getLogger(__name__)
+
+SNAPSHOT_FILE = "snapshot.json"
+WAL_FILE = "wal.jsonl"
+
+metrics.describe("cursor2api_stats_wal_events_total", "counter", "Counter events written to the stats WAL")
+metrics.describe("cursor2api_stats_write_errors_total", "counter", "Failed stats WAL or snapshot writes")
+
+
+class StatsSource(NamedTuple):
+    """A counter store the log persists: its full state, how to restore it and how to replay one event."""
+    snapshot: Callable[[], Any]
+    restore: Callable[[Any], None]
+    apply: Callable[[dict], None]
+
+
+class StatsLog:
+    """Counter events kept in memory, appended to the WAL on a timer and folded into snapshots."""
+    
+    def __init__(self, directory: str):
+        self.directory = directory
+        self._sources: Dict[str, StatsSource] = {}
+        self._buffer: List[str] = []
+        # Every event gets the next sequence number; a snapshot records the last one it covers
+        self._seq = 0
+        self._last_snapshot = time.time()
+        self._lock = threading.Lock()
+        # Serializes file writes, which run in worker threads off the event loop
+        self._io_lock = threading.Lock()
+        self._task: Optional[asyncio.Task] = None
+    
+    @property
+    def enabled(self) -> bool:
+        return bool(self.directory)
+    
+    def _path(self, name: str) -> str:
+        return os.path.join(self.directory, name)
+    
+    def register(self, name: str, snapshot: Callable[[], Any], restore: Callable[[Any], None],
+                 apply: Callable[[dict], None]):
+        """Persist a counter store under a name."""
+        self._sources[name] = StatsSource(snapshot, restore, apply)
+    
+    def append(self, source: str, event: dict):
+        """Queue an event already applied in memory; nothing on this path touches the disk."""
+        if not self.enabled:
+            return
+        with self._lock:
+            self._seq += 1
+            self._buffer.append(json.dumps({"seq": self._seq, "source": source, "event": event}, ensure_ascii=False))
+    
+    def flush(self):
+        """Append the buffered events to the WAL and sync it to disk."""
+        with self._lock:
+            lines, self._buffer = self._buffer, []
+        if not lines:
+            return
+        try:
+            with self._io_lock:
+                os.makedirs(self.directory, exist_ok=True)
+                with open(self._path(WAL_FILE), "a", encoding="utf-8") as f:
+                    f.write("\n".join(lines) + "\n")
+                    f.flush()
+                    os.fsync(f.fileno())
+        except OSError as e:
+            # Kept for the next attempt rather than lost
+            with self._lock:
+                self._buffer = lines + self._buffer
+            metrics.inc("cursor2api_stats_write_errors_total", file="wal")
+            logger.warning("Could not write the stats WAL: %s", e)
+            return
+        metrics.inc("cursor2api_stats_wal_events_total", len(lines))
+    
+    def _collect(self) -> dict:
+        """The state of every source and the last sequence number it covers. Runs on the event loop."""
+        # Counters and append() both run on the event loop, so nothing changes between these two reads
+        state = {name: source.snapshot() for name, source in self._sources.items()}
+        with self._lock:
+            seq = self._seq
+            # Buffered events are already part of the state
+            self._buffer = []
+        return {"seq": seq, "written_at": time.time(), "sources": state}
+    
+    def _write_snapshot(self, data: dict):
+        """Replace the snapshot file with data and start an empty WAL."""
+        try:
+            with self._io_lock:
+                os.makedirs(self.directory, exist_ok=True)
+                tmp = self._path(f"{SNAPSHOT_FILE}.tmp")
+                with open(tmp, "w", encoding="utf-8") as f:
+                    json.dump(data, f, ensure_ascii=False)
+                    f.flush()
+                    os.fsync(f.fileno())
+                os.replace(tmp, self._path(SNAPSHOT_FILE))
+                # A crash before this truncation is harmless: replay skips events the snapshot covers
+                open(self._path(WAL_FILE), "w").close()
+        except OSError as e:
+            metrics.inc("cursor2api_stats_write_errors_total", file="snapshot")
+            logger.warning("Could not write the stats snapshot: %s", e)
+            return
+        self._last_snapshot = time.time()
+    
+    def snapshot(self):
+        """Write the state of every source and start an empty WAL."""
+        if self.enabled:
+            self._write_snapshot(self._collect())
+    
+    async def snapshot_async(self):
+        """snapshot(), with the disk writes in a worker thread so the event loop keeps serving."""
+        if self.enabled:
+            await asyncio.to_thread(self._write_snapshot, self._collect())
+    
+    def recover(self):
+        """Restore the latest snapshot, then replay the WAL events written after it."""
+        if not self.enabled:
+            return
+        seq = 0
+        path = self._path(SNAPSHOT_FILE)
+        if os.path.exists(path):
+            try:
+                with open(path, encoding="utf-8") as f:
+                    data = json.load(f)
+            except (OSError, ValueError) as e:
+                # Snapshots are replaced atomically, so this is damage worth stopping for
+                raise ValueError(f"Invalid stats snapshot {path}: {e}") from e
+            seq = data.get("seq", 0)
+            for name, state in (data.get("sources") or {}).items():
+                if name in self._sources:
+                    self._sources[name].restore(state)
+        
+        replayed = 0
+        path = self._path(WAL_FILE)
+        if os.path.exists(path):
+            with open(path, encoding="utf-8") as f:
+                for line in f:
+                    try:
+                        entry = json.loads(line)
+                    except ValueError:
+                        # A write torn by the crash; everything before it is intact
+                        logger.warning("Stats WAL ends in a partial entry after seq %d; ignoring it", seq)
+                        break
+                    if entry["seq"] <= seq:
+                        continue
+                    source = self._sources.get(entry["source"])
+                    if source:
+                        source.apply(entry["event"])
+                    seq = entry["seq"]
+                    replayed += 1
+        
+        with self._lock:
+            self._seq = seq
+        logger.info("Restored usage counters from %s (%d WAL event(s) replayed)", self.directory, replayed)
+        # Fold the replayed events into a fresh snapshot so the WAL starts empty
+        self.snapshot()
+    
+    async def _run(self):
+        """Flush on STATS_FLUSH_INTERVAL and snapshot on STATS_SNAPSHOT_INTERVAL."""
+        while True:
+            await asyncio.sleep(max(settings.stats_flush_interval, 0.1))
+            if time.time() - self._last_snapshot >= settings.stats_snapshot_interval:
+                await self.snapshot_async()
+            else:
+                await asyncio.to_thread(self.flush)
+    
+    def start(self):
+        """Recover the counters and start flushing, if STATS_DIR is set."""
+        if self.enabled and self._task is None:
+            self.recover()
+            self._task = asyncio.create_task(self._run())
+    
+    async def stop(self):
+        """Stop flushing and write a final snapshot."""
+        if self._task:
+            self._task.cancel()
+            self._task = None
+            await self.snapshot_async()
+
+
+# Global stats log instance
+stats_log = StatsLog(settings.stats_dir)
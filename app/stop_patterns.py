@@ -0,0 +1,90 @@
+"""Server-side early termination on stop patterns and repetition loops."""
+import re
+import json
+from collections import Counter, deque
+from typing import List, Optional, Tuple
+from .config import settings
+
+# Only the recent output is searched for patterns
+PATTERN_WINDOW = 2000
+
+
+def _parse_patterns(raw: str) -> List[re.Pattern]:
+    """Parse stop patterns from a JSON array of regexes."""
+    if not raw.strip():
+        return []
+    try:
+        return [re.compile(p, re.MULTILINE) for p in json.loads(raw)]
+    except (ValueError, TypeError, re.error) as e:
+        raise ValueError(f"Invalid STOP_PATTERNS: {e}") from e
+
+
+stop_patterns = _parse_patterns(settings.stop_patterns)
+
+
+class StopDetector:
+    """Watches streamed output and decides when to cut the generation short."""
+    
+    def __init__(self):
+        # Fixed for the detector's lifetime; the n-gram window is sized from it
+        self.config = settings.get()
+        self.text = ""
+        self.reason: Optional[str] = None
+        self._pending_word = ""
+        self._ngrams: deque = deque(maxlen=2000)
+        self._ngram_counts: Counter = Counter()
+        self._words: deque = deque(maxlen=max(self.config.stop_repeat_ngram, 1))
+    
+    @property
+    def enabled(self) -> bool:
+        return bool(stop_patterns) or self.config.stop_repeat_ngram > 0
+    
+    def _check_patterns(self, chunk: str) -> Optional[int]:
+        """Find a new pattern match, returning the cut offset within chunk."""
+        window_start = max(len(self.text) - PATTERN_WINDOW, 0)
+        window = self.text[window_start:] + chunk
+        emitted = len(self.text) - window_start
+        for pattern in stop_patterns:
+            for match in pattern.finditer(window):
+                if match.end() > emitted:
+                    self.reason = f"pattern:{pattern.pattern}"
+                    return max(match.start() - emitted, 0)
+        return None
+    
+    def _check_repetition(self, chunk: str) -> bool:
+        """Count word n-grams and detect a degenerate loop."""
+        n = self.config.stop_repeat_ngram
+        words = (self._pending_word + chunk).split(" ")
+        # The last word may continue in the next chunk
+        self._pending_word = words.pop()
+        for word in words:
+            if not word.strip():
+                continue
+            self._words.append(word.strip())
+            if len(self._words) < n:
+                continue
+            ngram = tuple(self._words)
+            if len(self._ngrams) == self._ngrams.maxlen:
+                self._ngram_counts[self._ngrams[0]] -= 1
+            self._ngrams.append(ngram)
+            self._ngram_counts[ngram] += 1
+            if self._ngram_counts[ngram] >= self.config.stop_repeat_count:
+                self.reason = f"repetition:{' '.join(ngram)[:50]}"
+                return True
+        return False
+    
+    def feed(self, chunk: str) -> Tuple[str, bool]:
+        """Return the text to emit and whether the stream should stop."""
+        if not self.enabled:
+            return chunk, False
+        
+        cut = self._check_patterns(chunk) if stop_patterns else None
+        if cut is not None:
+            chunk = chunk[:cut]
+            self.text += chunk
+            return chunk, True
+        
+        self.text = (self.text + chunk)[-PATTERN_WINDOW * 2:]
+        if self.config.stop_repeat_ngram > 0 and self._check_repetition(chunk.replace("\n", " ")):
+            return chunk, True
+        return chunk, False
@@ -0,0 +1,88 @@
+"""Registry of in-flight client streams and upstream connections."""
+import time
+import threading
+from typing import Dict, List
+from .context import RequestContext
+from .metrics import metrics
+from .token_pool import display_key
+
+metrics.describe("cursor2api_active_streams", "gauge", "Streaming responses currently being sent to clients")
+metrics.describe("cursor2api_active_upstream_connections", "gauge", "Open upstream connections to Cursor")
+metrics.set("cursor2api_active_streams", 0)
+metrics.set("cursor2api_active_upstream_connections", 0)
+
+
+class ActiveStream:
+    """Progress of one streaming response."""
+    
+    def __init__(self, ctx: RequestContext):
+        self.ctx = ctx
+        self.started_at = time.time()
+        self.bytes_out = 0
+        self.chunks_out = 0
+        self.last_write_at = self.started_at
+    
+    def sent(self, data: str):
+        """Record a chunk written to the client."""
+        self.bytes_out += len(data.encode("utf-8"))
+        self.chunks_out += 1
+        self.last_write_at = time.time()
+    
+    def to_dict(self) -> dict:
+        """Serialize for /admin/streams."""
+        now = time.time()
+        key = self.ctx.api_key
+        return {
+            "request_id": self.ctx.request_id,
+            "model": self.ctx.info.model or self.ctx.model,
+            "key": display_key(key),
+            "client_ip": self.ctx.client_ip,
+            "age_seconds": round(now - self.started_at, 1),
+            # A stream that stopped writing long ago is likely stuck
+            "idle_seconds": round(now - self.last_write_at, 1),
+            "bytes_out": self.bytes_out,
+            "chunks_out": self.chunks_out,
+        }
+
+
+class StreamRegistry:
+    """Tracks active streams for /admin/streams and the connection gauges."""
+    
+    def __init__(self):
+        self.active: Dict[str, ActiveStream] = {}
+        self._lock = threading.Lock()
+    
+    def open(self, ctx: RequestContext) -> ActiveStream:
+        """Register a stream that is about to start."""
+        # Keyed by the server-side ID: two streams may carry the same client-chosen request ID
+        stream = ActiveStream(ctx)
+        with self._lock:
+            self.active[ctx.internal_id] = stream
+            metrics.set("cursor2api_active_streams", len(self.active))
+        return stream
+    
+    def close(self, ctx: RequestContext):
+        """Remove a finished or aborted stream."""
+        with self._lock:
+            self.active.pop(ctx.internal_id, None)
+            metrics.set("cursor2api_active_streams", len(self.active))
+    
+    @staticmethod
+    def upstream_opened():
+        """Count an upstream connection as open."""
+        metrics.inc("cursor2api_active_upstream_connections")
+    
+    @staticmethod
+    def upstream_closed():
+        """Count an upstream connection as closed."""
+        metrics.inc("cursor2api_active_upstream_connections", -1)
+    
+    def to_list(self) -> List[dict]:
+        """Active streams, oldest first."""
+        with self._lock:
+            streams = sorted(self.active.values(), key=lambda s: s.started_at)
+        return [s.to_dict() for s in streams]
+
+
+# Global stream registry instance
+stream_registry = StreamRegistry()
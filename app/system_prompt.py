@@ -0,0 +1,121 @@
+"""System prompt injection."""
+import re
+import json
+import logging
+from fnmatch import fnmatch
+from typing import Dict, List
+from .config import settings
+from .models import Message
+from .system_role import prepend_text
+
+logger = logging.getLogger(__name__)
+
+# SYSTEM_PROMPT_POSITION: prepend/append/replace edit the client's first system message; first and before_last add a
+# dedicated system message at the start or right before the latest user message
+
+# Phrases a client system prompt uses to countermand the operator's prompt
+DEFAULT_OVERRIDE_PATTERNS = [
+    r"(?i)\b(ignore|disregard|forget|override)\b[^.\n]{0,40}"
+    r"\b(previous|prior|above|earlier|system|all)\b[^.\n]{0,20}\b(instructions?|prompts?|rules?|messages?)\b",
+    r"(?i)\b(new|updated|real|actual) system prompt\b",
+    r"(?i)\byou are no longer\b",
+]
+# Roles a client can set instructions with; OpenAI's newer APIs call the system role "developer"
+CLIENT_SYSTEM_ROLES = ("system", "developer")
+# Role tags that would let a client fake a message boundary inside its text
+ROLE_TAG = re.compile(r"<\s*/?\s*(system|assistant|user|developer)\s*>", re.I)
+
+
+def _parse_model_prompts(raw: str) -> Dict[str, str]:
+    """Parse per-model prompt variants from a JSON object of {model pattern: prompt}."""
+    if not raw.strip():
+        return {}
+    try:
+        prompts = json.loads(raw)
+    except ValueError as e:
+        raise ValueError(f"Invalid SYSTEM_PROMPT_INJECT_MODELS: {e}") from e
+    if not isinstance(prompts, dict):
+        raise ValueError("Invalid SYSTEM_PROMPT_INJECT_MODELS: expected a JSON object")
+    return {str(k): str(v) for k, v in prompts.items()}
+
+
+def _parse_override_patterns(raw: str) -> List[re.Pattern]:
+    """Parse SYSTEM_PROMPT_OVERRIDE_PATTERNS, a JSON array of regexes (empty = built-in list)."""
+    if not raw.strip():
+        return [re.compile(p) for p in DEFAULT_OVERRIDE_PATTERNS]
+    try:
+        return [re.compile(str(p)) for p in json.loads(raw)]
+    except (ValueError, TypeError, re.error) as e:
+        raise ValueError(f"Invalid SYSTEM_PROMPT_OVERRIDE_PATTERNS: {e}") from e
+
+
+model_prompts = _parse_model_prompts(settings.system_prompt_inject_models)
+override_patterns = _parse_override_patterns(settings.system_prompt_override_patterns)
+
+if settings.system_prompt_locked and not settings.system_prompt_inject and not model_prompts:
+    raise ValueError("SYSTEM_PROMPT_LOCKED needs SYSTEM_PROMPT_INJECT or SYSTEM_PROMPT_INJECT_MODELS")
+
+
+def get_inject_prompt(model: str) -> str:
+    """Get the prompt to inject for a model; per-model variants win over the global prompt."""
+    for pattern, prompt in model_prompts.items():
+        if fnmatch(model, pattern):
+            return prompt
+    return settings.system_prompt_inject
+
+
+def sanitize_system_text(text: str) -> str:
+    """Neutralize override phrases and escape fake role markers in a client system prompt."""
+    for pattern in override_patterns:
+        text = pattern.sub("[removed]", text)
+    return ROLE_TAG.sub(lambda m: m.group(0).replace("<", "&lt;").replace(">", "&gt;"), text)
+
+
+def _guard_client_prompts(messages: List[Message]) -> List[Message]:
+    """Drop client system messages in locked mode, or sanitize them when enabled."""
+    if settings.system_prompt_locked:
+        kept = [msg for msg in messages if msg.role not in CLIENT_SYSTEM_ROLES]
+        if len(kept) != len(messages):
+            logger.info("Dropped %d client system message(s): system prompt is locked", len(messages) - len(kept))
+        return kept
+    if not settings.system_prompt_sanitize:
+        return messages
+    return [
+        Message(role=msg.role, content=sanitize_system_text(msg.get_text_content()), name=msg.name)
+        if msg.role in CLIENT_SYSTEM_ROLES else msg
+        for msg in messages
+    ]
+
+
+def inject_system_prompt(messages: List[Message], model: str, strategy: str = "") -> List[Message]:
+    """Inject the configured system prompt, synthesizing a system message if none exists."""
+    result = list(_guard_client_prompts(messages))
+    prompt = get_inject_prompt(model)
+    if not prompt:
+        return result
+    
+    position = settings.system_prompt_position
+    strategy = strategy or settings.system_role_strategy
+    if position == "before_last":
+        last_user = next((i for i in range(len(result) - 1, -1, -1) if result[i].role == "user"), None)
+        if last_user is not None and strategy != "assistant":
+            # merge and field gather every system message at the start, which would lose the position;
+            # carry the prompt in the latest user message instead
+            result[last_user] = prepend_text(result[last_user], prompt)
+            return result
+        if last_user is not None:
+            return result[:last_user] + [Message(role="system", content=prompt)] + result[last_user:]
+    index = next((i for i, msg in enumerate(result) if msg.role == "system"), None)
+    if index is None or position in ("first", "before_last"):
+        return [Message(role="system", content=prompt)] + result
+    
+    existing = result[index].get_text_content()
+    if position == "prepend":
+        content = f"{prompt}\n{existing}"
+    elif position == "replace":
+        content = prompt
+    else:
+        content = f"{existing}\n{prompt}"
+    
+    result[index] = Message(role="system", content=content, name=result[index].name)
+    return result
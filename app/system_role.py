@@ -0,0 +1,40 @@
+"""Strategies for carrying OpenAI system messages in a Cursor request."""
+from typing import List, Tuple
+from .config import settings, SYSTEM_ROLE_STRATEGIES
+from .models import Message
+
+# SYSTEM_ROLE_STRATEGY
+# assistant: send as a conversation message with role 2, which Cursor treats as a model turn
+# merge:     prepend the system text to the first user message
+# field:     send it in the request's explicit context, where Cursor puts user rules
+
+
+def prepend_text(message: Message, text: str) -> Message:
+    """Put text ahead of a message's content, keeping images and other content parts."""
+    if isinstance(message.content, list):
+        content = [{"type": "text", "text": text}] + message.content
+    else:
+        content = f"{text}\n\n{message.content or ''}"
+    return message.model_copy(update={"content": content})
+
+
+def apply_system_strategy(messages: List[Message], strategy: str = "") -> Tuple[List[Message], str]:
+    """Rewrite system messages per strategy, returning the messages and any instructions text."""
+    strategy = strategy or settings.system_role_strategy
+    if strategy not in SYSTEM_ROLE_STRATEGIES:
+        raise ValueError(f"Unknown system role strategy: {strategy}")
+    
+    system = [m.get_text_content() for m in messages if m.role == "system" and m.get_text_content()]
+    if strategy == "assistant" or not system:
+        return messages, ""
+    
+    instructions = "\n\n".join(system)
+    rest = [m for m in messages if m.role != "system"]
+    if strategy == "field":
+        return rest, instructions
+    
+    index = next((i for i, m in enumerate(rest) if m.role == "user"), None)
+    if index is None:
+        return [Message(role="user", content=instructions)] + rest, ""
+    rest[index] = prepend_text(rest[index], instructions)
+    return rest, ""
@@ -0,0 +1,45 @@
+"""Chat title generation helpers."""
+import re
+from typing import List
+from .models import Message
+
+# Prompts frontends send to name a conversation (Open WebUI, LibreChat, LobeChat, ...)
+TITLE_PATTERN = re.compile(
+    r"\b(generate|create|write|summarize)\b[^.\n]{0,40}\b(short|concise|brief|succinct)\b[^.\n]{0,40}\btitle\b"
+    r"|\btitle\b[^.\n]{0,20}\bfor (this|the) (conversation|chat)\b",
+    re.IGNORECASE
+)
+
+TITLE_INSTRUCTION = (
+    "Generate a concise title of 3-6 words that summarizes the conversation below. "
+    "Reply with the title only, without quotes or trailing punctuation, "
+    "in the same language as the conversation."
+)
+
+# Only the start of the conversation matters for a title
+TITLE_CONTEXT_CHARS = 2000
+
+
+def is_title_request(messages: List[Message]) -> bool:
+    """Check whether a chat request is a frontend title-generation call."""
+    if not messages:
+        return False
+    return bool(TITLE_PATTERN.search(messages[-1].get_text_content()))
+
+
+def build_title_messages(messages: List[Message]) -> List[Message]:
+    """Build the prompt for generating a title from a conversation."""
+    lines = []
+    for msg in messages:
+        if msg.role == "system":
+            continue
+        lines.append(f"{msg.role}: {msg.get_text_content()}")
+    conversation = "\n".join(lines)[:TITLE_CONTEXT_CHARS]
+    return [Message(role="user", content=f"{TITLE_INSTRUCTION}\n\n{conversation}")]
+
+
+def clean_title(text: str) -> str:
+    """Strip quotes, markdown and trailing punctuation from a generated title."""
+    title = text.strip().splitlines()[0] if text.strip() else ""
+    title = re.sub(r"^title:\s*", "", title.strip(" \"'`*#"), flags=re.IGNORECASE)
+    return title.strip(" \"'`*#").rstrip(".。!！")
@@ -0,0 +1,137 @@
+"""Extract the session token and machine IDs from a local Cursor IDE install."""
+import os
+import sys
+import json
+import time
+import base64
+import sqlite3
+from pathlib import Path
+from typing import Dict, List, Optional
+from .token_pool import decode_jwt_claims
+
+# Keys in the ItemTable of globalStorage/state.vscdb
+STATE_KEYS = {
+    "access_token": "cursorAuth/accessToken",
+    "refresh_token": "cursorAuth/refreshToken",
+    "email": "cursorAuth/cachedEmail",
+    "service_machine_id": "storage.serviceMachineId",
+}
+
+# Keys in globalStorage/storage.json
+STORAGE_KEYS = {
+    "machine_id": "telemetry.machineId",
+    "mac_machine_id": "telemetry.macMachineId",
+    "dev_device_id": "telemetry.devDeviceId",
+}
+
+
+def default_storage_dirs() -> List[Path]:
+    """Candidate Cursor globalStorage directories for this platform."""
+    home = Path.home()
+    if sys.platform == "win32":
+        roots = [Path(os.environ.get("APPDATA", home / "AppData" / "Roaming"))]
+    elif sys.platform == "darwin":
+        roots = [home / "Library" / "Application Support"]
+    else:
+        roots = [Path(os.environ.get("XDG_CONFIG_HOME", home / ".config"))]
+    return [root / "Cursor" / "User" / "globalStorage" for root in roots]
+
+
+def _read_state_db(path: Path) -> Dict[str, str]:
+    """Read the auth entries from state.vscdb without locking out a running IDE."""
+    found = {}
+    # Read-only URI so an open Cursor window keeps its lock
+    conn = sqlite3.connect(f"{path.as_uri()}?mode=ro", uri=True)
+    try:
+        for name, key in STATE_KEYS.items():
+            row = conn.execute("SELECT value FROM ItemTable WHERE key = ?", (key,)).fetchone()
+            if row and row[0]:
+                value = row[0].decode() if isinstance(row[0], bytes) else str(row[0])
+                found[name] = value.strip().strip('"')
+    finally:
+        conn.close()
+    return found
+
+
+def _read_storage_json(path: Path) -> Dict[str, str]:
+    """Read the telemetry machine IDs from storage.json."""
+    data = json.loads(path.read_text(encoding="utf-8"))
+    return {name: str(data[key]) for name, key in STORAGE_KEYS.items() if data.get(key)}
+
+
+def extract(storage_dir: Path) -> Dict[str, str]:
+    """Collect token and machine ID material from a globalStorage directory."""
+    found = {}
+    state_db = storage_dir / "state.vscdb"
+    storage_json = storage_dir / "storage.json"
+    if state_db.exists():
+        found.update(_read_state_db(state_db))
+    if storage_json.exists():
+        found.update(_read_storage_json(storage_json))
+    return found
+
+
+def session_token(access_token: str) -> str:
+    """Build a WorkosCursorSessionToken-style value from the IDE access token."""
+    # The sub claim looks like "auth0|user_01J..."; the cookie prefixes the user ID
+    subject = str(decode_jwt_claims(access_token).get("sub", ""))
+    user_id = subject.split("|")[-1]
+    return f"{user_id}%3A%3A{access_token}" if user_id.startswith("user_") else access_token
+
+
+def _timestamp_prefix() -> str:
+    """Obfuscated timestamp the IDE puts in front of the machine IDs."""
+    ts = int(time.time() * 1000) // 1000000
+    data = bytearray((ts >> shift) & 0xFF for shift in (40, 32, 24, 16, 8, 0))
+    key = 165
+    for i in range(len(data)):
+        data[i] = ((data[i] ^ key) + i) & 0xFF
+        key = data[i]
+    return base64.urlsafe_b64encode(bytes(data)).decode().rstrip("=")
+
+
+def checksum(machine_id: str, mac_machine_id: Optional[str] = None) -> str:
+    """Build an x-cursor-checksum value from the machine IDs."""
+    suffix = f"{machine_id}/{mac_machine_id}" if mac_machine_id else machine_id
+    return f"{_timestamp_prefix()}{suffix}"
+
+
+def format_env(found: Dict[str, str]) -> List[str]:
+    """Render extracted values as env lines ready to paste into .env."""
+    lines = []
+    if found.get("email"):
+        lines.append(f"# Account: {found['email']}")
+    if found.get("access_token"):
+        lines.append(f"CURSOR_TOKEN={session_token(found['access_token'])}")
+    if found.get("machine_id"):
+        lines.append(f"CURSOR_CHECKSUM={checksum(found['machine_id'], found.get('mac_machine_id'))}")
+    for name in ("machine_id", "mac_machine_id", "dev_device_id", "service_machine_id"):
+        if found.get(name):
+            lines.append(f"# {name}: {found[name]}")
+    return lines
+
+
+def run_extract(args: List[str]) -> int:
+    """`token extract [--dir PATH]`: print env values read from the local Cursor install."""
+    dirs = default_storage_dirs()
+    if len(args) >= 2 and args[0] == "--dir":
+        dirs = [Path(args[1]).expanduser()]
+    
+    for storage_dir in dirs:
+        if not storage_dir.is_dir():
+            continue
+        print(f"Reading {storage_dir}", file=sys.stderr)
+        try:
+            found = extract(storage_dir)
+        except (sqlite3.Error, OSError, ValueError) as e:
+            print(f"Could not read Cursor state: {e}", file=sys.stderr)
+            return 1
+        if not found.get("access_token"):
+            print("No session token found; log in to Cursor IDE first", file=sys.stderr)
+            return 1
+        print("\n".join(format_env(found)))
+        return 0
+    
+    searched = ", ".join(str(d) for d in dirs)
+    print(f"Cursor globalStorage not found (looked in {searched}); pass --dir PATH", file=sys.stderr)
+    return 1
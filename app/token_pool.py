@@ -0,0 +1,418 @@
+"""Cursor token pool with fast-request budget tracking."""
+import time
+import json
+import hashlib
+import base64
+import random
+import logging
+import statistics
+import threading
+from datetime import datetime, timezone
+from typing import Dict, List, Optional, Tuple
+from .config import settings
+from .stats_log import stats_log
+
+logger = logging.getLogger(__name__)
+
+if settings.token_health_half_life <= 0:
+    raise ValueError(f"Invalid TOKEN_HEALTH_HALF_LIFE: {settings.token_health_half_life} (must be positive)")
+
+
+class BudgetExhaustedError(Exception):
+    """Raised when every token has used up its fast-request budget."""
+
+
+class TokensExpiredError(Exception):
+    """Raised when every token's JWT has expired."""
+
+
+class NoTaggedTokenError(Exception):
+    """Raised when no usable token carries the requested tag."""
+
+
+def current_period() -> str:
+    """Get the budget period key (calendar month)."""
+    return time.strftime("%Y-%m")
+
+
+def decode_jwt_claims(token: str) -> dict:
+    """Decode the claims of a JWT without verifying its signature."""
+    parts = token.split(".")
+    if len(parts) != 3:
+        return {}
+    try:
+        payload = parts[1] + "=" * (-len(parts[1]) % 4)
+        claims = json.loads(base64.urlsafe_b64decode(payload))
+    except (ValueError, TypeError):
+        return {}
+    return claims if isinstance(claims, dict) else {}
+
+
+def _parse_token_tags(raw: str, count: int) -> Dict[int, List[str]]:
+    """Parse {tag: [positions]} into token index -> tags."""
+    if not raw.strip():
+        return {}
+    tags: Dict[int, List[str]] = {}
+    try:
+        for tag, positions in json.loads(raw).items():
+            for position in positions:
+                if not 1 <= int(position) <= count:
+                    raise ValueError(f"tag {tag} refers to token {position}, but only {count} are configured")
+                tags.setdefault(int(position) - 1, []).append(str(tag))
+    except (ValueError, TypeError, AttributeError) as e:
+        raise ValueError(f"Invalid CURSOR_TOKEN_TAGS: {e}") from e
+    return tags
+
+
+def _parse_key_tags(raw: str) -> Dict[str, str]:
+    """Parse {api_key: tag}, where "*" applies to keys without an entry."""
+    if not raw.strip():
+        return {}
+    try:
+        return {str(key): str(tag) for key, tag in json.loads(raw).items()}
+    except (ValueError, TypeError, AttributeError) as e:
+        raise ValueError(f"Invalid KEY_TOKEN_TAGS: {e}") from e
+
+
+def mask_token(token: str) -> str:
+    """Mask a token for display."""
+    if len(token) <= 12:
+        return "***"
+    return f"{token[:6]}...{token[-4:]}"
+
+
+def display_key(api_key: str) -> str:
+    """Show a caller for admin views: signed (hmac:) and JWT (jwt:) identities as is, API keys masked."""
+    return api_key if api_key.startswith(("hmac:", "jwt:")) else mask_token(api_key)
+
+
+class TokenState:
+    """Usage state of a single Cursor token."""
+    
+    def __init__(self, token: str, tags: Optional[List[str]] = None):
+        self.token = token
+        self.name = mask_token(token)
+        # Identifies the token in persisted counters without writing the token itself to disk
+        self.id = hashlib.sha256(token.encode()).hexdigest()[:16]
+        self.tags = tags or []
+        self.period = current_period()
+        self.fast_requests = 0
+        self.slow_requests = 0
+        
+        claims = decode_jwt_claims(token)
+        self.subject: Optional[str] = claims.get("sub")
+        exp = claims.get("exp")
+        self.expires_at: Optional[float] = float(exp) if isinstance(exp, (int, float)) else None
+        self._expiry_logged: Optional[str] = None
+        self.dead = False
+        self.ttfb_ema: Optional[float] = None
+        self.weight = 1.0
+        # Upstream outcomes, fading with TOKEN_HEALTH_HALF_LIFE so a token earns its traffic back gradually
+        self.successes = 0.0
+        self.failures = 0.0
+        self.rate_limits = 0.0
+        self._decayed_at = time.time()
+    
+    def expires_in(self) -> Optional[float]:
+        """Get seconds until the token expires, or None when unknown."""
+        if self.expires_at is None:
+            return None
+        return self.expires_at - time.time()
+    
+    def is_expired(self) -> bool:
+        """Check whether the token's JWT has expired."""
+        remaining = self.expires_in()
+        return remaining is not None and remaining <= 0
+    
+    def is_usable(self) -> bool:
+        """Check whether the token can still be sent upstream."""
+        return not self.dead and not self.is_expired()
+    
+    def mark_dead(self, reason: str):
+        """Take the token out of rotation after the upstream rejected it."""
+        if not self.dead:
+            logger.warning("Cursor token %s marked dead: %s", self.name, reason)
+        self.dead = True
+    
+    def check_expiry(self):
+        """Log a warning once when the token is close to or past expiry."""
+        remaining = self.expires_in()
+        if remaining is None or self._expiry_logged == "expired":
+            return
+        if remaining <= 0:
+            logger.warning("Cursor token %s has expired and will be skipped", self.name)
+            self._expiry_logged = "expired"
+        elif remaining <= settings.token_expiry_warn_days * 86400 and not self._expiry_logged:
+            logger.warning("Cursor token %s expires in %.1f days", self.name, remaining / 86400)
+            self._expiry_logged = "warned"
+    
+    def _roll_period(self):
+        """Reset counters when a new budget period starts."""
+        period = current_period()
+        if period != self.period:
+            self.period = period
+            self.fast_requests = 0
+            self.slow_requests = 0
+    
+    def remaining(self) -> Optional[int]:
+        """Get remaining fast requests, or None when unlimited."""
+        self._roll_period()
+        budget = settings.fast_request_budget
+        if budget <= 0:
+            return None
+        return max(budget - self.fast_requests, 0)
+    
+    def has_budget(self) -> bool:
+        """Check whether the token still has fast requests left."""
+        remaining = self.remaining()
+        return remaining is None or remaining > 0
+    
+    def record_ttfb(self, ttfb_ms: float):
+        """Fold an observed time-to-first-byte into the moving average."""
+        if self.ttfb_ema is None:
+            self.ttfb_ema = ttfb_ms
+        else:
+            alpha = settings.token_ttfb_alpha
+            self.ttfb_ema = alpha * ttfb_ms + (1 - alpha) * self.ttfb_ema
+    
+    def _decay(self):
+        """Fade the outcome counters by the time passed since they were last touched."""
+        now = time.time()
+        factor = 0.5 ** ((now - self._decayed_at) / settings.token_health_half_life)
+        self.successes *= factor
+        self.failures *= factor
+        self.rate_limits *= factor
+        self._decayed_at = now
+    
+    def record_outcome(self, ok: bool, rate_limited: bool = False):
+        """Fold one upstream attempt into the health counters."""
+        self._decay()
+        if ok:
+            self.successes += 1
+        else:
+            self.failures += 1
+        if rate_limited:
+            self.rate_limits += 1
+    
+    def health(self) -> float:
+        """0-1 score from the decayed error rate, each recent 429 halving it."""
+        self._decay()
+        attempts = self.successes + self.failures
+        error_rate = self.failures / attempts if attempts else 0.0
+        return (1 - error_rate) / (1 + self.rate_limits)
+    
+    def record(self, model: str):
+        """Count a request against this token."""
+        self._roll_period()
+        if model == settings.budget_degrade_model:
+            self.slow_requests += 1
+        else:
+            self.fast_requests += 1
+    
+    def to_dict(self) -> dict:
+        """Serialize state for the admin API."""
+        return {
+            "name": self.name,
+            "tags": self.tags,
+            "period": self.period,
+            "fast_requests": self.fast_requests,
+            "slow_requests": self.slow_requests,
+            "budget": settings.fast_request_budget or None,
+            "remaining": self.remaining(),
+            "subject": self.subject,
+            "expires_at": (
+                datetime.fromtimestamp(self.expires_at, timezone.utc).isoformat()
+                if self.expires_at is not None else None
+            ),
+            "expires_in_days": round(self.expires_in() / 86400, 1) if self.expires_at is not None else None,
+            "expired": self.is_expired(),
+            "dead": self.dead,
+            "ttfb_ms_avg": round(self.ttfb_ema) if self.ttfb_ema is not None else None,
+            "weight": round(self.weight, 2),
+            "health": round(self.health(), 3),
+            "recent_failures": round(self.failures, 1),
+            "recent_rate_limits": round(self.rate_limits, 1),
+        }
+
+
+class TokenPool:
+    """Round-robin pool of Cursor tokens."""
+    
+    def __init__(self, tokens: List[str]):
+        tags = _parse_token_tags(settings.cursor_token_tags, len(tokens))
+        self.tokens = [TokenState(t, tags.get(i)) for i, t in enumerate(tokens)]
+        self.key_tags = _parse_key_tags(settings.key_token_tags)
+        self._index = 0
+        self._lock = threading.Lock()
+        # Conversation key -> (pinned token, last used)
+        self._pins: Dict[str, Tuple[TokenState, float]] = {}
+        for state in self.tokens:
+            state.check_expiry()
+    
+    def __len__(self) -> int:
+        return len(self.tokens)
+    
+    def reload(self, tokens: List[str]):
+        """Replace the configured tokens, keeping the usage state of those still present."""
+        tags = _parse_token_tags(settings.cursor_token_tags, len(tokens))
+        with self._lock:
+            existing = {t.token: t for t in self.tokens}
+            states = []
+            for i, token in enumerate(tokens):
+                state = existing.get(token) or TokenState(token)
+                # Tags are positional, so a token that moved picks up the tags of its new slot
+                state.tags = tags.get(i) or []
+                state.check_expiry()
+                states.append(state)
+            self.tokens = states
+            self._pins = {k: v for k, v in self._pins.items() if v[0] in states}
+            self._index = 0
+        logger.info("Token pool reloaded: %d token(s), %d new", len(states),
+                    sum(1 for t in tokens if t not in existing))
+    
+    def _update_weights(self):
+        """Demote tokens whose TTFB is well above the pool's median, and with health scoring, failing tokens."""
+        measured = [t.ttfb_ema for t in self.tokens if t.ttfb_ema is not None]
+        median = statistics.median(measured) if measured else None
+        for t in self.tokens:
+            weight = 1.0
+            # Slow TTFB is often the first sign of throttling on that account
+            if median is not None and t.ttfb_ema is not None and t.ttfb_ema > median:
+                weight = median / t.ttfb_ema
+            if settings.token_health_scoring:
+                weight *= t.health()
+            # Never zero: a recovering token keeps a trickle of traffic instead of all of it returning at once
+            t.weight = max(weight, settings.token_min_weight)
+    
+    def _next(self, candidates: List[TokenState]) -> TokenState:
+        """Pick the next candidate in round-robin order, or by weight."""
+        if (settings.token_latency_weighting or settings.token_health_scoring) and len(candidates) > 1:
+            self._update_weights()
+            return random.choices(candidates, weights=[t.weight for t in candidates])[0]
+        state = candidates[self._index % len(candidates)]
+        self._index += 1
+        return state
+    
+    def _select(self, candidates: List[TokenState], session_key: Optional[str]) -> TokenState:
+        """Pick a token, keeping a conversation on the token that started it."""
+        config = settings.get()
+        if not session_key or not config.session_continuity:
+            return self._next(candidates)
+        
+        now = time.time()
+        self._pins = {k: v for k, v in self._pins.items() if now - v[1] < config.session_ttl}
+        pinned = self._pins.get(session_key)
+        if pinned and pinned[0] in candidates:
+            state = pinned[0]
+        else:
+            state = self._next(candidates)
+            # Fail over only when the pinned token can no longer serve the request
+            if pinned:
+                logger.warning("Session %s failed over from token %s to %s",
+                               session_key[:8], pinned[0].name, state.name)
+        self._pins[session_key] = (state, now)
+        return state
+    
+    def has_tag(self, tag: str) -> bool:
+        """Check whether any configured token carries a tag."""
+        return any(tag in t.tags for t in self.tokens)
+    
+    def tag_for_key(self, api_key: str) -> Optional[str]:
+        """The token tag an API key's class is routed to, if any."""
+        return self.key_tags.get(api_key, self.key_tags.get("*")) or None
+    
+    def acquire(
+        self,
+        model: str,
+        session_key: Optional[str] = None,
+        tag: Optional[str] = None,
+        budgeted: bool = True
+    ) -> Tuple[TokenState, str]:
+        """Select a token for a request, returning the token and the model to use."""
+        with self._lock:
+            if not self.tokens:
+                raise ValueError("CURSOR_TOKEN is not configured")
+            
+            # Skip expired tokens instead of waiting for upstream 401s
+            for t in self.tokens:
+                t.check_expiry()
+            candidates = [t for t in self.tokens if t.is_usable()]
+            if not candidates:
+                raise TokensExpiredError("All Cursor tokens have expired or been rejected")
+            if tag:
+                candidates = [t for t in candidates if tag in t.tags]
+                if not candidates:
+                    raise NoTaggedTokenError(f"No usable Cursor token is tagged {tag}")
+            else:
+                # Reserved tokens are held back for their own class, so untagged traffic cannot drain them
+                reserved = {r.strip() for r in settings.reserved_token_tags.split(",") if r.strip()}
+                candidates = [t for t in candidates if not reserved.intersection(t.tags)]
+                if not candidates:
+                    raise NoTaggedTokenError("Every usable Cursor token is reserved for tagged traffic")
+            
+            config = settings.get()
+            action = config.budget_exhausted_action
+            # Unbudgeted requests (raw passthrough) are not fast requests and leave the counters alone
+            if budgeted and action != "none":
+                available = [t for t in candidates if t.has_budget()]
+                if available:
+                    candidates = available
+                elif action == "degrade":
+                    logger.warning("All tokens exhausted their fast-request budget, degrading %s to %s",
+                                   model, config.budget_degrade_model)
+                    model = config.budget_degrade_model
+                else:
+                    raise BudgetExhaustedError(
+                        "All Cursor tokens have exhausted their fast-request budget"
+                    )
+            
+            state = self._select(candidates, session_key)
+            if budgeted:
+                state.record(model)
+                stats_log.append("tokens", {
+                    "token": state.id, "period": state.period, "slow": model == config.budget_degrade_model
+                })
+            return state, model
+    
+    def counters(self) -> dict:
+        """Budget counters of every token, for the stats snapshot."""
+        with self._lock:
+            return {
+                t.id: {"period": t.period, "fast_requests": t.fast_requests, "slow_requests": t.slow_requests}
+                for t in self.tokens
+            }
+    
+    def restore_counters(self, data: dict):
+        """Restore snapshot counters of the tokens still configured; a past period's counts are dropped."""
+        with self._lock:
+            for t in self.tokens:
+                saved = data.get(t.id)
+                if saved and saved["period"] == current_period():
+                    t.period = saved["period"]
+                    t.fast_requests = saved["fast_requests"]
+                    t.slow_requests = saved["slow_requests"]
+    
+    def apply_counter(self, event: dict):
+        """Replay one request counted against a token."""
+        with self._lock:
+            state = next((t for t in self.tokens if t.id == event["token"]), None)
+            if state is None or event["period"] != current_period():
+                return
+            state._roll_period()
+            if event["slow"]:
+                state.slow_requests += 1
+            else:
+                state.fast_requests += 1
+    
+    def session_count(self, state: TokenState) -> int:
+        """Count conversations currently pinned to a token."""
+        return sum(1 for pinned, _ in self._pins.values() if pinned is state)
+    
+    def to_list(self) -> List[dict]:
+        """Serialize pool state for the admin API."""
+        return [{**t.to_dict(), "sessions": self.session_count(t)} for t in self.tokens]
+
+
+# Global token pool instance
+token_pool = TokenPool(settings.get_clean_tokens())
+stats_log.register("tokens", token_pool.counters, token_pool.restore_counters, token_pool.apply_counter)
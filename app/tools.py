@@ -0,0 +1,218 @@
+"""Tool calling emulation on top of plain-text Cursor completions."""
+import re
+import json
+import uuid
+import logging
+from typing import Any, Dict, List, Optional, Tuple
+from .config import settings
+from .models import Message
+
+logger = logging.getLogger(__name__)
+
+OPEN_TAG = "<tool_call"
+CLOSE_TAG = "</tool_call>"
+# Past calls are replayed with an id attribute, which the model may copy
+OPEN_TAG_PATTERN = re.compile(r"<tool_call\s+name=[\"']([^\"']+)[\"'][^>]*>")
+
+TOOL_INSTRUCTION = (
+    "You can call the tools listed below. To call a tool, write a block in exactly this form:\n"
+    "<tool_call name=\"TOOL_NAME\">\n"
+    "{JSON object with the arguments}\n"
+    "</tool_call>\n"
+    "The arguments must be valid JSON matching the tool's parameters schema. "
+    "You may write several blocks to call several tools. "
+    "Do not describe the call or wrap the block in code fences. "
+    "Tool results will be sent back to you in a later message as <tool_result> blocks "
+    "carrying the id of the call they answer; several results may arrive in one message."
+)
+
+
+def new_call_id() -> str:
+    """Generate an OpenAI-style tool call ID."""
+    return f"call_{uuid.uuid4().hex[:24]}"
+
+
+def tools_enabled(tools: Optional[List[Dict[str, Any]]], tool_choice: Any) -> bool:
+    """Check whether a request should use tool emulation."""
+    return settings.tool_emulation and bool(tools) and tool_choice != "none"
+
+
+def build_tool_prompt(tools: List[Dict[str, Any]], tool_choice: Any = None) -> str:
+    """Describe the available tools and the call format to the model."""
+    lines = [TOOL_INSTRUCTION, "", "Available tools:"]
+    for tool in tools:
+        function = tool.get("function", tool)
+        lines.append(f"- {function.get('name')}: {function.get('description', '')}".rstrip(": "))
+        if function.get("parameters"):
+            lines.append(f"  parameters: {json.dumps(function['parameters'], ensure_ascii=False)}")
+    
+    if tool_choice == "required":
+        lines.append("\nYou must call at least one tool.")
+    elif isinstance(tool_choice, dict) and tool_choice.get("function"):
+        lines.append(f"\nYou must call the tool {tool_choice['function'].get('name')}.")
+    return "\n".join(lines)
+
+
+def format_tool_call(name: str, arguments: str, call_id: Optional[str] = None) -> str:
+    """Render a tool call in the emulated text format."""
+    id_attr = f" id=\"{call_id}\"" if call_id else ""
+    return f"<tool_call name=\"{name}\"{id_attr}>\n{arguments}\n{CLOSE_TAG}"
+
+
+def format_tool_results(results: List[Message], names: Dict[str, str]) -> str:
+    """Merge consecutive tool result messages into one block, keeping call IDs."""
+    blocks = []
+    for msg in results:
+        name = msg.name or names.get(msg.tool_call_id, "tool")
+        blocks.append(
+            f"<tool_result id=\"{msg.tool_call_id or ''}\" name=\"{name}\">\n"
+            f"{msg.get_text_content()}\n</tool_result>"
+        )
+    header = "Result of your tool call:" if len(blocks) == 1 else \
+        f"Results of your {len(blocks)} tool calls, matched to each call by id:"
+    return "\n".join([header] + blocks)
+
+
+def prepare_tool_messages(messages: List[Message], tools: List[Dict[str, Any]], tool_choice: Any = None) -> List[Message]:
+    """Rewrite a tool-calling conversation into plain text messages."""
+    names = {}
+    pending: List[Message] = []
+    result = [Message(role="system", content=build_tool_prompt(tools, tool_choice))]
+    
+    def flush_results():
+        # Results of parallel calls go back as one message so the model sees them together
+        if pending:
+            result.append(Message(role="user", content=format_tool_results(pending, names)))
+            pending.clear()
+    
+    for msg in messages:
+        if msg.role == "tool":
+            pending.append(msg)
+            continue
+        flush_results()
+        if msg.role == "assistant" and msg.tool_calls:
+            blocks = [msg.get_text_content()] if msg.get_text_content() else []
+            for call in msg.tool_calls:
+                function = call.get("function", {})
+                names[call.get("id")] = function.get("name", "")
+                blocks.append(format_tool_call(function.get("name", ""), function.get("arguments", "{}"), call.get("id")))
+            result.append(Message(role="assistant", content="\n".join(blocks)))
+        else:
+            result.append(msg)
+    flush_results()
+    return result
+
+
+def _partial_suffix(text: str, tag: str) -> int:
+    """Length of the longest suffix of text that could start tag."""
+    for length in range(min(len(tag) - 1, len(text)), 0, -1):
+        if tag.startswith(text[-length:]):
+            return length
+    return 0
+
+
+class ToolCallParser:
+    """Turns streamed model text into OpenAI content and tool_calls deltas."""
+    
+    def __init__(self):
+        self.calls: List[Dict[str, Any]] = []
+        self._buffer = ""
+        self._in_call = False
+        self._args_started = False
+    
+    def _start_call(self, name: str) -> Dict[str, Any]:
+        call = {"id": new_call_id(), "type": "function", "function": {"name": name, "arguments": ""}}
+        self.calls.append(call)
+        self._in_call = True
+        self._args_started = False
+        return {"tool_calls": [{
+            "index": len(self.calls) - 1,
+            "id": call["id"],
+            "type": "function",
+            "function": {"name": name, "arguments": ""}
+        }]}
+    
+    def _args_delta(self, fragment: str) -> Optional[Dict[str, Any]]:
+        if not self._args_started:
+            fragment = fragment.lstrip()
+            self._args_started = bool(fragment)
+        if not fragment:
+            return None
+        self.calls[-1]["function"]["arguments"] += fragment
+        return {"tool_calls": [{"index": len(self.calls) - 1, "function": {"arguments": fragment}}]}
+    
+    def _end_call(self):
+        self._in_call = False
+        call = self.calls[-1]["function"]
+        try:
+            json.loads(call["arguments"] or "{}")
+        except ValueError:
+            logger.warning("Tool call %s has invalid JSON arguments", call["name"])
+    
+    def feed(self, chunk: str) -> List[Dict[str, Any]]:
+        """Consume a chunk and return the deltas that can be emitted so far."""
+        self._buffer += chunk
+        deltas = []
+        while self._buffer:
+            if self._in_call:
+                end = self._buffer.find(CLOSE_TAG)
+                if end == -1:
+                    # Stream argument fragments as they arrive, holding back a possible
+                    # partial close tag and whitespace that may precede it
+                    keep = _partial_suffix(self._buffer, CLOSE_TAG)
+                    fragment = self._buffer[:len(self._buffer) - keep].rstrip()
+                    self._buffer = self._buffer[len(fragment):]
+                    delta = self._args_delta(fragment)
+                    if delta:
+                        deltas.append(delta)
+                    break
+                delta = self._args_delta(self._buffer[:end].rstrip())
+                if delta:
+                    deltas.append(delta)
+                self._buffer = self._buffer[end + len(CLOSE_TAG):].lstrip("\n")
+                self._end_call()
+                continue
+            
+            start = self._buffer.find(OPEN_TAG)
+            if start == -1:
+                keep = _partial_suffix(self._buffer, OPEN_TAG)
+                text, self._buffer = self._buffer[:len(self._buffer) - keep], self._buffer[len(self._buffer) - keep:]
+                if text:
+                    deltas.append({"content": text})
+                break
+            
+            if start > 0:
+                deltas.append({"content": self._buffer[:start]})
+                self._buffer = self._buffer[start:]
+            match = OPEN_TAG_PATTERN.match(self._buffer)
+            if not match:
+                if ">" in self._buffer:
+                    # Not a well-formed tag; pass it through as text
+                    deltas.append({"content": OPEN_TAG})
+                    self._buffer = self._buffer[len(OPEN_TAG):]
+                    continue
+                break
+            self._buffer = self._buffer[match.end():]
+            deltas.append(self._start_call(match.group(1)))
+        return deltas
+    
+    def flush(self) -> List[Dict[str, Any]]:
+        """Emit whatever is still buffered once the stream has ended."""
+        deltas = []
+        if self._in_call:
+            delta = self._args_delta(self._buffer.rstrip())
+            if delta:
+                deltas.append(delta)
+            self._end_call()
+        elif self._buffer:
+            deltas.append({"content": self._buffer})
+        self._buffer = ""
+        return deltas
+
+
+def parse_tool_calls(text: str) -> Tuple[Optional[str], List[Dict[str, Any]]]:
+    """Split a complete response into its text content and tool calls."""
+    parser = ToolCallParser()
+    deltas = parser.feed(text) + parser.flush()
+    content = "".join(d.get("content", "") for d in deltas).strip()
+    return content or None, parser.calls
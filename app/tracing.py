@@ -0,0 +1,234 @@
+"""Export request traces to Langfuse or an OpenTelemetry collector."""
+import re
+import time
+import json
+import uuid
+import hashlib
+import base64
+import asyncio
+import logging
+from datetime import datetime, timezone
+from typing import Any, Dict, Optional
+import httpx
+from .config import settings
+from .context import RequestContext
+from .pricing import estimate_tokens, estimate_prompt_tokens, estimate_cost
+
+logger = logging.getLogger(__name__)
+
+EXPORTERS = ("langfuse", "otel")
+
+TRACE_ID = re.compile(r"[0-9a-f]{32}")
+
+
+def _wall_time(mono: Optional[float]) -> float:
+    """Convert a monotonic timestamp to wall-clock time."""
+    if mono is None:
+        return time.time()
+    return time.time() - (time.monotonic() - mono)
+
+
+def _otel_trace_id(request_id: str) -> str:
+    """An OTLP traceId (32 hex digits) for a request ID, which clients may have chosen freely."""
+    # Generated IDs already fit; anything else is hashed so distinct IDs stay distinct and valid
+    if TRACE_ID.fullmatch(request_id) and request_id != "0" * 32:
+        return request_id
+    return hashlib.sha256(request_id.encode()).hexdigest()[:32]
+
+
+def _iso(ts: float) -> str:
+    return datetime.fromtimestamp(ts, timezone.utc).isoformat().replace("+00:00", "Z")
+
+
+def _otel_attr(key: str, value: Any) -> dict:
+    """Build an OTLP/JSON key-value attribute."""
+    if isinstance(value, bool):
+        return {"key": key, "value": {"boolValue": value}}
+    if isinstance(value, int):
+        return {"key": key, "value": {"intValue": str(value)}}
+    if isinstance(value, float):
+        return {"key": key, "value": {"doubleValue": value}}
+    return {"key": key, "value": {"stringValue": str(value)}}
+
+
+class TraceExporter:
+    """Sends one trace per completed request, without blocking the response."""
+    
+    def __init__(self):
+        self._tasks = set()
+    
+    @property
+    def enabled(self) -> bool:
+        return settings.trace_export in EXPORTERS
+    
+    def export(self, ctx: RequestContext, response_id: str, completion: str, error: Optional[str] = None):
+        """Schedule a trace export for a finished request."""
+        if not self.enabled:
+            return
+        record = self._build_record(ctx, response_id, completion, error)
+        task = asyncio.get_running_loop().create_task(self._send(record))
+        # Keep a reference so the task isn't garbage-collected mid-flight
+        self._tasks.add(task)
+        task.add_done_callback(self._tasks.discard)
+    
+    def _build_record(self, ctx: RequestContext, response_id: str, completion: str, error: Optional[str]) -> dict:
+        """Collect the exporter-independent trace fields."""
+        info = ctx.info
+        include_content = settings.trace_include_content
+        model = info.model or ctx.model
+        prompt_tokens = estimate_prompt_tokens(ctx.messages)
+        completion_tokens = estimate_tokens(completion)
+        return {
+            "id": response_id,
+            "request_id": ctx.request_id,
+            "end_user": ctx.end_user or None,
+            "requested_model": info.requested_model or ctx.model,
+            "model": model,
+            "messages": [
+                {"role": msg.role, "content": msg.get_text_content()} for msg in ctx.messages
+            ] if include_content else None,
+            "completion": completion if include_content else None,
+            "error": error,
+            "ghost_mode": info.ghost_mode,
+            "start": _wall_time(info.started_at),
+            "first_token": _wall_time(info.first_byte_at) if info.first_byte_at else None,
+            "end": _wall_time(info.finished_at),
+            "prompt_tokens": prompt_tokens,
+            "completion_tokens": completion_tokens,
+            "cost": estimate_cost(model, prompt_tokens, completion_tokens),
+        }
+    
+    async def _send(self, record: dict):
+        """Send a trace, logging instead of raising on failure."""
+        try:
+            async with httpx.AsyncClient(timeout=10) as client:
+                if settings.trace_export == "langfuse":
+                    await self._send_langfuse(client, record)
+                else:
+                    await self._send_otel(client, record)
+        except Exception as e:
+            logger.warning("Trace export to %s failed: %s", settings.trace_export, e)
+    
+    async def _send_langfuse(self, client: httpx.AsyncClient, record: dict):
+        """Send a trace and generation through the Langfuse ingestion API."""
+        config = settings.get()
+        auth = base64.b64encode(
+            f"{config.langfuse_public_key}:{config.langfuse_secret_key}".encode()
+        ).decode()
+        now = _iso(time.time())
+        usage = {
+            "input": record["prompt_tokens"],
+            "output": record["completion_tokens"],
+            "total": record["prompt_tokens"] + record["completion_tokens"],
+            "unit": "TOKENS",
+        }
+        if record["cost"] is not None:
+            usage["totalCost"] = record["cost"]
+        
+        generation = {
+            "id": record["id"],
+            "traceId": record["request_id"],
+            "name": "chat-completion",
+            "model": record["model"],
+            "input": record["messages"],
+            "output": record["completion"],
+            "startTime": _iso(record["start"]),
+            "endTime": _iso(record["end"]),
+            "usage": usage,
+            "metadata": {
+                "requested_model": record["requested_model"],
+                "ghost_mode": record["ghost_mode"],
+                "instance": settings.instance_name or None,
+            },
+        }
+        if record["first_token"]:
+            generation["completionStartTime"] = _iso(record["first_token"])
+        if record["error"]:
+            generation["level"] = "ERROR"
+            generation["statusMessage"] = record["error"]
+        
+        batch = [
+            {
+                "id": uuid.uuid4().hex,
+                "type": "trace-create",
+                "timestamp": now,
+                "body": {"id": record["request_id"], "name": "cursor2api", "input": record["messages"],
+                         "output": record["completion"], "timestamp": _iso(record["start"]),
+                         "userId": record["end_user"]},
+            },
+            {"id": uuid.uuid4().hex, "type": "generation-create", "timestamp": now, "body": generation},
+        ]
+        response = await client.post(
+            f"{config.langfuse_host.rstrip('/')}/api/public/ingestion",
+            headers={"Authorization": f"Basic {auth}"},
+            json={"batch": batch},
+        )
+        response.raise_for_status()
+    
+    async def _send_otel(self, client: httpx.AsyncClient, record: dict):
+        """Send a span using the OpenTelemetry GenAI semantic conventions over OTLP/HTTP JSON."""
+        attributes = [
+            _otel_attr("gen_ai.system", "cursor"),
+            _otel_attr("gen_ai.operation.name", "chat"),
+            _otel_attr("gen_ai.request.model", record["requested_model"]),
+            _otel_attr("gen_ai.response.model", record["model"]),
+            _otel_attr("gen_ai.response.id", record["id"]),
+            _otel_attr("gen_ai.usage.input_tokens", record["prompt_tokens"]),
+            _otel_attr("gen_ai.usage.output_tokens", record["completion_tokens"]),
+        ]
+        if record["cost"] is not None:
+            attributes.append(_otel_attr("gen_ai.usage.cost", record["cost"]))
+        if record["error"]:
+            attributes.append(_otel_attr("error.type", record["error"]))
+        if record["end_user"]:
+            attributes.append(_otel_attr("enduser.id", record["end_user"]))
+        if record["ghost_mode"] is not None:
+            attributes.append(_otel_attr("cursor2api.ghost_mode", record["ghost_mode"]))
+        
+        events = []
+        if record["messages"] is not None:
+            events.append({
+                "timeUnixNano": str(int(record["start"] * 1e9)),
+                "name": "gen_ai.content.prompt",
+                "attributes": [_otel_attr("gen_ai.prompt", json.dumps(record["messages"], ensure_ascii=False))],
+            })
+            events.append({
+                "timeUnixNano": str(int(record["end"] * 1e9)),
+                "name": "gen_ai.content.completion",
+                "attributes": [_otel_attr("gen_ai.completion", record["completion"])],
+            })
+        
+        span = {
+            "traceId": _otel_trace_id(record["request_id"]),
+            "spanId": uuid.uuid4().hex[:16],
+            "name": f"chat {record['model']}",
+            "kind": 3,  # SPAN_KIND_CLIENT
+            "startTimeUnixNano": str(int(record["start"] * 1e9)),
+            "endTimeUnixNano": str(int(record["end"] * 1e9)),
+            "attributes": attributes,
+            "events": events,
+            "status": {"code": 2, "message": record["error"]} if record["error"] else {"code": 1},
+        }
+        resource = [_otel_attr("service.name", settings.otel_service_name)]
+        if settings.instance_name:
+            resource.append(_otel_attr("service.instance.id", settings.instance_name))
+        payload = {
+            "resourceSpans": [{
+                "resource": {"attributes": resource},
+                "scopeSpans": [{"scope": {"name": "cursor2api"}, "spans": [span]}],
+            }]
+        }
+        response = await client.post(settings.otel_endpoint, headers=self._otel_headers(), json=payload)
+        response.raise_for_status()
+    
+    @staticmethod
+    def _otel_headers() -> Dict[str, str]:
+        """Parse extra OTLP headers from a JSON object."""
+        raw = settings.otel_headers
+        if not raw.strip():
+            return {}
+        return {str(k): str(v) for k, v in json.loads(raw).items()}
+
+
+# Global trace exporter instance
+tracer = TraceExporter()
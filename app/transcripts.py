@@ -0,0 +1,117 @@
+"""Stored transcripts of completed requests, retrievable by response ID."""
+import os
+import re
+import json
+import time
+import hashlib
+import threading
+from typing import Optional
+from .config import settings
+from .context import RequestContext
+from .end_users import hide_user
+
+# Response IDs are generated by us, but the retrieval path is user input
+_ID_PATTERN = re.compile(r"^[A-Za-z0-9_-]{1,64}$")
+
+# Expired transcripts are swept at most this often
+PRUNE_INTERVAL = 60
+
+
+def _owner(api_key: str) -> str:
+    """Hash of the caller identity, so transcripts don't store raw keys."""
+    return hashlib.sha256(api_key.encode()).hexdigest()
+
+
+class TranscriptStore:
+    """One JSON file per response, kept for a retention window."""
+    
+    def __init__(self, directory: str):
+        self.directory = directory
+        self._last_prune = 0.0
+        self._lock = threading.Lock()
+    
+    def _path(self, response_id: str) -> Optional[str]:
+        """File for a response ID, or None if the ID is malformed."""
+        if not _ID_PATTERN.match(response_id):
+            return None
+        return os.path.join(self.directory, f"{response_id}.json")
+    
+    def record(
+        self,
+        ctx: RequestContext,
+        response_id: str,
+        created: int,
+        request: dict,
+        response: str,
+        finish_reason: Optional[str] = "stop",
+        error: Optional[str] = None
+    ):
+        """Save the request and fully assembled response."""
+        if not settings.transcripts:
+            return
+        path = self._path(response_id)
+        if path is None:
+            return
+        entry = {
+            "id": response_id,
+            "created": created,
+            "model": ctx.info.model or ctx.model,
+            "owner": _owner(ctx.api_key),
+            "end_user": ctx.end_user or None,
+            "request": hide_user(request),
+            "response": response,
+            "finish_reason": finish_reason if not error else None,
+            "error": error,
+        }
+        with self._lock:
+            os.makedirs(self.directory, exist_ok=True)
+            with open(path, "w", encoding="utf-8") as f:
+                json.dump(entry, f, ensure_ascii=False)
+            self._prune()
+    
+    def _prune(self):
+        """Delete transcripts older than the retention window."""
+        now = time.time()
+        if now - self._last_prune < PRUNE_INTERVAL:
+            return
+        self._last_prune = now
+        cutoff = now - settings.transcript_retention
+        for name in os.listdir(self.directory):
+            path = os.path.join(self.directory, name)
+            try:
+                if name.endswith(".json") and os.path.getmtime(path) < cutoff:
+                    os.remove(path)
+            except OSError:
+                pass
+    
+    def get(self, response_id: str, api_key: str) -> Optional[dict]:
+        """Load a transcript as a chat.completion object, if the caller owns it."""
+        path = self._path(response_id)
+        if path is None or not os.path.exists(path):
+            return None
+        if time.time() - os.path.getmtime(path) > settings.transcript_retention:
+            return None
+        with open(path, encoding="utf-8") as f:
+            entry = json.load(f)
+        if entry.get("owner") != _owner(api_key):
+            return None
+        
+        result = {
+            "id": entry["id"],
+            "object": "chat.completion",
+            "created": entry["created"],
+            "model": entry["model"],
+            "choices": [{
+                "index": 0,
+                "message": {"role": "assistant", "content": entry["response"]},
+                "finish_reason": entry["finish_reason"],
+            }],
+            "request": entry["request"],
+        }
+        if entry.get("error"):
+            result["error"] = {"message": entry["error"], "type": "api_error", "code": "cursor_api_error"}
+        return result
+
+
+# Global transcript store instance
+transcript_store = TranscriptStore(settings.transcript_dir)
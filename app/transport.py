@@ -0,0 +1,406 @@
+"""Transport, encoder and stream parser interfaces behind CursorClient."""
+import re
+import gzip
+import zlib
+import base64
+import codecs
+import struct
+from urllib.parse import unquote
+from contextlib import asynccontextmanager
+from typing import (
+    TYPE_CHECKING, AsyncContextManager, AsyncIterator, Dict, Mapping, Optional, Protocol, Tuple, Type, Union
+)
+import httpx
+from .metrics import metrics
+
+if TYPE_CHECKING:
+    from .cursor_client import CursorRequest
+
+metrics.describe("cursor2api_upstream_timeouts_total", "counter", "Upstream requests abandoned by timeout phase")
+
+# connect: no connection; ttfb: nothing after sending; idle: the stream stalled; total: STREAM_MAX_DURATION
+TIMEOUT_PHASES = ("connect", "ttfb", "idle", "total")
+
+
+class UpstreamTimeoutError(Exception):
+    """Raised when the upstream misses one of the configured timeouts."""
+    
+    def __init__(self, phase: str, seconds: float):
+        self.phase = phase
+        self.seconds = seconds
+        metrics.inc("cursor2api_upstream_timeouts_total", phase=phase)
+        messages = {
+            "connect": f"Could not connect to the upstream within {seconds:g}s",
+            "ttfb": f"No response from the upstream within {seconds:g}s",
+            "idle": f"Upstream stream stalled for {seconds:g}s",
+            "total": f"Request exceeded the {seconds:g}s duration cap",
+        }
+        super().__init__(messages[phase])
+
+
+# Binary frames are parsed as they are; the -text variants carry the same frames base64-encoded
+BINARY_CONTENT_TYPES = ("application/grpc-web+proto", "application/grpc-web", "application/connect+proto")
+TEXT_CONTENT_TYPES = ("application/grpc-web-text+proto", "application/grpc-web-text")
+# Says nothing about the body, so the first bytes decide
+GENERIC_CONTENT_TYPES = ("", "application/octet-stream")
+
+# Characters kept from a mismatched body for the error message
+SNIPPET_LENGTH = 200
+
+
+class UnexpectedContentTypeError(Exception):
+    """Raised when the upstream answers with something other than gRPC-Web, such as an HTML error page."""
+    
+    def __init__(self, content_type: str, body: bytes):
+        self.content_type = content_type or "no content type"
+        self.snippet = re.sub(r"\s+", " ", body.decode("utf-8", errors="replace")).strip()[:SNIPPET_LENGTH]
+        super().__init__(f"Upstream answered with {self.content_type} instead of gRPC-Web: {self.snippet}")
+
+
+def content_kind(content_type: str) -> Optional[str]:
+    """Classify a response Content-Type as binary, text (base64) or generic; None for anything else."""
+    media_type = content_type.split(";")[0].strip().lower()
+    if media_type in BINARY_CONTENT_TYPES:
+        return "binary"
+    if media_type in TEXT_CONTENT_TYPES:
+        return "text"
+    if media_type in GENERIC_CONTENT_TYPES:
+        return "generic"
+    return None
+
+
+def looks_like_document(chunk: bytes) -> bool:
+    """Whether the first bytes are HTML, XML or JSON rather than a frame, which starts with a flag byte."""
+    return chunk.lstrip()[:1] in (b"<", b"{", b"[")
+
+
+class Base64FrameDecoder:
+    """Decodes a grpc-web-text body as it streams in."""
+    
+    def __init__(self):
+        self._pending = b""
+    
+    def feed(self, data: bytes) -> bytes:
+        """Decode every complete 4-character group; the rest waits for the next chunk."""
+        self._pending += b"".join(data.split())
+        usable = len(self._pending) // 4 * 4
+        groups, self._pending = self._pending[:usable], self._pending[usable:]
+        # Each message is encoded on its own, so padding can appear mid-stream and ends a message
+        out, start = b"", 0
+        for end in range(4, len(groups) + 1, 4):
+            if groups[end - 1:end] == b"=":
+                out += base64.b64decode(groups[start:end])
+                start = end
+        return out + base64.b64decode(groups[start:])
+
+
+async def grpc_web_body(content_type: str, chunks: AsyncIterator[bytes]) -> AsyncIterator[bytes]:
+    """Yield the binary frames of a response body, decoding grpc-web-text and refusing anything else."""
+    kind = content_kind(content_type)
+    decoder = Base64FrameDecoder() if kind == "text" else None
+    sniffed = kind != "generic"
+    async for chunk in chunks:
+        if kind is None or (not sniffed and chunk and looks_like_document(chunk)):
+            # An error page from a proxy or WAF, not something the frame parser should see
+            raise UnexpectedContentTypeError(content_type, chunk)
+        sniffed = sniffed or bool(chunk)
+        yield decoder.feed(chunk) if decoder else chunk
+
+
+class UpstreamResponse(Protocol):
+    """The parts of an HTTP response the client reads."""
+    status_code: int
+    headers: Mapping[str, str]
+    
+    async def aread(self) -> bytes: ...
+    
+    def aiter_bytes(self) -> AsyncIterator[bytes]: ...
+
+
+class Transport(Protocol):
+    """Sends a framed request body and streams back the response."""
+    
+    def stream(
+        self, url: str, body: bytes, headers: dict, timeout: Union[float, httpx.Timeout, None] = None
+    ) -> AsyncContextManager[UpstreamResponse]: ...
+    
+    async def close(self): ...
+
+
+class Encoder(Protocol):
+    """Turns a CursorRequest into the framed bytes sent upstream."""
+    
+    def encode(self, request: "CursorRequest") -> bytes: ...
+    
+    def frame(self, data: bytes) -> bytes: ...
+
+
+class StreamParser(Protocol):
+    """Extracts text payloads from buffered response bytes."""
+    
+    def parse(self, buffer: bytes) -> Tuple[bytes, int]:
+        """Return (UTF-8 payload, bytes consumed); (b\"\", 0) means more data is needed."""
+        ...
+
+
+class HttpTransport:
+    """gRPC-Web over a shared httpx client."""
+    
+    def __init__(self, timeout: Union[float, httpx.Timeout]):
+        self.timeout = timeout
+        self._http: Optional[httpx.AsyncClient] = None
+    
+    @property
+    def http(self) -> httpx.AsyncClient:
+        """Shared HTTP client, so upstream connections are reused across requests."""
+        if self._http is None:
+            self._http = httpx.AsyncClient(timeout=self.timeout)
+        return self._http
+    
+    @asynccontextmanager
+    async def stream(self, url: str, body: bytes, headers: dict, timeout: Union[float, httpx.Timeout, None] = None):
+        """POST the body and yield the streaming response."""
+        kwargs = {"timeout": timeout} if timeout is not None else {}
+        async with self.http.stream("POST", url, content=body, headers=headers, **kwargs) as response:
+            yield response
+    
+    async def close(self):
+        """Close pooled upstream connections."""
+        if self._http is not None:
+            await self._http.aclose()
+            self._http = None
+
+
+# How bytes that are not valid UTF-8 are decoded: U+FFFD, dropped, or failing the request
+DECODE_ERROR_MODES = ("replace", "ignore", "strict")
+
+
+class GuessedPayload(bytes):
+    """A payload the v1 heuristic found by pattern; a false match is garbage rather than text."""
+
+
+class Utf8Assembler:
+    """Decodes payloads as one UTF-8 stream, holding a character split across frames until it completes."""
+    
+    def __init__(self, errors: str = "replace"):
+        self._decoder = codecs.getincrementaldecoder("utf-8")(errors=errors)
+    
+    def feed(self, data: bytes) -> str:
+        """Decode a payload; trailing bytes of an incomplete character wait for the next one."""
+        if isinstance(data, GuessedPayload) and not self._decodes(data):
+            # Dropped whole, as before reassembly, instead of surfacing as U+FFFD or failing the request
+            return ""
+        return self._decoder.decode(data)
+    
+    def _decodes(self, data: bytes) -> bool:
+        """Whether data continues the held bytes as valid UTF-8, an unfinished last character allowed."""
+        probe = codecs.getincrementaldecoder("utf-8")()
+        probe.setstate(self._decoder.getstate())
+        try:
+            probe.decode(data)
+        except UnicodeDecodeError:
+            return False
+        return True
+    
+    def flush(self) -> str:
+        """Decode whatever is still held once the stream has ended."""
+        return self._decoder.decode(b"", final=True)
+
+
+class GrpcWebEncoder:
+    """The hand-written protobuf encoder with a gRPC-Web envelope."""
+    
+    def encode(self, request: "CursorRequest") -> bytes:
+        """Encode the request message."""
+        return request.encode()
+    
+    def frame(self, data: bytes) -> bytes:
+        """Build gRPC-Web envelope with 5-byte length prefix."""
+        # Format: 1-byte compression flag + 4-byte big-endian length + data
+        return struct.pack(">BI", 0, len(data)) + data
+
+
+class GrpcWebParser:
+    """Parses text deltas out of gRPC-Web StreamChat response frames."""
+    
+    def parse(self, buffer: bytes) -> Tuple[bytes, int]:
+        """Parse a gRPC-Web chunk and extract its text payload."""
+        # Look for delimiter pattern: 00 00 00 00
+        delimiter = b'\x00\x00\x00\x00'
+        idx = buffer.find(delimiter)
+        
+        if idx == -1 or len(buffer) < idx + 7:
+            return b"", 0
+        
+        # Check bytes after delimiter
+        byte1 = buffer[idx + 4]
+        byte2 = buffer[idx + 5]
+        byte3 = buffer[idx + 6]
+        
+        # Validate: byte2 should be 0x0A
+        if byte2 != 0x0A:
+            return b"", idx + 1
+        
+        # Validate: byte1 - 2 should equal byte3
+        if byte1 - 2 != byte3:
+            return b"", idx + 1
+        
+        length = byte3
+        chunk_start = idx + 7
+        chunk_end = chunk_start + length
+        
+        if len(buffer) < chunk_end:
+            return b"", 0
+        
+        # Frames are cut by byte count, so a payload may end mid-character; Utf8Assembler joins them
+        return GuessedPayload(buffer[chunk_start:chunk_end]), chunk_end
+
+
+# gRPC-Web frame flags: bit 0 marks a compressed payload, bit 7 a trailer frame
+FLAG_COMPRESSED = 0x01
+FLAG_TRAILER = 0x80
+
+# An envelope claiming more than this is taken for misaligned bytes rather than waited for
+MAX_ENVELOPE = 4 * 1024 * 1024
+
+# Auto-detection only waits this long for an envelope before trying the v1 heuristic instead
+AUTO_MAX_ENVELOPE = 64 * 1024
+
+
+def _read_varint(data: bytes, pos: int) -> Tuple[int, int]:
+    """Decode the varint at pos, returning (value, position after it)."""
+    value = shift = 0
+    while True:
+        if pos >= len(data) or shift > 63:
+            raise ValueError("truncated varint")
+        byte = data[pos]
+        pos += 1
+        value |= (byte & 0x7F) << shift
+        if not byte & 0x80:
+            return value, pos
+        shift += 7
+
+
+def grpc_trailer(data: bytes) -> Optional[Tuple[int, str]]:
+    """(grpc-status, grpc-message) of the first trailer frame found in data, or None without one."""
+    pos = data.find(FLAG_TRAILER.to_bytes(1, "big"))
+    while pos != -1 and pos + 5 <= len(data):
+        length = struct.unpack_from(">I", data, pos + 1)[0]
+        if pos + 5 + length <= len(data):
+            # Trailers are HTTP/1-style header lines
+            fields = {}
+            for line in data[pos + 5:pos + 5 + length].decode("latin-1").split("\r\n"):
+                name, _, value = line.partition(":")
+                fields[name.strip().lower()] = value.strip()
+            status = fields.get("grpc-status", "")
+            if status.isdigit():
+                return int(status), unquote(fields.get("grpc-message", ""))
+        pos = data.find(FLAG_TRAILER.to_bytes(1, "big"), pos + 1)
+    return None
+
+
+def grpc_header_status(headers: Mapping[str, str]) -> Optional[Tuple[int, str]]:
+    """(grpc-status, grpc-message) from response headers, as sent by a trailers-only response."""
+    status = headers.get("grpc-status", "")
+    return (int(status), unquote(headers.get("grpc-message", ""))) if status.isdigit() else None
+
+
+def protobuf_field(message: bytes, field: int) -> bytes:
+    """Concatenated values of a length-delimited field; raises ValueError for malformed protobuf."""
+    out = b""
+    pos = 0
+    while pos < len(message):
+        key, pos = _read_varint(message, pos)
+        number, wire = key >> 3, key & 7
+        if number == 0:
+            raise ValueError("field number 0")
+        if wire == 0:
+            _, pos = _read_varint(message, pos)
+        elif wire == 1:
+            pos += 8
+        elif wire == 2:
+            length, pos = _read_varint(message, pos)
+            if pos + length > len(message):
+                raise ValueError("truncated field")
+            if number == field:
+                out += message[pos:pos + length]
+            pos += length
+        elif wire == 5:
+            pos += 4
+        else:
+            raise ValueError(f"unsupported wire type {wire}")
+    if pos > len(message):
+        raise ValueError("truncated field")
+    return out
+
+
+def _envelope(buffer: bytes, pos: int = 0) -> Optional[Tuple[int, int]]:
+    """(flag, length) of a plausible envelope header at pos, or None when the bytes cannot be one."""
+    flag, length = struct.unpack_from(">BI", buffer, pos)
+    if flag & ~(FLAG_COMPRESSED | FLAG_TRAILER) or length > MAX_ENVELOPE:
+        return None
+    return flag, length
+
+
+class EnvelopeParser:
+    """Reads length-prefixed gRPC-Web frames and decodes the text field of each StreamChat message."""
+    
+    def parse(self, buffer: bytes) -> Tuple[bytes, int]:
+        """Return the text of the next frame that has any, consuming the frames without text before it."""
+        pos = 0
+        while len(buffer) >= pos + 5:
+            header = _envelope(buffer, pos)
+            if header is None:
+                # Out of step with the framing; reported to the caller as skipped bytes
+                return b"", max(pos, 1)
+            flag, length = header
+            end = pos + 5 + length
+            if len(buffer) < end:
+                break
+            # Trailers carry grpc-status, never text
+            text = b"" if flag & FLAG_TRAILER else self._text(flag, buffer[pos + 5:end])
+            if text is None:
+                return b"", end
+            pos = end
+            if text:
+                return text, end
+        # Frames without text wait to be consumed with the next text frame, so they are not counted as skips
+        return b"", 0
+    
+    @staticmethod
+    def _text(flag: int, payload: bytes) -> Optional[bytes]:
+        """Text of one message, or None when it cannot be decoded."""
+        try:
+            if flag & FLAG_COMPRESSED:
+                payload = gzip.decompress(payload)
+            return protobuf_field(payload, 1)
+        except (ValueError, OSError, EOFError, zlib.error):
+            return None
+
+
+class AutoParser:
+    """Parses envelopes while the buffer starts with one, falling back to the v1 heuristic otherwise."""
+    
+    def __init__(self):
+        self.v1 = GrpcWebParser()
+        self.v2 = EnvelopeParser()
+    
+    def parse(self, buffer: bytes) -> Tuple[bytes, int]:
+        """Decide per frame, so a response is read correctly whichever framing the endpoint speaks."""
+        if len(buffer) < 5:
+            return b"", 0
+        header = _envelope(buffer)
+        if header is not None and header[1] <= AUTO_MAX_ENVELOPE:
+            payload, consumed = self.v2.parse(buffer)
+            # Text, or a well-formed envelope still arriving
+            if payload or consumed == 0:
+                return payload, consumed
+        return self.v1.parse(buffer)
+
+
+# Response parsing profiles: new framing fixes ship as a new profile instead of changing an existing one
+PARSER_PROFILES: Dict[str, Type] = {
+    "v1": GrpcWebParser,
+    "v2": EnvelopeParser,
+    "auto": AutoParser,
+}
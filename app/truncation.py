@@ -0,0 +1,122 @@
+"""Input truncation policy preserving message boundaries and recent context."""
+import logging
+from typing import List, Set, Tuple
+from .config import settings, Settings
+from .models import Message
+from .pricing import estimate_tokens
+
+logger = logging.getLogger(__name__)
+
+# LENGTH_UNIT: bytes match the upstream request size; chars and tokens don't charge CJK text three times over
+
+# Messages shorter than this after truncation are dropped instead of kept as a stub
+MIN_KEEP_LENGTH = 200
+
+
+def measure(text: str) -> int:
+    """Measure input length in LENGTH_UNIT."""
+    unit = settings.length_unit
+    if unit == "chars":
+        return len(text)
+    if unit == "tokens":
+        return estimate_tokens(text)
+    return len(text.encode("utf-8"))
+
+
+def _fitting_chars(text: str, length: int, from_end: bool) -> int:
+    """The most characters from one end of text whose token estimate fits in length."""
+    # The estimate only grows as characters are added, so binary search finds the cut
+    low, high = 0, len(text)
+    while low < high:
+        mid = (low + high + 1) // 2
+        part = text[len(text) - mid:] if from_end else text[:mid]
+        if estimate_tokens(part) <= length:
+            low = mid
+        else:
+            high = mid - 1
+    return low
+
+
+def take_head(text: str, length: int) -> str:
+    """The start of text, at most `length` in LENGTH_UNIT."""
+    if length <= 0:
+        return ""
+    unit = settings.length_unit
+    if unit == "chars":
+        return text[:length]
+    if unit == "tokens":
+        return text[:_fitting_chars(text, length, from_end=False)]
+    return text.encode("utf-8")[:length].decode("utf-8", errors="ignore")
+
+
+def take_tail(text: str, length: int) -> str:
+    """The end of text, at most `length` in LENGTH_UNIT."""
+    if length <= 0:
+        return ""
+    unit = settings.length_unit
+    if unit == "chars":
+        return text[-length:]
+    if unit == "tokens":
+        kept = _fitting_chars(text, length, from_end=True)
+        return text[len(text) - kept:]
+    return text.encode("utf-8")[-length:].decode("utf-8", errors="ignore")
+
+
+def keep_tail(text: str, length: int, marker: str) -> str:
+    """Keep the most recent `length` of text, marking the cut with an ellipsis."""
+    return f"{marker}{take_tail(text, length)}"
+
+
+def _protected_indexes(messages: List[Message], config: Settings) -> Set[int]:
+    """Indexes that are only truncated as a last resort: system, first user, last N."""
+    protected = {i for i, msg in enumerate(messages) if msg.role == "system"}
+    keep_last = max(config.truncation_keep_last, 1)
+    protected.update(range(max(len(messages) - keep_last, 0), len(messages)))
+    if config.truncation_keep_first_user:
+        first_user = next((i for i, msg in enumerate(messages) if msg.role == "user"), None)
+        if first_user is not None:
+            protected.add(first_user)
+    return protected
+
+
+def truncate_messages(messages: List[Message], max_length: int) -> Tuple[List[Message], bool]:
+    """Shrink messages to fit max_length, returning the result and whether anything was cut."""
+    contents = [msg.get_text_content() for msg in messages]
+    total = sum(measure(c) for c in contents)
+    if max_length <= 0 or total <= max_length:
+        return messages, False
+    
+    config = settings.get()
+    protected = _protected_indexes(messages, config)
+    dropped = set()
+    
+    # Oldest unprotected messages first, then protected non-system ones (the latest last)
+    order = [i for i in range(len(messages)) if i not in protected]
+    order += [i for i in sorted(protected) if messages[i].role != "system"]
+    
+    for i in order:
+        excess = total - max_length
+        if excess <= 0:
+            break
+        size = measure(contents[i])
+        marker = measure(config.truncation_marker)
+        keep = size - excess - marker
+        if keep >= MIN_KEEP_LENGTH or (i in protected and keep > 0):
+            contents[i] = keep_tail(contents[i], keep, config.truncation_marker)
+            total -= size - measure(contents[i])
+        elif i != len(messages) - 1:
+            # The latest message is never dropped, only cut
+            dropped.add(i)
+            total -= size
+    
+    result = []
+    for i, msg in enumerate(messages):
+        if i in dropped:
+            continue
+        if contents[i] != msg.get_text_content():
+            msg = Message(role=msg.role, content=contents[i], name=msg.name)
+        result.append(msg)
+    
+    logger.info("Truncated input to %d %s (limit %d): %d messages dropped",
+                total, config.length_unit, max_length, len(dropped))
+    return result, True
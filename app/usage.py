@@ -0,0 +1,199 @@
+"""Estimated usage and cost aggregated per API key and per Cursor token."""
+import hashlib
+import threading
+from typing import Dict
+from .config import settings
+from .context import RequestContext
+from .pricing import estimate_tokens, estimate_prompt_tokens, estimate_cost
+from .token_pool import display_key
+from .stats_log import stats_log
+from .registration import registry
+
+# Totals of the labels beyond USAGE_MAX_LABELS
+OTHER_LABEL = "(other)"
+
+
+def key_id(api_key: str) -> str:
+    """Stable ID totals are grouped by; masked keys collide, and the key itself must not be stored."""
+    return hashlib.sha256(api_key.encode()).hexdigest()[:16]
+
+
+class UsageTotals:
+    """Running totals for one API key or token."""
+    
+    def __init__(self):
+        self.requests = 0
+        self.prompt_tokens = 0
+        self.completion_tokens = 0
+        self.cost = 0.0
+        self.unpriced_requests = 0
+        self.compression_saved_tokens = 0
+    
+    def add(self, prompt_tokens: int, completion_tokens: int, cost, saved_tokens: int = 0):
+        self.requests += 1
+        self.compression_saved_tokens += saved_tokens
+        self.prompt_tokens += prompt_tokens
+        self.completion_tokens += completion_tokens
+        if cost is None:
+            self.unpriced_requests += 1
+        else:
+            self.cost += cost
+    
+    def state(self) -> dict:
+        """Raw counters, unrounded, for the stats snapshot."""
+        return dict(vars(self))
+    
+    @classmethod
+    def from_state(cls, state: dict) -> "UsageTotals":
+        totals = cls()
+        totals.__dict__.update(state)
+        return totals
+    
+    def to_dict(self) -> dict:
+        return {
+            "requests": self.requests,
+            "prompt_tokens": self.prompt_tokens,
+            "completion_tokens": self.completion_tokens,
+            "estimated_cost": round(self.cost, 6),
+            "unpriced_requests": self.unpriced_requests,
+            "compression_saved_tokens": self.compression_saved_tokens,
+        }
+
+
+class VariantStats:
+    """Latency and length of the responses served by one experiment variant."""
+    
+    def __init__(self):
+        self.requests = 0
+        self.completion_tokens = 0
+        self.completion_chars = 0
+        self.ttfb_ms = 0
+        self.duration_ms = 0
+        # Cached replays have no upstream timings
+        self.timed = 0
+    
+    def add(self, ctx: RequestContext, completion: str, completion_tokens: int):
+        self.requests += 1
+        self.completion_tokens += completion_tokens
+        self.completion_chars += len(completion)
+        if ctx.info.ttfb_ms is not None and ctx.info.duration_ms is not None:
+            self.timed += 1
+            self.ttfb_ms += ctx.info.ttfb_ms
+            self.duration_ms += ctx.info.duration_ms
+    
+    def to_dict(self) -> dict:
+        return {
+            "requests": self.requests,
+            "avg_completion_tokens": round(self.completion_tokens / self.requests, 1) if self.requests else None,
+            "avg_completion_chars": round(self.completion_chars / self.requests, 1) if self.requests else None,
+            "avg_ttfb_ms": round(self.ttfb_ms / self.timed) if self.timed else None,
+            "avg_duration_ms": round(self.duration_ms / self.timed) if self.timed else None,
+        }
+
+
+class UsageStore:
+    """In-memory usage store for chargeback."""
+    
+    def __init__(self):
+        # Key ID -> totals, and the masked key shown for it
+        self.keys: Dict[str, UsageTotals] = {}
+        self.key_names: Dict[str, str] = {}
+        self.tokens: Dict[str, UsageTotals] = {}
+        # "key=value" request metadata label -> totals
+        self.labels: Dict[str, UsageTotals] = {}
+        # Experiment ID -> variant ID -> stats
+        self.experiments: Dict[str, Dict[str, VariantStats]] = {}
+        self._lock = threading.Lock()
+    
+    def record(self, ctx: RequestContext, completion: str):
+        """Add a finished request's estimated usage and cost."""
+        model = ctx.info.model or ctx.model
+        prompt_tokens = estimate_prompt_tokens(ctx.messages)
+        completion_tokens = estimate_tokens(completion)
+        cost = estimate_cost(model, prompt_tokens, completion_tokens)
+        event = {
+            "key": key_id(ctx.api_key),
+            "key_name": display_key(ctx.api_key),
+            "token": ctx.info.token,
+            "labels": [f"{label}={value}" for label, value in (ctx.overrides.get("metadata") or {}).items()],
+            "prompt_tokens": prompt_tokens,
+            "completion_tokens": completion_tokens,
+            "cost": cost,
+            "saved_tokens": ctx.overrides.get("compression_saved_tokens", 0),
+        }
+        with self._lock:
+            self._add(event)
+            experiment = ctx.overrides.get("experiment")
+            if experiment:
+                variants = self.experiments.setdefault(experiment[0], {})
+                variants.setdefault(experiment[1], VariantStats()).add(ctx, completion, completion_tokens)
+        stats_log.append("usage", event)
+        registry.record_usage(ctx.api_key, prompt_tokens + completion_tokens)
+    
+    def _add(self, event: dict):
+        """Add one request to its key, token and label totals. Caller holds the lock."""
+        args = (event["prompt_tokens"], event["completion_tokens"], event["cost"], event["saved_tokens"])
+        self.keys.setdefault(event["key"], UsageTotals()).add(*args)
+        # Events written before keys were hashed carry the masked key as the ID
+        self.key_names[event["key"]] = event.get("key_name", event["key"])
+        if event["token"]:
+            self.tokens.setdefault(event["token"], UsageTotals()).add(*args)
+        for label in event["labels"]:
+            label = self._label(label)
+            if label:
+                self.labels.setdefault(label, UsageTotals()).add(*args)
+    
+    def _label(self, label: str) -> str:
+        """Totals a "key=value" label counts under; "" outside USAGE_LABEL_KEYS. Caller holds the lock."""
+        key = label.partition("=")[0]
+        allowed = settings.get_usage_label_keys()
+        if allowed and key not in allowed:
+            return ""
+        # Metadata is caller-chosen, so new labels stop getting their own totals at the cap
+        if label not in self.labels and len(self.labels) >= settings.usage_max_labels:
+            return OTHER_LABEL
+        return label
+    
+    def apply(self, event: dict):
+        """Replay a recorded request from the stats WAL."""
+        with self._lock:
+            self._add(event)
+    
+    def snapshot(self) -> dict:
+        """Key, token and label totals for the stats snapshot; experiment stats are not persisted."""
+        with self._lock:
+            state = {
+                group: {name: totals.state() for name, totals in getattr(self, group).items()}
+                for group in ("keys", "tokens", "labels")
+            }
+            state["key_names"] = dict(self.key_names)
+            return state
+    
+    def restore(self, state: dict):
+        """Replace the totals with those of a stats snapshot."""
+        with self._lock:
+            for group in ("keys", "tokens", "labels"):
+                setattr(self, group, {
+                    name: UsageTotals.from_state(totals) for name, totals in (state.get(group) or {}).items()
+                })
+            self.key_names = {k: (state.get("key_names") or {}).get(k, k) for k in self.keys}
+    
+    def to_dict(self) -> dict:
+        """Serialize totals for the admin API."""
+        with self._lock:
+            return {
+                "keys": {k: {"key": self.key_names.get(k, k), **v.to_dict()} for k, v in self.keys.items()},
+                "tokens": {k: v.to_dict() for k, v in self.tokens.items()},
+                "labels": {k: v.to_dict() for k, v in self.labels.items()},
+                "experiments": {
+                    e: {variant: stats.to_dict() for variant, stats in variants.items()}
+                    for e, variants in self.experiments.items()
+                },
+                "total_estimated_cost": round(sum(v.cost for v in self.keys.values()), 6),
+                "total_compression_saved_tokens": sum(v.compression_saved_tokens for v in self.keys.values()),
+            }
+
+
+# Global usage store instance
+usage_store = UsageStore()
+stats_log.register("usage", usage_store.snapshot, usage_store.restore, usage_store.apply)
@@ -0,0 +1,89 @@
+"""Strict-mode rejection of request parameters the backend cannot honor."""
+from typing import Dict, Iterator, List, Tuple
+from .models import ChatCompletionRequest
+from .tools import tools_enabled
+
+# OpenAI's limits on the metadata map
+METADATA_MAX_PAIRS = 16
+METADATA_MAX_KEY_LENGTH = 64
+METADATA_MAX_VALUE_LENGTH = 512
+
+
+class UnsupportedParameterError(Exception):
+    """Raised in strict mode for a parameter that would otherwise be ignored."""
+    
+    def __init__(self, param: str, message: str):
+        super().__init__(message)
+        self.param = param
+
+
+def _problems(request: ChatCompletionRequest) -> Iterator[Tuple[str, str]]:
+    """Yield (param, message) for every unsupported parameter."""
+    extra = request.model_extra or {}
+    
+    if extra.get("audio") is not None:
+        yield "audio", "Audio output is not supported by this backend."
+    modalities = extra.get("modalities")
+    if modalities and any(m != "text" for m in modalities):
+        yield "modalities", "Only the 'text' modality is supported."
+    for param in ("functions", "function_call"):
+        if extra.get(param) is not None:
+            yield param, f"'{param}' is deprecated and not supported; use 'tools' with TOOL_EMULATION enabled."
+    if request.tools and not tools_enabled(request.tools, request.tool_choice) and request.tool_choice != "none":
+        yield "tools", "Tool calling is not enabled on this deployment (TOOL_EMULATION=false)."
+    if request.n and request.n > 1:
+        yield "n", "Only n=1 is supported; use best_of to pick among several generations."
+    if extra.get("logprobs") or extra.get("top_logprobs"):
+        yield "logprobs", "Log probabilities are not available from this backend."
+    if extra.get("logit_bias"):
+        yield "logit_bias", "logit_bias is not supported by this backend."
+    response_format = extra.get("response_format")
+    if isinstance(response_format, dict) and response_format.get("type", "text") != "text":
+        yield "response_format", f"response_format type '{response_format.get('type')}' is not supported."
+    if extra.get("prediction") is not None:
+        yield "prediction", "Predicted outputs are not supported by this backend."
+
+
+def validate_strict(request: ChatCompletionRequest):
+    """Raise UnsupportedParameterError if the request uses an unsupported parameter."""
+    problem = next(_problems(request), None)
+    if problem:
+        raise UnsupportedParameterError(*problem)
+
+
+def ignored_parameters(request: ChatCompletionRequest) -> List[str]:
+    """Parameters that will be ignored outside strict mode."""
+    return [param for param, _ in _problems(request)]
+
+
+def dropped_content_types(request: ChatCompletionRequest) -> List[str]:
+    """Content part types (image_url, input_audio, ...) the upstream never sees."""
+    dropped = set()
+    for msg in request.messages:
+        if isinstance(msg.content, list):
+            dropped.update(
+                str(part.get("type")) for part in msg.content
+                if isinstance(part, dict) and part.get("type") != "text"
+            )
+    return sorted(dropped)
+
+
+class InvalidMetadataError(ValueError):
+    """Raised for a metadata map outside OpenAI's limits."""
+    
+    def __init__(self, message: str, param: str = "metadata"):
+        super().__init__(message)
+        self.param = param
+
+
+def validate_metadata(metadata: Dict[str, str]):
+    """Check the metadata map against OpenAI's limits, so labels behave the same on both."""
+    if len(metadata) > METADATA_MAX_PAIRS:
+        raise InvalidMetadataError(f"metadata may have at most {METADATA_MAX_PAIRS} pairs")
+    for key, value in metadata.items():
+        if len(key) > METADATA_MAX_KEY_LENGTH:
+            raise InvalidMetadataError(f"metadata keys may be at most {METADATA_MAX_KEY_LENGTH} characters")
+        if len(value) > METADATA_MAX_VALUE_LENGTH:
+            raise InvalidMetadataError(
+                f"metadata values may be at most {METADATA_MAX_VALUE_LENGTH} characters", f"metadata.{key}"
+            )
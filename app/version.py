@@ -0,0 +1,87 @@
+"""Cursor client version auto-detection."""
+import re
+import asyncio
+import logging
+from typing import Optional
+import httpx
+from .config import settings
+
+logger = logging.getLogger(__name__)
+
+VERSION_PATTERN = re.compile(r"\d+\.\d+\.\d+")
+# Release file names a download redirect points at, e.g. cursor-0.50.5-x86_64.AppImage
+RELEASE_FILE_PATTERN = re.compile(r"cursor[-_](\d+\.\d+\.\d+)[-_.][^/]*$", re.IGNORECASE)
+
+
+class VersionDetector:
+    """Keeps the x-cursor-client-version header in sync with Cursor releases."""
+    
+    def __init__(self):
+        self.detected_version: Optional[str] = None
+        self.last_error: Optional[str] = None
+        self._task: Optional[asyncio.Task] = None
+    
+    @property
+    def current(self) -> str:
+        """Get the version string to send upstream."""
+        if settings.cursor_version_auto and self.detected_version:
+            return self.detected_version
+        return settings.cursor_version
+    
+    def _parse_version(self, response: httpx.Response) -> Optional[str]:
+        """Extract a version number from release metadata or a download redirect."""
+        # Error pages and HTML bodies must never decide the version sent upstream
+        if response.is_redirect:
+            path = httpx.URL(response.headers.get("location", "")).path
+            match = RELEASE_FILE_PATTERN.search(path)
+            return match.group(1) if match else None
+        if not response.is_success:
+            return None
+        try:
+            data = response.json()
+        except ValueError:
+            return None
+        version = data.get("version") if isinstance(data, dict) else None
+        if isinstance(version, str) and VERSION_PATTERN.fullmatch(version):
+            return version
+        return None
+    
+    async def check(self) -> Optional[str]:
+        """Fetch release metadata once and update the detected version."""
+        try:
+            async with httpx.AsyncClient(timeout=15) as client:
+                response = await client.get(settings.cursor_version_check_url)
+            version = self._parse_version(response)
+            if not version:
+                raise ValueError(f"no version found in response (status {response.status_code})")
+        except Exception as e:
+            self.last_error = str(e)
+            logger.warning("Cursor version check failed: %s", e)
+            return None
+        
+        self.last_error = None
+        if version != self.detected_version:
+            logger.info("Detected Cursor version %s (configured %s)", version, settings.cursor_version)
+            self.detected_version = version
+        return version
+    
+    async def _run(self):
+        """Periodically refresh the detected version."""
+        while True:
+            await self.check()
+            await asyncio.sleep(max(settings.cursor_version_check_interval, 60))
+    
+    def start(self):
+        """Start the background checker if auto-detection is enabled."""
+        if settings.cursor_version_auto and self._task is None:
+            self._task = asyncio.create_task(self._run())
+    
+    async def stop(self):
+        """Stop the background checker."""
+        if self._task:
+            self._task.cancel()
+            self._task = None
+
+
+# Global version detector instance
+version_detector = VersionDetector()
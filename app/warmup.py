@@ -0,0 +1,94 @@
+"""Startup warm-up of upstream connections and per-token pre-flight auth."""
+import time
+import asyncio
+import logging
+from typing import Dict, Optional
+from .config import settings
+from .cursor_client import cursor_client
+from .token_pool import token_pool, TokenState
+
+logger = logging.getLogger(__name__)
+
+
+class WarmUp:
+    """Pre-establishes TLS connections and checks tokens before traffic arrives."""
+    
+    def __init__(self):
+        self.done = False
+        self.duration_ms: Optional[int] = None
+        self.connections = 0
+        self.tokens: Dict[str, str] = {}
+        self._task: Optional[asyncio.Task] = None
+    
+    async def _open_connection(self) -> bool:
+        """Open one pooled connection; any HTTP response means TLS is established."""
+        try:
+            await cursor_client.http.get(cursor_client.api_url, timeout=10)
+            return True
+        except Exception as e:
+            logger.warning("Warm-up connection to %s failed: %s", cursor_client.api_url, e)
+            return False
+    
+    async def _preflight(self, state: TokenState) -> str:
+        """Send a tiny authenticated request for one token."""
+        try:
+            response = await cursor_client.http.get(
+                f"{cursor_client.api_url}{settings.warmup_preflight_path}",
+                headers={"Authorization": f"Bearer {state.token}"},
+                timeout=10,
+            )
+        except Exception as e:
+            return f"error: {e}"
+        if response.status_code == 401:
+            state.mark_dead("pre-flight authentication returned 401")
+            return "unauthorized"
+        if response.status_code >= 400:
+            return f"error: HTTP {response.status_code}"
+        return "ok"
+    
+    async def run(self):
+        """Run the warm-up once."""
+        started = time.monotonic()
+        results = await asyncio.gather(*(self._open_connection() for _ in range(settings.warmup_connections)))
+        self.connections = sum(results)
+        
+        if settings.warmup_preflight:
+            states = [t for t in token_pool.tokens if t.is_usable()]
+            outcomes = await asyncio.gather(*(self._preflight(t) for t in states))
+            self.tokens = {t.name: outcome for t, outcome in zip(states, outcomes)}
+            for name, outcome in self.tokens.items():
+                log = logger.info if outcome == "ok" else logger.warning
+                log("Pre-flight auth for token %s: %s", name, outcome)
+        
+        self.duration_ms = int((time.monotonic() - started) * 1000)
+        self.done = True
+        logger.info("Warm-up finished in %d ms: %d/%d connections", self.duration_ms,
+                    self.connections, settings.warmup_connections)
+    
+    def start(self):
+        """Start the warm-up in the background so startup isn't blocked."""
+        # DRY_RUN sends nothing upstream, including warm-up traffic
+        if settings.dry_run or (settings.warmup_connections <= 0 and not settings.warmup_preflight):
+            self.done = True
+            return
+        if self._task is None:
+            self._task = asyncio.create_task(self.run())
+    
+    async def stop(self):
+        """Cancel an unfinished warm-up."""
+        if self._task:
+            self._task.cancel()
+            self._task = None
+    
+    def to_dict(self) -> dict:
+        """Serialize warm-up results for /readyz."""
+        return {
+            "done": self.done,
+            "duration_ms": self.duration_ms,
+            "connections": self.connections,
+            "tokens": self.tokens,
+        }
+
+
+# Global warm-up instance
+warmup = WarmUp()
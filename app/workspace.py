@@ -0,0 +1,70 @@
+"""Per-request workspace context sent as `extra_body.workspace`."""
+from typing import Any, Dict, List, Optional
+
+# Cap on file contents forwarded as context
+MAX_FILE_CHARS = 100000
+
+
+class WorkspaceFile:
+    """A file the client has open, optionally with its contents."""
+    
+    def __init__(self, path: str, content: str = "", line: int = 0):
+        self.path = path
+        self.content = content[:MAX_FILE_CHARS]
+        self.line = line
+    
+    @classmethod
+    def parse(cls, value: Any) -> "WorkspaceFile":
+        """Parse a path string or a {path, content, line} object."""
+        if isinstance(value, str):
+            return cls(value)
+        if isinstance(value, dict) and isinstance(value.get("path"), str):
+            try:
+                line = int(value.get("line") or 0)
+            except (TypeError, ValueError):
+                line = -1
+            # Encoded as a varint, which has no negative form
+            if line < 0:
+                raise ValueError("workspace file line must be a non-negative integer")
+            return cls(value["path"], str(value.get("content") or ""), line)
+        raise ValueError("workspace files must be a path or an object with a path")
+
+
+class Workspace:
+    """Project context a coding assistant passes along with a request."""
+    
+    def __init__(self, root: str = "", open_files: Optional[List[WorkspaceFile]] = None,
+                 active_file: Optional[WorkspaceFile] = None):
+        self.root = root
+        self.open_files = open_files or []
+        self.active_file = active_file
+    
+    @classmethod
+    def parse(cls, data: Dict[str, Any]) -> "Workspace":
+        """Parse the workspace object, raising ValueError on a malformed one."""
+        if not isinstance(data, dict):
+            raise ValueError("workspace must be an object")
+        root = data.get("root", "")
+        if not isinstance(root, str):
+            raise ValueError("workspace.root must be a string")
+        open_files = data.get("open_files") or []
+        if not isinstance(open_files, list):
+            raise ValueError("workspace.open_files must be a list")
+        active = data.get("active_file")
+        return cls(
+            root=root,
+            open_files=[WorkspaceFile.parse(f) for f in open_files],
+            active_file=WorkspaceFile.parse(active) if active else None,
+        )
+    
+    def context_text(self) -> str:
+        """Describe the open files for the request's explicit context field."""
+        if not self.open_files:
+            return ""
+        parts = ["Open files:"]
+        for f in self.open_files:
+            parts.append(f"- {f.path}")
+        for f in self.open_files:
+            if f.content:
+                parts.append(f"\n--- {f.path} ---\n{f.content}")
+        return "\n".join(parts)
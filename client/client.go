@@ -0,0 +1,218 @@
+// Package client is a small Go client for the cursor2api proxy.
+//
+// It covers chat completions (plain and streaming) and model listing so
+// services can call the proxy without pulling in a full OpenAI SDK.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Client talks to a cursor2api proxy.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// New creates a client for the proxy at baseURL, e.g. "http://localhost:8000".
+func New(baseURL, apiKey string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ListModels returns the models served by the proxy.
+func (c *Client) ListModels(ctx context.Context) ([]Model, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list modelList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("cursor2api: decode models: %w", err)
+	}
+	return list.Data, nil
+}
+
+// ChatCompletion sends a non-streaming chat completion request.
+func (c *Client) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	req.Stream = false
+	resp, err := c.do(ctx, http.MethodPost, "/v1/chat/completions", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("cursor2api: decode completion: %w", err)
+	}
+	return &out, nil
+}
+
+// StreamChatCompletion starts a streaming chat completion. The caller must
+// Close the returned stream.
+func (c *Client) StreamChatCompletion(ctx context.Context, req ChatCompletionRequest) (*Stream, error) {
+	req.Stream = true
+	resp, err := c.do(ctx, http.MethodPost, "/v1/chat/completions", req)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{body: resp.Body, scanner: newScanner(resp.Body)}, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("cursor2api: encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+func decodeError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+
+	// Errors are either OpenAI-style {"error": {...}} or FastAPI {"detail": "..."}
+	var envelope struct {
+		Error  *APIError `json:"error"`
+		Detail any       `json:"detail"`
+	}
+	if json.Unmarshal(data, &envelope) == nil {
+		switch {
+		case envelope.Error != nil:
+			envelope.Error.StatusCode = resp.StatusCode
+			return envelope.Error
+		case envelope.Detail != nil:
+			apiErr.Message = fmt.Sprint(envelope.Detail)
+			return apiErr
+		}
+	}
+	apiErr.Message = strings.TrimSpace(string(data))
+	return apiErr
+}
+
+// Stream reads chunks from a streaming chat completion.
+type Stream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	done    bool
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	return s
+}
+
+// Recv returns the next chunk, or io.EOF once the stream has finished.
+func (s *Stream) Recv() (*ChatCompletionChunk, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	for s.scanner.Scan() {
+		line := strings.TrimSpace(s.scanner.Text())
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			s.done = true
+			return nil, io.EOF
+		}
+
+		// Mid-stream failures arrive as an error event instead of a chunk
+		var event struct {
+			ChatCompletionChunk
+			Error *APIError `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("cursor2api: decode chunk: %w", err)
+		}
+		if event.Error != nil {
+			s.done = true
+			return nil, event.Error
+		}
+		chunk := event.ChatCompletionChunk
+		return &chunk, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	s.done = true
+	return nil, io.ErrUnexpectedEOF
+}
+
+// Close releases the underlying connection.
+func (s *Stream) Close() error {
+	return s.body.Close()
+}
+
+// Collect reads the rest of the stream and returns the concatenated content.
+func (s *Stream) Collect() (string, error) {
+	var sb strings.Builder
+	for {
+		chunk, err := s.Recv()
+		if errors.Is(err, io.EOF) {
+			return sb.String(), nil
+		}
+		if err != nil {
+			return sb.String(), err
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta != nil {
+				sb.WriteString(choice.Delta.Content)
+			}
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/jiah0231/cursor2api-go/client
+
+go 1.21
@@ -1,4 +1,6 @@
 """Cursor2API - Convert Cursor IDE API to OpenAI-compatible API."""
+import sys
+import logging
 import uvicorn
 from fastapi import FastAPI, Request
 from fastapi.staticfiles import StaticFiles
@@ -6,7 +8,36 @@ from fastapi.responses import FileResponse, HTMLResponse
 from fastapi.middleware.cors import CORSMiddleware
 
 from app.config import settings
+from app.config_check import check_config
 from app.routes import router
+from app.admin import router as admin_router
+from app.version import version_detector
+from app.warmup import warmup
+from app.canary import canary
+from app.secret_files import secret_file_watcher
+from app.stats_log import stats_log
+from app.callbacks import callback_dispatcher
+from app.registration import registry
+from app.log_stream import log_broadcaster
+from app.cursor_client import cursor_client
+from app.openapi import build_openapi
+from app.recovery import init_sentry, unhandled_exception_handler
+from app.request_ids import RequestIdMiddleware, RequestIdFormatter
+from app.http_compression import CompressionMiddleware
+from app.abuse import AbuseMiddleware
+from app.diagnostics import start_tracemalloc
+
+# Typos and conflicting settings are reported before anything is configured or started
+check_config()
+
+# Configure logging; every line carries the request ID it was logged under
+log_handler = logging.StreamHandler()
+log_handler.setFormatter(RequestIdFormatter(
+    "%(asctime)s %(instance_label)s%(levelname)s %(name)s [%(request_id_label)s]: %(message)s"
+))
+logging.basicConfig(level=settings.log_level.upper(), handlers=[log_handler])
+# Feed /admin/logs/stream
+log_broadcaster.install()
 
 # Create FastAPI application
 app = FastAPI(
@@ -15,6 +46,7 @@ app = FastAPI(
     version="2.0.0",
     docs_url="/docs" if settings.debug else None,
     redoc_url="/redoc" if settings.debug else None,
+    openapi_url="/openapi.json",
 )
 
 # Add CORS middleware
@@ -24,10 +56,59 @@ app.add_middleware(
     allow_credentials=True,
     allow_methods=["*"],
     allow_headers=["*"],
+    expose_headers=[
+        "X-Upstream-TTFB", "X-Upstream-Duration", "X-Queue-Wait", "X-Model-Used", "X-Request-ID", "X-Ghost-Mode",
+        "X-Instance-Name",
+    ],
 )
 
+# Banned keys and IPs are turned away before reaching a handler
+app.add_middleware(AbuseMiddleware)
+
+# gzip / br for clients that accept it; inside RequestIdMiddleware so its headers ride along unchanged
+app.add_middleware(CompressionMiddleware)
+
+# Added last so it runs first: the ID is in place for every other middleware and handler
+app.add_middleware(RequestIdMiddleware)
+
+# Turn exceptions that escape a handler into OpenAI-style 500s
+init_sentry()
+app.add_exception_handler(Exception, unhandled_exception_handler)
+
+
+@app.on_event("startup")
+async def startup():
+    """Start background tasks."""
+    version_detector.start()
+    warmup.start()
+    canary.start()
+    secret_file_watcher.start()
+    stats_log.start()
+    start_tracemalloc()
+
+
+@app.on_event("shutdown")
+async def shutdown():
+    """Stop background tasks."""
+    await version_detector.stop()
+    await warmup.stop()
+    await canary.stop()
+    await secret_file_watcher.stop()
+    # Before the client closes, so deferred completions can still reach Cursor
+    await callback_dispatcher.stop()
+    await cursor_client.close()
+    # Usage counted against registered keys' quotas since the last periodic save
+    registry.flush()
+    # Last, so the final snapshot includes the usage of everything that finished above
+    await stats_log.stop()
+
+
 # Include API routes
 app.include_router(router)
+app.include_router(admin_router)
+
+# Serve an OpenAPI spec that documents auth, extension headers and error formats
+app.openapi = lambda: build_openapi(app)
 
 # Mount static files
 app.mount("/static", StaticFiles(directory="static"), name="static")
@@ -46,22 +127,31 @@ async def favicon():
 
 
 if __name__ == "__main__":
+    # CLI commands, e.g. `python main.py replay <response-id>`
+    if len(sys.argv) > 1:
+        from app.cli import run
+        sys.exit(run(sys.argv[1:]))
+    
+    host, port = settings.get_bind_address()
+    display_host = f"[{host}]" if ":" in host else host
+    
     print(f"""
 ╔═══════════════════════════════════════════════════════════╗
 ║                    Cursor2API v2.0.0                      ║
 ║           Cursor IDE API → OpenAI Compatible API          ║
 ╠═══════════════════════════════════════════════════════════╣
-║  服务地址: http://localhost:{settings.port}                       ║
-║  API密钥: {settings.api_key[:20]}{'...' if len(settings.api_key) > 20 else ''}                              
+║  服务地址: http://{display_host}:{port}
+║  API密钥: {len(settings.get_api_keys())} 个                              
 ║  Cursor Token: {'已配置 ✓' if settings.get_clean_token() else '未配置 ✗'}                               ║
 ║  支持模型: {len(settings.get_models())} 个                                     ║
+║  配置环境: {settings.profile or 'default'}
 ╚═══════════════════════════════════════════════════════════╝
     """)
     
     uvicorn.run(
         "main:app",
-        host="0.0.0.0",
-        port=settings.port,
+        host=host,
+        port=port,
         reload=settings.debug
     )
 
@@ -0,0 +1,7 @@
+"""Offline tests; run with `python -m unittest` from the repository root."""
+import os
+
+# Settings are read when app modules are first imported, so the test defaults go in before that
+os.environ.setdefault("API_KEY", "sk-test")
+os.environ.setdefault("CURSOR_TOKEN", "user_test-token")
+os.environ.setdefault("MODELS", "claude-3.5-sonnet,gpt-4o")
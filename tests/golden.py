@@ -0,0 +1,55 @@
+"""Golden request/response fixtures recorded from real client SDKs."""
+import os
+import json
+from pathlib import Path
+from typing import Iterator, Tuple
+
+FIXTURES = Path(__file__).parent / "fixtures"
+
+# Re-record the expected responses instead of comparing against them
+UPDATE = os.environ.get("UPDATE_GOLDEN") == "1"
+
+# Differ on every run: response IDs, timestamps and the IDs of the upstream request
+VOLATILE = {"id": "<id>", "created": 0}
+UPSTREAM_IDS = ("conversation_id", "trace_id", "request_id")
+
+
+def load(group: str) -> Iterator[Tuple[Path, dict]]:
+    """Every fixture of a group, in name order."""
+    for path in sorted((FIXTURES / group).glob("*.json")):
+        with open(path, encoding="utf-8") as f:
+            yield path, json.load(f)
+
+
+def save(path: Path, fixture: dict):
+    """Write a fixture back after re-recording its response."""
+    with open(path, "w", encoding="utf-8") as f:
+        json.dump(fixture, f, indent=2, ensure_ascii=False)
+        f.write("\n")
+
+
+def normalize(value):
+    """Replace the volatile fields of a response body or stream event with placeholders."""
+    if isinstance(value, list):
+        return [normalize(v) for v in value]
+    if not isinstance(value, dict):
+        return value
+    result = {}
+    for key, item in value.items():
+        if key in VOLATILE and not isinstance(item, (dict, list)):
+            result[key] = VOLATILE[key]
+        elif key == "upstream" and isinstance(item, dict):
+            result[key] = {k: f"<{k}>" for k in item if k in UPSTREAM_IDS}
+        else:
+            result[key] = normalize(item)
+    return result
+
+
+def parse_sse(text: str) -> list:
+    """The data payloads of an SSE body, JSON-decoded except for the [DONE] sentinel."""
+    events = []
+    for line in text.splitlines():
+        if line.startswith("data: "):
+            payload = line[len("data: "):]
+            events.append(payload if payload == "[DONE]" else json.loads(payload))
+    return events
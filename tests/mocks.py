@@ -0,0 +1,94 @@
+"""In-memory Transport and Encoder implementations for exercising CursorClient offline."""
+import struct
+import asyncio
+from urllib.parse import quote
+from contextlib import asynccontextmanager
+from typing import Any, AsyncIterator, Dict, List, Optional, Union
+from app.transport import GrpcWebEncoder
+
+
+def text_frame(text: str) -> bytes:
+    """Build a StreamChat response frame carrying one short text delta."""
+    data = text.encode("utf-8")
+    if len(data) > 127:
+        raise ValueError("text_frame only builds single-byte-length frames; split longer text")
+    message = b"\x0a" + bytes([len(data)]) + data
+    return struct.pack(">BI", 0, len(message)) + message
+
+
+def trailer_frame(status: int, message: str = "") -> bytes:
+    """Build a gRPC-Web trailer frame carrying a grpc-status."""
+    fields = f"grpc-status:{status}\r\ngrpc-message:{quote(message)}\r\n".encode()
+    return struct.pack(">BI", 0x80, len(fields)) + fields
+
+
+class MockResponse:
+    """A scripted upstream response."""
+    
+    def __init__(
+        self,
+        chunks: Optional[List[Union[bytes, Exception]]] = None,
+        status_code: int = 200,
+        body: bytes = b"",
+        headers: Optional[Dict[str, str]] = None,
+        delay: float = 0
+    ):
+        self.status_code = status_code
+        self.chunks = chunks or []
+        self.body = body
+        # Seconds before the first chunk, for time-to-first-token behaviour
+        self.delay = delay
+        # Keys in lower case, as httpx looks them up
+        self.headers = headers or {"content-type": "application/grpc-web+proto"}
+    
+    @classmethod
+    def text(cls, *deltas: str, delay: float = 0) -> "MockResponse":
+        """A 200 response streaming the given text deltas, one frame each."""
+        return cls([text_frame(d) for d in deltas], delay=delay)
+    
+    async def aread(self) -> bytes:
+        """Read the whole body, as httpx does for error responses."""
+        return self.body or b"".join(self.chunks)
+    
+    async def aiter_bytes(self) -> AsyncIterator[bytes]:
+        """Yield the scripted chunks; an Exception entry is raised mid-stream."""
+        if self.delay:
+            await asyncio.sleep(self.delay)
+        for chunk in self.chunks:
+            if isinstance(chunk, Exception):
+                raise chunk
+            yield chunk
+
+
+class MockTransport:
+    """Replays scripted responses in order and records every request."""
+    
+    def __init__(self, responses: List[Union[MockResponse, Exception]]):
+        self.responses = list(responses)
+        self.requests: List[dict] = []
+    
+    @asynccontextmanager
+    async def stream(self, url: str, body: bytes, headers: dict, timeout: Optional[Any] = None):
+        """Record the request and yield the next scripted response."""
+        self.requests.append({"url": url, "body": body, "headers": headers, "timeout": timeout})
+        if not self.responses:
+            raise AssertionError(f"MockTransport has no response left for {url}")
+        response = self.responses.pop(0)
+        if isinstance(response, Exception):
+            raise response
+        yield response
+    
+    async def close(self):
+        """Nothing to close."""
+
+
+class RecordingEncoder(GrpcWebEncoder):
+    """The real encoder, keeping each CursorRequest for inspection."""
+    
+    def __init__(self):
+        self.requests = []
+    
+    def encode(self, request) -> bytes:
+        """Record the request, then encode it normally."""
+        self.requests.append(request)
+        return super().encode(request)
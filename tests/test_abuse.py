@@ -0,0 +1,115 @@
+"""Error-rate bans, subject pruning and ban enforcement in app.abuse."""
+import unittest
+from unittest import mock
+from app.config import settings
+from app.abuse import AbuseMonitor, AbuseMiddleware, AbuseBannedError, PRUNE_INTERVAL, is_rejection, subjects_for
+
+
+class AbuseMonitorTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(abuse_detection=True, abuse_min_requests=4, abuse_error_rate=0.5)
+        self.monitor = AbuseMonitor()
+        self.subjects = subjects_for("sk-test", "203.0.113.7")
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    def test_only_request_rejections_count(self):
+        self.assertTrue(is_rejection(400))
+        self.assertTrue(is_rejection(413))
+        # Token trouble, upstream failures and requests that never reached Cursor
+        for status in (None, 200, 401, 403, 429, 500, 502):
+            self.assertFalse(is_rejection(status), status)
+    
+    def test_upstream_rejections_ban_the_caller(self):
+        for _ in range(4):
+            self.monitor.record_response(self.subjects, 400)
+        
+        with self.assertRaises(AbuseBannedError):
+            self.monitor.check(self.subjects)
+    
+    def test_token_errors_do_not_ban(self):
+        for status in (401, 403, 429, None):
+            self.monitor.record_response(self.subjects, status)
+        
+        self.monitor.check(self.subjects)
+    
+    def test_idle_subjects_are_pruned(self):
+        with mock.patch("app.abuse.time.time", return_value=1000.0):
+            self.monitor.record_response(self.subjects, 200)
+            self.monitor.record_prompt(self.subjects, "digest")
+        self.assertEqual(len(self.monitor._responses), 2)
+        
+        later = 1000.0 + settings.abuse_window + PRUNE_INTERVAL
+        with mock.patch("app.abuse.time.time", return_value=later):
+            self.monitor.record_response(["ip:198.51.100.1"], 200)
+        
+        self.assertEqual(set(self.monitor._responses), {"ip:198.51.100.1"})
+        self.assertEqual(dict(self.monitor._prompts), {})
+    
+    def test_lapsed_escalation_is_pruned(self):
+        with mock.patch("app.abuse.time.time", return_value=1000.0):
+            for _ in range(4):
+                self.monitor.record_response(self.subjects, 400)
+        self.assertEqual(set(self.monitor._offences), set(self.subjects))
+        
+        later = 1000.0 + settings.abuse_reset_after + PRUNE_INTERVAL
+        with mock.patch("app.abuse.time.time", return_value=later):
+            self.monitor.record_response(["ip:198.51.100.1"], 200)
+        
+        self.assertEqual(self.monitor._offences, {})
+        self.assertEqual(self.monitor.bans, {})
+
+
+
+class AbuseMiddlewareTest(unittest.IsolatedAsyncioTestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(abuse_detection=True, abuse_min_requests=4, abuse_error_rate=0.5)
+        self.monitor = AbuseMonitor()
+        self.reached = []
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    async def app(self, scope, receive, send):
+        self.reached.append(scope["path"])
+    
+    async def call(self, path: str, authorization: bytes) -> list:
+        sent = []
+        
+        async def send(message):
+            sent.append(message)
+        
+        scope = {"type": "http", "path": path, "headers": [(b"authorization", authorization)],
+                 "client": ("198.51.100.9", 4000)}
+        with mock.patch("app.abuse.abuse_monitor", self.monitor), \
+                mock.patch("app.abuse.jwt_authenticator.verify", mock.AsyncMock(return_value="jwt:alice")):
+            await AbuseMiddleware(self.app)(scope, None, send)
+        return sent
+    
+    async def test_banned_jwt_caller_is_rejected(self):
+        # Offences are recorded against the resolved identity, not the bearer token
+        for _ in range(4):
+            self.monitor.record_response(subjects_for("jwt:alice", ""), 400)
+        
+        sent = await self.call("/generate", b"Bearer header.claims.signature")
+        
+        self.assertEqual(sent[0]["status"], 429)
+        self.assertEqual(self.reached, [])
+    
+    async def test_health_and_admin_are_not_guarded(self):
+        for _ in range(4):
+            self.monitor.record_response(subjects_for("jwt:alice", ""), 400)
+        
+        for path in ("/health", "/admin/abuse"):
+            await self.call(path, b"Bearer header.claims.signature")
+        
+        self.assertEqual(self.reached, ["/health", "/admin/abuse"])
+
+
+if __name__ == "__main__":
+    unittest.main()
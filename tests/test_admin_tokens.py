@@ -0,0 +1,68 @@
+"""Admin key checks and short-lived log stream tokens in app.admin."""
+import time
+import unittest
+from app.config import settings
+from app.admin import log_stream_token, verify_log_stream_token, verify_admin_key, LOG_STREAM_TOKEN_TTL
+
+
+class LogStreamTokenTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(admin_key="sk-admin")
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    def test_fresh_token_is_accepted(self):
+        self.assertTrue(verify_log_stream_token(log_stream_token(int(time.time()) + LOG_STREAM_TOKEN_TTL)))
+    
+    def test_expired_token_is_refused(self):
+        self.assertFalse(verify_log_stream_token(log_stream_token(int(time.time()) - 1)))
+    
+    def test_tampered_expiry_is_refused(self):
+        token = log_stream_token(int(time.time()) + LOG_STREAM_TOKEN_TTL)
+        _, _, mac = token.partition(".")
+        
+        self.assertFalse(verify_log_stream_token(f"{int(time.time()) + 86400}.{mac}"))
+    
+    def test_admin_key_rotation_revokes_tokens(self):
+        token = log_stream_token(int(time.time()) + LOG_STREAM_TOKEN_TTL)
+        settings.update(admin_key="sk-admin-2")
+        
+        self.assertFalse(verify_log_stream_token(token))
+    
+    def test_admin_key_itself_is_not_a_token(self):
+        self.assertFalse(verify_log_stream_token("sk-admin"))
+        self.assertFalse(verify_log_stream_token(None))
+    
+    def test_non_ascii_token_is_refused(self):
+        expires = int(time.time()) + LOG_STREAM_TOKEN_TTL
+        
+        self.assertFalse(verify_log_stream_token(f"{expires}.clé-ünïcode"))
+
+
+class AdminEnabledTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(admin_key="sk-admin")
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    def test_admin_key_is_accepted(self):
+        self.assertTrue(verify_admin_key("Bearer sk-admin"))
+        self.assertFalse(verify_admin_key("Bearer sk-other"))
+    
+    def test_empty_admin_key_disables_admin(self):
+        token = log_stream_token(int(time.time()) + LOG_STREAM_TOKEN_TTL)
+        settings.update(admin_key="", api_key="sk-client")
+        
+        self.assertFalse(verify_admin_key("Bearer sk-client"))
+        self.assertFalse(verify_admin_key("Bearer "))
+        self.assertFalse(verify_log_stream_token(token))
+
+
+if __name__ == "__main__":
+    unittest.main()
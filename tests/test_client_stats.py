@@ -0,0 +1,45 @@
+"""Fingerprint counting and its bounds in app.client_stats."""
+import unittest
+from app.client_stats import ClientStats, MAX_BREAKDOWN, OTHER, fingerprint
+
+
+def event(runtime_version: str, os: str = "Linux", at: int = 0) -> dict:
+    headers = {
+        "user-agent": "OpenAI/Python 1.30.1",
+        "x-stainless-lang": "python",
+        "x-stainless-package-version": "1.30.1",
+        "x-stainless-runtime": "CPython",
+        "x-stainless-runtime-version": runtime_version,
+        "x-stainless-os": os,
+        "x-stainless-arch": "x64",
+    }
+    return {**fingerprint(headers), "key": "sk-a", "at": at}
+
+
+class ClientStatsTest(unittest.TestCase):
+    
+    def setUp(self):
+        self.stats = ClientStats()
+    
+    def test_requests_are_grouped_by_sdk_version(self):
+        self.stats._add(event("3.12.1"))
+        self.stats._add(event("3.11.4", "MacOS"))
+        
+        entry = self.stats.entries["openai-python 1.30.1"]
+        self.assertEqual(entry["requests"], 2)
+        self.assertEqual(entry["runtimes"], {"CPython 3.12.1": 1, "CPython 3.11.4": 1})
+        self.assertEqual(entry["platforms"], {"Linux x64": 1, "MacOS x64": 1})
+    
+    def test_runtimes_and_platforms_are_capped(self):
+        for i in range(MAX_BREAKDOWN + 5):
+            self.stats._add(event(f"3.{i}", f"os-{i}", i))
+        
+        entry = self.stats.entries["openai-python 1.30.1"]
+        self.assertEqual(len(entry["runtimes"]), MAX_BREAKDOWN + 1)
+        self.assertEqual(entry["runtimes"][OTHER], 5)
+        self.assertEqual(len(entry["platforms"]), MAX_BREAKDOWN + 1)
+        self.assertEqual(entry["requests"], MAX_BREAKDOWN + 5)
+
+
+if __name__ == "__main__":
+    unittest.main()
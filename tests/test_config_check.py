@@ -0,0 +1,32 @@
+"""Enumerated settings in app.config_check."""
+import unittest
+from app.config import settings
+from app.config_check import check_settings
+
+
+class EnumeratedSettingsTest(unittest.TestCase):
+    
+    def errors(self, **changes) -> list:
+        config = settings.get().model_copy(update=changes)
+        return [issue.setting for issue in check_settings(config) if issue.level == "error"]
+    
+    def test_defaults_are_valid(self):
+        self.assertEqual([], self.errors())
+    
+    def test_typo_in_enumerated_setting_is_an_error(self):
+        for name, value in (("auth_mode", "jwts"), ("length_unit", "char"), ("system_role_strategy", "merged"),
+                            ("message_uuid_mode", "per_message"), ("maintenance_action", "deny")):
+            with self.subTest(name=name):
+                self.assertIn(name.upper(), self.errors(**{name: value}))
+    
+    def test_unknown_compat_flag_is_an_error(self):
+        self.assertIn("COMPAT_MODE", self.errors(compat_mode="role_delta,stream_usages"))
+        self.assertNotIn("COMPAT_MODE", self.errors(compat_mode="role_delta, stream_usage"))
+    
+    def test_log_level_is_case_insensitive(self):
+        self.assertNotIn("LOG_LEVEL", self.errors(log_level="debug"))
+        self.assertIn("LOG_LEVEL", self.errors(log_level="verbose"))
+
+
+if __name__ == "__main__":
+    unittest.main()
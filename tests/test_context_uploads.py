@@ -0,0 +1,77 @@
+"""Per-key limits and chunk size caps in app.context_uploads."""
+import tempfile
+import unittest
+from app.config import settings
+from app.context_uploads import ContextStore, ContextUploadError, read_chunk
+
+
+async def parts(*chunks: bytes):
+    """Yield chunks as a request body stream does."""
+    for chunk in chunks:
+        yield chunk
+
+
+class ContextStoreLimitsTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(context_upload_max_per_key=2, context_upload_quota_bytes=10, context_upload_max_bytes=8)
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.store = ContextStore(tmp.name)
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    def test_upload_count_is_limited_per_key(self):
+        self.store.create("sk-a")
+        self.store.create("sk-a")
+        
+        with self.assertRaises(ContextUploadError) as caught:
+            self.store.create("sk-a")
+        self.assertEqual(caught.exception.code, "too_many_context_uploads")
+        # Other keys have their own allowance
+        self.store.create("sk-b")
+    
+    def test_bytes_are_limited_across_a_keys_uploads(self):
+        first = self.store.create("sk-a")["id"]
+        second = self.store.create("sk-a")["id"]
+        self.store.put_chunk(first, "sk-a", 0, b"x" * 6)
+        
+        with self.assertRaises(ContextUploadError) as caught:
+            self.store.put_chunk(second, "sk-a", 0, b"x" * 6)
+        self.assertEqual(caught.exception.code, "context_quota_exceeded")
+        # Replacing a chunk only counts the difference
+        self.store.put_chunk(first, "sk-a", 0, b"x" * 8)
+    
+    def test_deleted_uploads_free_the_allowance(self):
+        first = self.store.create("sk-a")["id"]
+        self.store.create("sk-a")
+        self.store.delete(first, "sk-a")
+        
+        self.store.create("sk-a")
+
+
+class ReadChunkTest(unittest.IsolatedAsyncioTestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(context_upload_max_bytes=8)
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    async def test_declared_length_is_refused_before_reading(self):
+        with self.assertRaises(ContextUploadError):
+            await read_chunk(parts(), "9")
+    
+    async def test_stream_is_cut_off_at_the_limit(self):
+        with self.assertRaises(ContextUploadError):
+            await read_chunk(parts(b"x" * 5, b"x" * 5), "")
+    
+    async def test_small_body_is_read(self):
+        self.assertEqual(await read_chunk(parts(b"abc", b"de"), "5"), b"abcde")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,48 @@
+"""End user hashing and idle eviction in app.end_users."""
+import os
+import json
+import tempfile
+import unittest
+from unittest import mock
+from app.config import settings
+from app.end_users import EndUserRegistry, PRUNE_INTERVAL, hash_user
+from app.journal import Journal
+
+
+class EndUserRegistryTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(end_user_idle_ttl=3600)
+        self.registry = EndUserRegistry("")
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    def test_idle_end_users_are_forgotten(self):
+        with mock.patch("app.end_users.time.time", return_value=1000.0):
+            self.registry.record("idle", "sk-a")
+            self.registry.block("idle")
+        
+        later = 1000.0 + 3600 + PRUNE_INTERVAL
+        with mock.patch("app.end_users.time.time", return_value=later):
+            self.registry.record("active", "sk-a")
+        
+        self.assertEqual(set(self.registry.seen), {"active"})
+        # A block outlives the activity record
+        self.assertIn("idle", self.registry.blocked)
+    
+    def test_journal_stores_the_hash_of_user(self):
+        with tempfile.TemporaryDirectory() as directory:
+            settings.update(journal_enabled=True)
+            journal = Journal(os.path.join(directory, "journal.jsonl"))
+            journal.record("chatcmpl-1", {"model": "gpt-4o", "user": "alice@example.com"}, "Hi", "gpt-4o")
+            with open(journal.path, encoding="utf-8") as f:
+                entry = json.loads(f.read())
+        
+        self.assertEqual(entry["request"]["user"], hash_user("alice@example.com"))
+        self.assertNotIn("alice@example.com", json.dumps(entry))
+
+
+if __name__ == "__main__":
+    unittest.main()
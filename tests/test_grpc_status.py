@@ -0,0 +1,48 @@
+"""grpc-status errors sent in place of a StreamChat response."""
+import unittest
+from app.drift import ProtocolDriftError
+from app.errors import UpstreamError, UpstreamQuotaError
+from app.transport import grpc_trailer
+from .mocks import MockResponse, text_frame, trailer_frame
+from .test_retries import UpstreamTestCase
+
+
+class TrailerParsingTest(unittest.TestCase):
+    
+    def test_reads_status_and_message(self):
+        self.assertEqual(grpc_trailer(trailer_frame(8, "Too many requests")), (8, "Too many requests"))
+    
+    def test_finds_trailer_after_other_frames(self):
+        self.assertEqual(grpc_trailer(text_frame("Hi") + trailer_frame(0)), (0, ""))
+    
+    def test_none_without_trailer(self):
+        self.assertIsNone(grpc_trailer(text_frame("Hi")))
+        self.assertIsNone(grpc_trailer(b"\x80\x00\x00"))
+
+
+class GrpcErrorTest(UpstreamTestCase):
+    
+    async def test_error_trailer_is_raised_instead_of_drift(self):
+        client = self.client(MockResponse([trailer_frame(8, "rate limited")]))
+        
+        with self.assertRaisesRegex(UpstreamQuotaError, "rate limited"):
+            await self.collect(client, self.context())
+    
+    async def test_trailers_only_response_is_raised(self):
+        headers = {"content-type": "application/grpc-web+proto", "grpc-status": "3", "grpc-message": "bad%20request"}
+        client = self.client(MockResponse(headers=headers))
+        ctx = self.context()
+        
+        with self.assertRaisesRegex(UpstreamError, "bad request"):
+            await self.collect(client, ctx)
+        self.assertEqual(ctx.info.status, 400)
+    
+    async def test_unparsed_body_is_still_drift(self):
+        client = self.client(MockResponse([b"<html>maintenance</html>"]))
+        
+        with self.assertRaises(ProtocolDriftError):
+            await self.collect(client, self.context())
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,44 @@
+"""Who is shown the server notice in app.notice."""
+import unittest
+from app.context import RequestContext
+from app.models import Message
+from app.notice import NoticeBoard
+
+
+class NoticeTest(unittest.TestCase):
+    
+    def setUp(self):
+        self.board = NoticeBoard()
+    
+    def context(self, api_key="sk-chat-1", end_user="", eligible=True):
+        ctx = RequestContext.create("gpt-4o", [Message(role="user", content="hi")], api_key=api_key, end_user=end_user)
+        ctx.overrides["notice"] = eligible
+        return ctx
+    
+    def test_shown_once_per_end_user(self):
+        self.board.set("Maintenance tonight", ["sk-chat-*"])
+        
+        self.assertEqual(self.board.take(self.context(end_user="a")), "Maintenance tonight\n\n")
+        self.assertEqual(self.board.take(self.context(end_user="a")), "")
+        self.assertEqual(self.board.take(self.context(end_user="b")), "Maintenance tonight\n\n")
+    
+    def test_keys_must_opt_in(self):
+        self.board.set("Maintenance tonight", [])
+        
+        self.assertEqual(self.board.take(self.context()), "")
+    
+    def test_other_keys_are_not_shown(self):
+        self.board.set("Maintenance tonight", ["sk-chat-*"])
+        
+        self.assertEqual(self.board.take(self.context(api_key="sk-batch")), "")
+    
+    def test_requests_not_marked_by_the_handler_are_skipped(self):
+        self.board.set("Maintenance tonight", ["*"])
+        
+        self.assertEqual(self.board.take(self.context(eligible=False)), "")
+        # Still owed to that end user on their next chat reply
+        self.assertEqual(self.board.take(self.context()), "Maintenance tonight\n\n")
+
+
+if __name__ == "__main__":
+    unittest.main()
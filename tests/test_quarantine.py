@@ -0,0 +1,52 @@
+"""Sample scrubbing and write limits in app.quarantine."""
+import os
+import tempfile
+import unittest
+from unittest import mock
+from app.config import settings
+from app.quarantine import Quarantine, scrub
+from app.registration import KEY_PREFIX
+
+
+class QuarantineTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        self.dir = tempfile.TemporaryDirectory()
+        settings.update(quarantine_dir=self.dir.name, quarantine_skip_interval=60)
+        self.quarantine = Quarantine()
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+        self.dir.cleanup()
+    
+    def samples(self):
+        return os.listdir(self.dir.name)
+    
+    def test_skips_are_written_once_per_interval(self):
+        with mock.patch("app.quarantine.time.time", return_value=1000.0):
+            self.quarantine.capture("skipped", b"\x01\x02")
+            self.quarantine.capture("skipped", b"\x03\x04")
+        self.assertEqual(len(self.samples()), 1)
+        
+        with mock.patch("app.quarantine.time.time", return_value=1061.0):
+            self.quarantine.capture("skipped", b"\x03\x04")
+        self.assertEqual(len(self.samples()), 2)
+    
+    def test_repeated_samples_are_written_once(self):
+        self.quarantine.capture("unparsed", b"\x05\x06")
+        self.quarantine.capture("unparsed", b"\x05\x06")
+        self.quarantine.capture("unparsed", b"\x07")
+        
+        self.assertEqual(len(self.samples()), 2)
+    
+    def test_registered_keys_are_scrubbed(self):
+        # Run together with the preceding field bytes, where no word boundary marks the key
+        key = f"{KEY_PREFIX}{'a' * 32}".encode()
+        
+        self.assertEqual(scrub(b"\x12(" + key + b";"), b"\x12(" + b"*" * len(key) + b";")
+        self.assertEqual(scrub(b"id" + key), b"id" + b"*" * len(key))
+
+
+if __name__ == "__main__":
+    unittest.main()
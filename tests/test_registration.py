@@ -0,0 +1,110 @@
+"""Invitation codes, hashed key storage and quotas in app.registration."""
+import os
+import json
+import tempfile
+import unittest
+from app.config import settings
+from app.limits import stream_limiter
+from app.model_access import model_access
+from app.registration import Registry, KeyQuotaExceededError, hash_key
+
+
+class RegistryTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(registration=True)
+        self.dir = tempfile.TemporaryDirectory()
+        self.path = os.path.join(self.dir.name, "registrations.json")
+        self.registry = Registry(self.path)
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+        self.dir.cleanup()
+    
+    def redeem(self, **invitation) -> str:
+        code = self.registry.create_invitation(**invitation)["code"]
+        return self.registry.redeem(code, "alice")["api_key"]
+    
+    def test_only_the_hash_of_a_key_is_saved(self):
+        key = self.redeem()
+        with open(self.path, encoding="utf-8") as f:
+            saved = f.read()
+        
+        self.assertNotIn(key, saved)
+        self.assertIn(hash_key(key), json.loads(saved)["keys"])
+        self.assertTrue(Registry(self.path).is_key(key))
+    
+    def test_plaintext_keys_from_an_older_file_are_hashed(self):
+        key = "sk-c2a-" + "a" * 32
+        with open(self.path, "w", encoding="utf-8") as f:
+            json.dump({"invitations": {}, "keys": {key: {"id": "key_1", "name": "bob"}}}, f)
+        
+        registry = Registry(self.path)
+        
+        self.assertTrue(registry.is_key(key))
+        with open(self.path, encoding="utf-8") as f:
+            self.assertNotIn(key, f.read())
+    
+    def test_request_quota(self):
+        key = self.redeem(max_requests=2)
+        for _ in range(2):
+            self.registry.check_quota(key)
+            self.registry.record_usage(key, 10)
+        
+        with self.assertRaisesRegex(KeyQuotaExceededError, "used 2 of its 2 requests"):
+            self.registry.check_quota(key)
+    
+    def test_token_quota(self):
+        key = self.redeem(max_tokens=100)
+        self.registry.record_usage(key, 60)
+        self.registry.check_quota(key)
+        self.registry.record_usage(key, 60)
+        
+        with self.assertRaises(KeyQuotaExceededError):
+            self.registry.check_quota(key)
+    
+    def test_usage_is_saved(self):
+        key = self.redeem(max_requests=5)
+        self.registry.record_usage(key, 10)
+        self.registry.flush()
+        
+        entry = Registry(self.path).keys[hash_key(key)]
+        self.assertEqual((entry["requests"], entry["tokens"]), (1, 10))
+    
+    def test_revoked_key_is_rejected(self):
+        key = self.redeem()
+        key_id = self.registry.keys[hash_key(key)]["id"]
+        
+        self.assertTrue(self.registry.revoke_key(key_id))
+        self.assertFalse(self.registry.is_key(key))
+
+
+class InvitationQuotaTest(unittest.TestCase):
+    """The global registry's invitation settings reach the stream limiter and model access."""
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(registration=True)
+        from app.registration import registry
+        self.registry = registry
+        self._path, registry.path = registry.path, ""
+        code = registry.create_invitation(models=["claude-*"], stream_limit=1)["code"]
+        self.key = registry.redeem(code)["api_key"]
+    
+    def tearDown(self):
+        self.registry.revoke_key(self.key)
+        self.registry.path = self._path
+        settings.replace(self._settings)
+    
+    def test_stream_limit_and_models_apply(self):
+        self.assertEqual(stream_limiter.limit_for(self.key), 1)
+        self.assertTrue(model_access.is_allowed(self.key, "claude-3.5-sonnet"))
+        self.assertFalse(model_access.is_allowed(self.key, "gpt-4o"))
+    
+    def test_other_keys_are_not_restricted(self):
+        self.assertTrue(model_access.is_allowed("sk-other", "gpt-4o"))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,140 @@
+"""Retries, recovery and model fallback in CursorClient, against scripted upstream responses."""
+import unittest
+from app.config import settings
+from app.context import RequestContext
+from app.models import Message
+from app.cursor_client import CursorClient
+from app.slo import TTFTExceededError
+from .mocks import MockTransport, MockResponse, RecordingEncoder, text_frame
+
+
+class UpstreamTestCase(unittest.IsolatedAsyncioTestCase):
+    """Runs each test with its own settings snapshot, restored afterwards."""
+    
+    def setUp(self):
+        self._settings = settings.get()
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    def client(self, *responses) -> CursorClient:
+        self.transport = MockTransport(list(responses))
+        self.encoder = RecordingEncoder()
+        return CursorClient(transport=self.transport, encoder=self.encoder)
+    
+    async def collect(self, client: CursorClient, ctx: RequestContext) -> str:
+        return "".join([chunk async for chunk in client.chat_completion_stream(ctx)])
+    
+    @staticmethod
+    def context(model: str = "claude-3.5-sonnet") -> RequestContext:
+        return RequestContext.create(model, [Message(role="user", content="hi")])
+    
+    @staticmethod
+    def warning_codes(ctx: RequestContext):
+        return [w["code"] for w in ctx.overrides.get("warnings", [])]
+
+
+class FallbackTest(UpstreamTestCase):
+    
+    def setUp(self):
+        super().setUp()
+        settings.update(model_fallbacks="claude-3.5-sonnet->gpt-4o", stream_recovery=False)
+    
+    async def test_upstream_error_falls_back_to_next_model(self):
+        client = self.client(MockResponse(status_code=500, body=b"overloaded"), MockResponse.text("Hi"))
+        ctx = self.context()
+        
+        self.assertEqual(await self.collect(client, ctx), "Hi")
+        self.assertEqual([r.model.model_name for r in self.encoder.requests], ["claude-3.5-sonnet", "gpt-4o"])
+        self.assertEqual(ctx.info.model, "gpt-4o")
+        self.assertEqual(ctx.info.requested_model, "claude-3.5-sonnet")
+        self.assertIn("model_fallback", self.warning_codes(ctx))
+    
+    async def test_connection_error_falls_back(self):
+        client = self.client(ConnectionError("reset"), MockResponse.text("Hi"))
+        
+        self.assertEqual(await self.collect(client, self.context()), "Hi")
+        self.assertEqual(len(self.transport.requests), 2)
+    
+    async def test_no_fallback_once_output_was_sent(self):
+        client = self.client(MockResponse([text_frame("Hel"), ConnectionError("reset")]), MockResponse.text("Hi"))
+        
+        with self.assertRaises(ConnectionError):
+            await self.collect(client, self.context())
+        # A second model would restart an answer the client already started receiving
+        self.assertEqual(len(self.transport.requests), 1)
+    
+    async def test_last_model_error_is_raised(self):
+        client = self.client(ConnectionError("reset"), ConnectionError("reset again"))
+        
+        with self.assertRaisesRegex(ConnectionError, "reset again"):
+            await self.collect(client, self.context())
+    
+    async def test_model_without_chain_is_tried_once(self):
+        client = self.client(ConnectionError("reset"), MockResponse.text("Hi"))
+        
+        with self.assertRaises(ConnectionError):
+            await self.collect(client, self.context("gpt-4o"))
+        self.assertEqual(len(self.transport.requests), 1)
+
+
+class RecoveryTest(UpstreamTestCase):
+    
+    def setUp(self):
+        super().setUp()
+        settings.update(stream_recovery=True, model_fallbacks="")
+    
+    async def test_mid_stream_failure_continues_from_partial_output(self):
+        client = self.client(MockResponse([text_frame("Hel"), ConnectionError("reset")]), MockResponse.text("lo"))
+        ctx = self.context()
+        
+        self.assertEqual(await self.collect(client, ctx), "Hello")
+        continuation = [m.content for m in self.encoder.requests[1].messages]
+        self.assertIn("Hel", continuation)
+        self.assertEqual(continuation[-1], settings.stream_recovery_prompt)
+        self.assertIn("stream_recovered", self.warning_codes(ctx))
+    
+    async def test_failure_before_output_is_not_recovered(self):
+        client = self.client(ConnectionError("reset"), MockResponse.text("Hi"))
+        
+        with self.assertRaises(ConnectionError):
+            await self.collect(client, self.context())
+        self.assertEqual(len(self.transport.requests), 1)
+    
+    async def test_disabled_recovery_raises(self):
+        settings.update(stream_recovery=False)
+        client = self.client(MockResponse([text_frame("Hel"), ConnectionError("reset")]), MockResponse.text("lo"))
+        
+        with self.assertRaises(ConnectionError):
+            await self.collect(client, self.context())
+
+
+class TTFTRetryTest(UpstreamTestCase):
+    
+    def setUp(self):
+        super().setUp()
+        settings.update(ttft_slo=0.05, ttft_slo_retry="token", ttft_slo_retries=1, model_fallbacks="")
+    
+    async def test_missed_slo_retries(self):
+        client = self.client(MockResponse.text("slow", delay=0.5), MockResponse.text("fast"))
+        
+        self.assertEqual(await self.collect(client, self.context()), "fast")
+        self.assertEqual(len(self.transport.requests), 2)
+    
+    async def test_retries_are_bounded(self):
+        client = self.client(MockResponse.text("slow", delay=0.5), MockResponse.text("slower", delay=0.5))
+        
+        with self.assertRaises(TTFTExceededError):
+            await self.collect(client, self.context())
+        self.assertEqual(len(self.transport.requests), 2)
+    
+    async def test_model_mode_moves_down_the_fallback_chain(self):
+        settings.update(ttft_slo_retry="model", model_fallbacks="claude-3.5-sonnet->gpt-4o")
+        client = self.client(MockResponse.text("slow", delay=0.5), MockResponse.text("fast"))
+        
+        self.assertEqual(await self.collect(client, self.context()), "fast")
+        self.assertEqual([r.model.model_name for r in self.encoder.requests], ["claude-3.5-sonnet", "gpt-4o"])
+
+
+if __name__ == "__main__":
+    unittest.main()
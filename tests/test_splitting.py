@@ -0,0 +1,54 @@
+"""Oversized message strategies in app.splitting."""
+import unittest
+from unittest import mock
+from app.config import settings
+from app.context import RequestContext
+from app.limits import stream_limiter, StreamLimitExceeded
+from app.models import Message
+from app.splitting import handle_oversized_messages
+
+
+class SummarizeTest(unittest.IsolatedAsyncioTestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        settings.update(oversize_message_strategy="summarize", max_message_length=100, length_unit="chars",
+                        key_stream_limit=1, key_stream_queue_timeout=0)
+        self.slots = []
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+        stream_limiter.active.pop("sk-test", None)
+        stream_limiter._started.pop("sk-test", None)
+    
+    def context(self) -> RequestContext:
+        text = "\n".join(f"line {i} " + "x" * 40 for i in range(6))
+        return RequestContext.create("gpt-4o", [Message(role="user", content=text)], api_key="sk-test")
+    
+    async def summarize(self, ctx: RequestContext) -> str:
+        self.slots.append(stream_limiter.active.get("sk-test", 0))
+        return "summary"
+    
+    async def test_parts_hold_one_slot_of_the_key(self):
+        ctx = self.context()
+        with mock.patch("app.splitting.cursor_client.chat_completion", side_effect=self.summarize):
+            await handle_oversized_messages(ctx)
+        
+        self.assertGreater(len(self.slots), 1)
+        self.assertEqual(set(self.slots), {1})
+        self.assertIn("summary", ctx.messages[0].content)
+        # Released again for the request itself
+        self.assertEqual(stream_limiter.active.get("sk-test", 0), 0)
+    
+    async def test_key_at_its_limit_is_refused(self):
+        stream_limiter.acquire("sk-test")
+        with mock.patch("app.splitting.cursor_client.chat_completion", side_effect=self.summarize):
+            with self.assertRaises(StreamLimitExceeded):
+                await handle_oversized_messages(self.context())
+        
+        self.assertEqual(self.slots, [])
+        stream_limiter.release("sk-test")
+
+
+if __name__ == "__main__":
+    unittest.main()
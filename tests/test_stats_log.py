@@ -0,0 +1,66 @@
+"""WAL and snapshot persistence in app.stats_log."""
+import tempfile
+import unittest
+from app.stats_log import StatsLog
+
+
+class Counter:
+    """A minimal counter store registered with a StatsLog."""
+    
+    def __init__(self, log: StatsLog):
+        self.value = 0
+        self.log = log
+        log.register("counter", lambda: self.value, self.restore, self.apply)
+    
+    def restore(self, state):
+        self.value = state
+    
+    def apply(self, event):
+        self.value += event["n"]
+    
+    def add(self, n):
+        self.apply({"n": n})
+        self.log.append("counter", {"n": n})
+
+
+class StatsLogTest(unittest.IsolatedAsyncioTestCase):
+    
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.directory = tmp.name
+    
+    def restored(self) -> int:
+        counter = Counter(StatsLog(self.directory))
+        counter.log.recover()
+        return counter.value
+    
+    async def test_flushed_events_are_replayed(self):
+        counter = Counter(StatsLog(self.directory))
+        counter.add(2)
+        counter.add(3)
+        counter.log.flush()
+        
+        self.assertEqual(self.restored(), 5)
+    
+    async def test_snapshot_async_covers_buffered_events(self):
+        counter = Counter(StatsLog(self.directory))
+        counter.add(2)
+        await counter.log.snapshot_async()
+        counter.add(3)
+        counter.log.flush()
+        
+        self.assertEqual(self.restored(), 5)
+    
+    async def test_stop_writes_a_final_snapshot(self):
+        log = StatsLog(self.directory)
+        counter = Counter(log)
+        log.start()
+        counter.add(7)
+        await log.stop()
+        
+        self.assertEqual(self.restored(), 7)
+
+
+if __name__ == "__main__":
+    unittest.main()
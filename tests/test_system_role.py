@@ -0,0 +1,61 @@
+"""System message strategies in app.system_role."""
+import unittest
+from app.config import settings
+from app.models import Message
+from app.system_role import apply_system_strategy
+
+IMAGE = {"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA"}}
+
+
+class SystemStrategyTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    def messages(self, content="Hi"):
+        return [Message(role="system", content="Be brief."), Message(role="user", content=content)]
+    
+    def test_default_keeps_system_messages(self):
+        messages = self.messages()
+        
+        self.assertEqual(apply_system_strategy(messages), (messages, ""))
+    
+    def test_merge_prepends_to_first_user_message(self):
+        messages, instructions = apply_system_strategy(self.messages(), "merge")
+        
+        self.assertEqual(instructions, "")
+        self.assertEqual([m.role for m in messages], ["user"])
+        self.assertEqual(messages[0].content, "Be brief.\n\nHi")
+    
+    def test_merge_keeps_content_parts(self):
+        parts = [{"type": "text", "text": "What is this?"}, IMAGE]
+        messages, _ = apply_system_strategy(self.messages(parts), "merge")
+        
+        self.assertEqual(messages[0].content, [{"type": "text", "text": "Be brief."}] + parts)
+    
+    def test_merge_without_user_message_adds_one(self):
+        messages, _ = apply_system_strategy([Message(role="system", content="Be brief.")], "merge")
+        
+        self.assertEqual([(m.role, m.content) for m in messages], [("user", "Be brief.")])
+    
+    def test_field_returns_instructions(self):
+        messages, instructions = apply_system_strategy(self.messages(), "field")
+        
+        self.assertEqual(instructions, "Be brief.")
+        self.assertEqual([m.role for m in messages], ["user"])
+    
+    def test_configured_strategy_applies(self):
+        settings.update(system_role_strategy="field")
+        
+        self.assertEqual(apply_system_strategy(self.messages())[1], "Be brief.")
+    
+    def test_unknown_strategy_is_rejected(self):
+        with self.assertRaises(ValueError):
+            apply_system_strategy(self.messages(), "developer")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,61 @@
+"""Per-phase upstream timeouts in CursorClient."""
+import unittest
+import httpx
+from app.config import settings
+from app.transport import UpstreamTimeoutError
+from .mocks import MockResponse, text_frame
+from .test_retries import UpstreamTestCase
+
+
+class TimeoutTest(UpstreamTestCase):
+    
+    def setUp(self):
+        super().setUp()
+        settings.update(model_fallbacks="", stream_recovery=False, ttft_slo=0)
+    
+    def test_read_timeout_allows_the_longer_phase(self):
+        settings.update(ttfb_timeout=5, idle_timeout=30)
+        client = self.client()
+        
+        self.assertEqual(client._timeout_for(self.context()).read, 30)
+    
+    def test_read_timeout_is_unlimited_when_a_phase_is(self):
+        settings.update(ttfb_timeout=0, idle_timeout=30)
+        client = self.client()
+        
+        self.assertIsNone(client._timeout_for(self.context()).read)
+    
+    async def test_slow_first_byte_is_a_ttfb_timeout(self):
+        settings.update(ttfb_timeout=0.05, idle_timeout=30)
+        client = self.client(MockResponse.text("late", delay=0.5))
+        
+        with self.assertRaises(UpstreamTimeoutError) as caught:
+            await self.collect(client, self.context())
+        self.assertEqual((caught.exception.phase, caught.exception.seconds), ("ttfb", 0.05))
+    
+    async def test_idle_limit_applies_after_the_first_byte(self):
+        # A TTFB shorter than the idle limit no longer cuts off a stream pausing between chunks
+        settings.update(ttfb_timeout=0.05, idle_timeout=30)
+        client = self.client(MockResponse.text("Hel", "lo"))
+        
+        self.assertEqual(await self.collect(client, self.context()), "Hello")
+    
+    async def test_read_timeout_mid_stream_is_labelled_idle(self):
+        settings.update(ttfb_timeout=5, idle_timeout=30)
+        client = self.client(MockResponse([text_frame("Hel"), httpx.ReadTimeout("read")]))
+        
+        with self.assertRaises(UpstreamTimeoutError) as caught:
+            await self.collect(client, self.context())
+        self.assertEqual((caught.exception.phase, caught.exception.seconds), ("idle", 30))
+    
+    async def test_raw_passthrough_has_the_same_ttfb_limit(self):
+        settings.update(ttfb_timeout=0.05, idle_timeout=30)
+        client = self.client(MockResponse.text("late", delay=0.5))
+        
+        with self.assertRaises(UpstreamTimeoutError) as caught:
+            [chunk async for chunk in client.stream_raw("StreamChat", b"", self.context())]
+        self.assertEqual(caught.exception.phase, "ttfb")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,23 @@
+"""OTLP span fields in app.tracing."""
+import unittest
+from app.tracing import _otel_trace_id
+
+
+class TraceIdTest(unittest.TestCase):
+    
+    def test_generated_request_ids_are_kept(self):
+        self.assertEqual(_otel_trace_id("0123456789abcdef0123456789abcdef"), "0123456789abcdef0123456789abcdef")
+    
+    def test_client_request_ids_are_hashed_to_hex(self):
+        for request_id in ("req-1", "ABCDEF0123456789ABCDEF0123456789", "x" * 128, "0" * 32):
+            trace_id = _otel_trace_id(request_id)
+            self.assertRegex(trace_id, r"^[0-9a-f]{32}$")
+            self.assertNotEqual(trace_id, "0" * 32)
+    
+    def test_distinct_ids_stay_distinct(self):
+        # Truncating would have mapped both to the same trace
+        self.assertNotEqual(_otel_trace_id("a" * 40 + "1"), _otel_trace_id("a" * 40 + "2"))
+
+
+if __name__ == "__main__":
+    unittest.main()
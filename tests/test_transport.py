@@ -0,0 +1,47 @@
+"""UTF-8 reassembly of response payloads in app.transport."""
+import struct
+import unittest
+from app.transport import GrpcWebParser, Utf8Assembler
+
+
+def v1_frame(data: bytes) -> bytes:
+    """A frame laid out the way the v1 heuristic expects, with arbitrary payload bytes."""
+    return struct.pack(">BI", 0, len(data) + 2) + b"\x0a" + bytes([len(data)]) + data
+
+
+class Utf8AssemblerTest(unittest.TestCase):
+    
+    def decode(self, stream: bytes, errors: str = "replace") -> str:
+        parser, assembler, out = GrpcWebParser(), Utf8Assembler(errors), ""
+        while True:
+            payload, consumed = parser.parse(stream)
+            if consumed == 0:
+                return out + assembler.flush()
+            stream = stream[consumed:]
+            out += assembler.feed(payload)
+    
+    def test_character_split_across_v1_frames_is_joined(self):
+        data = "你好".encode("utf-8")
+        
+        self.assertEqual(self.decode(v1_frame(data[:4]) + v1_frame(data[4:])), "你好")
+    
+    def test_undecodable_v1_frame_is_dropped(self):
+        stream = v1_frame(b"Hi ") + v1_frame(b"\xff\xfe garbage") + v1_frame(b"there")
+        
+        self.assertEqual(self.decode(stream), "Hi there")
+        self.assertEqual(self.decode(stream, "strict"), "Hi there")
+    
+    def test_dropped_frame_keeps_a_pending_character(self):
+        data = "é".encode("utf-8")
+        stream = v1_frame(data[:1]) + v1_frame(b"\xff") + v1_frame(data[1:])
+        
+        self.assertEqual(self.decode(stream), "é")
+    
+    def test_other_payloads_follow_the_error_mode(self):
+        assembler = Utf8Assembler("replace")
+        
+        self.assertEqual(assembler.feed(b"a\xffb"), "a�b")
+
+
+if __name__ == "__main__":
+    unittest.main()
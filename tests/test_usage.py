@@ -0,0 +1,91 @@
+"""Label aggregation in app.usage and the usage reported in responses."""
+import unittest
+from unittest import mock
+from app.config import settings
+from app.context import RequestContext
+from app.models import Message
+from app.usage import UsageStore, OTHER_LABEL, key_id
+from app.pricing import estimate_prompt_tokens
+from app.routes import estimated_usage
+
+
+def event(*labels: str) -> dict:
+    return {"key": key_id("sk-test"), "key_name": "***", "token": "", "labels": list(labels), "prompt_tokens": 10,
+            "completion_tokens": 5, "cost": None, "saved_tokens": 0}
+
+
+class LabelTest(unittest.TestCase):
+    
+    def setUp(self):
+        self._settings = settings.get()
+        self.store = UsageStore()
+    
+    def tearDown(self):
+        settings.replace(self._settings)
+    
+    def test_labels_beyond_the_cap_share_one_total(self):
+        settings.update(usage_max_labels=2)
+        for value in ("a", "b", "c", "d", "a"):
+            self.store.apply(event(f"user={value}"))
+        
+        self.assertEqual(set(self.store.labels), {"user=a", "user=b", OTHER_LABEL})
+        self.assertEqual(self.store.labels["user=a"].requests, 2)
+        self.assertEqual(self.store.labels[OTHER_LABEL].requests, 2)
+    
+    def test_only_allowlisted_keys_are_aggregated(self):
+        settings.update(usage_label_keys="team, env")
+        self.store.apply(event("team=search", "request_id=123", "env=prod"))
+        
+        self.assertEqual(set(self.store.labels), {"team=search", "env=prod"})
+        # Key totals are unaffected
+        self.assertEqual(self.store.keys[key_id("sk-test")].requests, 1)
+
+
+class KeyTotalsTest(unittest.TestCase):
+    
+    def setUp(self):
+        self.store = UsageStore()
+    
+    def record(self, api_key: str):
+        ctx = RequestContext.create("gpt-4o", [Message(role="user", content="Hi")], api_key=api_key)
+        with mock.patch("app.usage.stats_log.append"):
+            self.store.record(ctx, "Hello")
+    
+    def test_keys_with_the_same_masked_form_stay_separate(self):
+        # The short keys both mask to "***", the long ones both to "sk-ten...-one"
+        for api_key in ("sk-a", "sk-b", "sk-tenant-a-one", "sk-tenant-b-one", "sk-tenant-b-one"):
+            self.record(api_key)
+        
+        keys = self.store.to_dict()["keys"]
+        self.assertEqual(len(keys), 4)
+        self.assertEqual(keys[key_id("sk-tenant-b-one")]["requests"], 2)
+        self.assertEqual(keys[key_id("sk-tenant-a-one")]["requests"], 1)
+        self.assertEqual(keys[key_id("sk-tenant-a-one")]["key"], keys[key_id("sk-tenant-b-one")]["key"])
+        self.assertEqual(keys[key_id("sk-a")]["key"], "***")
+    
+    def test_snapshot_keeps_ids_and_names_but_not_keys(self):
+        self.record("sk-tenant-a-one")
+        state = self.store.snapshot()
+        
+        self.assertNotIn("sk-tenant-a-one", str(state))
+        restored = UsageStore()
+        restored.restore(state)
+        self.assertEqual(restored.to_dict()["keys"], self.store.to_dict()["keys"])
+
+
+
+class EstimatedUsageTest(unittest.TestCase):
+    
+    def test_usage_matches_the_recorded_estimate(self):
+        messages = [Message(role="system", content="You are a helpful assistant."),
+                    Message(role="user", content="Say hello")]
+        ctx = RequestContext.create("gpt-4o", messages, api_key="sk-test")
+        usage = estimated_usage(ctx, "Hello there!")
+        
+        self.assertEqual(usage.prompt_tokens, estimate_prompt_tokens(messages))
+        self.assertEqual((usage.prompt_tokens, usage.completion_tokens), (10, 3))
+        self.assertEqual(usage.total_tokens, 13)
+
+
+if __name__ == "__main__":
+    unittest.main()
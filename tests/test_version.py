@@ -0,0 +1,34 @@
+"""Release metadata parsing in app.version."""
+import unittest
+import httpx
+from app.version import VersionDetector
+
+
+class ParseVersionTest(unittest.TestCase):
+    
+    def setUp(self):
+        self.detector = VersionDetector()
+    
+    def test_json_version(self):
+        response = httpx.Response(200, json={"version": "0.50.5"})
+        self.assertEqual(self.detector._parse_version(response), "0.50.5")
+    
+    def test_download_redirect(self):
+        response = httpx.Response(302, headers={"location": "https://downloads.example.com/cursor-0.50.5-x86_64.AppImage"})
+        self.assertEqual(self.detector._parse_version(response), "0.50.5")
+    
+    def test_error_status_is_ignored(self):
+        response = httpx.Response(503, json={"version": "9.9.9"})
+        self.assertIsNone(self.detector._parse_version(response))
+    
+    def test_html_body_is_ignored(self):
+        response = httpx.Response(200, text="<html>Served by nginx 1.25.3</html>")
+        self.assertIsNone(self.detector._parse_version(response))
+    
+    def test_malformed_version_is_ignored(self):
+        response = httpx.Response(200, json={"version": "1.2.3<script>"})
+        self.assertIsNone(self.detector._parse_version(response))
+
+
+if __name__ == "__main__":
+    unittest.main()